@@ -0,0 +1,275 @@
+// Package batch assigns drivers to rides in batches: ride requests are collected over a short window,
+// then drivers are assigned to all of them at once minimizing the total pickup time, instead of giving
+// each request its nearest driver in arrival order
+package batch
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/trietphm/gruber/app/eta"
+	"github.com/trietphm/gruber/app/matching"
+	"github.com/trietphm/gruber/model/mpg"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+// Options Batcher options, zero values use defaults
+type Options struct {
+	// Window Time requests are collected before a batch is matched (default 2s)
+	Window time.Duration
+	// MaxSize A batch is matched as soon as it has this many requests (default 100)
+	MaxSize int
+	// Workers Candidates and speeds of a batch are read with this many concurrent reads at most (default 8)
+	Workers int
+	// Candidates Maximum number of candidate drivers of a ride (default 20), more than matching.Top so rides of
+	// a batch near each other do not compete for the same few drivers
+	Candidates int
+}
+
+// Batcher Assign drivers to batches of requested rides
+type Batcher struct {
+	matcher   *matching.Matcher
+	estimator *eta.Estimator
+	opts      Options
+
+	mu      sync.Mutex
+	pending []request
+	timer   *time.Timer
+	closed  bool
+
+	// matching Batches are assigned one at a time, drivers claimed by a previous batch after the candidates were
+	// read are skipped by Claim
+	matching sync.Mutex
+}
+
+var _ matching.Assigner = (*Batcher)(nil)
+
+// request Ride waiting for its batch
+type request struct {
+	ride     *mpg.Ride
+	excluded []int
+	result   chan result
+}
+
+// result Result of AssignDriver
+type result struct {
+	assigned bool
+	err      error
+}
+
+// New Create a batcher finding candidate drivers with matcher, the cost of a driver is its pickup time
+// estimated by estimator
+func New(matcher *matching.Matcher, estimator *eta.Estimator, opts Options) *Batcher {
+	if opts.Window <= 0 {
+		opts.Window = 2 * time.Second
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 100
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 8
+	}
+	if opts.Candidates <= 0 {
+		opts.Candidates = 20
+	}
+
+	return &Batcher{
+		matcher:   matcher,
+		estimator: estimator,
+		opts:      opts,
+	}
+}
+
+// AssignDriver Add a requested ride to the current batch and wait until the batch is matched. It returns false
+// and leaves the ride unchanged if no driver is left for the ride or the ride is no longer requested.
+// Rides picked up in a queued airport are assigned right away so drivers keep their arrival order. After Close
+// the ride is assigned at once by the matcher
+func (b *Batcher) AssignDriver(ride *mpg.Ride, excluded []int) (bool, error) {
+	if b.matcher.QueueZone(ride.Lat, ride.Lng) != nil {
+		return b.matcher.AssignDriver(ride, excluded)
+	}
+
+	req := request{
+		ride:     ride,
+		excluded: excluded,
+		result:   make(chan result, 1),
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return b.matcher.AssignDriver(ride, excluded)
+	}
+	b.pending = append(b.pending, req)
+	if len(b.pending) >= b.opts.MaxSize {
+		batch := b.take()
+		b.mu.Unlock()
+		b.match(batch)
+	} else {
+		if len(b.pending) == 1 {
+			b.timer = time.AfterFunc(b.opts.Window, b.flush)
+		}
+		b.mu.Unlock()
+	}
+
+	res := <-req.result
+	return res.assigned, res.err
+}
+
+// Close Match the current batch without waiting for its window, rides requested afterwards are not batched
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	b.closed = true
+	batch := b.take()
+	b.mu.Unlock()
+
+	b.match(batch)
+}
+
+// flush Match the current batch when its window ends
+func (b *Batcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+
+	b.match(batch)
+}
+
+// take Take the current batch and stop its timer, b.mu must be held
+func (b *Batcher) take() []request {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// match Assign drivers to a batch minimizing the total pickup time, then send the result of every request.
+// The candidates of a ride are the nearest eligible drivers, more than the matcher finds for it alone, they are
+// read before the batch waits for the previous one. Rides left without driver are then assigned the best remaining driver one by one
+func (b *Batcher) match(batch []request) {
+	if len(batch) == 0 {
+		return
+	}
+	costs, driverIDs, errs := b.costs(batch, time.Now())
+
+	b.matching.Lock()
+	defer b.matching.Unlock()
+
+	assignment := assign(costs)
+	results := make([]result, len(batch))
+	for i, req := range batch {
+		if errs[i] != nil {
+			results[i].err = errs[i]
+			continue
+		}
+		if assignment[i] >= 0 {
+			results[i].assigned, results[i].err = b.matcher.Claim(req.ride, driverIDs[assignment[i]])
+		}
+	}
+
+	// Rides whose candidates all went to other rides of the batch, or were claimed meanwhile, may still
+	// find drivers further away once the batch is assigned
+	for i, req := range batch {
+		if errs[i] == nil && results[i].err == nil && !results[i].assigned {
+			results[i].assigned, results[i].err = b.matcher.AssignDriver(req.ride, req.excluded)
+		}
+		req.result <- results[i]
+	}
+}
+
+// costs Build the cost matrix of a batch: the pickup time in seconds of each candidate driver (column) of each
+// ride (row), +Inf for drivers which are not candidates. Candidates of the rides, then speeds of the drivers,
+// are read concurrently. A ride whose candidates can not be read has no candidate and its error is returned
+func (b *Batcher) costs(batch []request, now time.Time) ([][]float64, []int, []error) {
+	var (
+		costs     = make([][]float64, len(batch))
+		errs      = make([]error, len(batch))
+		nearest   = make([][]mredis.DriverLocation, len(batch))
+		driverIDs = []int{}
+		columns   = map[int]int{}
+	)
+	b.parallel(len(batch), func(i int) {
+		nearest[i], errs[i] = b.candidates(batch[i])
+	})
+	for i := range batch {
+		for _, driver := range nearest[i] {
+			if _, ok := columns[driver.DriverID]; !ok {
+				columns[driver.DriverID] = len(driverIDs)
+				driverIDs = append(driverIDs, driver.DriverID)
+			}
+		}
+	}
+
+	speeds := make([]float64, len(driverIDs))
+	speedErrs := make([]error, len(driverIDs))
+	b.parallel(len(driverIDs), func(j int) {
+		speeds[j], speedErrs[j] = b.estimator.Speed(driverIDs[j], now)
+	})
+
+	for i := range batch {
+		costs[i] = make([]float64, len(driverIDs))
+		for j := range costs[i] {
+			costs[i][j] = math.Inf(1)
+		}
+		for _, driver := range nearest[i] {
+			j := columns[driver.DriverID]
+			if speedErrs[j] != nil {
+				errs[i] = speedErrs[j]
+				break
+			}
+			costs[i][j] = eta.Duration(driver.Distance, speeds[j]).Seconds()
+		}
+		if errs[i] != nil {
+			for j := range costs[i] {
+				costs[i][j] = math.Inf(1)
+			}
+		}
+	}
+
+	return costs, driverIDs, errs
+}
+
+// candidates Get the candidate drivers of a ride nearest first, without its excluded drivers
+func (b *Batcher) candidates(req request) ([]mredis.DriverLocation, error) {
+	drivers, err := b.matcher.EligibleDrivers(req.ride.Lat, req.ride.Lng, req.ride.VehicleClass, b.opts.Candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := make(map[int]bool, len(req.excluded))
+	for _, driverID := range req.excluded {
+		skip[driverID] = true
+	}
+	candidates := make([]mredis.DriverLocation, 0, len(drivers))
+	for _, driver := range drivers {
+		if !skip[driver.DriverID] {
+			candidates = append(candidates, driver)
+		}
+	}
+
+	return candidates, nil
+}
+
+// parallel Call f with 0 to n-1 from at most Workers goroutines and wait for every call
+func (b *Batcher) parallel(n int, f func(i int)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < b.opts.Workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,191 @@
+package batch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/app/eta"
+	"github.com/trietphm/gruber/app/matching"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// newEstimator Estimator at a constant 30 km/h
+func newEstimator(t *testing.T) *eta.Estimator {
+	profile, err := eta.ParseProfile(30, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eta.New(memory.NewCassandra(), profile, time.UTC, 0)
+}
+
+// newDrivers Create available drivers on the equator at longitudes lngs
+func newDrivers(t *testing.T, dbPg *memory.Pg, dbRedis *memory.Redis, lngs ...float64) {
+	for _, lng := range lngs {
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := dbPg.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		if err := dbRedis.PushDriverLocationGeo(driver.ID, 0, lng, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newRides Create requested rides on the equator at longitudes lngs
+func newRides(t *testing.T, dbPg *memory.Pg, lngs ...float64) []mpg.Ride {
+	rides := make([]mpg.Ride, len(lngs))
+	for i, lng := range lngs {
+		rides[i] = mpg.Ride{PassengerID: 1, Lat: 0, Lng: lng, Status: mpg.RideRequested}
+		if err := dbPg.CreateRide(&rides[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rides
+}
+
+func TestAssignDriver(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	matcher := matching.New(dbPg, dbRedis, nil, nil, 0)
+	b := New(matcher, newEstimator(t), Options{Window: 50 * time.Millisecond})
+
+	// Drivers 1 and 2 at 0 and 2 km, 0.01 degree of longitude is about 1.11 km. The first ride is slightly
+	// nearer to driver 1 but the second ride is only near driver 1, greedy matching would give driver 2 to it
+	newDrivers(t, dbPg, dbRedis, 0, 0.018)
+	rides := newRides(t, dbPg, 0.008, -0.009, 0.5)
+
+	var wg sync.WaitGroup
+	assigned := make([]bool, len(rides))
+	errs := make([]error, len(rides))
+	for i := range rides {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assigned[i], errs[i] = b.AssignDriver(&rides[i], nil)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	assert.Equal(t, []bool{true, true, false}, assigned)
+	assert.Equal(t, 2, rides[0].DriverID)
+	assert.Equal(t, 1, rides[1].DriverID)
+	// The third ride is too far from every driver
+	assert.Equal(t, 0, rides[2].DriverID)
+	assert.Equal(t, mpg.RideRequested, rides[2].Status)
+
+	driver, _ := dbPg.GetDriver(1)
+	assert.Equal(t, mpg.StateBusy, driver.State)
+	stored, _ := dbPg.GetRide(rides[1].ID)
+	assert.Equal(t, mpg.RideAssigned, stored.Status)
+	assert.Equal(t, 1, stored.DriverID)
+}
+
+func TestAssignDriverExcluded(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	b := New(matching.New(dbPg, dbRedis, nil, nil, 0), newEstimator(t), Options{MaxSize: 1})
+
+	newDrivers(t, dbPg, dbRedis, 0, 0.01)
+	rides := newRides(t, dbPg, 0)
+
+	// A batch of one is matched at once
+	assigned, err := b.AssignDriver(&rides[0], []int{1})
+	assert.NoError(t, err)
+	assert.True(t, assigned)
+	assert.Equal(t, 2, rides[0].DriverID)
+
+	// The ride is no longer requested
+	assigned, err = b.AssignDriver(&rides[0], nil)
+	assert.NoError(t, err)
+	assert.False(t, assigned)
+	assert.Equal(t, 2, rides[0].DriverID)
+}
+
+func TestClose(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	b := New(matching.New(dbPg, dbRedis, nil, nil, 0), newEstimator(t), Options{Window: time.Hour})
+
+	newDrivers(t, dbPg, dbRedis, 0, 0.01)
+	rides := newRides(t, dbPg, 0, 0.01)
+
+	// The ride waits for a batch window of an hour until Close
+	done := make(chan bool)
+	go func() {
+		assigned, err := b.AssignDriver(&rides[0], nil)
+		assert.NoError(t, err)
+		done <- assigned
+	}()
+	for {
+		b.mu.Lock()
+		waiting := len(b.pending)
+		b.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Close()
+	assert.True(t, <-done)
+	assert.Equal(t, 1, rides[0].DriverID)
+
+	// Assigned at once after Close
+	assigned, err := b.AssignDriver(&rides[1], nil)
+	assert.NoError(t, err)
+	assert.True(t, assigned)
+	assert.Equal(t, 2, rides[1].DriverID)
+}
+
+func TestCandidates(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	b := New(matching.New(dbPg, dbRedis, nil, nil, 0), newEstimator(t), Options{})
+
+	// More candidates than the matcher finds for a ride alone, without excluded drivers
+	lngs := make([]float64, 2*matching.Top)
+	for i := range lngs {
+		lngs[i] = float64(i) * 0.001
+	}
+	newDrivers(t, dbPg, dbRedis, lngs...)
+	rides := newRides(t, dbPg, 0)
+
+	candidates, err := b.candidates(request{ride: &rides[0], excluded: []int{1}})
+	assert.NoError(t, err)
+	if assert.Len(t, candidates, len(lngs)-1) {
+		assert.Equal(t, 2, candidates[0].DriverID)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	b := New(nil, nil, Options{Workers: 3})
+
+	var (
+		mu            sync.Mutex
+		called        = make([]bool, 10)
+		running, peak int
+	)
+	b.parallel(len(called), func(i int) {
+		mu.Lock()
+		called[i] = true
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	for i := range called {
+		assert.True(t, called[i], i)
+	}
+	assert.True(t, peak > 1 && peak <= 3, peak)
+}
@@ -0,0 +1,109 @@
+package batch
+
+import "math"
+
+// assign Minimum cost assignment of rows to columns with the Hungarian algorithm in O(n²m).
+// It returns the column of each row, -1 if the row is not assigned. A row is not assigned if there are
+// fewer columns than rows or if its only columns left cost +Inf, which marks a forbidden pair
+func assign(cost [][]float64) []int {
+	rows := len(cost)
+	if rows == 0 {
+		return []int{}
+	}
+	columns := len(cost[0])
+	if columns < rows {
+		// Rows must not outnumber columns, solve the transposed matrix
+		transposed := make([][]float64, columns)
+		for j := range transposed {
+			transposed[j] = make([]float64, rows)
+			for i := range cost {
+				transposed[j][i] = cost[i][j]
+			}
+		}
+		assignment := make([]int, rows)
+		for i := range assignment {
+			assignment[i] = -1
+		}
+		for j, i := range assign(transposed) {
+			if i >= 0 {
+				assignment[i] = j
+			}
+		}
+		return assignment
+	}
+
+	// Forbidden pairs cost more than any assignment of allowed pairs, so they are only used when a row has
+	// no allowed column left, then they are dropped
+	maxCost := 0.0
+	for _, row := range cost {
+		for _, c := range row {
+			if !math.IsInf(c, 1) && c > maxCost {
+				maxCost = c
+			}
+		}
+	}
+	forbidden := float64(rows+1) * (maxCost + 1)
+	at := func(i, j int) float64 {
+		if math.IsInf(cost[i][j], 1) {
+			return forbidden
+		}
+		return cost[i][j]
+	}
+
+	// Potentials u of rows and v of columns, rowOf[j] is the row of column j, indexes start at 1
+	// and column 0 is a virtual column holding the row being added
+	u := make([]float64, rows+1)
+	v := make([]float64, columns+1)
+	rowOf := make([]int, columns+1)
+	way := make([]int, columns+1)
+	for i := 1; i <= rows; i++ {
+		rowOf[0] = i
+		j0 := 0
+		minv := make([]float64, columns+1)
+		used := make([]bool, columns+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for rowOf[j0] != 0 {
+			used[j0] = true
+			i0, delta, j1 := rowOf[j0], math.Inf(1), 0
+			for j := 1; j <= columns; j++ {
+				if used[j] {
+					continue
+				}
+				if reduced := at(i0-1, j-1) - u[i0] - v[j]; reduced < minv[j] {
+					minv[j], way[j] = reduced, j0
+				}
+				if minv[j] < delta {
+					delta, j1 = minv[j], j
+				}
+			}
+			for j := 0; j <= columns; j++ {
+				if used[j] {
+					u[rowOf[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+		}
+		// Flip the augmenting path
+		for j0 != 0 {
+			j1 := way[j0]
+			rowOf[j0] = rowOf[j1]
+			j0 = j1
+		}
+	}
+
+	assignment := make([]int, rows)
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	for j := 1; j <= columns; j++ {
+		if i := rowOf[j]; i != 0 && !math.IsInf(cost[i-1][j-1], 1) {
+			assignment[i-1] = j - 1
+		}
+	}
+	return assignment
+}
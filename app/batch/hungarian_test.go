@@ -0,0 +1,96 @@
+package batch
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssign(t *testing.T) {
+	inf := math.Inf(1)
+	tt := []struct {
+		cost     [][]float64
+		expected []int
+	}{
+		{[][]float64{}, []int{}},
+		{[][]float64{{4, 1, 3}, {2, 0, 5}, {3, 2, 2}}, []int{1, 0, 2}},
+		// More columns than rows
+		{[][]float64{{9, 1, 8}, {1, 9, 8}}, []int{1, 0}},
+		// More rows than columns, the most expensive row is left
+		{[][]float64{{1, 9}, {9, 1}, {5, 5}}, []int{0, 1, -1}},
+		// No column
+		{[][]float64{{}, {}}, []int{-1, -1}},
+		// Forbidden pairs
+		{[][]float64{{1, inf}, {2, inf}}, []int{0, -1}},
+		{[][]float64{{1, 2}, {inf, 100}}, []int{0, 1}},
+		{[][]float64{{inf, inf}, {inf, 3}}, []int{-1, 1}},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, assign(tc.cost), "%v", tc.cost)
+	}
+}
+
+func TestAssignOptimal(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		rows, columns := 1+random.Intn(5), 1+random.Intn(5)
+		cost := make([][]float64, rows)
+		for i := range cost {
+			cost[i] = make([]float64, columns)
+			for j := range cost[i] {
+				cost[i][j] = float64(random.Intn(100))
+			}
+		}
+
+		assignment := assign(cost)
+		used := map[int]bool{}
+		total, assigned := 0.0, 0
+		for i, j := range assignment {
+			if j < 0 {
+				continue
+			}
+			assert.False(t, used[j], "column %d assigned twice", j)
+			used[j] = true
+			total += cost[i][j]
+			assigned++
+		}
+		expected := rows
+		if columns < rows {
+			expected = columns
+		}
+		assert.Equal(t, expected, assigned)
+		assert.Equal(t, bruteForce(cost, 0, map[int]bool{}), total, "%v", cost)
+	}
+}
+
+// bruteForce Minimum total cost assigning as many rows as possible, from row i with used columns
+func bruteForce(cost [][]float64, i int, used map[int]bool) float64 {
+	if i == len(cost) {
+		return 0
+	}
+
+	free := 0
+	for j := range cost[i] {
+		if !used[j] {
+			free++
+		}
+	}
+	best := math.Inf(1)
+	// Rows can only be skipped when there are not enough columns left
+	if free < len(cost)-i {
+		best = bruteForce(cost, i+1, used)
+	}
+	for j := range cost[i] {
+		if used[j] {
+			continue
+		}
+		used[j] = true
+		if total := cost[i][j] + bruteForce(cost, i+1, used); total < best {
+			best = total
+		}
+		used[j] = false
+	}
+	return best
+}
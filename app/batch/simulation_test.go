@@ -0,0 +1,109 @@
+package batch
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/app/eta"
+	"github.com/trietphm/gruber/app/matching"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// outcome Result of matching the rides of a simulation
+type outcome struct {
+	assigned int
+	// pickup Total pickup time of assigned rides
+	pickup time.Duration
+}
+
+// simulate Match rides to drivers placed at random in a square of side km around (0, 0), either greedily
+// in arrival order or in one batch
+func simulate(t *testing.T, seed int64, rides, drivers int, side float64, batched bool) outcome {
+	random := rand.New(rand.NewSource(seed))
+	// About 111 km per degree on the equator
+	position := func() (float64, float64) {
+		return (random.Float64() - 0.5) * side / 111, (random.Float64() - 0.5) * side / 111
+	}
+
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	locations := map[int][2]float64{}
+	for i := 0; i < drivers; i++ {
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := dbPg.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		lat, lng := position()
+		if err := dbRedis.PushDriverLocationGeo(driver.ID, lat, lng, nil); err != nil {
+			t.Fatal(err)
+		}
+		locations[driver.ID] = [2]float64{lat, lng}
+	}
+	requested := make([]mpg.Ride, rides)
+	for i := range requested {
+		lat, lng := position()
+		requested[i] = mpg.Ride{PassengerID: 1, Lat: lat, Lng: lng, Status: mpg.RideRequested}
+		if err := dbPg.CreateRide(&requested[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	estimator := newEstimator(t)
+	matcher := matching.New(dbPg, dbRedis, nil, nil, 0)
+	if batched {
+		b := New(matcher, estimator, Options{})
+		batch := make([]request, len(requested))
+		for i := range requested {
+			batch[i] = request{ride: &requested[i], result: make(chan result, 1)}
+		}
+		b.match(batch)
+	} else {
+		for i := range requested {
+			if _, err := matcher.AssignDriver(&requested[i], nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var result outcome
+	for _, ride := range requested {
+		if ride.DriverID == 0 {
+			continue
+		}
+		location := locations[ride.DriverID]
+		result.assigned++
+		result.pickup += eta.Duration(geo.Distance(location[0], location[1], ride.Lat, ride.Lng), 30)
+	}
+	return result
+}
+
+func TestSimulation(t *testing.T) {
+	tt := []struct {
+		rides, drivers int
+		side           float64
+	}{
+		{10, 20, 5},
+		{20, 20, 5},
+		{30, 50, 10},
+		// Rides close to each other share more than matching.Top nearest drivers
+		{12, 12, 1},
+		{40, 60, 3},
+	}
+	for _, tc := range tt {
+		for seed := int64(1); seed <= 5; seed++ {
+			greedy := simulate(t, seed, tc.rides, tc.drivers, tc.side, false)
+			batched := simulate(t, seed, tc.rides, tc.drivers, tc.side, true)
+			t.Logf("rides %d drivers %d side %vkm seed %d: greedy %d assigned in %v, batched %d assigned in %v",
+				tc.rides, tc.drivers, tc.side, seed, greedy.assigned, greedy.pickup, batched.assigned, batched.pickup)
+
+			assert.True(t, batched.assigned >= greedy.assigned)
+			if batched.assigned == greedy.assigned {
+				assert.True(t, batched.pickup <= greedy.pickup)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Package cancellation decides the fee of a ride cancellation
+package cancellation
+
+import (
+	"time"
+
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// Policy Cancellation rules, fees are in the smallest currency unit
+type Policy struct {
+	// FreeWindow Passengers cancel for free this long after the request
+	FreeWindow time.Duration
+	// Fee Charged when the passenger cancels after the free window and a driver was assigned
+	Fee int64
+	// NoShowWait Wait of the driver at pickup after which the passenger is a no-show, 0 disables no-shows
+	NoShowWait time.Duration
+	// NoShowFee Charged to the passenger on a no-show, whoever cancels
+	NoShowFee int64
+}
+
+// Decision Outcome of a cancellation
+type Decision struct {
+	// Fee Charged to the passenger
+	Fee int64
+	// NoShow The driver waited NoShowWait at pickup
+	NoShow bool
+	// Redispatch The driver cancelled, the ride goes back to dispatch instead of being cancelled
+	Redispatch bool
+}
+
+// Decide Apply the policy to a ride cancelled by a passenger or a driver at a time
+func (p Policy) Decide(ride *mpg.Ride, cancelledBy string, at time.Time) Decision {
+	if p.NoShowWait > 0 && ride.Status == mpg.RideArrived && at.Sub(ride.ArrivedAt) >= p.NoShowWait {
+		return Decision{Fee: p.NoShowFee, NoShow: true}
+	}
+
+	if cancelledBy == mpg.CancelledByDriver {
+		return Decision{Redispatch: true}
+	}
+
+	if ride.DriverID != 0 && at.Sub(ride.CreatedAt) > p.FreeWindow {
+		return Decision{Fee: p.Fee}
+	}
+
+	return Decision{}
+}
@@ -0,0 +1,53 @@
+package cancellation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+func TestDecide(t *testing.T) {
+	policy := Policy{
+		FreeWindow: 2 * time.Minute,
+		Fee:        10000,
+		NoShowWait: 5 * time.Minute,
+		NoShowFee:  20000,
+	}
+	requestedAt := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	requested := mpg.Ride{Status: mpg.RideRequested, CreatedAt: requestedAt}
+	assigned := mpg.Ride{Status: mpg.RideAssigned, DriverID: 1, CreatedAt: requestedAt, AssignedAt: requestedAt.Add(time.Minute)}
+	arrived := assigned
+	arrived.Status = mpg.RideArrived
+	arrived.ArrivedAt = requestedAt.Add(10 * time.Minute)
+
+	tt := []struct {
+		name        string
+		ride        mpg.Ride
+		cancelledBy string
+		at          time.Time
+		expected    Decision
+	}{
+		{"PassengerWithoutDriver", requested, mpg.CancelledByPassenger, requestedAt.Add(time.Hour), Decision{}},
+		{"PassengerInFreeWindow", assigned, mpg.CancelledByPassenger, requestedAt.Add(2 * time.Minute), Decision{}},
+		{"PassengerAfterAssigned", assigned, mpg.CancelledByPassenger, requestedAt.Add(3 * time.Minute), Decision{Fee: 10000}},
+		{"PassengerBeforeNoShow", arrived, mpg.CancelledByPassenger, arrived.ArrivedAt.Add(4 * time.Minute), Decision{Fee: 10000}},
+		{"PassengerNoShow", arrived, mpg.CancelledByPassenger, arrived.ArrivedAt.Add(5 * time.Minute), Decision{Fee: 20000, NoShow: true}},
+		{"DriverAssigned", assigned, mpg.CancelledByDriver, requestedAt.Add(3 * time.Minute), Decision{Redispatch: true}},
+		{"DriverBeforeNoShow", arrived, mpg.CancelledByDriver, arrived.ArrivedAt.Add(time.Minute), Decision{Redispatch: true}},
+		{"DriverNoShow", arrived, mpg.CancelledByDriver, arrived.ArrivedAt.Add(6 * time.Minute), Decision{Fee: 20000, NoShow: true}},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, policy.Decide(&tc.ride, tc.cancelledBy, tc.at), tc.name)
+	}
+}
+
+func TestDecideNoShowDisabled(t *testing.T) {
+	policy := Policy{FreeWindow: 2 * time.Minute, Fee: 10000}
+	requestedAt := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	arrived := mpg.Ride{Status: mpg.RideArrived, DriverID: 1, CreatedAt: requestedAt, ArrivedAt: requestedAt.Add(time.Minute)}
+
+	assert.Equal(t, Decision{Fee: 10000}, policy.Decide(&arrived, mpg.CancelledByPassenger, arrived.ArrivedAt.Add(time.Hour)))
+	assert.Equal(t, Decision{Redispatch: true}, policy.Decide(&arrived, mpg.CancelledByDriver, arrived.ArrivedAt.Add(time.Hour)))
+}
@@ -0,0 +1,229 @@
+// Package earnings totals what drivers earn from their completed rides by day and by week
+package earnings
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+const (
+	// LineRide Completed ride, the driver earns the fare less the commission plus the tip
+	LineRide = "ride"
+	// LineAdjustment Adjustment by support
+	LineAdjustment = "adjustment"
+)
+
+// Line Completed ride or adjustment of a statement, amounts are in the smallest currency unit
+type Line struct {
+	Kind string
+	// At Completion of the ride or creation of the adjustment
+	At           time.Time
+	RideID       int
+	AdjustmentID int
+	Currency     string
+	Fare         int64
+	Commission   int64
+	Tip          int64
+	Adjustment   int64
+	Memo         string
+}
+
+// Net Earned by the driver
+func (line *Line) Net() int64 {
+	return line.Fare - line.Commission + line.Tip + line.Adjustment
+}
+
+// Totals Sums of the lines of a period in a currency
+type Totals struct {
+	// Start Start of the day, the week or the statement
+	Start       time.Time
+	Currency    string
+	Rides       int
+	Fares       int64
+	Commission  int64
+	Tips        int64
+	Adjustments int64
+	Net         int64
+}
+
+// add Add a line to the totals
+func (totals *Totals) add(line *Line) {
+	if line.Kind == LineRide {
+		totals.Rides++
+	}
+	totals.Fares += line.Fare
+	totals.Commission += line.Commission
+	totals.Tips += line.Tip
+	totals.Adjustments += line.Adjustment
+	totals.Net += line.Net()
+}
+
+// Statement Earnings of a driver from a time until before another. Every total is the sum of the lines,
+// which are the ride and adjustment records as they are
+type Statement struct {
+	DriverID int
+	From     time.Time
+	To       time.Time
+	// Lines Rides and adjustments in time order
+	Lines []Line
+	// Days Totals by day and currency, days without lines are omitted
+	Days []Totals
+	// Weeks Totals by week from Monday and currency, weeks without lines are omitted
+	Weeks []Totals
+	// Totals Totals of the statement by currency
+	Totals []Totals
+}
+
+// NewStatement Build the statement of rides completed and adjustments created from a time until before another.
+// Days start at midnight and weeks on Monday in the location of from
+func NewStatement(driverID int, from, to time.Time, rides []mpg.Ride, adjustments []mpg.EarningAdjustment) *Statement {
+	location := from.Location()
+	lines := make([]Line, 0, len(rides)+len(adjustments))
+	for _, ride := range rides {
+		lines = append(lines, Line{
+			Kind:       LineRide,
+			At:         ride.CompletedAt.In(location),
+			RideID:     ride.ID,
+			Currency:   ride.Currency,
+			Fare:       ride.Fare,
+			Commission: ride.Commission,
+			Tip:        ride.Tip,
+		})
+	}
+	for _, adjustment := range adjustments {
+		lines = append(lines, Line{
+			Kind:         LineAdjustment,
+			At:           adjustment.CreatedAt.In(location),
+			RideID:       adjustment.RideID,
+			AdjustmentID: adjustment.ID,
+			Currency:     adjustment.Currency,
+			Adjustment:   adjustment.Amount,
+			Memo:         adjustment.Reason,
+		})
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].At.Before(lines[j].At) })
+
+	return &Statement{
+		DriverID: driverID,
+		From:     from,
+		To:       to,
+		Lines:    lines,
+		Days:     total(lines, Day),
+		Weeks:    total(lines, Week),
+		Totals:   total(lines, func(time.Time) time.Time { return from }),
+	}
+}
+
+// Day Start of the day of a time in its location
+func Day(at time.Time) time.Time {
+	return time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+}
+
+// Week Start of the week of a time in its location, weeks start on Monday
+func Week(at time.Time) time.Time {
+	day := Day(at)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// total Totals of lines by period start and currency, in start then currency order
+func total(lines []Line, start func(time.Time) time.Time) []Totals {
+	type key struct {
+		start    time.Time
+		currency string
+	}
+	index := map[key]int{}
+	totals := []Totals{}
+	for i := range lines {
+		k := key{start: start(lines[i].At), currency: lines[i].Currency}
+		if _, ok := index[k]; !ok {
+			index[k] = len(totals)
+			totals = append(totals, Totals{Start: k.start, Currency: k.currency})
+		}
+		totals[index[k]].add(&lines[i])
+	}
+	sort.SliceStable(totals, func(i, j int) bool {
+		if !totals[i].Start.Equal(totals[j].Start) {
+			return totals[i].Start.Before(totals[j].Start)
+		}
+		return totals[i].Currency < totals[j].Currency
+	})
+	return totals
+}
+
+// WriteCSV Write the lines of the statement then its totals by currency as CSV with a header row
+func (s *Statement) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"time", "kind", "ride_id", "adjustment_id", "currency", "fare", "commission", "tip", "adjustment", "net", "memo"})
+	for i := range s.Lines {
+		line := &s.Lines[i]
+		writer.Write([]string{
+			line.At.Format(time.RFC3339),
+			line.Kind,
+			optionalID(line.RideID),
+			optionalID(line.AdjustmentID),
+			line.Currency,
+			strconv.FormatInt(line.Fare, 10),
+			strconv.FormatInt(line.Commission, 10),
+			strconv.FormatInt(line.Tip, 10),
+			strconv.FormatInt(line.Adjustment, 10),
+			strconv.FormatInt(line.Net(), 10),
+			line.Memo,
+		})
+	}
+	for _, totals := range s.Totals {
+		writer.Write([]string{
+			s.From.Format(time.RFC3339),
+			"total",
+			"",
+			"",
+			totals.Currency,
+			strconv.FormatInt(totals.Fares, 10),
+			strconv.FormatInt(totals.Commission, 10),
+			strconv.FormatInt(totals.Tips, 10),
+			strconv.FormatInt(totals.Adjustments, 10),
+			strconv.FormatInt(totals.Net, 10),
+			strconv.Itoa(totals.Rides) + " rides",
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// optionalID Format an id, empty if 0
+func optionalID(id int) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.Itoa(id)
+}
+
+// Service Statements of the earnings of drivers
+type Service struct {
+	dbPg database.PgI
+}
+
+// New Create earnings service
+func New(dbPg database.PgI) *Service {
+	return &Service{dbPg: dbPg}
+}
+
+// Statement Get the statement of a driver from a time until before another, see NewStatement
+func (s *Service) Statement(driverID int, from, to time.Time) (*Statement, error) {
+	rides, err := s.dbPg.GetCompletedRides(driverID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	adjustments, err := s.dbPg.GetEarningAdjustments(driverID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStatement(driverID, from, to, rides, adjustments), nil
+}
@@ -0,0 +1,143 @@
+package earnings
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+var ict = time.FixedZone("ICT", 7*60*60)
+
+func TestDayWeek(t *testing.T) {
+	tt := []struct {
+		at   time.Time
+		day  time.Time
+		week time.Time
+	}{
+		// Monday
+		{time.Date(2026, 1, 5, 0, 0, 0, 0, ict), time.Date(2026, 1, 5, 0, 0, 0, 0, ict), time.Date(2026, 1, 5, 0, 0, 0, 0, ict)},
+		{time.Date(2026, 1, 7, 23, 59, 59, 0, ict), time.Date(2026, 1, 7, 0, 0, 0, 0, ict), time.Date(2026, 1, 5, 0, 0, 0, 0, ict)},
+		// Sunday
+		{time.Date(2026, 1, 11, 12, 0, 0, 0, ict), time.Date(2026, 1, 11, 0, 0, 0, 0, ict), time.Date(2026, 1, 5, 0, 0, 0, 0, ict)},
+		// Across a month
+		{time.Date(2026, 3, 1, 8, 0, 0, 0, ict), time.Date(2026, 3, 1, 0, 0, 0, 0, ict), time.Date(2026, 2, 23, 0, 0, 0, 0, ict)},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.day, Day(tc.at), tc.at.String())
+		assert.Equal(t, tc.week, Week(tc.at), tc.at.String())
+	}
+}
+
+func TestStatement(t *testing.T) {
+	dbPg := memory.NewPg()
+	// Sunday 4 January to Monday 5 January, in ICT
+	from := time.Date(2026, 1, 4, 0, 0, 0, 0, ict)
+	to := time.Date(2026, 1, 6, 0, 0, 0, 0, ict)
+	rides := []mpg.Ride{
+		// 23:30 on Sunday in ICT
+		{DriverID: 1, Status: mpg.RideCompleted, CompletedAt: time.Date(2026, 1, 4, 16, 30, 0, 0, time.UTC), Fare: 50001, Commission: 10000, Currency: "VND", Tip: 5000},
+		// 00:30 on Monday in ICT
+		{DriverID: 1, Status: mpg.RideCompleted, CompletedAt: time.Date(2026, 1, 4, 17, 30, 0, 0, time.UTC), Fare: 33333, Commission: 6667, Currency: "VND"},
+		{DriverID: 1, Status: mpg.RideCompleted, CompletedAt: time.Date(2026, 1, 5, 3, 0, 0, 0, time.UTC), Fare: 1250, Commission: 250, Currency: "USD"},
+		// Outside the statement, another driver or not completed
+		{DriverID: 1, Status: mpg.RideCompleted, CompletedAt: time.Date(2026, 1, 5, 17, 0, 0, 0, time.UTC), Fare: 40000, Commission: 8000, Currency: "VND"},
+		{DriverID: 2, Status: mpg.RideCompleted, CompletedAt: time.Date(2026, 1, 5, 3, 0, 0, 0, time.UTC), Fare: 40000, Commission: 8000, Currency: "VND"},
+		{DriverID: 1, Status: mpg.RideStarted, Currency: "VND"},
+	}
+	for i := range rides {
+		if err := dbPg.CreateRide(&rides[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	adjustment := mpg.EarningAdjustment{DriverID: 1, RideID: rides[1].ID, Amount: -2000, Currency: "VND", Reason: "Toll, refunded",
+		CreatedAt: time.Date(2026, 1, 5, 4, 0, 0, 0, time.UTC)}
+	if err := dbPg.CreateEarningAdjustment(&adjustment); err != nil {
+		t.Fatal(err)
+	}
+
+	statement, err := New(dbPg).Statement(1, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sunday := time.Date(2026, 1, 4, 0, 0, 0, 0, ict)
+	monday := time.Date(2026, 1, 5, 0, 0, 0, 0, ict)
+	assert.Equal(t, []Totals{
+		{Start: sunday, Currency: "VND", Rides: 1, Fares: 50001, Commission: 10000, Tips: 5000, Net: 45001},
+		{Start: monday, Currency: "USD", Rides: 1, Fares: 1250, Commission: 250, Net: 1000},
+		{Start: monday, Currency: "VND", Rides: 1, Fares: 33333, Commission: 6667, Adjustments: -2000, Net: 24666},
+	}, statement.Days)
+	assert.Equal(t, []Totals{
+		{Start: time.Date(2025, 12, 29, 0, 0, 0, 0, ict), Currency: "VND", Rides: 1, Fares: 50001, Commission: 10000, Tips: 5000, Net: 45001},
+		{Start: monday, Currency: "USD", Rides: 1, Fares: 1250, Commission: 250, Net: 1000},
+		{Start: monday, Currency: "VND", Rides: 1, Fares: 33333, Commission: 6667, Adjustments: -2000, Net: 24666},
+	}, statement.Weeks)
+	assert.Equal(t, []Totals{
+		{Start: from, Currency: "USD", Rides: 1, Fares: 1250, Commission: 250, Net: 1000},
+		{Start: from, Currency: "VND", Rides: 2, Fares: 83334, Commission: 16667, Tips: 5000, Adjustments: -2000, Net: 69667},
+	}, statement.Totals)
+
+	var buf bytes.Buffer
+	if err := statement.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `time,kind,ride_id,adjustment_id,currency,fare,commission,tip,adjustment,net,memo
+2026-01-04T23:30:00+07:00,ride,1,,VND,50001,10000,5000,0,45001,
+2026-01-05T00:30:00+07:00,ride,2,,VND,33333,6667,0,0,26666,
+2026-01-05T10:00:00+07:00,ride,3,,USD,1250,250,0,0,1000,
+2026-01-05T11:00:00+07:00,adjustment,2,1,VND,0,0,0,-2000,-2000,"Toll, refunded"
+2026-01-04T00:00:00+07:00,total,,,USD,1250,250,0,0,1000,1 rides
+2026-01-04T00:00:00+07:00,total,,,VND,83334,16667,5000,-2000,69667,2 rides
+`, buf.String())
+}
+
+// TestStatementReconcile Days, weeks and the statement total the ride and adjustment records exactly
+func TestStatementReconcile(t *testing.T) {
+	from := time.Date(2026, 2, 1, 0, 0, 0, 0, ict)
+	to := from.AddDate(0, 0, 60)
+	rides := []mpg.Ride{}
+	adjustments := []mpg.EarningAdjustment{}
+	var fares, commission, tips, adjusted int64
+	for i := 0; i < 500; i++ {
+		ride := mpg.Ride{
+			ID:          i + 1,
+			CompletedAt: from.Add(time.Duration(i) * 173 * time.Minute),
+			Fare:        int64(15000 + i*137),
+			Commission:  int64(3000 + i*27),
+			Tip:         int64(i%7) * 1000,
+			Currency:    "VND",
+		}
+		rides = append(rides, ride)
+		fares += ride.Fare
+		commission += ride.Commission
+		tips += ride.Tip
+		if i%50 == 0 {
+			adjustment := mpg.EarningAdjustment{ID: i + 1, Amount: int64(i - 250), Currency: "VND", CreatedAt: ride.CompletedAt}
+			adjustments = append(adjustments, adjustment)
+			adjusted += adjustment.Amount
+		}
+	}
+
+	statement := NewStatement(1, from, to, rides, adjustments)
+	expected := Totals{Start: from, Currency: "VND", Rides: len(rides), Fares: fares, Commission: commission, Tips: tips,
+		Adjustments: adjusted, Net: fares - commission + tips + adjusted}
+	assert.Equal(t, []Totals{expected}, statement.Totals)
+	assert.Len(t, statement.Lines, len(rides)+len(adjustments))
+
+	for _, periods := range [][]Totals{statement.Days, statement.Weeks} {
+		sum := Totals{Start: from, Currency: "VND"}
+		for _, period := range periods {
+			sum.Rides += period.Rides
+			sum.Fares += period.Fares
+			sum.Commission += period.Commission
+			sum.Tips += period.Tips
+			sum.Adjustments += period.Adjustments
+			sum.Net += period.Net
+		}
+		assert.Equal(t, expected, sum)
+	}
+}
@@ -0,0 +1,155 @@
+// Package eta estimates the pickup time of drivers from an average speed profile by time of day,
+// refined with the recent speed of each driver
+package eta
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mcass"
+)
+
+const (
+	// movingDistance Shorter moves between two locations are GPS noise of a stopped driver, in kilometer
+	movingDistance = 0.02
+	// minMovingTime Recent speed is not used if the driver moved less than this
+	minMovingTime = 30 * time.Second
+	// maxSpeed Faster recent speed in km/h is a GPS jump
+	maxSpeed = 120
+)
+
+// Profile Average speed in km/h of each hour of day
+type Profile [24]float64
+
+// ParseProfile Parse hour ranges with their speed, e.g. "7-9:15,17-19:12" is 15 km/h from 7:00 to 9:59
+// and 12 km/h from 17:00 to 19:59. Other hours have defaultSpeed
+func ParseProfile(defaultSpeed float64, spec string) (Profile, error) {
+	var profile Profile
+	if defaultSpeed <= 0 {
+		return profile, fmt.Errorf("Invalid default speed %v", defaultSpeed)
+	}
+	for hour := range profile {
+		profile[hour] = defaultSpeed
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 {
+			return profile, fmt.Errorf("Invalid speed profile %q", item)
+		}
+		speed, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || speed <= 0 {
+			return profile, fmt.Errorf("Invalid speed profile %q", item)
+		}
+
+		hours := strings.Split(parts[0], "-")
+		if len(hours) > 2 {
+			return profile, fmt.Errorf("Invalid speed profile %q", item)
+		}
+		from, err := strconv.Atoi(hours[0])
+		if err != nil {
+			return profile, fmt.Errorf("Invalid speed profile %q", item)
+		}
+		to := from
+		if len(hours) == 2 {
+			if to, err = strconv.Atoi(hours[1]); err != nil {
+				return profile, fmt.Errorf("Invalid speed profile %q", item)
+			}
+		}
+		if from < 0 || to > 23 || from > to {
+			return profile, fmt.Errorf("Invalid speed profile %q", item)
+		}
+
+		for hour := from; hour <= to; hour++ {
+			profile[hour] = speed
+		}
+	}
+
+	return profile, nil
+}
+
+// Estimator Estimate pickup time of drivers
+type Estimator struct {
+	dbCass   database.CassandraI
+	profile  Profile
+	location *time.Location
+	window   time.Duration
+}
+
+// New Create an estimator, hours of the profile are in location. The recent speed of a driver is computed
+// from its location history of the last window, a zero window disables it
+func New(dbCass database.CassandraI, profile Profile, location *time.Location, window time.Duration) *Estimator {
+	return &Estimator{
+		dbCass:   dbCass,
+		profile:  profile,
+		location: location,
+		window:   window,
+	}
+}
+
+// Estimate Estimate the time a driver needs to drive distance kilometer at a time
+func (e *Estimator) Estimate(driverID int, distance float64, at time.Time) (time.Duration, error) {
+	speed, err := e.Speed(driverID, at)
+	if err != nil {
+		return 0, err
+	}
+
+	return Duration(distance, speed), nil
+}
+
+// Speed Expected speed in km/h of a driver at a time. The speed of the hour is averaged with the recent speed
+// of the driver when it moved long enough
+func (e *Estimator) Speed(driverID int, at time.Time) (float64, error) {
+	speed := e.profile[at.In(e.location).Hour()]
+	if e.window > 0 {
+		history, err := e.dbCass.GetDriverHistory(driverID, at.Add(-e.window))
+		if err != nil {
+			return 0, err
+		}
+		if recent, ok := recentSpeed(history); ok {
+			speed = (speed + recent) / 2
+		}
+	}
+
+	return speed, nil
+}
+
+// Duration Time to drive distance kilometer at speed km/h
+func Duration(distance, speed float64) time.Duration {
+	return time.Duration(distance / speed * float64(time.Hour))
+}
+
+// recentSpeed Average speed in km/h while the driver moved, history is newest first
+func recentSpeed(history []mcass.DriverLocation) (float64, bool) {
+	var (
+		distance float64
+		moving   time.Duration
+	)
+	for i := 1; i < len(history); i++ {
+		newer, older := history[i-1], history[i]
+		d := geo.Distance(older.Lat, older.Lng, newer.Lat, newer.Lng)
+		if d < movingDistance {
+			continue
+		}
+		distance += d
+		moving += newer.CreatedAt.Sub(older.CreatedAt)
+	}
+	if moving < minMovingTime {
+		return 0, false
+	}
+
+	speed := distance / moving.Hours()
+	if speed > maxSpeed {
+		return 0, false
+	}
+	return speed, true
+}
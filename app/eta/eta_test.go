@@ -0,0 +1,98 @@
+package eta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/model/mcass"
+)
+
+func TestParseProfile(t *testing.T) {
+	profile, err := ParseProfile(25, "7-9:15, 17-19:12,23:40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, float64(25), profile[0])
+	assert.Equal(t, float64(25), profile[6])
+	assert.Equal(t, float64(15), profile[7])
+	assert.Equal(t, float64(15), profile[9])
+	assert.Equal(t, float64(25), profile[10])
+	assert.Equal(t, float64(12), profile[19])
+	assert.Equal(t, float64(40), profile[23])
+
+	profile, err = ParseProfile(30, "")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(30), profile[12])
+
+	for _, spec := range []string{"7-9", "7-9:x", "7-9:0", "9-7:10", "0-24:10", "a-9:10", "1-2-3:10"} {
+		_, err := ParseProfile(25, spec)
+		assert.Error(t, err, spec)
+	}
+	_, err = ParseProfile(0, "")
+	assert.Error(t, err)
+}
+
+func TestEstimate(t *testing.T) {
+	profile, _ := ParseProfile(30, "8:15")
+	at := time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC)
+	db := memory.NewCassandra()
+
+	// Without history: 3 km at 15 km/h
+	e := New(db, profile, time.UTC, 10*time.Minute)
+	eta, err := e.Estimate(1, 3, at)
+	assert.NoError(t, err)
+	assert.Equal(t, 12*time.Minute, eta)
+
+	// Profile hours are in the estimator location
+	eta, err = New(db, profile, time.FixedZone("UTC+1", 3600), 0).Estimate(1, 3, at)
+	assert.NoError(t, err)
+	assert.Equal(t, 6*time.Minute, eta)
+
+	// Driver 1 drove 1.11 km in 2 minutes (33 km/h) then stopped, averaged with 15 km/h is 24 km/h
+	history := []mcass.DriverLocation{
+		{DriverID: 1, Lat: 0, Lng: 0, CreatedAt: at.Add(-5 * time.Minute)},
+		{DriverID: 1, Lat: 0, Lng: 0.005, CreatedAt: at.Add(-4 * time.Minute)},
+		{DriverID: 1, Lat: 0, Lng: 0.01, CreatedAt: at.Add(-3 * time.Minute)},
+		{DriverID: 1, Lat: 0, Lng: 0.01001, CreatedAt: at.Add(-time.Minute)},
+		// Older than the window
+		{DriverID: 1, Lat: 1, Lng: 1, CreatedAt: at.Add(-time.Hour)},
+	}
+	for i := range history {
+		if err := db.CreateDriverLocation(&history[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eta, err = e.Estimate(1, 3, at)
+	assert.NoError(t, err)
+	recent := 1.1123 / (2.0 / 60)
+	assert.InDelta(t, (3 / ((15 + recent) / 2) * float64(time.Hour)), float64(eta), float64(time.Second))
+}
+
+func TestRecentSpeed(t *testing.T) {
+	now := time.Now()
+	_, ok := recentSpeed(nil)
+	assert.False(t, ok)
+
+	// Stopped
+	_, ok = recentSpeed([]mcass.DriverLocation{
+		{Lat: 0, Lng: 0.00001, CreatedAt: now},
+		{Lat: 0, Lng: 0, CreatedAt: now.Add(-time.Minute)},
+	})
+	assert.False(t, ok)
+
+	// GPS jump
+	_, ok = recentSpeed([]mcass.DriverLocation{
+		{Lat: 0, Lng: 1, CreatedAt: now},
+		{Lat: 0, Lng: 0, CreatedAt: now.Add(-time.Minute)},
+	})
+	assert.False(t, ok)
+
+	speed, ok := recentSpeed([]mcass.DriverLocation{
+		{Lat: 0, Lng: 0.01, CreatedAt: now},
+		{Lat: 0, Lng: 0, CreatedAt: now.Add(-time.Minute)},
+	})
+	assert.True(t, ok)
+	assert.InDelta(t, 66.7, speed, 0.1)
+}
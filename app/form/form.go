@@ -1,11 +1,41 @@
 package form
 
 import (
+	"encoding/json"
 	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/trietphm/gruber/app/geofence"
+	"github.com/trietphm/gruber/app/heatmap"
+	"github.com/trietphm/gruber/geo"
 	"github.com/trietphm/gruber/model/mpg"
 )
 
+// MaxStops Maximum stops of a ride before its dropoff
+const MaxStops = 5
+
+const (
+	// MaxRatingTags Maximum tags of a rating
+	MaxRatingTags = 5
+	// MaxTagLength Maximum length of a rating tag in characters
+	MaxTagLength = 32
+	// MaxCommentLength Maximum length of a rating comment in characters
+	MaxCommentLength = 1000
+)
+
+// MaxEarningsDays Maximum days of an earnings statement
+const MaxEarningsDays = 92
+
+// rePhone Phone number in E.164 format, the leading + is optional
+var rePhone = regexp.MustCompile(`^\+?[1-9][0-9]{7,14}$`)
+
+// reCurrency ISO 4217 currency code
+var reCurrency = regexp.MustCompile(`^[A-Z]{3}$`)
+
 // Driver input for sign up driver
 type Driver struct {
 	Name string `json:"name"`
@@ -13,7 +43,18 @@ type Driver struct {
 
 // Passenger input for sign up passenger
 type Passenger struct {
-	Name string `json:"name"`
+	Name                 string `json:"name"`
+	Phone                string `json:"phone"`
+	Email                string `json:"email"`
+	DefaultPaymentMethod string `json:"default_payment_method"`
+}
+
+// UpdatePassenger Input for update passenger profile, only given fields are updated
+type UpdatePassenger struct {
+	Name                 *string `json:"name"`
+	Phone                *string `json:"phone"`
+	Email                *string `json:"email"`
+	DefaultPaymentMethod *string `json:"default_payment_method"`
 }
 
 // Location input location with latitude and longitude
@@ -22,6 +63,47 @@ type Location struct {
 	Lng float64 `json:"lng"`
 }
 
+// Stop Input stop of a ride, the place id of the maps provider is optional
+type Stop struct {
+	Location Location `json:"location"`
+	Address  string   `json:"address"`
+	PlaceID  string   `json:"place_id"`
+}
+
+// Date Input date in format 2006-01-02
+type Date time.Time
+
+// UnmarshalJSON Parse date from a json string
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+
+	t, err := time.Parse(mpg.DateFormat, str)
+	if err != nil {
+		return err
+	}
+	*d = Date(t)
+	return nil
+}
+
+// Vehicle Input for add a driver's vehicle
+type Vehicle struct {
+	Plate string `json:"plate"`
+	Make  string `json:"make"`
+	Model string `json:"model"`
+	Color string `json:"color"`
+	Seats int    `json:"seats"`
+	Class string `json:"class"`
+}
+
+// DriverDocument Input for save a driver's document, the type is in the url
+type DriverDocument struct {
+	Number    string `json:"number"`
+	ExpiresAt Date   `json:"expires_at"`
+}
+
 // DriverState Input for update driver state
 type DriverState struct {
 	State string `json:"state"`
@@ -29,27 +111,131 @@ type DriverState struct {
 
 // RequestRide Input for request a ride
 type RequestRide struct {
-	PassengerID int      `json:"passenger_id"`
-	Location    Location `json:"location"`
+	PassengerID  int      `json:"passenger_id"`
+	Location     Location `json:"location"`
+	VehicleClass string   `json:"vehicle_class"`
+	// Stops Stops between pickup and dropoff in visit order, they require a dropoff
+	Stops   []Stop `json:"stops"`
+	Dropoff *Stop  `json:"dropoff"`
+}
+
+// ScheduleRide Input for schedule a ride ahead of its pickup time
+type ScheduleRide struct {
+	RequestRide
+	PickupAt time.Time `json:"pickup_at"`
+}
+
+// CancelRide Input for cancel a ride
+type CancelRide struct {
+	CancelledBy string `json:"cancelled_by"`
+	// DriverID Driver cancelling the ride, required when cancelled by the driver
+	DriverID int    `json:"driver_id"`
+	Reason   string `json:"reason"`
+}
+
+// DeclineRide Input for decline a ride by its driver
+type DeclineRide struct {
+	DriverID int `json:"driver_id"`
 }
 
-// Validate Validate input request ride
-func (input *RequestRide) Validate() error {
+// Validate Validate input request ride, the pickup must be served by fences
+func (input *RequestRide) Validate(fences *geofence.Fences) error {
 	if input.PassengerID <= 0 {
 		return errors.New("Not found passenger")
 	}
 
-	if input.Location.Lat > 90 || input.Location.Lat < -90 {
+	if err := input.Location.Validate(); err != nil {
+		return err
+	}
+
+	if err := fences.CheckPickup(input.Location.Lat, input.Location.Lng); err != nil {
+		return err
+	}
+
+	// Empty vehicle class matches drivers of every class
+	if input.VehicleClass != "" && !ValidVehicleClass(input.VehicleClass) {
+		return errors.New("Invalid vehicle class")
+	}
+
+	if len(input.Stops) > MaxStops {
+		return errors.New("Too many stops")
+	}
+
+	if len(input.Stops) > 0 && input.Dropoff == nil {
+		return errors.New("Stops require a dropoff")
+	}
+
+	for _, stop := range input.Stops {
+		if err := stop.Location.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if input.Dropoff != nil {
+		if err := input.Dropoff.Location.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate Validate input location
+func (input Location) Validate() error {
+	if input.Lat > 90 || input.Lat < -90 {
 		return errors.New("Invalid latitude")
 	}
 
-	if input.Location.Lng > 180 || input.Location.Lng < -180 {
+	if input.Lng > 180 || input.Lng < -180 {
 		return errors.New("Invalid longitude")
 	}
 
 	return nil
 }
 
+// Validate Validate input schedule ride, the pickup time must be in the future
+func (input *ScheduleRide) Validate(fences *geofence.Fences) error {
+	if err := input.RequestRide.Validate(fences); err != nil {
+		return err
+	}
+
+	if len(input.Stops) > 0 || input.Dropoff != nil {
+		return errors.New("Scheduled rides do not support stops")
+	}
+
+	if !input.PickupAt.After(time.Now()) {
+		return errors.New("Pickup time must be in the future")
+	}
+
+	return nil
+}
+
+// Validate Validate input cancel ride, it is cancelled by the passenger or the driver
+func (input *CancelRide) Validate() error {
+	if input.CancelledBy != mpg.CancelledByPassenger && input.CancelledBy != mpg.CancelledByDriver {
+		return errors.New("Invalid cancelled by")
+	}
+
+	if input.CancelledBy == mpg.CancelledByDriver && input.DriverID <= 0 {
+		return errors.New("Not found driver")
+	}
+
+	if input.Reason == "" {
+		return errors.New("Reason can not be empty")
+	}
+
+	return nil
+}
+
+// Validate Validate input decline ride
+func (input *DeclineRide) Validate() error {
+	if input.DriverID <= 0 {
+		return errors.New("Not found driver")
+	}
+
+	return nil
+}
+
 // Validate validate update driver state
 func (input *DriverState) Validate() error {
 	if input.State == "" || (input.State != mpg.StateAvailable && input.State != mpg.StateBusy) {
@@ -59,6 +245,51 @@ func (input *DriverState) Validate() error {
 	return nil
 }
 
+// Validate validate input add vehicle
+func (input *Vehicle) Validate() error {
+	if input.Plate == "" {
+		return errors.New("Plate can not be empty")
+	}
+
+	if input.Seats < 1 || input.Seats > 16 {
+		return errors.New("Invalid seats")
+	}
+
+	if !ValidVehicleClass(input.Class) {
+		return errors.New("Invalid vehicle class")
+	}
+
+	return nil
+}
+
+// ValidVehicleClass Check vehicle class is economy, xl or premium
+func ValidVehicleClass(class string) bool {
+	switch class {
+	case mpg.VehicleClassEconomy, mpg.VehicleClassXL, mpg.VehicleClassPremium:
+		return true
+	}
+
+	return false
+}
+
+// Validate validate input save driver document
+func (input *DriverDocument) Validate() error {
+	if input.Number == "" {
+		return errors.New("Number can not be empty")
+	}
+
+	if time.Time(input.ExpiresAt).IsZero() {
+		return errors.New("Expiry date can not be empty")
+	}
+
+	return nil
+}
+
+// ValidDocumentType Check document type is license or insurance
+func ValidDocumentType(documentType string) bool {
+	return documentType == mpg.DocumentLicense || documentType == mpg.DocumentInsurance
+}
+
 // Validate validate input sign up driver
 func (input *Driver) Validate() error {
 	if input.Name == "" {
@@ -68,11 +299,275 @@ func (input *Driver) Validate() error {
 	return nil
 }
 
-// Validate validate input sign up passenger
+// Validate validate input sign up passenger, phone, email and payment method are optional
 func (input *Passenger) Validate() error {
 	if input.Name == "" {
 		return errors.New("Name can not be empty")
 	}
 
+	return validateContact(input.Phone, input.Email, input.DefaultPaymentMethod)
+}
+
+// Validate validate input update passenger
+func (input *UpdatePassenger) Validate() error {
+	if input.Name != nil && *input.Name == "" {
+		return errors.New("Name can not be empty")
+	}
+
+	var phone, email, paymentMethod string
+	if input.Phone != nil {
+		phone = *input.Phone
+	}
+	if input.Email != nil {
+		email = *input.Email
+	}
+	if input.DefaultPaymentMethod != nil {
+		if *input.DefaultPaymentMethod == "" {
+			return errors.New("Invalid payment method")
+		}
+		paymentMethod = *input.DefaultPaymentMethod
+	}
+
+	return validateContact(phone, email, paymentMethod)
+}
+
+// Apply Copy given fields to passenger
+func (input *UpdatePassenger) Apply(passenger *mpg.Passenger) {
+	if input.Name != nil {
+		passenger.Name = *input.Name
+	}
+	if input.Phone != nil {
+		passenger.Phone = *input.Phone
+	}
+	if input.Email != nil {
+		passenger.Email = *input.Email
+	}
+	if input.DefaultPaymentMethod != nil {
+		passenger.DefaultPaymentMethod = *input.DefaultPaymentMethod
+	}
+}
+
+// validateContact Validate phone, email and payment method, empty values are valid
+func validateContact(phone, email, paymentMethod string) error {
+	if phone != "" && !rePhone.MatchString(phone) {
+		return errors.New("Invalid phone")
+	}
+
+	if email != "" {
+		address, err := mail.ParseAddress(email)
+		if err != nil || address.Address != email {
+			return errors.New("Invalid email")
+		}
+	}
+
+	switch paymentMethod {
+	case "", mpg.PaymentMethodCash, mpg.PaymentMethodCard, mpg.PaymentMethodWallet:
+	default:
+		return errors.New("Invalid payment method")
+	}
+
+	return nil
+}
+
+// RateRide Input for rate a completed ride, the passenger rates the driver and the driver rates the passenger
+type RateRide struct {
+	RatedBy string   `json:"rated_by"`
+	Rating  int      `json:"rating"`
+	Tags    []string `json:"tags"`
+	Comment string   `json:"comment"`
+}
+
+// Validate Validate input rate ride
+func (input *RateRide) Validate() error {
+	if input.RatedBy != mpg.RatedByPassenger && input.RatedBy != mpg.RatedByDriver {
+		return errors.New("Invalid rated by")
+	}
+
+	if input.Rating < mpg.MinRating || input.Rating > mpg.MaxRating {
+		return errors.New("Invalid rating")
+	}
+
+	if len(input.Tags) > MaxRatingTags {
+		return errors.New("Too many tags")
+	}
+
+	for _, tag := range input.Tags {
+		if tag == "" || utf8.RuneCountInString(tag) > MaxTagLength {
+			return errors.New("Invalid tag")
+		}
+	}
+
+	if utf8.RuneCountInString(input.Comment) > MaxCommentLength {
+		return errors.New("Comment is too long")
+	}
+
+	return nil
+}
+
+// RefundRide Input for refund part of the fare of a paid ride, the amount is in the smallest currency unit
+type RefundRide struct {
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// Validate Validate input refund ride
+func (input *RefundRide) Validate() error {
+	if input.Amount <= 0 {
+		return errors.New("Invalid amount")
+	}
+
+	if utf8.RuneCountInString(input.Reason) > MaxCommentLength {
+		return errors.New("Reason is too long")
+	}
+
+	return nil
+}
+
+// TipRide Input for tip the driver of a completed ride, the amount is in the smallest currency unit of the fare
+type TipRide struct {
+	Amount int64 `json:"amount"`
+}
+
+// Validate Validate input tip ride
+func (input *TipRide) Validate() error {
+	if input.Amount <= 0 {
+		return errors.New("Invalid amount")
+	}
+
+	return nil
+}
+
+// EarningAdjustment Input for adjust the earnings of a driver, a positive amount is credited and a negative one debited.
+// The currency is the fare currency if empty
+type EarningAdjustment struct {
+	RideID   int    `json:"ride_id"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Reason   string `json:"reason"`
+}
+
+// Validate Validate input earning adjustment
+func (input *EarningAdjustment) Validate() error {
+	if input.Amount == 0 {
+		return errors.New("Invalid amount")
+	}
+
+	if input.Currency != "" && !reCurrency.MatchString(input.Currency) {
+		return errors.New("Invalid currency")
+	}
+
+	if strings.TrimSpace(input.Reason) == "" {
+		return errors.New("Reason is required")
+	}
+
+	if utf8.RuneCountInString(input.Reason) > MaxCommentLength {
+		return errors.New("Reason is too long")
+	}
+
+	return nil
+}
+
+// Earnings Input query for the earnings of a driver from a day to a day included, in format 2006-01-02.
+// From is the Monday of the week of To and To is today if missing
+type Earnings struct {
+	From string `form:"from"`
+	To   string `form:"to"`
+}
+
+// Range Start of From until the end of To in the location of now, at most MaxEarningsDays
+func (input *Earnings) Range(now time.Time) (time.Time, time.Time, error) {
+	location := now.Location()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	if input.To != "" {
+		var err error
+		if to, err = time.ParseInLocation(mpg.DateFormat, input.To, location); err != nil {
+			return time.Time{}, time.Time{}, errors.New("Invalid to")
+		}
+	}
+
+	from := to.AddDate(0, 0, -((int(to.Weekday()) + 6) % 7))
+	if input.From != "" {
+		var err error
+		if from, err = time.ParseInLocation(mpg.DateFormat, input.From, location); err != nil {
+			return time.Time{}, time.Time{}, errors.New("Invalid from")
+		}
+	}
+
+	to = to.AddDate(0, 0, 1)
+	if !from.Before(to) || from.AddDate(0, 0, MaxEarningsDays).Before(to) {
+		return time.Time{}, time.Time{}, errors.New("Invalid range")
+	}
+
+	return from, to, nil
+}
+
+// LowRatings Input query for the latest ratings up to MaxRating of the last days, by a side or both if RatedBy is empty
+type LowRatings struct {
+	MaxRating int    `form:"max_rating"`
+	RatedBy   string `form:"rated_by"`
+	Days      int    `form:"days"`
+	Limit     int    `form:"limit"`
+}
+
+// NewLowRatings Input low ratings with the defaults of missing parameters
+func NewLowRatings() LowRatings {
+	return LowRatings{MaxRating: 2, Days: 7, Limit: 100}
+}
+
+// Validate Validate input low ratings
+func (input *LowRatings) Validate() error {
+	if input.MaxRating < mpg.MinRating || input.MaxRating > mpg.MaxRating {
+		return errors.New("Invalid max rating")
+	}
+
+	if input.RatedBy != "" && input.RatedBy != mpg.RatedByPassenger && input.RatedBy != mpg.RatedByDriver {
+		return errors.New("Invalid rated by")
+	}
+
+	if input.Days < 1 || input.Days > 90 {
+		return errors.New("Invalid days")
+	}
+
+	if input.Limit < 1 || input.Limit > 1000 {
+		return errors.New("Invalid limit")
+	}
+
+	return nil
+}
+
+// Heatmap Input query for the heatmap of a bounding box at a map zoom level
+type Heatmap struct {
+	MinLat float64 `form:"min_lat"`
+	MinLng float64 `form:"min_lng"`
+	MaxLat float64 `form:"max_lat"`
+	MaxLng float64 `form:"max_lng"`
+	Zoom   int     `form:"zoom"`
+	// Requests Count recent ride requests too
+	Requests bool `form:"requests"`
+}
+
+// Box Bounding box of the input
+func (input *Heatmap) Box() geo.Box {
+	return geo.Box{MinLat: input.MinLat, MinLng: input.MinLng, MaxLat: input.MaxLat, MaxLng: input.MaxLng}
+}
+
+// Validate Validate input heatmap, the box must not cross the antimeridian nor have too many cells at the zoom level
+func (input *Heatmap) Validate() error {
+	if input.MinLat < -90 || input.MaxLat > 90 || input.MinLat >= input.MaxLat {
+		return errors.New("Invalid latitude")
+	}
+
+	if input.MinLng < -180 || input.MaxLng > 180 || input.MinLng >= input.MaxLng {
+		return errors.New("Invalid longitude")
+	}
+
+	if input.Zoom < 0 || input.Zoom > heatmap.MaxZoom {
+		return errors.New("Invalid zoom")
+	}
+
+	if heatmap.CellCount(input.Box(), heatmap.Precision(input.Zoom)) > heatmap.MaxCells {
+		return errors.New("Bounding box is too large for the zoom")
+	}
+
 	return nil
 }
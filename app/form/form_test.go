@@ -1,6 +1,14 @@
 package form
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trietphm/gruber/app/geofence"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mpg"
+)
 
 func TestRequestRideValidate(t *testing.T) {
 	tt := []struct {
@@ -57,9 +65,76 @@ func TestRequestRideValidate(t *testing.T) {
 			},
 			"Not found passenger",
 		},
+		{
+			RequestRide{
+				PassengerID:  1,
+				Location:     Location{Lat: 10.23423, Lng: 101},
+				VehicleClass: "xl",
+			},
+			"",
+		},
+		{
+			RequestRide{
+				PassengerID:  1,
+				Location:     Location{Lat: 10.23423, Lng: 101},
+				VehicleClass: "boat",
+			},
+			"Invalid vehicle class",
+		},
+		{
+			RequestRide{
+				PassengerID: 1,
+				Location:    Location{Lat: 10.23423, Lng: 101},
+				Stops:       []Stop{{Location: Location{Lat: 10.3, Lng: 101}, Address: "School"}},
+				Dropoff:     &Stop{Location: Location{Lat: 10.4, Lng: 101}, Address: "Airport", PlaceID: "place-1"},
+			},
+			"",
+		},
+		{
+			RequestRide{
+				PassengerID: 1,
+				Location:    Location{Lat: 10.23423, Lng: 101},
+				Dropoff:     &Stop{Location: Location{Lat: 10.4, Lng: 101}},
+			},
+			"",
+		},
+		{
+			RequestRide{
+				PassengerID: 1,
+				Location:    Location{Lat: 10.23423, Lng: 101},
+				Stops:       []Stop{{Location: Location{Lat: 10.3, Lng: 101}}},
+			},
+			"Stops require a dropoff",
+		},
+		{
+			RequestRide{
+				PassengerID: 1,
+				Location:    Location{Lat: 10.23423, Lng: 101},
+				Stops:       make([]Stop, MaxStops+1),
+				Dropoff:     &Stop{Location: Location{Lat: 10.4, Lng: 101}},
+			},
+			"Too many stops",
+		},
+		{
+			RequestRide{
+				PassengerID: 1,
+				Location:    Location{Lat: 10.23423, Lng: 101},
+				Stops:       []Stop{{Location: Location{Lat: 91, Lng: 101}}},
+				Dropoff:     &Stop{Location: Location{Lat: 10.4, Lng: 101}},
+			},
+			"Invalid latitude",
+		},
+		{
+			RequestRide{
+				PassengerID: 1,
+				Location:    Location{Lat: 10.23423, Lng: 101},
+				Dropoff:     &Stop{Location: Location{Lat: 10.4, Lng: -181}},
+			},
+			"Invalid longitude",
+		},
 	}
 	for _, tc := range tt {
-		err := tc.input.Validate()
+		err := tc.input.Validate(nil)
 		if tc.expectedErrMessage == "" {
 			if err != nil {
 				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
@@ -73,6 +148,39 @@ func TestRequestRideValidate(t *testing.T) {
 	}
 }
 
+func TestRequestRideValidateFences(t *testing.T) {
+	square := func(lat, lng, size float64) []geo.Polygon {
+		return []geo.Polygon{{{{Lat: lat, Lng: lng}, {Lat: lat, Lng: lng + size}, {Lat: lat + size, Lng: lng + size}, {Lat: lat + size, Lng: lng}}}}
+	}
+	fences := geofence.New([]geofence.Zone{
+		{Name: "city", Kind: mpg.ZoneServiceArea, Polygons: square(10, 106, 1)},
+		{Name: "military", Kind: mpg.ZoneRestricted, Polygons: square(10.1, 106.1, 0.1)},
+	})
+
+	tt := []struct {
+		location           Location
+		expectedErrMessage string
+	}{
+		{Location{Lat: 10.823099, Lng: 106.629664}, ""},
+		{Location{Lat: 10.15, Lng: 106.15}, "Pickup is in a restricted zone"},
+		{Location{Lat: 21.028511, Lng: 105.804817}, "Pickup is outside service areas"},
+		{Location{Lat: 100, Lng: 106.629664}, "Invalid latitude"},
+	}
+	for _, tc := range tt {
+		input := RequestRide{PassengerID: 1, Location: tc.location}
+		err := input.Validate(fences)
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.location, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.location, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
 func TestDriverStateValidate(t *testing.T) {
 	tt := []struct {
 		input              DriverState
@@ -183,3 +291,402 @@ func TestPassengerValidate(t *testing.T) {
 		}
 	}
 }
+
+func TestPassengerContactValidate(t *testing.T) {
+	tt := []struct {
+		input              Passenger
+		expectedErrMessage string
+	}{
+		{
+			Passenger{Name: "passenger", Phone: "+84901234567", Email: "passenger@example.com", DefaultPaymentMethod: "card"},
+			"",
+		},
+		{
+			Passenger{Name: "passenger", Phone: "0901"},
+			"Invalid phone",
+		},
+		{
+			Passenger{Name: "passenger", Email: "passenger"},
+			"Invalid email",
+		},
+		{
+			Passenger{Name: "passenger", Email: "Passenger <passenger@example.com>"},
+			"Invalid email",
+		},
+		{
+			Passenger{Name: "passenger", DefaultPaymentMethod: "bitcoin"},
+			"Invalid payment method",
+		},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+
+		}
+	}
+}
+
+func TestUpdatePassengerValidate(t *testing.T) {
+	empty := ""
+	name := "passenger"
+	phone := "abc"
+	tt := []struct {
+		input              UpdatePassenger
+		expectedErrMessage string
+	}{
+		{UpdatePassenger{}, ""},
+		{UpdatePassenger{Name: &name}, ""},
+		{UpdatePassenger{Name: &empty}, "Name can not be empty"},
+		{UpdatePassenger{Phone: &empty}, ""},
+		{UpdatePassenger{Phone: &phone}, "Invalid phone"},
+		{UpdatePassenger{DefaultPaymentMethod: &empty}, "Invalid payment method"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+
+		}
+	}
+}
+
+func TestVehicleValidate(t *testing.T) {
+	tt := []struct {
+		input              Vehicle
+		expectedErrMessage string
+	}{
+		{Vehicle{Plate: "", Seats: 4, Class: "economy"}, "Plate can not be empty"},
+		{Vehicle{Plate: "51A-12345", Seats: 0, Class: "economy"}, "Invalid seats"},
+		{Vehicle{Plate: "51A-12345", Seats: 17, Class: "economy"}, "Invalid seats"},
+		{Vehicle{Plate: "51A-12345", Seats: 4, Class: ""}, "Invalid vehicle class"},
+		{Vehicle{Plate: "51A-12345", Seats: 4, Class: "boat"}, "Invalid vehicle class"},
+		{Vehicle{Plate: "51A-12345", Seats: 4, Class: "economy"}, ""},
+		{Vehicle{Plate: "51A-12345", Seats: 7, Class: "xl"}, ""},
+		{Vehicle{Plate: "51A-12345", Seats: 4, Class: "premium"}, ""},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestDriverDocumentValidate(t *testing.T) {
+	expiresAt := Date(time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC))
+	tt := []struct {
+		input              DriverDocument
+		expectedErrMessage string
+	}{
+		{DriverDocument{Number: "", ExpiresAt: expiresAt}, "Number can not be empty"},
+		{DriverDocument{Number: "L1"}, "Expiry date can not be empty"},
+		{DriverDocument{Number: "L1", ExpiresAt: expiresAt}, ""},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestScheduleRideValidate(t *testing.T) {
+	location := Location{Lat: 10.823099, Lng: 106.629664}
+	tt := []struct {
+		input              ScheduleRide
+		expectedErrMessage string
+	}{
+		{ScheduleRide{RequestRide{PassengerID: 1, Location: location}, time.Now().Add(time.Hour)}, ""},
+		{ScheduleRide{RequestRide{PassengerID: 1, Location: location}, time.Now().Add(-time.Minute)}, "Pickup time must be in the future"},
+		{ScheduleRide{RequestRide{PassengerID: 1, Location: location}, time.Time{}}, "Pickup time must be in the future"},
+		{ScheduleRide{RequestRide{PassengerID: 0, Location: location}, time.Now().Add(time.Hour)}, "Not found passenger"},
+		{ScheduleRide{RequestRide{PassengerID: 1, Location: location, VehicleClass: "boat"}, time.Now().Add(time.Hour)}, "Invalid vehicle class"},
+		{ScheduleRide{RequestRide{PassengerID: 1, Location: location, Dropoff: &Stop{Location: location}}, time.Now().Add(time.Hour)}, "Scheduled rides do not support stops"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate(nil)
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestRateRideValidate(t *testing.T) {
+	tt := []struct {
+		input              RateRide
+		expectedErrMessage string
+	}{
+		{RateRide{RatedBy: "passenger", Rating: 5}, ""},
+		{RateRide{RatedBy: "driver", Rating: 1, Tags: []string{"late", "rude"}, Comment: "Kept me waiting"}, ""},
+		{RateRide{RatedBy: "", Rating: 5}, "Invalid rated by"},
+		{RateRide{RatedBy: "support", Rating: 5}, "Invalid rated by"},
+		{RateRide{RatedBy: "passenger", Rating: 0}, "Invalid rating"},
+		{RateRide{RatedBy: "passenger", Rating: 6}, "Invalid rating"},
+		{RateRide{RatedBy: "passenger", Rating: 4, Tags: []string{"a", "b", "c", "d", "e", "f"}}, "Too many tags"},
+		{RateRide{RatedBy: "passenger", Rating: 4, Tags: []string{""}}, "Invalid tag"},
+		{RateRide{RatedBy: "passenger", Rating: 4, Tags: []string{strings.Repeat("a", MaxTagLength+1)}}, "Invalid tag"},
+		{RateRide{RatedBy: "passenger", Rating: 4, Tags: []string{strings.Repeat("é", MaxTagLength)}}, ""},
+		{RateRide{RatedBy: "passenger", Rating: 4, Comment: strings.Repeat("a", MaxCommentLength+1)}, "Comment is too long"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestRefundRideValidate(t *testing.T) {
+	tt := []struct {
+		input              RefundRide
+		expectedErrMessage string
+	}{
+		{RefundRide{Amount: 20000}, ""},
+		{RefundRide{Amount: 1, Reason: "Wrong route"}, ""},
+		{RefundRide{Amount: 0}, "Invalid amount"},
+		{RefundRide{Amount: -1}, "Invalid amount"},
+		{RefundRide{Amount: 1, Reason: strings.Repeat("a", MaxCommentLength+1)}, "Reason is too long"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestTipRideValidate(t *testing.T) {
+	tt := []struct {
+		input              TipRide
+		expectedErrMessage string
+	}{
+		{TipRide{Amount: 5000}, ""},
+		{TipRide{Amount: 0}, "Invalid amount"},
+		{TipRide{Amount: -1}, "Invalid amount"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestEarningAdjustmentValidate(t *testing.T) {
+	tt := []struct {
+		input              EarningAdjustment
+		expectedErrMessage string
+	}{
+		{EarningAdjustment{Amount: 20000, Reason: "Weekend bonus"}, ""},
+		{EarningAdjustment{RideID: 1, Amount: -3000, Currency: "USD", Reason: "Toll refunded"}, ""},
+		{EarningAdjustment{Amount: 0, Reason: "Nothing"}, "Invalid amount"},
+		{EarningAdjustment{Amount: 1, Currency: "usd", Reason: "Bonus"}, "Invalid currency"},
+		{EarningAdjustment{Amount: 1, Currency: "DONG", Reason: "Bonus"}, "Invalid currency"},
+		{EarningAdjustment{Amount: 1}, "Reason is required"},
+		{EarningAdjustment{Amount: 1, Reason: "  "}, "Reason is required"},
+		{EarningAdjustment{Amount: 1, Reason: strings.Repeat("a", MaxCommentLength+1)}, "Reason is too long"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestEarningsRange(t *testing.T) {
+	ict := time.FixedZone("ICT", 7*60*60)
+	// Wednesday
+	now := time.Date(2026, 1, 7, 15, 0, 0, 0, ict)
+	tt := []struct {
+		input              Earnings
+		from               time.Time
+		to                 time.Time
+		expectedErrMessage string
+	}{
+		{Earnings{}, time.Date(2026, 1, 5, 0, 0, 0, 0, ict), time.Date(2026, 1, 8, 0, 0, 0, 0, ict), ""},
+		{Earnings{From: "2026-01-01", To: "2026-01-01"}, time.Date(2026, 1, 1, 0, 0, 0, 0, ict), time.Date(2026, 1, 2, 0, 0, 0, 0, ict), ""},
+		{Earnings{To: "2026-01-04"}, time.Date(2025, 12, 29, 0, 0, 0, 0, ict), time.Date(2026, 1, 5, 0, 0, 0, 0, ict), ""},
+		{Earnings{From: "2025-10-07", To: "2026-01-06"}, time.Date(2025, 10, 7, 0, 0, 0, 0, ict), time.Date(2026, 1, 7, 0, 0, 0, 0, ict), ""},
+		{Earnings{From: "2025-10-06", To: "2026-01-06"}, time.Time{}, time.Time{}, "Invalid range"},
+		{Earnings{From: "2026-01-08"}, time.Time{}, time.Time{}, "Invalid range"},
+		{Earnings{From: "2026/01/01"}, time.Time{}, time.Time{}, "Invalid from"},
+		{Earnings{To: "yesterday"}, time.Time{}, time.Time{}, "Invalid to"},
+	}
+	for _, tc := range tt {
+		from, to, err := tc.input.Range(now)
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+			if !from.Equal(tc.from) || !to.Equal(tc.to) {
+				t.Errorf("FAIL with input: %v expected %s to %s but output %s to %s", tc.input, tc.from, tc.to, from, to)
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestLowRatingsValidate(t *testing.T) {
+	tt := []struct {
+		input              LowRatings
+		expectedErrMessage string
+	}{
+		{NewLowRatings(), ""},
+		{LowRatings{MaxRating: 3, RatedBy: "driver", Days: 90, Limit: 1000}, ""},
+		{LowRatings{MaxRating: 0, Days: 7, Limit: 100}, "Invalid max rating"},
+		{LowRatings{MaxRating: 6, Days: 7, Limit: 100}, "Invalid max rating"},
+		{LowRatings{MaxRating: 2, RatedBy: "support", Days: 7, Limit: 100}, "Invalid rated by"},
+		{LowRatings{MaxRating: 2, Days: 0, Limit: 100}, "Invalid days"},
+		{LowRatings{MaxRating: 2, Days: 91, Limit: 100}, "Invalid days"},
+		{LowRatings{MaxRating: 2, Days: 7, Limit: 0}, "Invalid limit"},
+		{LowRatings{MaxRating: 2, Days: 7, Limit: 1001}, "Invalid limit"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestCancelRideValidate(t *testing.T) {
+	tt := []struct {
+		input              CancelRide
+		expectedErrMessage string
+	}{
+		{CancelRide{CancelledBy: "passenger", Reason: "Changed plans"}, ""},
+		{CancelRide{CancelledBy: "driver", DriverID: 3, Reason: "Flat tire"}, ""},
+		{CancelRide{CancelledBy: "driver", Reason: "Flat tire"}, "Not found driver"},
+		{CancelRide{CancelledBy: "", Reason: "Changed plans"}, "Invalid cancelled by"},
+		{CancelRide{CancelledBy: "admin", Reason: "Changed plans"}, "Invalid cancelled by"},
+		{CancelRide{CancelledBy: "passenger", Reason: ""}, "Reason can not be empty"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestDeclineRideValidate(t *testing.T) {
+	tt := []struct {
+		input              DeclineRide
+		expectedErrMessage string
+	}{
+		{DeclineRide{DriverID: 3}, ""},
+		{DeclineRide{}, "Not found driver"},
+		{DeclineRide{DriverID: -1}, "Not found driver"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
+
+func TestHeatmapValidate(t *testing.T) {
+	tt := []struct {
+		input              Heatmap
+		expectedErrMessage string
+	}{
+		{Heatmap{MinLat: 10.7, MinLng: 106.6, MaxLat: 10.9, MaxLng: 106.8, Zoom: 13}, ""},
+		{Heatmap{MinLat: 10.7, MinLng: 106.6, MaxLat: 10.9, MaxLng: 106.8, Zoom: 13, Requests: true}, ""},
+		{Heatmap{MinLat: 10.9, MinLng: 106.6, MaxLat: 10.7, MaxLng: 106.8, Zoom: 13}, "Invalid latitude"},
+		{Heatmap{MinLat: -91, MinLng: 106.6, MaxLat: 10.7, MaxLng: 106.8, Zoom: 13}, "Invalid latitude"},
+		{Heatmap{MinLat: 10.7, MinLng: 106.6, MaxLat: 10.9, MaxLng: 106.6, Zoom: 13}, "Invalid longitude"},
+		{Heatmap{MinLat: 10.7, MinLng: 106.6, MaxLat: 10.9, MaxLng: 106.8, Zoom: -1}, "Invalid zoom"},
+		{Heatmap{MinLat: 10.7, MinLng: 106.6, MaxLat: 10.9, MaxLng: 106.8, Zoom: 21}, "Invalid zoom"},
+		{Heatmap{MinLat: 0, MinLng: 100, MaxLat: 20, MaxLng: 120, Zoom: 15}, "Bounding box is too large for the zoom"},
+	}
+	for _, tc := range tt {
+		err := tc.input.Validate()
+		if tc.expectedErrMessage == "" {
+			if err != nil {
+				t.Errorf("FAIL with input: %v expected empty but output %s", tc.input, err.Error())
+			}
+		} else {
+			if err == nil || err.Error() != tc.expectedErrMessage {
+				t.Errorf("FAIL with input: %v expected %s but output %v", tc.input, tc.expectedErrMessage, err)
+			}
+		}
+	}
+}
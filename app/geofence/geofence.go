@@ -0,0 +1,280 @@
+// Package geofence checks locations against zones: service areas where rides are served, airports with
+// their own rules and restricted areas. Zones are loaded from GeoJSON files or the zones table at startup
+package geofence
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// Zone Geofenced zone with the rules of an airport
+type Zone struct {
+	// ID Row id of zones from the database, 0 for zones from files
+	ID       int
+	Name     string
+	Kind     string
+	Polygons []geo.Polygon
+	// Queue Drivers in the zone are dispatched in arrival order
+	Queue bool
+	// PickupFee Fee added to rides picked up in the zone, in the smallest currency unit
+	PickupFee int64
+	// FareMultiplier Multiplier of the fare of rides picked up in the zone
+	FareMultiplier float64
+}
+
+// Contains Check a coordinate is in the zone
+func (z *Zone) Contains(lat, lng float64) bool {
+	for _, polygon := range z.Polygons {
+		if polygon.Contains(lat, lng) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Fences Set of zones, a nil *Fences has no zone and serves every location
+type Fences struct {
+	zones []Zone
+	// serviceAreas Whether there is a service area, otherwise every location outside restricted zones is served
+	serviceAreas bool
+}
+
+// New Create fences of zones
+func New(zones []Zone) *Fences {
+	f := &Fences{zones: zones}
+	for _, zone := range zones {
+		if zone.Kind == mpg.ZoneServiceArea {
+			f.serviceAreas = true
+		}
+	}
+
+	return f
+}
+
+// Load Load zones of the GeoJSON files and of the database as configured, nil if there is no zone
+func Load(dbPg database.PgI, conf config.Geofence) (*Fences, error) {
+	zones := []Zone{}
+	for _, path := range strings.Split(conf.Files, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fileZones, err := ParseGeoJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		zones = append(zones, fileZones...)
+	}
+
+	if conf.Database {
+		rows, err := dbPg.GetZones()
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			zone, err := FromModel(row)
+			if err != nil {
+				return nil, err
+			}
+			zones = append(zones, zone)
+		}
+	}
+
+	if len(zones) == 0 {
+		return nil, nil
+	}
+	return New(zones), nil
+}
+
+// Zones Get every zone
+func (f *Fences) Zones() []Zone {
+	if f == nil {
+		return []Zone{}
+	}
+
+	return f.zones
+}
+
+// ZonesAt Get the zones containing a coordinate
+func (f *Fences) ZonesAt(lat, lng float64) []Zone {
+	zones := []Zone{}
+	for _, zone := range f.Zones() {
+		if zone.Contains(lat, lng) {
+			zones = append(zones, zone)
+		}
+	}
+
+	return zones
+}
+
+// Airport Get the airport zone containing a coordinate, nil if there is none
+func (f *Fences) Airport(lat, lng float64) *Zone {
+	for _, zone := range f.ZonesAt(lat, lng) {
+		if zone.Kind == mpg.ZoneAirport {
+			return &zone
+		}
+	}
+
+	return nil
+}
+
+// CheckPickup Check rides are served at a pickup location: it is not in a restricted zone, and it is
+// in a service area or an airport unless there is no service area
+func (f *Fences) CheckPickup(lat, lng float64) error {
+	served := f == nil || !f.serviceAreas
+	for _, zone := range f.ZonesAt(lat, lng) {
+		switch zone.Kind {
+		case mpg.ZoneRestricted:
+			return errors.New("Pickup is in a restricted zone")
+		case mpg.ZoneServiceArea, mpg.ZoneAirport:
+			served = true
+		}
+	}
+	if !served {
+		return errors.New("Pickup is outside service areas")
+	}
+
+	return nil
+}
+
+// featureCollection GeoJSON feature collection of zones
+type featureCollection struct {
+	Type     string `json:"type"`
+	Features []struct {
+		Geometry   json.RawMessage `json:"geometry"`
+		Properties struct {
+			Name           string  `json:"name"`
+			Kind           string  `json:"kind"`
+			Queue          bool    `json:"queue"`
+			PickupFee      int64   `json:"pickup_fee"`
+			FareMultiplier float64 `json:"fare_multiplier"`
+		} `json:"properties"`
+	} `json:"features"`
+}
+
+// ParseGeoJSON Parse zones of a GeoJSON FeatureCollection, the zone of a feature is in its properties name, kind,
+// and for airports queue, pickup_fee and fare_multiplier (default 1). Geometries are Polygon or MultiPolygon
+func ParseGeoJSON(data []byte) ([]Zone, error) {
+	var collection featureCollection
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, err
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("Invalid GeoJSON type %q, expected FeatureCollection", collection.Type)
+	}
+
+	zones := make([]Zone, len(collection.Features))
+	for i, feature := range collection.Features {
+		zone, err := newZone(feature.Properties.Name, feature.Properties.Kind, string(feature.Geometry))
+		if err != nil {
+			return nil, err
+		}
+		zone.Queue = feature.Properties.Queue
+		zone.PickupFee = feature.Properties.PickupFee
+		if feature.Properties.FareMultiplier != 0 {
+			zone.FareMultiplier = feature.Properties.FareMultiplier
+		}
+		zones[i] = zone
+	}
+
+	return zones, nil
+}
+
+// FromModel Convert a zone of the database
+func FromModel(row mpg.Zone) (Zone, error) {
+	zone, err := newZone(row.Name, row.Kind, row.Geometry)
+	if err != nil {
+		return zone, err
+	}
+	zone.ID = row.ID
+	zone.Queue = row.Queue
+	zone.PickupFee = row.PickupFee
+	if row.FareMultiplier != 0 {
+		zone.FareMultiplier = row.FareMultiplier
+	}
+
+	return zone, nil
+}
+
+// newZone Create a zone with default rules, its geometry is a GeoJSON Polygon or MultiPolygon
+func newZone(name, kind, geometry string) (Zone, error) {
+	zone := Zone{Name: name, Kind: kind, FareMultiplier: 1}
+	if name == "" {
+		return zone, errors.New("Zone name can not be empty")
+	}
+
+	switch kind {
+	case mpg.ZoneServiceArea, mpg.ZoneAirport, mpg.ZoneRestricted:
+	default:
+		return zone, fmt.Errorf("Zone %s: invalid kind %q", name, kind)
+	}
+
+	polygons, err := parseGeometry(geometry)
+	if err != nil {
+		return zone, fmt.Errorf("Zone %s: %v", name, err)
+	}
+	zone.Polygons = polygons
+	return zone, nil
+}
+
+// parseGeometry Parse polygons of a GeoJSON Polygon or MultiPolygon geometry, positions are [lng, lat]
+func parseGeometry(geometry string) ([]geo.Polygon, error) {
+	var parsed struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}
+	if err := json.Unmarshal([]byte(geometry), &parsed); err != nil {
+		return nil, err
+	}
+
+	var coordinates [][][][]float64
+	switch parsed.Type {
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(parsed.Coordinates, &polygon); err != nil {
+			return nil, err
+		}
+		coordinates = [][][][]float64{polygon}
+	case "MultiPolygon":
+		if err := json.Unmarshal(parsed.Coordinates, &coordinates); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Invalid geometry type %q, expected Polygon or MultiPolygon", parsed.Type)
+	}
+
+	polygons := make([]geo.Polygon, len(coordinates))
+	for i, rings := range coordinates {
+		if len(rings) == 0 {
+			return nil, errors.New("Polygon without ring")
+		}
+		polygons[i] = make(geo.Polygon, len(rings))
+		for j, ring := range rings {
+			if len(ring) < 3 {
+				return nil, errors.New("Ring with less than 3 positions")
+			}
+			polygons[i][j] = make([]geo.Point, len(ring))
+			for k, position := range ring {
+				if len(position) < 2 {
+					return nil, errors.New("Invalid position")
+				}
+				polygons[i][j][k] = geo.Point{Lat: position[1], Lng: position[0]}
+			}
+		}
+	}
+
+	return polygons, nil
+}
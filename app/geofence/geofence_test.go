@@ -0,0 +1,148 @@
+package geofence
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// city Service area from lat 10 to 11 and lng 106 to 107 with a restricted square and an airport in it
+const city = `{
+	"type": "FeatureCollection",
+	"features": [
+		{
+			"type": "Feature",
+			"geometry": {"type": "Polygon", "coordinates": [[[106, 10], [107, 10], [107, 11], [106, 11], [106, 10]]]},
+			"properties": {"name": "city", "kind": "service_area"}
+		},
+		{
+			"type": "Feature",
+			"geometry": {"type": "MultiPolygon", "coordinates": [[[[106.1, 10.1], [106.2, 10.1], [106.2, 10.2], [106.1, 10.2]]]]},
+			"properties": {"name": "military", "kind": "restricted"}
+		},
+		{
+			"type": "Feature",
+			"geometry": {"type": "Polygon", "coordinates": [[[106.6, 10.8], [106.7, 10.8], [106.7, 10.9], [106.6, 10.9]]]},
+			"properties": {"name": "airport", "kind": "airport", "queue": true, "pickup_fee": 10000, "fare_multiplier": 1.2}
+		}
+	]
+}`
+
+func TestParseGeoJSON(t *testing.T) {
+	zones, err := ParseGeoJSON([]byte(city))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, zones, 3) {
+		assert.Equal(t, "city", zones[0].Name)
+		assert.Equal(t, mpg.ZoneServiceArea, zones[0].Kind)
+		assert.Equal(t, float64(1), zones[0].FareMultiplier)
+		assert.Len(t, zones[1].Polygons, 1)
+		assert.Equal(t, Zone{
+			Name:           "airport",
+			Kind:           mpg.ZoneAirport,
+			Polygons:       zones[2].Polygons,
+			Queue:          true,
+			PickupFee:      10000,
+			FareMultiplier: 1.2,
+		}, zones[2])
+		assert.True(t, zones[2].Contains(10.85, 106.65))
+		assert.False(t, zones[2].Contains(10.85, 106.75))
+	}
+
+	tt := []struct {
+		data               string
+		expectedErrMessage string
+	}{
+		{`{"type":"Feature"}`, `Invalid GeoJSON type "Feature", expected FeatureCollection`},
+		{`{"type":"FeatureCollection","features":[{"properties":{"kind":"airport"}}]}`, "Zone name can not be empty"},
+		{`{"type":"FeatureCollection","features":[{"properties":{"name":"a","kind":"city"}}]}`, `Zone a: invalid kind "city"`},
+		{`{"type":"FeatureCollection","features":[{"geometry":{"type":"Point","coordinates":[1,2]},"properties":{"name":"a","kind":"airport"}}]}`, `Zone a: Invalid geometry type "Point", expected Polygon or MultiPolygon`},
+		{`{"type":"FeatureCollection","features":[{"geometry":{"type":"Polygon","coordinates":[[[1,2],[2,3]]]},"properties":{"name":"a","kind":"airport"}}]}`, "Zone a: Ring with less than 3 positions"},
+	}
+	for _, tc := range tt {
+		_, err := ParseGeoJSON([]byte(tc.data))
+		if assert.Error(t, err) {
+			assert.Equal(t, tc.expectedErrMessage, err.Error())
+		}
+	}
+}
+
+func TestCheckPickup(t *testing.T) {
+	zones, err := ParseGeoJSON([]byte(city))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fences := New(zones)
+
+	tt := []struct {
+		fences             *Fences
+		lat, lng           float64
+		expectedErrMessage string
+	}{
+		{fences, 10.5, 106.5, ""},
+		{fences, 10.15, 106.15, "Pickup is in a restricted zone"},
+		{fences, 12, 106.5, "Pickup is outside service areas"},
+		{fences, 10.85, 106.65, ""},
+		// Without service area only restricted zones are checked
+		{New(zones[1:]), 12, 106.5, ""},
+		{New(zones[1:]), 10.15, 106.15, "Pickup is in a restricted zone"},
+		{nil, 10.15, 106.15, ""},
+	}
+	for _, tc := range tt {
+		err := tc.fences.CheckPickup(tc.lat, tc.lng)
+		if tc.expectedErrMessage == "" {
+			assert.NoError(t, err, "%v,%v", tc.lat, tc.lng)
+		} else if assert.Error(t, err, "%v,%v", tc.lat, tc.lng) {
+			assert.Equal(t, tc.expectedErrMessage, err.Error())
+		}
+	}
+
+	if airport := fences.Airport(10.85, 106.65); assert.NotNil(t, airport) {
+		assert.Equal(t, "airport", airport.Name)
+	}
+	assert.Nil(t, fences.Airport(10.5, 106.5))
+	assert.Len(t, fences.ZonesAt(10.85, 106.65), 2)
+	var none *Fences
+	assert.Equal(t, []Zone{}, none.Zones())
+}
+
+func TestLoad(t *testing.T) {
+	file, err := ioutil.TempFile("", "zones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(city); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	dbPg := memory.NewPg()
+	row := mpg.Zone{
+		Name:     "suburb",
+		Kind:     mpg.ZoneServiceArea,
+		Geometry: `{"type":"Polygon","coordinates":[[[107,10],[108,10],[108,11],[107,11]]]}`,
+	}
+	if err := dbPg.CreateZone(&row); err != nil {
+		t.Fatal(err)
+	}
+
+	fences, err := Load(dbPg, config.Geofence{})
+	assert.NoError(t, err)
+	assert.Nil(t, fences)
+
+	fences, err = Load(dbPg, config.Geofence{Files: file.Name(), Database: true})
+	if assert.NoError(t, err) && assert.Len(t, fences.Zones(), 4) {
+		assert.Equal(t, row.ID, fences.Zones()[3].ID)
+		assert.NoError(t, fences.CheckPickup(10.5, 107.5))
+	}
+
+	_, err = Load(dbPg, config.Geofence{Files: "missing.geojson"})
+	assert.Error(t, err)
+}
@@ -1,13 +1,29 @@
 package handler
 
 import (
+	"bytes"
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/trietphm/gruber/app/batch"
+	"github.com/trietphm/gruber/app/cancellation"
+	"github.com/trietphm/gruber/app/earnings"
+	"github.com/trietphm/gruber/app/eta"
 	"github.com/trietphm/gruber/app/form"
+	"github.com/trietphm/gruber/app/geofence"
+	"github.com/trietphm/gruber/app/heatmap"
+	"github.com/trietphm/gruber/app/ledger"
+	"github.com/trietphm/gruber/app/matching"
+	"github.com/trietphm/gruber/app/middleware"
+	"github.com/trietphm/gruber/app/payment"
+	"github.com/trietphm/gruber/app/pricing"
+	"github.com/trietphm/gruber/app/trip"
 	"github.com/trietphm/gruber/app/view"
+	"github.com/trietphm/gruber/config"
 	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/database/writebehind"
 	"github.com/trietphm/gruber/model/mcass"
 	"github.com/trietphm/gruber/model/mpg"
 	"github.com/trietphm/gruber/util"
@@ -18,29 +34,159 @@ type Handler struct {
 	dbPg    database.PgI
 	dbCass  database.CassandraI
 	dbRedis database.RedisI
+	matcher *matching.Matcher
+	// assigner Assign drivers to rides, the matcher or a batcher of it
+	assigner matching.Assigner
+	policy   cancellation.Policy
+	eta      *eta.Estimator
+	// fences Zones checked at pickup, nil when no zone is configured
+	fences  *geofence.Fences
+	heatmap *heatmap.Heatmap
+	pricing pricing.Pricing
+	// ledger Record and collect fares, nil when no payment provider is configured
+	ledger   *ledger.Ledger
+	earnings *earnings.Service
+	// location Timezone of the days of earnings statements
+	location *time.Location
+}
+
+// Options Configuration and services of the engine besides its datastores
+type Options struct {
+	Config config.Config
+	// Fences Zones checked at pickup, nil when no zone is configured
+	Fences *geofence.Fences
+	// Provider Payment provider collecting fares, nil disables charging
+	Provider payment.Provider
+	// Matcher and Assigner Match drivers and assign rides to them, see NewMatcher
+	Matcher  *matching.Matcher
+	Assigner matching.Assigner
 }
 
 // NewEngine Setup API router
-func NewEngine(dbPg database.PgI, dbCass database.CassandraI, dbRedis database.RedisI) (*gin.Engine, error) {
+func NewEngine(dbPg database.PgI, dbCass database.CassandraI, dbRedis database.RedisI, options Options) (*gin.Engine, error) {
+	conf := &options.Config
+	estimator, err := newEstimator(dbCass, conf.ETA)
+	if err != nil {
+		return nil, err
+	}
+
+	location := time.UTC
+	if conf.Earnings.Timezone != "" {
+		if location, err = time.LoadLocation(conf.Earnings.Timezone); err != nil {
+			return nil, err
+		}
+	}
+
 	engine := gin.Default()
 	handler := Handler{
-		dbPg:    dbPg,
-		dbCass:  dbCass,
-		dbRedis: dbRedis,
+		dbPg:     dbPg,
+		dbCass:   dbCass,
+		dbRedis:  dbRedis,
+		matcher:  options.Matcher,
+		assigner: options.Assigner,
+		policy: cancellation.Policy{
+			FreeWindow: conf.Cancellation.FreeWindow,
+			Fee:        conf.Cancellation.Fee,
+			NoShowWait: conf.Cancellation.NoShowWait,
+			NoShowFee:  conf.Cancellation.NoShowFee,
+		},
+		eta:      estimator,
+		fences:   options.Fences,
+		heatmap:  heatmap.New(dbPg, dbRedis),
+		pricing:  pricing.New(conf.Pricing),
+		earnings: earnings.New(dbPg),
+		location: location,
+	}
+	if options.Provider != nil {
+		handler.ledger = ledger.New(dbPg, options.Provider)
 	}
+
 	router := engine.Group("")
-	router.POST("/passengers", handler.CreatePassenger)
-	router.POST("/requests", handler.RequestDrivers)
+	defaultGroup := router.Group("", middleware.RateLimit(dbRedis, "default", conf.RateLimit.DefaultRate, conf.RateLimit.DefaultBurst, middleware.KeyByIdentity))
+	defaultGroup.POST("/passengers", handler.CreatePassenger)
+	defaultGroup.GET("/passengers/:id", handler.GetPassenger)
+	defaultGroup.PATCH("/passengers/:id", handler.UpdatePassenger)
+	defaultGroup.DELETE("/passengers/:id", handler.DeletePassenger)
+	defaultGroup.POST("/requests", handler.RequestDrivers)
+	defaultGroup.POST("/scheduled-rides", handler.CreateScheduledRide)
+	defaultGroup.GET("/scheduled-rides/:id", handler.GetScheduledRide)
+	defaultGroup.DELETE("/scheduled-rides/:id", handler.CancelScheduledRide)
+	defaultGroup.POST("/rides", handler.CreateRide)
+	defaultGroup.GET("/rides/:id", handler.GetRide)
+	defaultGroup.POST("/rides/:id/arrived", handler.ArriveRide)
+	defaultGroup.POST("/rides/:id/start", handler.StartRide)
+	defaultGroup.POST("/rides/:id/stops/:position/arrived", handler.ArriveRideStop)
+	defaultGroup.POST("/rides/:id/stops/:position/departed", handler.DepartRideStop)
+	defaultGroup.POST("/rides/:id/complete", handler.CompleteRide)
+	defaultGroup.POST("/rides/:id/cancel", handler.CancelRide)
+	defaultGroup.POST("/rides/:id/decline", handler.DeclineRide)
+	defaultGroup.POST("/rides/:id/rating", handler.RateRide)
+	defaultGroup.POST("/rides/:id/tip", handler.TipRide)
+	defaultGroup.GET("/rides/:id/payments", handler.GetRidePayments)
+	defaultGroup.POST("/rides/:id/charge", handler.ChargeRide)
+	defaultGroup.POST("/rides/:id/refunds", handler.RefundRide)
+	defaultGroup.GET("/admin/zones", handler.GetZones)
+	defaultGroup.GET("/admin/heatmap", handler.GetHeatmap)
+	defaultGroup.GET("/admin/ratings", handler.GetLowRatings)
 
-	driverGroup := router.Group("/drivers")
+	driverGroup := router.Group("/drivers", middleware.RateLimit(dbRedis, "drivers", conf.RateLimit.DriversRate, conf.RateLimit.DriversBurst, middleware.KeyByParam("id")))
 	driverGroup.POST("", handler.CreateDriver)
 	driverGroup.PUT("/:id/locations", handler.UpdateDriverLocation)
 	driverGroup.GET("/:id/history", handler.GetDriverHistory)
 	driverGroup.PATCH("/:id", handler.UpdateDriverState)
+	driverGroup.GET("/:id", handler.GetDriver)
+	driverGroup.GET("/:id/vehicles", handler.GetVehicles)
+	driverGroup.POST("/:id/vehicles", handler.CreateVehicle)
+	driverGroup.DELETE("/:id/vehicles/:vehicle_id", handler.DeleteVehicle)
+	driverGroup.GET("/:id/documents", handler.GetDriverDocuments)
+	driverGroup.PUT("/:id/documents/:type", handler.SaveDriverDocument)
+	driverGroup.GET("/:id/earnings", handler.GetDriverEarnings)
+	driverGroup.GET("/:id/earnings/statement", handler.GetDriverEarningsStatement)
+	driverGroup.POST("/:id/adjustments", handler.CreateEarningAdjustment)
 
 	return engine, nil
 }
 
+// NewMatcher Create the matcher of drivers and the assigner of rides, shared by ride requests and scheduled rides.
+// The assigner is a batch.Batcher when matchingConf sets a batch window, it must be closed on shutdown
+func NewMatcher(dbPg database.PgI, dbCass database.CassandraI, dbRedis database.RedisI, etaConf config.ETA, matchingConf config.Matching, fences *geofence.Fences) (*matching.Matcher, matching.Assigner, error) {
+	matcher := matching.New(dbPg, dbRedis, matching.NewRanker(dbPg, dbCass, matchingConf), fences, matchingConf.MinRating)
+	if matchingConf.BatchWindow <= 0 {
+		return matcher, matcher, nil
+	}
+
+	estimator, err := newEstimator(dbCass, etaConf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return matcher, batch.New(matcher, estimator, batch.Options{
+		Window:  matchingConf.BatchWindow,
+		MaxSize: matchingConf.BatchSize,
+	}), nil
+}
+
+// newEstimator Create the pickup time estimator of the configuration
+func newEstimator(dbCass database.CassandraI, conf config.ETA) (*eta.Estimator, error) {
+	defaultSpeed := conf.DefaultSpeed
+	if defaultSpeed <= 0 {
+		defaultSpeed = 25
+	}
+	profile, err := eta.ParseProfile(defaultSpeed, conf.SpeedProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	location := time.UTC
+	if conf.Timezone != "" {
+		if location, err = time.LoadLocation(conf.Timezone); err != nil {
+			return nil, err
+		}
+	}
+
+	return eta.New(dbCass, profile, location, conf.HistoryWindow), nil
+}
+
 // CreatePassenger Sign up passenger
 func (h *Handler) CreatePassenger(c *gin.Context) {
 	var input form.Passenger
@@ -55,7 +201,13 @@ func (h *Handler) CreatePassenger(c *gin.Context) {
 	}
 
 	passenger := mpg.Passenger{
-		Name: input.Name,
+		Name:                 input.Name,
+		Phone:                input.Phone,
+		Email:                input.Email,
+		DefaultPaymentMethod: input.DefaultPaymentMethod,
+	}
+	if passenger.DefaultPaymentMethod == "" {
+		passenger.DefaultPaymentMethod = mpg.PaymentMethodCash
 	}
 	if err := h.dbPg.CreatePassenger(&passenger); err != nil {
 		util.RespInternalServerError(c, err)
@@ -68,6 +220,81 @@ func (h *Handler) CreatePassenger(c *gin.Context) {
 	util.RespOK(c, resp)
 }
 
+// GetPassenger Get passenger profile
+func (h *Handler) GetPassenger(c *gin.Context) {
+	passenger, ok := h.findPassenger(c)
+	if !ok {
+		return
+	}
+
+	util.RespOK(c, view.PopulatePassenger(passenger))
+}
+
+// UpdatePassenger Update passenger profile
+func (h *Handler) UpdatePassenger(c *gin.Context) {
+	var input form.UpdatePassenger
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	passenger, ok := h.findPassenger(c)
+	if !ok {
+		return
+	}
+
+	input.Apply(passenger)
+	if err := h.dbPg.UpdatePassenger(passenger); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulatePassenger(passenger))
+}
+
+// DeletePassenger Soft delete passenger
+func (h *Handler) DeletePassenger(c *gin.Context) {
+	passenger, ok := h.findPassenger(c)
+	if !ok {
+		return
+	}
+
+	if err := h.dbPg.DeletePassenger(passenger.ID); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	resp := struct{}{}
+	util.RespOK(c, resp)
+}
+
+// findPassenger Get passenger of param id, it responds not found or error and returns false on failure
+func (h *Handler) findPassenger(c *gin.Context) (*mpg.Passenger, bool) {
+	passengerID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		util.RespNotFound(c)
+		return nil, false
+	}
+
+	passenger, err := h.dbPg.GetPassenger(passengerID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return nil, false
+	}
+
+	if passenger == nil {
+		util.RespNotFound(c)
+		return nil, false
+	}
+
+	return passenger, true
+}
+
 // RequestDrivers Get list nearest drivers
 func (h *Handler) RequestDrivers(c *gin.Context) {
 	var input form.RequestRide
@@ -76,22 +303,828 @@ func (h *Handler) RequestDrivers(c *gin.Context) {
 		return
 	}
 
-	if err := input.Validate(); err != nil {
+	if err := input.Validate(h.fences); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	drivers, err := h.matcher.NearestDrivers(input.Location.Lat, input.Location.Lng, input.VehicleClass)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	now := time.Now()
+	etas := make([]time.Duration, len(drivers))
+	for i, driver := range drivers {
+		if etas[i], err = h.eta.Estimate(driver.DriverID, driver.Distance, now); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+	}
+
+	resp := view.PopulateDriverRequests(drivers, etas)
+	util.RespOK(c, resp)
+}
+
+// CreateScheduledRide Schedule a ride, drivers are searched by the scheduler a lead time before pickup
+func (h *Handler) CreateScheduledRide(c *gin.Context) {
+	var input form.ScheduleRide
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(h.fences); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	passenger, err := h.dbPg.GetPassenger(input.PassengerID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if passenger == nil {
+		util.RespBadRequest(c, "Not found passenger")
+		return
+	}
+
+	ride := mpg.ScheduledRide{
+		PassengerID:  passenger.ID,
+		Lat:          input.Location.Lat,
+		Lng:          input.Location.Lng,
+		VehicleClass: input.VehicleClass,
+		PickupAt:     input.PickupAt,
+		Status:       mpg.ScheduledRidePending,
+	}
+	if err := h.dbPg.CreateScheduledRide(&ride); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateScheduledRide(&ride))
+}
+
+// GetScheduledRide Get scheduled ride with its status and drivers once dispatched
+func (h *Handler) GetScheduledRide(c *gin.Context) {
+	ride, ok := h.findScheduledRide(c)
+	if !ok {
+		return
+	}
+
+	util.RespOK(c, view.PopulateScheduledRide(ride))
+}
+
+// CancelScheduledRide Cancel a scheduled ride which is not dispatched yet, with its ride if it is still requested
+func (h *Handler) CancelScheduledRide(c *gin.Context) {
+	ride, ok := h.findScheduledRide(c)
+	if !ok {
+		return
+	}
+
+	ride.Status = mpg.ScheduledRideCancelled
+	updated, err := h.dbPg.UpdateScheduledRideStatus(ride, mpg.ScheduledRidePending)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if !updated {
+		util.RespConflict(c, "Ride can not be cancelled")
+		return
+	}
+
+	// The scheduler requested the ride but found no driver yet
+	if ride.RideID != 0 {
+		requested := mpg.Ride{ID: ride.RideID, Status: mpg.RideCancelled, CancelledAt: time.Now()}
+		if _, err := h.dbPg.UpdateRideStatus(&requested, mpg.RideRequested); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+	}
+
+	util.RespOK(c, view.PopulateScheduledRide(ride))
+}
+
+// findScheduledRide Get scheduled ride of param id, it responds not found or error and returns false on failure
+func (h *Handler) findScheduledRide(c *gin.Context) (*mpg.ScheduledRide, bool) {
+	rideID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		util.RespNotFound(c)
+		return nil, false
+	}
+
+	ride, err := h.dbPg.GetScheduledRide(rideID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return nil, false
+	}
+
+	if ride == nil {
+		util.RespNotFound(c)
+		return nil, false
+	}
+
+	return ride, true
+}
+
+// CreateRide Request a ride and assign the best driver, the ride stays requested if no driver is found
+func (h *Handler) CreateRide(c *gin.Context) {
+	var input form.RequestRide
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(h.fences); err != nil {
 		util.RespBadRequest(c, err.Error())
 		return
 	}
 
-	// Set default radius 10 km. TODO if not enough then increase radius
-	var defaultRadius float64 = 10
-	numberOfTop := 5
-	drivers, err := h.dbRedis.GetNearestDrivers(input.Location.Lat, input.Location.Lng, defaultRadius, numberOfTop)
+	passenger, err := h.dbPg.GetPassenger(input.PassengerID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if passenger == nil {
+		util.RespBadRequest(c, "Not found passenger")
+		return
+	}
+
+	ride := mpg.Ride{
+		PassengerID:   passenger.ID,
+		Lat:           input.Location.Lat,
+		Lng:           input.Location.Lng,
+		VehicleClass:  input.VehicleClass,
+		Status:        mpg.RideRequested,
+		PaymentMethod: passenger.DefaultPaymentMethod,
+	}
+	stops := newRideStops(&input)
+	if err := h.dbPg.CreateRideWithStops(&ride, stops); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if _, err := h.assigner.AssignDriver(&ride, nil); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateRide(&ride, stops, nil))
+}
+
+// newRideStops Stops of a requested ride in visit order from position 1, the dropoff is last
+func newRideStops(input *form.RequestRide) []mpg.RideStop {
+	stops := []mpg.RideStop{}
+	for _, stop := range input.Stops {
+		stops = append(stops, newRideStop(stop, len(stops)+1))
+	}
+	if input.Dropoff != nil {
+		dropoff := newRideStop(*input.Dropoff, len(stops)+1)
+		dropoff.Dropoff = true
+		stops = append(stops, dropoff)
+	}
+	return stops
+}
+
+// newRideStop Stop of a requested ride at a position
+func newRideStop(stop form.Stop, position int) mpg.RideStop {
+	return mpg.RideStop{
+		Position: position,
+		Lat:      stop.Location.Lat,
+		Lng:      stop.Location.Lng,
+		Address:  stop.Address,
+		PlaceID:  stop.PlaceID,
+	}
+}
+
+// GetRide Get ride with its stops and cancellations
+func (h *Handler) GetRide(c *gin.Context) {
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	stops, err := h.dbPg.GetRideStops(ride.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	cancellations, err := h.dbPg.GetRideCancellations(ride.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateRide(ride, stops, cancellations))
+}
+
+// ArriveRide The assigned driver arrived at pickup, the no-show wait starts
+func (h *Handler) ArriveRide(c *gin.Context) {
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	if ride.Status != mpg.RideAssigned {
+		util.RespConflict(c, "Ride is not assigned")
+		return
+	}
+
+	ride.Status = mpg.RideArrived
+	ride.ArrivedAt = time.Now()
+	updated, err := h.dbPg.UpdateRideStatus(ride, mpg.RideAssigned)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if !updated {
+		util.RespConflict(c, "Ride is not assigned")
+		return
+	}
+
+	util.RespOK(c, view.PopulateRide(ride, nil, nil))
+}
+
+// StartRide The driver picked up the passenger and leaves pickup
+func (h *Handler) StartRide(c *gin.Context) {
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	if err := trip.Start(ride, time.Now()); err != nil {
+		util.RespConflict(c, err.Error())
+		return
+	}
+
+	updated, err := h.dbPg.UpdateRideStatus(ride, mpg.RideArrived)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if !updated {
+		util.RespConflict(c, trip.ErrNotArrived.Error())
+		return
+	}
+
+	stops, err := h.dbPg.GetRideStops(ride.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateRide(ride, stops, nil))
+}
+
+// ArriveRideStop The driver arrived at a stop of a started ride, arriving at the dropoff completes the ride
+func (h *Handler) ArriveRideStop(c *gin.Context) {
+	h.updateRideStop(c, trip.Arrive)
+}
+
+// DepartRideStop The driver left a stop of a started ride
+func (h *Handler) DepartRideStop(c *gin.Context) {
+	h.updateRideStop(c, trip.Depart)
+}
+
+// CompleteRide The driver dropped off the passenger, every stop before the dropoff must be departed
+func (h *Handler) CompleteRide(c *gin.Context) {
+	h.updateRideStop(c, func(ride *mpg.Ride, stops []mpg.RideStop, _ int, at time.Time) (*mpg.RideStop, error) {
+		return trip.Complete(ride, stops, at)
+	})
+}
+
+// updateRideStop Apply a stop event to a started ride and save it. The driver is released when the ride completes
+func (h *Handler) updateRideStop(c *gin.Context, event func(*mpg.Ride, []mpg.RideStop, int, time.Time) (*mpg.RideStop, error)) {
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	position := 0
+	if c.Param("position") != "" {
+		var err error
+		position, err = strconv.Atoi(c.Param("position"))
+		if err != nil {
+			util.RespNotFound(c)
+			return
+		}
+	}
+
+	stops, err := h.dbPg.GetRideStops(ride.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	stop, err := event(ride, stops, position, time.Now())
+	if err == trip.ErrStopNotFound {
+		util.RespNotFound(c)
+		return
+	}
+	if err != nil {
+		util.RespConflict(c, err.Error())
+		return
+	}
+
+	if ride.Status == mpg.RideCompleted {
+		h.pricing.Price(ride, stops, h.fences.Airport(ride.Lat, ride.Lng))
+	}
+
+	var updated bool
+	if stop != nil {
+		updated, err = h.dbPg.UpdateRideStop(ride, mpg.RideStarted, stop)
+	} else {
+		updated, err = h.dbPg.UpdateRideStatus(ride, mpg.RideStarted)
+	}
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if !updated {
+		util.RespConflict(c, trip.ErrNotStarted.Error())
+		return
+	}
+
+	if ride.Status == mpg.RideCompleted {
+		if err := h.dbPg.UpdateDriverState(ride.DriverID, mpg.StateAvailable); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+		if _, err := h.dbRedis.ReleaseDriver(ride.DriverID, ride.ID); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+	}
+
+	res := view.PopulateRide(ride, stops, nil)
+	if ride.Status == mpg.RideCompleted {
+		res.Payment = h.collectPayment(c, ride)
+	}
+	util.RespOK(c, res)
+}
+
+// CancelRide Cancel a ride by the passenger or the driver with the fee of the cancellation policy.
+// When the driver cancels and the passenger is not a no-show, the driver is released and another driver is assigned
+func (h *Handler) CancelRide(c *gin.Context) {
+	var input form.CancelRide
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	// A started ride has the passenger on board
+	if ride.Status == mpg.RideCancelled || ride.Status == mpg.RideStarted || ride.Status == mpg.RideCompleted ||
+		(input.CancelledBy == mpg.CancelledByDriver && ride.DriverID == 0) {
+		util.RespConflict(c, "Ride can not be cancelled")
+		return
+	}
+
+	// A driver only cancels the ride it is assigned
+	if input.CancelledBy == mpg.CancelledByDriver && input.DriverID != ride.DriverID {
+		util.RespForbidden(c, "Ride is assigned to another driver")
+		return
+	}
+
+	now := time.Now()
+	decision := h.policy.Decide(ride, input.CancelledBy, now)
+	rideCancellation := mpg.RideCancellation{
+		RideID:      ride.ID,
+		DriverID:    ride.DriverID,
+		CancelledBy: input.CancelledBy,
+		Reason:      input.Reason,
+		Fee:         decision.Fee,
+		NoShow:      decision.NoShow,
+	}
+	from := ride.Status
+	if decision.Redispatch {
+		ride.Status = mpg.RideRequested
+		ride.DriverID = 0
+		ride.AssignedAt = time.Time{}
+		ride.ArrivedAt = time.Time{}
+	} else {
+		ride.Status = mpg.RideCancelled
+		ride.CancelledAt = now
+	}
+	updated, err := h.dbPg.CancelRide(ride, from, &rideCancellation)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if !updated {
+		util.RespConflict(c, "Ride can not be cancelled")
+		return
+	}
+
+	// Release the driver and its claim, it is back in the geo set on its next location update
+	if rideCancellation.DriverID != 0 {
+		if err := h.dbPg.UpdateDriverState(rideCancellation.DriverID, mpg.StateAvailable); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+		if _, err := h.dbRedis.ReleaseDriver(rideCancellation.DriverID, ride.ID); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+	}
+
+	cancellations, err := h.dbPg.GetRideCancellations(ride.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if decision.Redispatch {
+		if err := h.redispatch(ride, cancellations); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+	}
+
+	res := view.PopulateRide(ride, nil, cancellations)
+	if ride.Status == mpg.RideCancelled {
+		res.Payment = h.collectPayment(c, ride)
+	}
+	util.RespOK(c, res)
+}
+
+// DeclineRide The assigned driver declines the ride before arriving. The driver is released and back in the geo sets
+// at its latest location at once, and another driver is assigned
+func (h *Handler) DeclineRide(c *gin.Context) {
+	var input form.DeclineRide
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	if ride.Status != mpg.RideAssigned {
+		util.RespConflict(c, "Ride is not assigned")
+		return
+	}
+
+	if input.DriverID != ride.DriverID {
+		util.RespForbidden(c, "Ride is assigned to another driver")
+		return
+	}
+
+	// The decline is kept as a cancellation by the driver so the driver is not assigned the ride again
+	rideCancellation := mpg.RideCancellation{
+		RideID:      ride.ID,
+		DriverID:    ride.DriverID,
+		CancelledBy: mpg.CancelledByDriver,
+		Reason:      "Declined",
+	}
+	ride.Status = mpg.RideRequested
+	ride.DriverID = 0
+	ride.AssignedAt = time.Time{}
+	updated, err := h.dbPg.CancelRide(ride, mpg.RideAssigned, &rideCancellation)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if !updated {
+		util.RespConflict(c, "Ride is not assigned")
+		return
+	}
+
+	if err := h.dbPg.UpdateDriverState(rideCancellation.DriverID, mpg.StateAvailable); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+	if _, err := h.dbRedis.ReleaseDriver(rideCancellation.DriverID, ride.ID); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	// A driver never located is back in the geo sets on its first location update
+	driver, err := h.dbPg.GetDriver(rideCancellation.DriverID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+	if driver != nil {
+		latestLocation, err := h.dbCass.GetDriverLatestLocation(driver.ID)
+		if err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+		if latestLocation != nil {
+			if err := h.dbRedis.PushDriverLocationGeo(driver.ID, latestLocation.Lat, latestLocation.Lng, driver.VehicleClasses); err != nil {
+				util.RespInternalServerError(c, err)
+				return
+			}
+
+			if err := matching.UpdateQueues(h.dbRedis, h.fences, driver.ID, latestLocation.Lat, latestLocation.Lng); err != nil {
+				util.RespInternalServerError(c, err)
+				return
+			}
+		}
+	}
+
+	cancellations, err := h.dbPg.GetRideCancellations(ride.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if err := h.redispatch(ride, cancellations); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateRide(ride, nil, cancellations))
+}
+
+// redispatch Assign another driver to a requested ride, drivers who cancelled or declined it are not assigned again
+func (h *Handler) redispatch(ride *mpg.Ride, cancellations []mpg.RideCancellation) error {
+	excluded := []int{}
+	for _, previous := range cancellations {
+		if previous.CancelledBy == mpg.CancelledByDriver {
+			excluded = append(excluded, previous.DriverID)
+		}
+	}
+
+	_, err := h.assigner.AssignDriver(ride, excluded)
+	return err
+}
+
+// RateRide Rate a completed ride by the passenger or the driver, each side rates the other once.
+// The average rating of the rated driver or passenger is updated
+func (h *Handler) RateRide(c *gin.Context) {
+	var input form.RateRide
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	if ride.Status != mpg.RideCompleted {
+		util.RespConflict(c, "Ride is not completed")
+		return
+	}
+
+	rating := mpg.RideRating{
+		RideID:      ride.ID,
+		DriverID:    ride.DriverID,
+		PassengerID: ride.PassengerID,
+		RatedBy:     input.RatedBy,
+		Rating:      input.Rating,
+		Tags:        input.Tags,
+		Comment:     input.Comment,
+	}
+	created, err := h.dbPg.CreateRideRating(&rating)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if !created {
+		util.RespConflict(c, "Ride is already rated")
+		return
+	}
+
+	util.RespOK(c, view.PopulateRideRating(&rating))
+}
+
+// TipRide The passenger tips the driver of a completed ride once, the tip is collected like the fare
+func (h *Handler) TipRide(c *gin.Context) {
+	var input form.TipRide
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	if ride.Status != mpg.RideCompleted {
+		util.RespConflict(c, "Ride is not completed")
+		return
+	}
+
+	ride.Tip = input.Amount
+	updated, err := h.dbPg.UpdateRideTip(ride)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if !updated {
+		util.RespConflict(c, "Ride is already tipped")
+		return
+	}
+
+	stops, err := h.dbPg.GetRideStops(ride.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	res := view.PopulateRide(ride, stops, nil)
+	res.Payment = h.collectPayment(c, ride)
+	util.RespOK(c, res)
+}
+
+// collectPayment Charge the fare and tip of a completed ride or the fee of a cancelled one and get the payment status of
+// the response, empty if payments are disabled or there is nothing to charge. A failure is logged with the request and
+// the amount stays owed until ChargeRide is retried
+func (h *Handler) collectPayment(c *gin.Context, ride *mpg.Ride) string {
+	if h.ledger == nil {
+		return ""
+	}
+
+	_, err := h.charge(ride)
+	switch err {
+	case nil:
+		// Cash passengers are not charged by the provider, the fee stays owed
+		if ride.Status == mpg.RideCancelled && ride.PaymentMethod == mpg.PaymentMethodCash {
+			return view.PaymentOwed
+		}
+		return view.PaymentPaid
+	case ledger.ErrNotChargeable:
+		return ""
+	case payment.ErrDeclined:
+		c.Error(err)
+		return view.PaymentDeclined
+	default:
+		c.Error(err)
+		return view.PaymentFailed
+	}
+}
+
+// charge Charge the fare of a completed ride or the fee of the last cancellation of a cancelled one
+func (h *Handler) charge(ride *mpg.Ride) ([]mpg.JournalEntry, error) {
+	if ride.Status != mpg.RideCancelled {
+		return h.ledger.ChargeRide(ride)
+	}
+
+	cancellations, err := h.dbPg.GetRideCancellations(ride.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cancellations) == 0 {
+		return nil, ledger.ErrNotChargeable
+	}
+
+	return h.ledger.ChargeCancellation(ride, &cancellations[len(cancellations)-1], h.pricing.Currency)
+}
+
+// GetRidePayments Get the ledger entries of a ride, oldest first
+func (h *Handler) GetRidePayments(c *gin.Context) {
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	entries, err := h.dbPg.GetRideJournalEntries(ride.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateJournalEntries(entries))
+}
+
+// ChargeRide Collect the fare of a completed ride or the fee of a cancelled one again after a failed payment, it is charged
+// once however often it is retried
+func (h *Handler) ChargeRide(c *gin.Context) {
+	if h.ledger == nil {
+		util.RespConflict(c, "Payments are disabled")
+		return
+	}
+
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	entries, err := h.charge(ride)
+	if err == ledger.ErrNotChargeable {
+		util.RespConflict(c, err.Error())
+		return
+	}
+	if err == payment.ErrDeclined {
+		util.RespPaymentRequired(c, err.Error())
+		return
+	}
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateJournalEntries(entries))
+}
+
+// RefundRide Refund part of the fare of a ride paid through the payment provider. The Idempotency-Key header identifies
+// the refund, a retry with the same key returns the recorded refund
+func (h *Handler) RefundRide(c *gin.Context) {
+	if h.ledger == nil {
+		util.RespConflict(c, "Payments are disabled")
+		return
+	}
+
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		util.RespBadRequest(c, "Missing idempotency key")
+		return
+	}
+
+	var input form.RefundRide
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	ride, ok := h.findRide(c)
+	if !ok {
+		return
+	}
+
+	entry, err := h.ledger.Refund(ride, input.Amount, key, input.Reason)
+	if err == ledger.ErrNotPaid || err == ledger.ErrNotRefundable || err == ledger.ErrExceedsFare || err == ledger.ErrKeyReused ||
+		err == ledger.ErrRefundFailed {
+		util.RespConflict(c, err.Error())
+		return
+	}
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateJournalEntry(entry))
+}
+
+// findRide Get ride of param id, it responds not found or error and returns false on failure
+func (h *Handler) findRide(c *gin.Context) (*mpg.Ride, bool) {
+	rideID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		util.RespNotFound(c)
+		return nil, false
+	}
+
+	ride, err := h.dbPg.GetRide(rideID)
 	if err != nil {
 		util.RespInternalServerError(c, err)
-		return
+		return nil, false
 	}
 
-	resp := view.PopulateDriverRequests(drivers)
-	util.RespOK(c, resp)
+	if ride == nil {
+		util.RespNotFound(c)
+		return nil, false
+	}
+
+	return ride, true
 }
 
 // CreateDriver Sign up driver
@@ -147,10 +1180,29 @@ func (h *Handler) UpdateDriverLocation(c *gin.Context) {
 		return
 	}
 
-	// Push to redis
-	if err := h.dbRedis.PushDriverLocationGeo(driver.ID, input.Lat, input.Lng); err != nil {
-		util.RespInternalServerError(c, err)
-		return
+	// Push to redis, vehicle classes kept with the driver are indexed again so added or removed vehicles are picked up.
+	// Busy drivers are removed from the geo set so they are not matched again, an update which read the driver
+	// available while it was assigned a ride may have pushed it back
+	if driver.State != mpg.StateBusy {
+		if err := h.dbRedis.PushDriverLocationGeo(driver.ID, input.Lat, input.Lng, driver.VehicleClasses); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+
+		if err := matching.UpdateQueues(h.dbRedis, h.fences, driver.ID, input.Lat, input.Lng); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+	} else {
+		if err := h.dbRedis.RemoveDriverLocationGeo(driver.ID); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+
+		if err := matching.LeaveQueues(h.dbRedis, h.fences, driver.ID); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
 	}
 
 	// Save to cassandra
@@ -158,9 +1210,14 @@ func (h *Handler) UpdateDriverLocation(c *gin.Context) {
 		DriverID:  driver.ID,
 		Lat:       input.Lat,
 		Lng:       input.Lng,
-		CreatedAt: time.Now().Unix(),
+		CreatedAt: time.Now(),
 	}
 	if err := h.dbCass.CreateDriverLocation(&location); err != nil {
+		if err == writebehind.ErrQueueFull {
+			// Location history is behind, the driver app sends the location again later
+			util.RespServiceUnavailable(c, err.Error(), time.Second)
+			return
+		}
 		util.RespInternalServerError(c, err)
 		return
 	}
@@ -238,6 +1295,21 @@ func (h *Handler) UpdateDriverState(c *gin.Context) {
 		return
 	}
 
+	// Get driver latest location, a driver is available at it so a driver never located can not be available
+	var latestLocation *mcass.DriverLocation
+	if input.State == mpg.StateAvailable {
+		latestLocation, err = h.dbCass.GetDriverLatestLocation(driver.ID)
+		if err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+
+		if latestLocation == nil {
+			util.RespConflict(c, "No known location")
+			return
+		}
+	}
+
 	// Update database postgresql
 	if err := h.dbPg.UpdateDriverState(driver.ID, input.State); err != nil {
 		util.RespInternalServerError(c, err)
@@ -247,14 +1319,12 @@ func (h *Handler) UpdateDriverState(c *gin.Context) {
 	// Update driver geo in redis
 	switch input.State {
 	case mpg.StateAvailable:
-		// Get driver latest location
-		latestLocation, err := h.dbCass.GetDriverLatestLocation(driver.ID)
-		if err != nil {
+		if err := h.dbRedis.PushDriverLocationGeo(driver.ID, latestLocation.Lat, latestLocation.Lng, driver.VehicleClasses); err != nil {
 			util.RespInternalServerError(c, err)
 			return
 		}
 
-		if err := h.dbRedis.PushDriverLocationGeo(driver.ID, latestLocation.Lat, latestLocation.Lng); err != nil {
+		if err := matching.UpdateQueues(h.dbRedis, h.fences, driver.ID, latestLocation.Lat, latestLocation.Lng); err != nil {
 			util.RespInternalServerError(c, err)
 			return
 		}
@@ -264,8 +1334,352 @@ func (h *Handler) UpdateDriverState(c *gin.Context) {
 			return
 		}
 
+		if err := matching.LeaveQueues(h.dbRedis, h.fences, driver.ID); err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+	}
+
+	resp := struct{}{}
+	util.RespOK(c, resp)
+}
+
+// GetDriver Get driver profile with vehicles and documents
+func (h *Handler) GetDriver(c *gin.Context) {
+	driver, ok := h.findDriver(c)
+	if !ok {
+		return
+	}
+
+	vehicles, err := h.dbPg.GetVehicles(driver.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	documents, err := h.dbPg.GetDriverDocuments(driver.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateDriver(driver, vehicles, documents))
+}
+
+// GetVehicles Get driver's vehicles
+func (h *Handler) GetVehicles(c *gin.Context) {
+	driver, ok := h.findDriver(c)
+	if !ok {
+		return
+	}
+
+	vehicles, err := h.dbPg.GetVehicles(driver.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateVehicles(vehicles))
+}
+
+// CreateVehicle Add a vehicle to driver
+func (h *Handler) CreateVehicle(c *gin.Context) {
+	var input form.Vehicle
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	driver, ok := h.findDriver(c)
+	if !ok {
+		return
+	}
+
+	vehicle := mpg.Vehicle{
+		DriverID: driver.ID,
+		Plate:    input.Plate,
+		Make:     input.Make,
+		Model:    input.Model,
+		Color:    input.Color,
+		Seats:    input.Seats,
+		Class:    input.Class,
+	}
+	if err := h.dbPg.CreateVehicle(&vehicle); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateVehicle(&vehicle))
+}
+
+// DeleteVehicle Remove a vehicle of driver
+func (h *Handler) DeleteVehicle(c *gin.Context) {
+	driver, ok := h.findDriver(c)
+	if !ok {
+		return
+	}
+
+	vehicleID, err := strconv.Atoi(c.Param("vehicle_id"))
+	if err != nil {
+		util.RespNotFound(c)
+		return
+	}
+
+	vehicle, err := h.dbPg.GetVehicle(vehicleID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	if vehicle == nil || vehicle.DriverID != driver.ID {
+		util.RespNotFound(c)
+		return
+	}
+
+	if err := h.dbPg.DeleteVehicle(vehicle.ID); err != nil {
+		util.RespInternalServerError(c, err)
+		return
 	}
 
 	resp := struct{}{}
 	util.RespOK(c, resp)
 }
+
+// GetDriverDocuments Get driver's documents
+func (h *Handler) GetDriverDocuments(c *gin.Context) {
+	driver, ok := h.findDriver(c)
+	if !ok {
+		return
+	}
+
+	documents, err := h.dbPg.GetDriverDocuments(driver.ID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateDriverDocuments(documents))
+}
+
+// SaveDriverDocument Add or replace driver's license or insurance
+func (h *Handler) SaveDriverDocument(c *gin.Context) {
+	documentType := c.Param("type")
+	if !form.ValidDocumentType(documentType) {
+		util.RespNotFound(c)
+		return
+	}
+
+	var input form.DriverDocument
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	driver, ok := h.findDriver(c)
+	if !ok {
+		return
+	}
+
+	document := mpg.DriverDocument{
+		DriverID:  driver.ID,
+		Type:      documentType,
+		Number:    input.Number,
+		ExpiresAt: time.Time(input.ExpiresAt),
+	}
+	if err := h.dbPg.SaveDriverDocument(&document); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateDriverDocument(&document))
+}
+
+// findDriver Get driver of param id, it responds not found or error and returns false on failure
+func (h *Handler) findDriver(c *gin.Context) (*mpg.Driver, bool) {
+	driverID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		util.RespNotFound(c)
+		return nil, false
+	}
+
+	driver, err := h.dbPg.GetDriver(driverID)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return nil, false
+	}
+
+	if driver == nil {
+		util.RespNotFound(c)
+		return nil, false
+	}
+
+	return driver, true
+}
+
+// GetZones List geofenced zones as a GeoJSON FeatureCollection
+func (h *Handler) GetZones(c *gin.Context) {
+	util.RespOK(c, view.PopulateZones(h.fences.Zones()))
+}
+
+// GetLowRatings Get the latest low ratings for support, newest first
+func (h *Handler) GetLowRatings(c *gin.Context) {
+	input := form.NewLowRatings()
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -input.Days)
+	ratings, err := h.dbPg.GetLowRatings(input.MaxRating, input.RatedBy, since, input.Limit)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateRideRatings(ratings))
+}
+
+// GetHeatmap Count available drivers, and recent ride requests if requested, per geohash cell of a bounding box
+// as a GeoJSON FeatureCollection
+func (h *Handler) GetHeatmap(c *gin.Context) {
+	var input form.Heatmap
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	cells, err := h.heatmap.Cells(input.Box(), input.Zoom, input.Requests, time.Now())
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateHeatmapCells(cells))
+}
+
+// GetDriverEarnings Get the earnings of a driver by day and week, see form.Earnings for the days
+func (h *Handler) GetDriverEarnings(c *gin.Context) {
+	statement, ok := h.findEarnings(c)
+	if !ok {
+		return
+	}
+
+	util.RespOK(c, view.PopulateEarnings(statement))
+}
+
+// GetDriverEarningsStatement Export the earnings of a driver as a CSV statement, see form.Earnings for the days
+func (h *Handler) GetDriverEarningsStatement(c *gin.Context) {
+	statement, ok := h.findEarnings(c)
+	if !ok {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := statement.WriteCSV(&buf); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	filename := fmt.Sprintf("earnings-%d-%s-%s.csv", statement.DriverID,
+		statement.From.Format(mpg.DateFormat), statement.To.AddDate(0, 0, -1).Format(mpg.DateFormat))
+	util.RespCSV(c, filename, buf.Bytes())
+}
+
+// findEarnings Get the earnings statement of the driver of param id for the days of the query,
+// it responds bad request, not found or error and returns false on failure
+func (h *Handler) findEarnings(c *gin.Context) (*earnings.Statement, bool) {
+	var input form.Earnings
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return nil, false
+	}
+
+	from, to, err := input.Range(time.Now().In(h.location))
+	if err != nil {
+		util.RespBadRequest(c, err.Error())
+		return nil, false
+	}
+
+	driver, ok := h.findDriver(c)
+	if !ok {
+		return nil, false
+	}
+
+	statement, err := h.earnings.Statement(driver.ID, from, to)
+	if err != nil {
+		util.RespInternalServerError(c, err)
+		return nil, false
+	}
+
+	return statement, true
+}
+
+// CreateEarningAdjustment Credit or debit the earnings of a driver, about one of its rides if a ride is given
+func (h *Handler) CreateEarningAdjustment(c *gin.Context) {
+	var input form.EarningAdjustment
+	if err := c.Bind(&input); err != nil {
+		util.RespBadRequest(c, "Invalid format")
+		return
+	}
+
+	if err := input.Validate(); err != nil {
+		util.RespBadRequest(c, err.Error())
+		return
+	}
+
+	driver, ok := h.findDriver(c)
+	if !ok {
+		return
+	}
+
+	adjustment := mpg.EarningAdjustment{
+		DriverID: driver.ID,
+		Amount:   input.Amount,
+		Currency: input.Currency,
+		Reason:   input.Reason,
+	}
+	if adjustment.Currency == "" {
+		adjustment.Currency = h.pricing.Currency
+	}
+
+	if input.RideID != 0 {
+		ride, err := h.dbPg.GetRide(input.RideID)
+		if err != nil {
+			util.RespInternalServerError(c, err)
+			return
+		}
+
+		if ride == nil || ride.DriverID != driver.ID {
+			util.RespBadRequest(c, "Not found ride")
+			return
+		}
+		adjustment.RideID = ride.ID
+	}
+
+	if err := h.dbPg.CreateEarningAdjustment(&adjustment); err != nil {
+		util.RespInternalServerError(c, err)
+		return
+	}
+
+	util.RespOK(c, view.PopulateEarningAdjustment(&adjustment))
+}
@@ -6,11 +6,21 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/app/geofence"
+	"github.com/trietphm/gruber/app/matching"
+	"github.com/trietphm/gruber/app/payment"
+	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/database/writebehind"
+	"github.com/trietphm/gruber/geo"
 	"github.com/trietphm/gruber/model/mcass"
 	"github.com/trietphm/gruber/model/mpg"
 	"github.com/trietphm/gruber/model/mredis"
@@ -24,7 +34,32 @@ func newMockEngine(t *testing.T) *gin.Engine {
 	mockDbPg := mockDbPg{}
 	mockDbRedis := mockDbRedis{}
 	mockDbCass := mockDbCass{}
-	engine, err := NewEngine(mockDbPg, mockDbCass, mockDbRedis)
+	fences, err := geofence.Load(mockDbPg, config.Geofence{Database: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fare of ride 6 is charged by the provider
+	provider := payment.NewFake()
+	if _, err := provider.Charge("ride:6:payment", 1, 50000, "VND"); err != nil {
+		t.Fatal(err)
+	}
+	matcher := matching.New(mockDbPg, mockDbRedis, nil, fences, 0)
+	engine, err := NewEngine(mockDbPg, mockDbCass, mockDbRedis, Options{
+		Config: config.Config{
+			Cancellation: config.Cancellation{
+				FreeWindow: 2 * time.Minute,
+				Fee:        10000,
+				NoShowWait: 5 * time.Minute,
+				NoShowFee:  20000,
+			},
+			ETA:     config.ETA{DefaultSpeed: 30},
+			Pricing: config.Pricing{Currency: "VND", BaseFare: 10000},
+		},
+		Fences:   fences,
+		Provider: provider,
+		Matcher:  matcher,
+		Assigner: matcher,
+	})
 	if err != nil {
 		t.FailNow()
 		return nil
@@ -33,6 +68,21 @@ func newMockEngine(t *testing.T) *gin.Engine {
 	return engine
 }
 
+func TestNewEngineInvalidETA(t *testing.T) {
+	for _, conf := range []config.ETA{{SpeedProfile: "7-9"}, {Timezone: "Nowhere/City"}} {
+		_, err := NewEngine(mockDbPg{}, mockDbCass{}, mockDbRedis{}, Options{Config: config.Config{ETA: conf}})
+		assert.Error(t, err)
+
+		_, _, err = NewMatcher(mockDbPg{}, mockDbCass{}, mockDbRedis{}, conf, config.Matching{BatchWindow: time.Second}, nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestNewEngineInvalidEarnings(t *testing.T) {
+	_, err := NewEngine(mockDbPg{}, mockDbCass{}, mockDbRedis{}, Options{Config: config.Config{Earnings: config.Earnings{Timezone: "Nowhere/City"}}})
+	assert.Error(t, err)
+}
+
 func TestGetDriverHistory(t *testing.T) {
 	tt := []struct {
 		url        string
@@ -134,6 +184,211 @@ func TestCreatePassenger(t *testing.T) {
 	ts.Close()
 }
 
+func TestGetPassenger(t *testing.T) {
+	tt := []struct {
+		url        string
+		StatusCode int
+		RespData   string
+	}{
+		{"/passengers/1", http.StatusOK, `{"id":1,"name":"Passenger 1","phone":"","email":"","rating":0,"default_payment_method":"cash","created_at":"2018-03-10T00:00:00Z"}`},
+		{"/passengers/0", http.StatusNotFound, ""},
+		{"/passengers/-1", http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+		{"/passengers/abc", http.StatusNotFound, ""},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	for _, tc := range tt {
+		client := ts.Client()
+		resp, err := client.Get(ts.URL + tc.url)
+		if err != nil {
+			t.Log(ts.URL+"/"+tc.url, err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode)
+		assert.Equal(t, tc.RespData, string(body))
+	}
+	ts.Close()
+}
+
+func TestUpdatePassenger(t *testing.T) {
+	tt := []struct {
+		url        string
+		input      string
+		StatusCode int
+		RespData   string
+	}{
+		{"/passengers/1", `{"phone":"+84901234567","default_payment_method":"card"}`, http.StatusOK, `{"id":1,"name":"Passenger 1","phone":"+84901234567","email":"","rating":0,"default_payment_method":"card","created_at":"2018-03-10T00:00:00Z"}`},
+		{"/passengers/1", `{"name":""}`, http.StatusBadRequest, `{"message":"Name can not be empty"}`},
+		{"/passengers/1", `{"email":"abc"}`, http.StatusBadRequest, `{"message":"Invalid email"}`},
+		{"/passengers/1", `{"name":1}`, http.StatusBadRequest, `{"message":"Invalid format"}`},
+		{"/passengers/1", `{"name":"INVALID"}`, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+		{"/passengers/0", `{"name":"passenger"}`, http.StatusNotFound, ``},
+		{"/passengers/-1", `{"name":"passenger"}`, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	for _, tc := range tt {
+		client := ts.Client()
+		url := ts.URL + tc.url
+		req, err := http.NewRequest("PATCH", url, bytes.NewBuffer([]byte(tc.input)))
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		req.Header.Add("content-type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode)
+		assert.Equal(t, tc.RespData, string(body))
+	}
+	ts.Close()
+}
+
+func TestDeletePassenger(t *testing.T) {
+	tt := []struct {
+		url        string
+		StatusCode int
+		RespData   string
+	}{
+		{"/passengers/1", http.StatusOK, `{}`},
+		{"/passengers/0", http.StatusNotFound, ``},
+		{"/passengers/-1", http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	for _, tc := range tt {
+		client := ts.Client()
+		url := ts.URL + tc.url
+		req, err := http.NewRequest("DELETE", url, nil)
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode)
+		assert.Equal(t, tc.RespData, string(body))
+	}
+	ts.Close()
+}
+
+func TestGetDriver(t *testing.T) {
+	tt := []struct {
+		url        string
+		StatusCode int
+		RespData   string
+	}{
+		{"/drivers/1", http.StatusOK, `{"id":1,"name":"Driver 1","state":"","created_at":"0001-01-01T00:00:00Z","vehicles":[{"id":1,"plate":"51A-12345","make":"Toyota","model":"Vios","color":"white","seats":4,"class":"economy"}],"documents":[{"type":"license","number":"L1","expires_at":"2030-01-31"}]}`},
+		{"/drivers/1/vehicles", http.StatusOK, `[{"id":1,"plate":"51A-12345","make":"Toyota","model":"Vios","color":"white","seats":4,"class":"economy"}]`},
+		{"/drivers/1/documents", http.StatusOK, `[{"type":"license","number":"L1","expires_at":"2030-01-31"}]`},
+		{"/drivers/0", http.StatusNotFound, ""},
+		{"/drivers/0/vehicles", http.StatusNotFound, ""},
+		{"/drivers/-1/documents", http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	for _, tc := range tt {
+		client := ts.Client()
+		resp, err := client.Get(ts.URL + tc.url)
+		if err != nil {
+			t.Log(ts.URL+"/"+tc.url, err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode)
+		assert.Equal(t, tc.RespData, string(body))
+	}
+	ts.Close()
+}
+
+func TestDriverVehiclesAndDocuments(t *testing.T) {
+	tt := []struct {
+		method     string
+		url        string
+		input      string
+		StatusCode int
+		RespData   string
+	}{
+		{"POST", "/drivers/1/vehicles", `{"plate":"51A-12345","make":"Toyota","model":"Vios","color":"white","seats":4,"class":"economy"}`, http.StatusOK, `{"id":1,"plate":"51A-12345","make":"Toyota","model":"Vios","color":"white","seats":4,"class":"economy"}`},
+		{"POST", "/drivers/1/vehicles", `{"plate":"","seats":4,"class":"economy"}`, http.StatusBadRequest, `{"message":"Plate can not be empty"}`},
+		{"POST", "/drivers/1/vehicles", `{"plate":"51A-12345","seats":4,"class":"boat"}`, http.StatusBadRequest, `{"message":"Invalid vehicle class"}`},
+		{"POST", "/drivers/1/vehicles", `{"plate":"INVALID","seats":4,"class":"xl"}`, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+		{"POST", "/drivers/0/vehicles", `{"plate":"51A-12345","seats":4,"class":"xl"}`, http.StatusNotFound, ``},
+		{"DELETE", "/drivers/1/vehicles/1", ``, http.StatusOK, `{}`},
+		{"DELETE", "/drivers/1/vehicles/2", ``, http.StatusNotFound, ``},
+		{"DELETE", "/drivers/1/vehicles/0", ``, http.StatusNotFound, ``},
+		{"DELETE", "/drivers/1/vehicles/abc", ``, http.StatusNotFound, ``},
+		{"DELETE", "/drivers/1/vehicles/-1", ``, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+		{"PUT", "/drivers/1/documents/license", `{"number":"L1","expires_at":"2030-01-31"}`, http.StatusOK, `{"type":"license","number":"L1","expires_at":"2030-01-31"}`},
+		{"PUT", "/drivers/1/documents/license", `{"number":"L1","expires_at":"31/01/2030"}`, http.StatusBadRequest, `{"message":"Invalid format"}`},
+		{"PUT", "/drivers/1/documents/insurance", `{"number":"","expires_at":"2030-01-31"}`, http.StatusBadRequest, `{"message":"Number can not be empty"}`},
+		{"PUT", "/drivers/1/documents/insurance", `{"number":"I1"}`, http.StatusBadRequest, `{"message":"Expiry date can not be empty"}`},
+		{"PUT", "/drivers/1/documents/insurance", `{"number":"INVALID","expires_at":"2030-01-31"}`, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+		{"PUT", "/drivers/1/documents/passport", `{"number":"P1","expires_at":"2030-01-31"}`, http.StatusNotFound, ``},
+		{"PUT", "/drivers/0/documents/license", `{"number":"L1","expires_at":"2030-01-31"}`, http.StatusNotFound, ``},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	for _, tc := range tt {
+		client := ts.Client()
+		url := ts.URL + tc.url
+		req, err := http.NewRequest(tc.method, url, bytes.NewBuffer([]byte(tc.input)))
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		req.Header.Add("content-type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode, tc.method+" "+tc.url)
+		assert.Equal(t, tc.RespData, string(body), tc.method+" "+tc.url)
+	}
+	ts.Close()
+}
+
 func TestUpdateDriverLocation(t *testing.T) {
 	tt := []struct {
 		url        string
@@ -142,9 +397,11 @@ func TestUpdateDriverLocation(t *testing.T) {
 		RespData   string
 	}{
 		{"/drivers/1/locations", `{"location":{"lat":30,"lng":100}}`, http.StatusOK, `{"id":1,"location":{"lat":30,"lng":100}}`},
+		{"/drivers/1/locations", `{"location":{"lat":25.5,"lng":95.5}}`, http.StatusOK, `{"id":1,"location":{"lat":30,"lng":100}}`},
 		{"/drivers/abc/locations", `{"location":{"lat":30,"lng":100}}`, http.StatusNotFound, ``},
 		{"/drivers/0/locations", `{"location":{"lat":30,"lng":100}}`, http.StatusNotFound, ``},
 		{"/drivers/-1/locations", `{"location":{"lat":30,"lng":100}}`, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+		{"/drivers/2/locations", `{"location":{"lat":30,"lng":100}}`, http.StatusServiceUnavailable, `{"message":"Driver location queue is full"}`},
 		{"/drivers/1/locations", `{"location":{"lat":"30a","lng":1aa00}}`, http.StatusBadRequest, `{"message":"Invalid format"}`},
 	}
 
@@ -176,6 +433,63 @@ func TestUpdateDriverLocation(t *testing.T) {
 	ts.Close()
 }
 
+func TestUpdateDriverLocationAssignRace(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	matcher := matching.New(dbPg, dbRedis, nil, nil, 0)
+	router, err := NewEngine(dbPg, memory.NewCassandra(), dbRedis, Options{
+		Config:   config.Config{ETA: config.ETA{DefaultSpeed: 30}},
+		Matcher:  matcher,
+		Assigner: matcher,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable, VehicleClasses: []string{mpg.VehicleClassEconomy}}
+	if err := dbPg.CreateDriver(&driver); err != nil {
+		t.Fatal(err)
+	}
+	ride := mpg.Ride{PassengerID: 1, Lat: 10, Lng: 106}
+	if err := dbPg.CreateRide(&ride); err != nil {
+		t.Fatal(err)
+	}
+
+	updateLocation := func() {
+		req := httptest.NewRequest("PUT", "/drivers/"+strconv.Itoa(driver.ID)+"/locations", bytes.NewBufferString(`{"lat":10,"lng":106}`))
+		req.Header.Add("content-type", "application/json")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	}
+	updateLocation()
+
+	// Updates which read the driver available may push it back while it is assigned
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			updateLocation()
+		}()
+	}
+	assigned, err := matcher.AssignDriver(&ride, nil)
+	wg.Wait()
+	assert.NoError(t, err)
+	assert.True(t, assigned)
+
+	// The push of an update which read the driver available before the assignment lands after it
+	if err := dbRedis.PushDriverLocationGeo(driver.ID, 10, 106, driver.VehicleClasses); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next update of the busy driver removes it from the geo set
+	updateLocation()
+	drivers, err := dbRedis.GetNearestDrivers(10, 106, 5, 10, mpg.VehicleClassEconomy)
+	assert.NoError(t, err)
+	assert.Len(t, drivers, 0)
+}
+
 func TestRequestDrivers(t *testing.T) {
 	tt := []struct {
 		url        string
@@ -186,6 +500,11 @@ func TestRequestDrivers(t *testing.T) {
 		{"/requests", `{"passenger_id":1, "location":{"lat":30,"lng":100}}`, http.StatusOK, `[]`},
 		{"/requests", `{"passenger_id":-1, "location":{"lat":30,"lng":100}}`, http.StatusBadRequest, `{"message":"Not found passenger"}`},
 		{"/requests", `{"passenger_id":"1", "location":{"lat":30,"lng":100}}`, http.StatusBadRequest, `{"message":"Invalid format"}`},
+		{"/requests", `{"passenger_id":1, "location":{"lat":30,"lng":100}, "vehicle_class":"premium"}`, http.StatusOK, `[{"id":3,"location":{"lat":30,"lng":100},"distance":1.235,"eta":149}]`},
+		{"/requests", `{"passenger_id":1, "location":{"lat":30,"lng":100}, "vehicle_class":"xl"}`, http.StatusOK, `[]`},
+		{"/requests", `{"passenger_id":1, "location":{"lat":30,"lng":100}, "vehicle_class":"boat"}`, http.StatusBadRequest, `{"message":"Invalid vehicle class"}`},
+		{"/requests", `{"passenger_id":1, "location":{"lat":31.5,"lng":101.5}}`, http.StatusBadRequest, `{"message":"Pickup is in a restricted zone"}`},
+		{"/requests", `{"passenger_id":1, "location":{"lat":10,"lng":100}}`, http.StatusBadRequest, `{"message":"Pickup is outside service areas"}`},
 	}
 
 	router := newMockEngine(t)
@@ -209,20 +528,30 @@ func TestRequestDrivers(t *testing.T) {
 	ts.Close()
 }
 
-func TestUpdateDriverState(t *testing.T) {
+func TestScheduledRides(t *testing.T) {
+	pickupAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
 	tt := []struct {
+		method     string
 		url        string
 		input      string
 		StatusCode int
 		RespData   string
 	}{
-		{"/drivers/1", `{"state":"available"}`, http.StatusOK, `{}`},
-		{"/drivers/1", `{"state":"busy"}`, http.StatusOK, `{}`},
-		{"/drivers/1", `{"state":1}`, http.StatusBadRequest, `{"message":"Invalid format"}`},
-		{"/drivers/1", `{"state":""}`, http.StatusBadRequest, `{"message":"Invalid state"}`},
-		{"/drivers/1", `{"state":"abcd"}`, http.StatusBadRequest, `{"message":"Invalid state"}`},
-		{"/drivers/0", `{"state":"busy"}`, http.StatusNotFound, ``},
-		{"/drivers/-1", `{"state":"busy"}`, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+		{"POST", "/scheduled-rides", `{"passenger_id":1, "location":{"lat":30,"lng":100}, "vehicle_class":"xl", "pickup_at":"` + pickupAt + `"}`, http.StatusOK, `{"id":1,"passenger_id":1,"location":{"lat":30,"lng":100},"vehicle_class":"xl","pickup_at":"` + pickupAt + `","status":"pending","ride_id":0,"driver_ids":[]}`},
+		{"POST", "/scheduled-rides", `{"passenger_id":1, "location":{"lat":30,"lng":100}, "pickup_at":"` + past + `"}`, http.StatusBadRequest, `{"message":"Pickup time must be in the future"}`},
+		{"POST", "/scheduled-rides", `{"passenger_id":1, "location":{"lat":30,"lng":100}}`, http.StatusBadRequest, `{"message":"Pickup time must be in the future"}`},
+		{"POST", "/scheduled-rides", `{"passenger_id":1, "location":{"lat":30,"lng":100}, "pickup_at":"tomorrow"}`, http.StatusBadRequest, `{"message":"Invalid format"}`},
+		{"POST", "/scheduled-rides", `{"passenger_id":1, "location":{"lat":91,"lng":100}, "pickup_at":"` + pickupAt + `"}`, http.StatusBadRequest, `{"message":"Invalid latitude"}`},
+		{"POST", "/scheduled-rides", `{"passenger_id":1, "location":{"lat":10,"lng":100}, "pickup_at":"` + pickupAt + `"}`, http.StatusBadRequest, `{"message":"Pickup is outside service areas"}`},
+		{"GET", "/scheduled-rides/2", ``, http.StatusOK, `{"id":2,"passenger_id":1,"location":{"lat":30,"lng":100},"vehicle_class":"","pickup_at":"2030-01-31T08:00:00Z","status":"dispatched","ride_id":2,"driver_ids":[3]}`},
+		{"GET", "/scheduled-rides/0", ``, http.StatusNotFound, ``},
+		{"GET", "/scheduled-rides/abc", ``, http.StatusNotFound, ``},
+		{"GET", "/scheduled-rides/-1", ``, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+		{"DELETE", "/scheduled-rides/1", ``, http.StatusOK, `{"id":1,"passenger_id":1,"location":{"lat":30,"lng":100},"vehicle_class":"","pickup_at":"2030-01-31T08:00:00Z","status":"cancelled","ride_id":0,"driver_ids":[]}`},
+		{"DELETE", "/scheduled-rides/3", ``, http.StatusOK, `{"id":3,"passenger_id":1,"location":{"lat":30,"lng":100},"vehicle_class":"","pickup_at":"2030-01-31T08:00:00Z","status":"cancelled","ride_id":1,"driver_ids":[]}`},
+		{"DELETE", "/scheduled-rides/2", ``, http.StatusConflict, `{"message":"Ride can not be cancelled"}`},
+		{"DELETE", "/scheduled-rides/0", ``, http.StatusNotFound, ``},
 	}
 
 	router := newMockEngine(t)
@@ -230,7 +559,7 @@ func TestUpdateDriverState(t *testing.T) {
 	for _, tc := range tt {
 		client := ts.Client()
 		url := ts.URL + tc.url
-		req, err := http.NewRequest("PATCH", url, bytes.NewBuffer([]byte(tc.input)))
+		req, err := http.NewRequest(tc.method, url, bytes.NewBuffer([]byte(tc.input)))
 		if err != nil {
 			t.Log(url, err)
 			return
@@ -247,69 +576,970 @@ func TestUpdateDriverState(t *testing.T) {
 			t.Errorf("read data from resp body fail")
 		}
 
-		assert.Equal(t, tc.StatusCode, resp.StatusCode)
-		assert.Equal(t, tc.RespData, string(body))
+		assert.Equal(t, tc.StatusCode, resp.StatusCode, tc.method+" "+tc.url)
+		assert.Equal(t, tc.RespData, string(body), tc.method+" "+tc.url)
 	}
 	ts.Close()
 }
 
-// ===============================
-// MOCK DATABASE
-// ===============================
-
-// CreateDriver Insert driver to database
-func (mockDbPg) CreateDriver(driver *mpg.Driver) error {
-	switch driver.Name {
-	case "INVALID":
-		return errors.New("Mock error database")
-	default:
-		driver.ID = 1
+func TestRides(t *testing.T) {
+	ride := func(id, driverID int, vehicleClass, status string) string {
+		return rideWithStops(id, driverID, vehicleClass, status, `[]`)
+	}
+	stops := `[{"position":1,"dropoff":false,"location":{"lat":30.1,"lng":100.1},"address":"School","place_id":""},` +
+		`{"position":2,"dropoff":true,"location":{"lat":30.2,"lng":100.2},"address":"Airport","place_id":"place-2"}]`
+	tt := []struct {
+		method     string
+		url        string
+		input      string
+		StatusCode int
+		RespData   string
+	}{
+		{"POST", "/rides", `{"passenger_id":1, "location":{"lat":30,"lng":100}, "vehicle_class":"premium"}`, http.StatusOK, ride(1, 3, "premium", "assigned")},
+		{"POST", "/rides", `{"passenger_id":1, "location":{"lat":30,"lng":100}}`, http.StatusOK, ride(1, 0, "", "requested")},
+		{"POST", "/rides", `{"passenger_id":0, "location":{"lat":30,"lng":100}}`, http.StatusBadRequest, `{"message":"Not found passenger"}`},
+		{"POST", "/rides", `{"passenger_id":1, "location":{"lat":30,"lng":100}, "stops":[{"location":{"lat":30.1,"lng":100.1},"address":"School"}],
+			"dropoff":{"location":{"lat":30.2,"lng":100.2},"address":"Airport","place_id":"place-2"}}`, http.StatusOK, rideWithStops(1, 0, "", "requested", stops)},
+		{"POST", "/rides", `{"passenger_id":1, "location":{"lat":30,"lng":100}, "stops":[{"location":{"lat":30.1,"lng":100.1}}]}`, http.StatusBadRequest, `{"message":"Stops require a dropoff"}`},
+		{"GET", "/rides/5", ``, http.StatusOK, rideWithStops(5, 3, "", "started", stops)},
+		{"GET", "/rides/2", ``, http.StatusOK, ride(2, 3, "", "assigned")},
+		{"GET", "/rides/0", ``, http.StatusNotFound, ``},
+		{"GET", "/rides/-1", ``, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+		{"POST", "/rides/2/arrived", ``, http.StatusOK, ride(2, 3, "", "arrived")},
+		{"POST", "/rides/1/arrived", ``, http.StatusConflict, `{"message":"Ride is not assigned"}`},
+		{"POST", "/rides/1/cancel", `{"cancelled_by":"passenger","reason":"Changed plans"}`, http.StatusOK, ride(1, 0, "", "cancelled")},
+		{"POST", "/rides/1/cancel", `{"cancelled_by":"driver","driver_id":3,"reason":"Flat tire"}`, http.StatusConflict, `{"message":"Ride can not be cancelled"}`},
+		{"POST", "/rides/2/cancel", `{"cancelled_by":"passenger","reason":"Changed plans"}`, http.StatusOK, ride(2, 3, "", "cancelled")},
+		// The driver is released and no other driver is found
+		{"POST", "/rides/2/cancel", `{"cancelled_by":"driver","driver_id":4,"reason":"Flat tire"}`, http.StatusForbidden, `{"message":"Ride is assigned to another driver"}`},
+		{"POST", "/rides/2/cancel", `{"cancelled_by":"driver","reason":"Flat tire"}`, http.StatusBadRequest, `{"message":"Not found driver"}`},
+		{"POST", "/rides/2/cancel", `{"cancelled_by":"driver","driver_id":3,"reason":"Flat tire"}`, http.StatusOK, ride(2, 0, "", "requested")},
+		// No-show
+		{"POST", "/rides/3/cancel", `{"cancelled_by":"driver","driver_id":3,"reason":"Passenger did not show up"}`, http.StatusOK, ride(3, 3, "", "cancelled")},
+		{"POST", "/rides/4/cancel", `{"cancelled_by":"passenger","reason":"Changed plans"}`, http.StatusConflict, `{"message":"Ride can not be cancelled"}`},
+		{"POST", "/rides/5/cancel", `{"cancelled_by":"passenger","reason":"Changed plans"}`, http.StatusConflict, `{"message":"Ride can not be cancelled"}`},
+		{"POST", "/rides/2/cancel", `{"cancelled_by":"nobody","reason":"Changed plans"}`, http.StatusBadRequest, `{"message":"Invalid cancelled by"}`},
+		{"POST", "/rides/0/cancel", `{"cancelled_by":"passenger","reason":"Changed plans"}`, http.StatusNotFound, ``},
+		// The driver is released and no other driver is found
+		{"POST", "/rides/2/decline", `{"driver_id":3}`, http.StatusOK, ride(2, 0, "", "requested")},
+		{"POST", "/rides/2/decline", `{"driver_id":4}`, http.StatusForbidden, `{"message":"Ride is assigned to another driver"}`},
+		{"POST", "/rides/2/decline", `{}`, http.StatusBadRequest, `{"message":"Not found driver"}`},
+		{"POST", "/rides/3/decline", `{"driver_id":3}`, http.StatusConflict, `{"message":"Ride is not assigned"}`},
+		{"POST", "/rides/1/decline", `{"driver_id":3}`, http.StatusConflict, `{"message":"Ride is not assigned"}`},
+		{"POST", "/rides/0/decline", `{"driver_id":3}`, http.StatusNotFound, ``},
 	}
-	return nil
 
-}
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	for _, tc := range tt {
+		client := ts.Client()
+		url := ts.URL + tc.url
+		req, err := http.NewRequest(tc.method, url, bytes.NewBuffer([]byte(tc.input)))
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		req.Header.Add("content-type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
 
-// CreatePassenger Insert passenger to database
-func (mockDbPg) CreatePassenger(passenger *mpg.Passenger) error {
-	switch passenger.Name {
-	case "INVALID":
-		return errors.New("Mock error database")
-	default:
-		passenger.ID = 1
+		assert.Equal(t, tc.StatusCode, resp.StatusCode, tc.method+" "+tc.url+" "+tc.input)
+		assert.Equal(t, tc.RespData, string(body), tc.method+" "+tc.url+" "+tc.input)
 	}
-	return nil
+	ts.Close()
 }
 
-// UpdateDriverState Update driver state in database
-func (mockDbPg) UpdateDriverState(driverID int, state string) error {
-	return nil
+// rideWithStops Response of a mock ride with stops and no cancellations
+func rideWithStops(id, driverID int, vehicleClass, status, stops string) string {
+	return `{"id":` + strconv.Itoa(id) + `,"passenger_id":1,"driver_id":` + strconv.Itoa(driverID) + `,"location":{"lat":30,"lng":100},"vehicle_class":"` + vehicleClass + `","status":"` + status + `","created_at":"2020-01-31T08:00:00Z","stops":` + stops + `,"cancellations":[]}`
 }
 
-func (mockDbPg) GetDriver(driverID int) (*mpg.Driver, error) {
-	switch driverID {
-	case 1:
-		return &mpg.Driver{
-			ID:   1,
-			Name: "Driver 1",
-		}, nil
-	case 0:
-		return nil, nil
-	case -1:
-		return nil, errors.New("Mock db error")
-	default:
-		return &mpg.Driver{
-			ID:   1,
-			Name: "Driver 1",
+func TestRideStops(t *testing.T) {
+	tt := []struct {
+		url        string
+		StatusCode int
+		// RespData Part of the response, times of the events are now
+		RespData string
+	}{
+		{"/rides/3/start", http.StatusOK, `"status":"started","created_at":"2020-01-31T08:00:00Z","started_at":"`},
+		{"/rides/1/start", http.StatusConflict, `{"message":"Driver is not at pickup"}`},
+		{"/rides/5/stops/1/arrived", http.StatusOK, `"address":"School","place_id":"","arrived_at":"`},
+		{"/rides/5/stops/2/arrived", http.StatusConflict, `{"message":"Previous stop is not departed"}`},
+		{"/rides/5/stops/3/arrived", http.StatusNotFound, ``},
+		{"/rides/5/stops/first/arrived", http.StatusNotFound, ``},
+		{"/rides/1/stops/1/arrived", http.StatusConflict, `{"message":"Ride is not started"}`},
+		{"/rides/0/stops/1/arrived", http.StatusNotFound, ``},
+		{"/rides/5/stops/1/departed", http.StatusConflict, `{"message":"Stop is not arrived"}`},
+		{"/rides/5/stops/2/departed", http.StatusConflict, `{"message":"Dropoff can not be departed"}`},
+		{"/rides/5/complete", http.StatusConflict, `{"message":"Previous stop is not departed"}`},
+		{"/rides/2/complete", http.StatusConflict, `{"message":"Ride is not started"}`},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	for _, tc := range tt {
+		resp, err := ts.Client().Post(ts.URL+tc.url, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode, tc.url)
+		assert.Contains(t, string(body), tc.RespData, tc.url)
+	}
+}
+
+func TestRidePayments(t *testing.T) {
+	tt := []struct {
+		method     string
+		url        string
+		key        string
+		input      string
+		StatusCode int
+		RespData   string
+	}{
+		{"GET", "/rides/7/payments", "", "", http.StatusOK,
+			`[{"id":1,"kind":"charge","ride_id":7,"amount":50000,"currency":"VND","provider_ref":"","memo":"","created_at":"2020-01-31T09:00:00Z"},` +
+				`{"id":2,"kind":"payment","ride_id":7,"amount":50000,"currency":"VND","provider_ref":"","memo":"cash","created_at":"2020-01-31T09:00:00Z"}]`},
+		{"GET", "/rides/1/payments", "", "", http.StatusOK, `[]`},
+		{"GET", "/rides/0/payments", "", "", http.StatusNotFound, ``},
+		{"POST", "/rides/7/charge", "", "", http.StatusOK, `"kind":"payment","ride_id":7`},
+		{"POST", "/rides/5/charge", "", "", http.StatusConflict, `{"message":"Ride is not chargeable"}`},
+		{"POST", "/rides/6/refunds", "r2", `{"amount":30000,"reason":"Driver took a detour"}`, http.StatusOK,
+			`{"id":4,"kind":"refund","ride_id":6,"amount":30000,"currency":"VND","provider_ref":"re_1","memo":"Driver took a detour","created_at":"2020-01-31T09:30:00Z"}`},
+		{"POST", "/rides/6/refunds", "r1", `{"amount":20000}`, http.StatusOK,
+			`{"id":3,"kind":"refund","ride_id":6,"amount":20000,"currency":"VND","provider_ref":"re_0","memo":"Wrong route","created_at":"2020-01-31T09:00:00Z"}`},
+		{"POST", "/rides/6/refunds", "r1", `{"amount":10000}`, http.StatusConflict, `{"message":"Idempotency key is already used"}`},
+		{"POST", "/rides/6/refunds", "r3", `{"amount":30001}`, http.StatusConflict, `{"message":"Refund exceeds the fare"}`},
+		{"POST", "/rides/7/refunds", "r1", `{"amount":10000}`, http.StatusConflict, `{"message":"Ride was paid in cash"}`},
+		{"POST", "/rides/5/refunds", "r1", `{"amount":10000}`, http.StatusConflict, `{"message":"Ride is not paid"}`},
+		{"POST", "/rides/6/refunds", "", `{"amount":10000}`, http.StatusBadRequest, `{"message":"Missing idempotency key"}`},
+		{"POST", "/rides/6/refunds", "r4", `{"amount":0}`, http.StatusBadRequest, `{"message":"Invalid amount"}`},
+		{"POST", "/rides/6/refunds", "r4", `{"amount":"10000"}`, http.StatusBadRequest, `{"message":"Invalid format"}`},
+		{"POST", "/rides/0/refunds", "r4", `{"amount":10000}`, http.StatusNotFound, ``},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	for _, tc := range tt {
+		req, err := http.NewRequest(tc.method, ts.URL+tc.url, bytes.NewBuffer([]byte(tc.input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.input != "" {
+			req.Header.Add("content-type", "application/json")
+		}
+		if tc.key != "" {
+			req.Header.Add("Idempotency-Key", tc.key)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode, tc.url)
+		assert.Contains(t, string(body), tc.RespData, tc.url)
+	}
+}
+
+func TestCancelRideFee(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	provider := payment.NewFake()
+	matcher := matching.New(dbPg, dbRedis, nil, nil, 0)
+	router, err := NewEngine(dbPg, memory.NewCassandra(), dbRedis, Options{
+		Config: config.Config{
+			Cancellation: config.Cancellation{FreeWindow: 2 * time.Minute, Fee: 10000},
+			ETA:          config.ETA{DefaultSpeed: 30},
+			Pricing:      config.Pricing{Currency: "VND"},
+		},
+		Provider: provider,
+		Matcher:  matcher,
+		Assigner: matcher,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passenger := mpg.Passenger{Name: "passenger", DefaultPaymentMethod: mpg.PaymentMethodCard}
+	if err := dbPg.CreatePassenger(&passenger); err != nil {
+		t.Fatal(err)
+	}
+	ride := mpg.Ride{PassengerID: passenger.ID, DriverID: 3, Lat: 10, Lng: 106, Status: mpg.RideAssigned, PaymentMethod: mpg.PaymentMethodCard,
+		CreatedAt: time.Now().Add(-5 * time.Minute)}
+	if err := dbPg.CreateRide(&ride); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fee is collected once however often the charge is retried
+	for _, url := range []string{"/rides/1/cancel", "/rides/1/charge"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", url, bytes.NewBufferString(`{"cancelled_by":"passenger","reason":"Changed plans"}`))
+		req.Header.Add("content-type", "application/json")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, url)
+		if url == "/rides/1/cancel" {
+			assert.Contains(t, w.Body.String(), `"status":"cancelled"`)
+			assert.Contains(t, w.Body.String(), `"payment":"paid"`)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/rides/1/payments", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `{"id":1,"kind":"charge","ride_id":1,"amount":10000,"currency":"VND","provider_ref":"","memo":"cancellation"`)
+	assert.Contains(t, w.Body.String(), `{"id":2,"kind":"payment","ride_id":1,"amount":10000,"currency":"VND","provider_ref":"ch_1","memo":"cancellation"`)
+	assert.Len(t, provider.Charges(), 1)
+	assert.Contains(t, provider.Charges(), "ride:1:cancellation:payment")
+}
+
+func TestPaymentsDisabled(t *testing.T) {
+	matcher := matching.New(mockDbPg{}, mockDbRedis{}, nil, nil, 0)
+	engine, err := NewEngine(mockDbPg{}, mockDbCass{}, mockDbRedis{}, Options{
+		Config:   config.Config{ETA: config.ETA{DefaultSpeed: 30}},
+		Matcher:  matcher,
+		Assigner: matcher,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{"/rides/6/charge", "/rides/6/refunds"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", url, nil)
+		req.Header.Add("Idempotency-Key", "r2")
+		engine.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusConflict, w.Code, url)
+		assert.Equal(t, `{"message":"Payments are disabled"}`, w.Body.String(), url)
+	}
+
+	// Tips are saved without a payment status
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/rides/6/tip", bytes.NewBufferString(`{"amount":5000}`))
+	req.Header.Add("content-type", "application/json")
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `"payment"`)
+}
+
+func TestTipRide(t *testing.T) {
+	tt := []struct {
+		url        string
+		input      string
+		StatusCode int
+		RespData   string
+	}{
+		{"/rides/6/tip", `{"amount":5000}`, http.StatusOK, `"fare":{"amount":50000,"commission":10000,"tip":5000,"currency":"VND"},"payment":"paid"`},
+		{"/rides/7/tip", `{"amount":5000}`, http.StatusConflict, `{"message":"Ride is already tipped"}`},
+		{"/rides/5/tip", `{"amount":5000}`, http.StatusConflict, `{"message":"Ride is not completed"}`},
+		{"/rides/6/tip", `{"amount":0}`, http.StatusBadRequest, `{"message":"Invalid amount"}`},
+		{"/rides/0/tip", `{"amount":5000}`, http.StatusNotFound, ``},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	for _, tc := range tt {
+		resp, err := ts.Client().Post(ts.URL+tc.url, "application/json", bytes.NewBuffer([]byte(tc.input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode, tc.url)
+		assert.Contains(t, string(body), tc.RespData, tc.url)
+	}
+}
+
+func TestDriverEarnings(t *testing.T) {
+	tt := []struct {
+		method     string
+		url        string
+		input      string
+		StatusCode int
+		RespData   string
+	}{
+		{"GET", "/drivers/1/earnings?from=2020-01-27&to=2020-01-31", ``, http.StatusOK,
+			`{"driver_id":1,"from":"2020-01-27","to":"2020-01-31",` +
+				`"totals":[{"start":"2020-01-27","currency":"VND","rides":2,"fares":80000,"commission":16000,"tips":5000,"adjustments":20000,"net":89000}],` +
+				`"days":[{"start":"2020-01-30","currency":"VND","rides":2,"fares":80000,"commission":16000,"tips":5000,"adjustments":0,"net":69000},` +
+				`{"start":"2020-01-31","currency":"VND","rides":0,"fares":0,"commission":0,"tips":0,"adjustments":20000,"net":20000}],` +
+				`"weeks":[{"start":"2020-01-27","currency":"VND","rides":2,"fares":80000,"commission":16000,"tips":5000,"adjustments":20000,"net":89000}],` +
+				`"lines":[{"kind":"ride","time":"2020-01-30T09:00:00Z","ride_id":6,"adjustment_id":0,"currency":"VND","fare":50000,"commission":10000,"tip":0,"adjustment":0,"net":40000,"memo":""},` +
+				`{"kind":"ride","time":"2020-01-30T10:00:00Z","ride_id":7,"adjustment_id":0,"currency":"VND","fare":30000,"commission":6000,"tip":5000,"adjustment":0,"net":29000,"memo":""},` +
+				`{"kind":"adjustment","time":"2020-01-31T09:00:00Z","ride_id":0,"adjustment_id":1,"currency":"VND","fare":0,"commission":0,"tip":0,"adjustment":20000,"net":20000,"memo":"Weekend bonus"}]}`},
+		{"GET", "/drivers/1/earnings?from=2020-01-01&to=2020-01-07", ``, http.StatusOK,
+			`{"driver_id":1,"from":"2020-01-01","to":"2020-01-07","totals":[],"days":[],"weeks":[],"lines":[]}`},
+		{"GET", "/drivers/1/earnings?from=2020-01-27&to=2020-01-26", ``, http.StatusBadRequest, `{"message":"Invalid range"}`},
+		{"GET", "/drivers/1/earnings?from=27-01-2020", ``, http.StatusBadRequest, `{"message":"Invalid from"}`},
+		{"GET", "/drivers/0/earnings", ``, http.StatusNotFound, ``},
+		{"GET", "/drivers/1/earnings/statement?from=2020-01-27&to=2020-01-31", ``, http.StatusOK,
+			"time,kind,ride_id,adjustment_id,currency,fare,commission,tip,adjustment,net,memo\n" +
+				"2020-01-30T09:00:00Z,ride,6,,VND,50000,10000,0,0,40000,\n" +
+				"2020-01-30T10:00:00Z,ride,7,,VND,30000,6000,5000,0,29000,\n" +
+				"2020-01-31T09:00:00Z,adjustment,,1,VND,0,0,0,20000,20000,Weekend bonus\n" +
+				"2020-01-27T00:00:00Z,total,,,VND,80000,16000,5000,20000,89000,2 rides\n"},
+		{"GET", "/drivers/1/earnings/statement?to=2020-13-01", ``, http.StatusBadRequest, `{"message":"Invalid to"}`},
+		{"POST", "/drivers/1/adjustments", `{"amount":20000,"reason":"Weekend bonus"}`, http.StatusOK,
+			`{"id":1,"driver_id":1,"ride_id":0,"amount":20000,"currency":"VND","reason":"Weekend bonus","created_at":"2020-01-31T09:00:00Z"}`},
+		{"POST", "/drivers/1/adjustments", `{"amount":-3000,"currency":"USD","reason":"Toll refunded"}`, http.StatusOK, `"amount":-3000,"currency":"USD"`},
+		{"POST", "/drivers/1/adjustments", `{"ride_id":6,"amount":-3000,"reason":"Toll refunded"}`, http.StatusBadRequest, `{"message":"Not found ride"}`},
+		{"POST", "/drivers/1/adjustments", `{"amount":20000}`, http.StatusBadRequest, `{"message":"Reason is required"}`},
+		{"POST", "/drivers/0/adjustments", `{"amount":20000,"reason":"Weekend bonus"}`, http.StatusNotFound, ``},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	for _, tc := range tt {
+		req, err := http.NewRequest(tc.method, ts.URL+tc.url, bytes.NewBuffer([]byte(tc.input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.input != "" {
+			req.Header.Add("content-type", "application/json")
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode, tc.url)
+		assert.Contains(t, string(body), tc.RespData, tc.url)
+		if resp.StatusCode == http.StatusOK && strings.Contains(tc.url, "/statement") {
+			assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+			assert.Equal(t, `attachment; filename="earnings-1-2020-01-27-2020-01-31.csv"`, resp.Header.Get("Content-Disposition"))
+		}
+	}
+}
+
+func TestRateRide(t *testing.T) {
+	tt := []struct {
+		method     string
+		url        string
+		input      string
+		StatusCode int
+		RespData   string
+	}{
+		{"POST", "/rides/6/rating", `{"rated_by":"passenger","rating":5,"tags":["friendly"],"comment":"Great ride"}`, http.StatusOK,
+			`{"id":1,"ride_id":6,"driver_id":3,"passenger_id":1,"rated_by":"passenger","rating":5,"tags":["friendly"],"comment":"Great ride","created_at":"2020-01-31T09:00:00Z"}`},
+		{"POST", "/rides/6/rating", `{"rated_by":"driver","rating":4}`, http.StatusOK,
+			`{"id":1,"ride_id":6,"driver_id":3,"passenger_id":1,"rated_by":"driver","rating":4,"tags":[],"comment":"","created_at":"2020-01-31T09:00:00Z"}`},
+		{"POST", "/rides/7/rating", `{"rated_by":"passenger","rating":5}`, http.StatusConflict, `{"message":"Ride is already rated"}`},
+		{"POST", "/rides/5/rating", `{"rated_by":"passenger","rating":5}`, http.StatusConflict, `{"message":"Ride is not completed"}`},
+		{"POST", "/rides/6/rating", `{"rated_by":"passenger","rating":6}`, http.StatusBadRequest, `{"message":"Invalid rating"}`},
+		{"POST", "/rides/6/rating", `{"rated_by":"passenger","rating":"5"}`, http.StatusBadRequest, `{"message":"Invalid format"}`},
+		{"POST", "/rides/0/rating", `{"rated_by":"passenger","rating":5}`, http.StatusNotFound, ``},
+		{"GET", "/admin/ratings", ``, http.StatusOK,
+			`[{"id":2,"ride_id":6,"driver_id":3,"passenger_id":1,"rated_by":"driver","rating":1,"tags":["late"],"comment":"","created_at":"2020-01-31T09:00:00Z"}]`},
+		{"GET", "/admin/ratings?rated_by=passenger&max_rating=3&days=30&limit=10", ``, http.StatusOK, `[]`},
+		{"GET", "/admin/ratings?max_rating=6", ``, http.StatusBadRequest, `{"message":"Invalid max rating"}`},
+		{"GET", "/admin/ratings?days=365", ``, http.StatusBadRequest, `{"message":"Invalid days"}`},
+		{"GET", "/admin/ratings?limit=abc", ``, http.StatusBadRequest, `{"message":"Invalid format"}`},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	for _, tc := range tt {
+		req, err := http.NewRequest(tc.method, ts.URL+tc.url, bytes.NewBuffer([]byte(tc.input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.input != "" {
+			req.Header.Add("content-type", "application/json")
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode, tc.method+" "+tc.url+" "+tc.input)
+		assert.Equal(t, tc.RespData, string(body), tc.method+" "+tc.url+" "+tc.input)
+	}
+}
+
+func TestUpdateDriverState(t *testing.T) {
+	tt := []struct {
+		url        string
+		input      string
+		StatusCode int
+		RespData   string
+	}{
+		{"/drivers/1", `{"state":"available"}`, http.StatusOK, `{}`},
+		{"/drivers/1", `{"state":"busy"}`, http.StatusOK, `{}`},
+		{"/drivers/2", `{"state":"available"}`, http.StatusConflict, `{"message":"No known location"}`},
+		{"/drivers/2", `{"state":"busy"}`, http.StatusOK, `{}`},
+		{"/drivers/1", `{"state":1}`, http.StatusBadRequest, `{"message":"Invalid format"}`},
+		{"/drivers/1", `{"state":""}`, http.StatusBadRequest, `{"message":"Invalid state"}`},
+		{"/drivers/1", `{"state":"abcd"}`, http.StatusBadRequest, `{"message":"Invalid state"}`},
+		{"/drivers/0", `{"state":"busy"}`, http.StatusNotFound, ``},
+		{"/drivers/-1", `{"state":"busy"}`, http.StatusInternalServerError, `{"message":"INTERNAL SERVER ERROR"}`},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	for _, tc := range tt {
+		client := ts.Client()
+		url := ts.URL + tc.url
+		req, err := http.NewRequest("PATCH", url, bytes.NewBuffer([]byte(tc.input)))
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		req.Header.Add("content-type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Log(url, err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode)
+		assert.Equal(t, tc.RespData, string(body))
+	}
+	ts.Close()
+}
+
+func TestGetZones(t *testing.T) {
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/admin/zones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Errorf("read data from resp body fail")
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"type":"FeatureCollection","features":[
+		{"type":"Feature","geometry":{"type":"MultiPolygon","coordinates":[[[[90,20],[110,20],[110,40],[90,40],[90,20]]]]},
+			"properties":{"id":1,"name":"region","kind":"service_area","queue":false,"pickup_fee":0,"fare_multiplier":1}},
+		{"type":"Feature","geometry":{"type":"MultiPolygon","coordinates":[[[[101,31],[102,31],[102,32],[101,32],[101,31]]]]},
+			"properties":{"id":2,"name":"base","kind":"restricted","queue":false,"pickup_fee":0,"fare_multiplier":1}},
+		{"type":"Feature","geometry":{"type":"MultiPolygon","coordinates":[[[[95,25],[96,25],[96,26],[95,26],[95,25]]]]},
+			"properties":{"id":3,"name":"airport","kind":"airport","queue":true,"pickup_fee":10000,"fare_multiplier":1.2}}
+	]}`, string(body))
+}
+
+func TestGetHeatmap(t *testing.T) {
+	tt := []struct {
+		url        string
+		StatusCode int
+		RespData   string
+	}{
+		{"/admin/heatmap?min_lat=0&min_lng=0&max_lat=0.05&max_lng=0.05&zoom=10", http.StatusOK, `{"type":"FeatureCollection","features":[]}`},
+		{"/admin/heatmap?min_lat=0&min_lng=0&max_lat=0.05&max_lng=0.05&zoom=10&requests=true", http.StatusOK, `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[0.0439453125,0],[0.0439453125,0.0439453125],[0,0.0439453125],[0,0]]]},"properties":{"geohash":"s0000","drivers":0,"requests":1}}]}`},
+		{"/admin/heatmap?min_lat=1&min_lng=0&max_lat=0&max_lng=0.05&zoom=10", http.StatusBadRequest, `{"message":"Invalid latitude"}`},
+		{"/admin/heatmap?min_lat=0&min_lng=0&max_lat=0.05&max_lng=181&zoom=10", http.StatusBadRequest, `{"message":"Invalid longitude"}`},
+		{"/admin/heatmap?min_lat=0&min_lng=0&max_lat=0.05&max_lng=0.05&zoom=21", http.StatusBadRequest, `{"message":"Invalid zoom"}`},
+		{"/admin/heatmap?min_lat=-80&min_lng=-170&max_lat=80&max_lng=170&zoom=16", http.StatusBadRequest, `{"message":"Bounding box is too large for the zoom"}`},
+		{"/admin/heatmap?min_lat=abc", http.StatusBadRequest, `{"message":"Invalid format"}`},
+	}
+
+	router := newMockEngine(t)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	for _, tc := range tt {
+		resp, err := ts.Client().Get(ts.URL + tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("read data from resp body fail")
+		}
+
+		assert.Equal(t, tc.StatusCode, resp.StatusCode, tc.url)
+		assert.Equal(t, tc.RespData, string(body), tc.url)
+	}
+}
+
+// ===============================
+// MOCK DATABASE
+// ===============================
+
+// CreateDriver Insert driver to database
+func (mockDbPg) CreateDriver(driver *mpg.Driver) error {
+	switch driver.Name {
+	case "INVALID":
+		return errors.New("Mock error database")
+	default:
+		driver.ID = 1
+	}
+	return nil
+
+}
+
+// CreatePassenger Insert passenger to database
+func (mockDbPg) CreatePassenger(passenger *mpg.Passenger) error {
+	switch passenger.Name {
+	case "INVALID":
+		return errors.New("Mock error database")
+	default:
+		passenger.ID = 1
+	}
+	return nil
+}
+
+// UpdateDriverState Update driver state in database
+func (mockDbPg) UpdateDriverState(driverID int, state string) error {
+	return nil
+}
+
+func (mockDbPg) GetDriver(driverID int) (*mpg.Driver, error) {
+	switch driverID {
+	case 1:
+		return &mpg.Driver{
+			ID:             1,
+			Name:           "Driver 1",
+			VehicleClasses: []string{mpg.VehicleClassEconomy},
+		}, nil
+	case 2:
+		// Driver 2 has no location
+		return &mpg.Driver{ID: 2, Name: "Driver 2"}, nil
+	case 0:
+		return nil, nil
+	case -1:
+		return nil, errors.New("Mock db error")
+	default:
+		return &mpg.Driver{
+			ID:             1,
+			Name:           "Driver 1",
+			VehicleClasses: []string{mpg.VehicleClassEconomy},
 		}, nil
 	}
 }
 
+// GetPassenger Get passenger by id
+func (mockDbPg) GetPassenger(passengerID int) (*mpg.Passenger, error) {
+	switch passengerID {
+	case 0:
+		return nil, nil
+	case -1:
+		return nil, errors.New("Mock db error")
+	default:
+		return &mpg.Passenger{
+			ID:                   passengerID,
+			Name:                 "Passenger 1",
+			DefaultPaymentMethod: mpg.PaymentMethodCash,
+			CreatedAt:            time.Date(2018, 3, 10, 0, 0, 0, 0, time.UTC),
+		}, nil
+	}
+}
+
+// UpdatePassenger Update passenger profile
+func (mockDbPg) UpdatePassenger(passenger *mpg.Passenger) error {
+	if passenger.Name == "INVALID" {
+		return errors.New("Mock error database")
+	}
+	return nil
+}
+
+// DeletePassenger Soft delete passenger
+func (mockDbPg) DeletePassenger(passengerID int) error {
+	return nil
+}
+
+// CreateVehicle Insert vehicle of a driver
+func (mockDbPg) CreateVehicle(vehicle *mpg.Vehicle) error {
+	if vehicle.Plate == "INVALID" {
+		return errors.New("Mock error database")
+	}
+	vehicle.ID = 1
+	return nil
+}
+
+// GetVehicle Get vehicle by id, vehicle 2 belongs to another driver
+func (mockDbPg) GetVehicle(vehicleID int) (*mpg.Vehicle, error) {
+	switch vehicleID {
+	case 0:
+		return nil, nil
+	case -1:
+		return nil, errors.New("Mock db error")
+	case 2:
+		return &mpg.Vehicle{ID: 2, DriverID: 2}, nil
+	default:
+		return &mpg.Vehicle{ID: vehicleID, DriverID: 1}, nil
+	}
+}
+
+// GetVehicles Get vehicles of a driver
+func (mockDbPg) GetVehicles(driverID int) ([]mpg.Vehicle, error) {
+	return []mpg.Vehicle{
+		{ID: 1, DriverID: driverID, Plate: "51A-12345", Make: "Toyota", Model: "Vios", Color: "white", Seats: 4, Class: mpg.VehicleClassEconomy},
+	}, nil
+}
+
+// DeleteVehicle Delete vehicle by id
+func (mockDbPg) DeleteVehicle(vehicleID int) error {
+	return nil
+}
+
+// SaveDriverDocument Insert or replace driver document
+func (mockDbPg) SaveDriverDocument(document *mpg.DriverDocument) error {
+	if document.Number == "INVALID" {
+		return errors.New("Mock error database")
+	}
+	document.ID = 1
+	return nil
+}
+
+// GetDriverDocuments Get documents of a driver
+func (mockDbPg) GetDriverDocuments(driverID int) ([]mpg.DriverDocument, error) {
+	return []mpg.DriverDocument{
+		{ID: 1, DriverID: driverID, Type: mpg.DocumentLicense, Number: "L1", ExpiresAt: time.Date(2030, 1, 31, 0, 0, 0, 0, time.UTC)},
+	}, nil
+}
+
+// GetDriversWithExpiredDocuments Driver 2 has an expired document
+func (mockDbPg) GetDriversWithExpiredDocuments(driverIDs []int, at time.Time) ([]int, error) {
+	expired := []int{}
+	for _, driverID := range driverIDs {
+		if driverID == 2 {
+			expired = append(expired, driverID)
+		}
+	}
+	return expired, nil
+}
+
+// GetDriversRatedBelow No driver is rated
+func (mockDbPg) GetDriversRatedBelow(driverIDs []int, rating float64) ([]int, error) {
+	return []int{}, nil
+}
+
+// CreateScheduledRide Insert scheduled ride
+func (mockDbPg) CreateScheduledRide(ride *mpg.ScheduledRide) error {
+	ride.ID = 1
+	return nil
+}
+
+// GetScheduledRide Ride 1 is pending, ride 2 is dispatched with ride 2, ride 3 is pending with requested ride 1
+func (mockDbPg) GetScheduledRide(rideID int) (*mpg.ScheduledRide, error) {
+	ride := mpg.ScheduledRide{
+		ID:          rideID,
+		PassengerID: 1,
+		Lat:         30,
+		Lng:         100,
+		PickupAt:    time.Date(2030, 1, 31, 8, 0, 0, 0, time.UTC),
+		Status:      mpg.ScheduledRidePending,
+	}
+	switch rideID {
+	case 0:
+		return nil, nil
+	case -1:
+		return nil, errors.New("Mock db error")
+	case 2:
+		ride.Status = mpg.ScheduledRideDispatched
+		ride.RideID = 2
+		ride.DriverIDs = []int{3}
+	case 3:
+		ride.RideID = 1
+	}
+	return &ride, nil
+}
+
+// GetDueScheduledRides Get pending rides to pick up until a time
+func (mockDbPg) GetDueScheduledRides(until time.Time) ([]mpg.ScheduledRide, error) {
+	return []mpg.ScheduledRide{}, nil
+}
+
+// UpdateScheduledRideStatus Only rides 1 and 3 are pending
+func (mockDbPg) UpdateScheduledRideStatus(ride *mpg.ScheduledRide, from string) (bool, error) {
+	return (ride.ID == 1 || ride.ID == 3) && from == mpg.ScheduledRidePending, nil
+}
+
+// LinkScheduledRide Only ride 1 is pending
+func (mockDbPg) LinkScheduledRide(scheduledRideID, rideID int) (bool, error) {
+	return scheduledRideID == 1, nil
+}
+
+// CreateRide Insert ride
+func (mockDbPg) CreateRide(ride *mpg.Ride) error {
+	ride.ID = 1
+	ride.CreatedAt = time.Date(2020, 1, 31, 8, 0, 0, 0, time.UTC)
+	return nil
+}
+
+// GetRide Ride 1 is requested, ride 2 is assigned to driver 3, the driver of ride 3 waits at pickup, ride 4 is cancelled,
+// ride 5 is started by driver 3, rides 6 and 7 are completed by driver 3 with a fare of 50000 VND
+func (mockDbPg) GetRide(rideID int) (*mpg.Ride, error) {
+	ride := mpg.Ride{
+		ID:          rideID,
+		PassengerID: 1,
+		Lat:         30,
+		Lng:         100,
+		Status:      mpg.RideRequested,
+		CreatedAt:   time.Date(2020, 1, 31, 8, 0, 0, 0, time.UTC),
+	}
+	switch rideID {
+	case 0:
+		return nil, nil
+	case -1:
+		return nil, errors.New("Mock db error")
+	case 2:
+		ride.Status = mpg.RideAssigned
+		ride.DriverID = 3
+	case 3:
+		ride.Status = mpg.RideArrived
+		ride.DriverID = 3
+		ride.ArrivedAt = time.Date(2020, 1, 31, 8, 10, 0, 0, time.UTC)
+	case 4:
+		ride.Status = mpg.RideCancelled
+	case 5:
+		ride.Status = mpg.RideStarted
+		ride.DriverID = 3
+	case 6, 7:
+		ride.Status = mpg.RideCompleted
+		ride.DriverID = 3
+		ride.Fare = 50000
+		ride.Commission = 10000
+		ride.Currency = "VND"
+		ride.PaymentMethod = mpg.PaymentMethodCard
+		if rideID == 7 {
+			ride.PaymentMethod = mpg.PaymentMethodCash
+		}
+	}
+	return &ride, nil
+}
+
+// UpdateRideStatus Update ride status
+func (mockDbPg) UpdateRideStatus(ride *mpg.Ride, from string) (bool, error) {
+	return true, nil
+}
+
+// CancelRide Update ride status and insert cancellation
+func (mockDbPg) CancelRide(ride *mpg.Ride, from string, cancellation *mpg.RideCancellation) (bool, error) {
+	return true, nil
+}
+
+// GetRideCancellations Get cancellations of a ride
+func (mockDbPg) GetRideCancellations(rideID int) ([]mpg.RideCancellation, error) {
+	return []mpg.RideCancellation{}, nil
+}
+
+// CreateRideWithStops Insert ride and its stops
+func (m mockDbPg) CreateRideWithStops(ride *mpg.Ride, stops []mpg.RideStop) error {
+	for i := range stops {
+		stops[i].ID = i + 1
+		stops[i].RideID = 1
+	}
+	return m.CreateRide(ride)
+}
+
+// GetRideStops Ride 5 has a stop and a dropoff, other rides have no stops
+func (mockDbPg) GetRideStops(rideID int) ([]mpg.RideStop, error) {
+	if rideID != 5 {
+		return []mpg.RideStop{}, nil
+	}
+	return []mpg.RideStop{
+		{ID: 1, RideID: 5, Position: 1, Lat: 30.1, Lng: 100.1, Address: "School"},
+		{ID: 2, RideID: 5, Position: 2, Dropoff: true, Lat: 30.2, Lng: 100.2, Address: "Airport", PlaceID: "place-2"},
+	}, nil
+}
+
+// UpdateRideStop Update ride status and stop times
+func (mockDbPg) UpdateRideStop(ride *mpg.Ride, from string, stop *mpg.RideStop) (bool, error) {
+	return true, nil
+}
+
+// CreateRideRating Ride 7 is already rated
+func (mockDbPg) CreateRideRating(rating *mpg.RideRating) (bool, error) {
+	if rating.RideID == 7 {
+		return false, nil
+	}
+	rating.ID = 1
+	rating.CreatedAt = time.Date(2020, 1, 31, 9, 0, 0, 0, time.UTC)
+	return true, nil
+}
+
+// GetLowRatings A rating of 1 by driver 3 to passenger 1
+func (mockDbPg) GetLowRatings(maxRating int, ratedBy string, since time.Time, limit int) ([]mpg.RideRating, error) {
+	if ratedBy == mpg.RatedByPassenger {
+		return []mpg.RideRating{}, nil
+	}
+	return []mpg.RideRating{{ID: 2, RideID: 6, DriverID: 3, PassengerID: 1, RatedBy: mpg.RatedByDriver, Rating: 1,
+		Tags: []string{"late"}, CreatedAt: time.Date(2020, 1, 31, 9, 0, 0, 0, time.UTC)}}, nil
+}
+
+// UpdateRideTip Ride 7 is already tipped
+func (mockDbPg) UpdateRideTip(ride *mpg.Ride) (bool, error) {
+	return ride.ID != 7, nil
+}
+
+// GetCompletedRides Driver 1 completed rides 6 and 7 on 30 January 2020, ride 7 with a tip
+func (mockDbPg) GetCompletedRides(driverID int, from, to time.Time) ([]mpg.Ride, error) {
+	completedAt := time.Date(2020, 1, 30, 9, 0, 0, 0, time.UTC)
+	if driverID != 1 || !completedAt.After(from) || !completedAt.Before(to) {
+		return []mpg.Ride{}, nil
+	}
+	return []mpg.Ride{
+		{ID: 6, PassengerID: 1, DriverID: 1, Status: mpg.RideCompleted, CompletedAt: completedAt, Fare: 50000, Commission: 10000, Currency: "VND"},
+		{ID: 7, PassengerID: 1, DriverID: 1, Status: mpg.RideCompleted, CompletedAt: completedAt.Add(time.Hour), Fare: 30000, Commission: 6000, Tip: 5000, Currency: "VND"},
+	}, nil
+}
+
+// CreateEarningAdjustment Insert adjustment
+func (mockDbPg) CreateEarningAdjustment(adjustment *mpg.EarningAdjustment) error {
+	adjustment.ID = 1
+	adjustment.CreatedAt = time.Date(2020, 1, 31, 9, 0, 0, 0, time.UTC)
+	return nil
+}
+
+// GetEarningAdjustments A bonus of driver 1 on 31 January 2020
+func (mockDbPg) GetEarningAdjustments(driverID int, from, to time.Time) ([]mpg.EarningAdjustment, error) {
+	createdAt := time.Date(2020, 1, 31, 9, 0, 0, 0, time.UTC)
+	if driverID != 1 || !createdAt.After(from) || !createdAt.Before(to) {
+		return []mpg.EarningAdjustment{}, nil
+	}
+	return []mpg.EarningAdjustment{{ID: 1, DriverID: 1, Amount: 20000, Currency: "VND", Reason: "Weekend bonus", CreatedAt: createdAt}}, nil
+}
+
+// GetOrCreateAccount Get account of an owner, ids follow the kinds
+func (mockDbPg) GetOrCreateAccount(kind string, ownerID int, currency string) (*mpg.Account, error) {
+	ids := map[string]int{mpg.AccountPassenger: 1, mpg.AccountDriver: 2, mpg.AccountCommission: 3, mpg.AccountCash: 4, mpg.AccountRefunds: 5}
+	return &mpg.Account{ID: ids[kind], Kind: kind, OwnerID: ownerID, Currency: currency}, nil
+}
+
+// CreateJournalEntry Insert journal entry
+func (mockDbPg) CreateJournalEntry(entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error) {
+	entry.ID = 4
+	entry.CreatedAt = time.Date(2020, 1, 31, 9, 30, 0, 0, time.UTC)
+	return true, nil
+}
+
+// CreateRefund Insert pending refund after the refunds of GetRideJournalEntries
+func (m mockDbPg) CreateRefund(refund *mpg.Refund, paymentKey string, reserve func(reserved int64) error) (bool, error) {
+	var reserved int64
+	entries, _ := m.GetRideJournalEntries(refund.RideID)
+	for _, entry := range entries {
+		if entry.Kind == mpg.EntryRefund {
+			reserved += entry.Amount
+		}
+	}
+
+	if err := reserve(reserved); err != nil {
+		return false, err
+	}
+	refund.ID = 2
+	refund.Status = mpg.RefundPending
+	return true, nil
+}
+
+// CompleteRefund Insert refund entry
+func (m mockDbPg) CompleteRefund(refund *mpg.Refund, entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error) {
+	refund.Status = mpg.RefundSucceeded
+	return m.CreateJournalEntry(entry, postings)
+}
+
+// FailRefund Save refund as failed
+func (mockDbPg) FailRefund(refundID int) error {
+	return nil
+}
+
+// GetJournalEntry Get an entry of the rides of GetRideJournalEntries
+func (m mockDbPg) GetJournalEntry(idempotencyKey string) (*mpg.JournalEntry, error) {
+	for _, rideID := range []int{6, 7} {
+		entries, _ := m.GetRideJournalEntries(rideID)
+		for _, entry := range entries {
+			if entry.IdempotencyKey == idempotencyKey {
+				return &entry, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// GetRideJournalEntries Ride 6 is charged, paid by the provider and refunded 20000, ride 7 is paid in cash
+func (mockDbPg) GetRideJournalEntries(rideID int) ([]mpg.JournalEntry, error) {
+	createdAt := time.Date(2020, 1, 31, 9, 0, 0, 0, time.UTC)
+	switch rideID {
+	case 6:
+		return []mpg.JournalEntry{
+			{ID: 1, IdempotencyKey: "ride:6:charge", Kind: mpg.EntryCharge, RideID: 6, Currency: "VND", Amount: 50000, CreatedAt: createdAt},
+			{ID: 2, IdempotencyKey: "ride:6:payment", Kind: mpg.EntryPayment, RideID: 6, Currency: "VND", Amount: 50000, ProviderRef: "ch_1", CreatedAt: createdAt},
+			{ID: 3, IdempotencyKey: "ride:6:refund:r1", Kind: mpg.EntryRefund, RideID: 6, Currency: "VND", Amount: 20000, ProviderRef: "re_0", Memo: "Wrong route", CreatedAt: createdAt},
+		}, nil
+	case 7:
+		return []mpg.JournalEntry{
+			{ID: 1, IdempotencyKey: "ride:7:charge", Kind: mpg.EntryCharge, RideID: 7, Currency: "VND", Amount: 50000, CreatedAt: createdAt},
+			{ID: 2, IdempotencyKey: "ride:7:payment", Kind: mpg.EntryPayment, RideID: 7, Currency: "VND", Amount: 50000, Memo: mpg.PaymentMethodCash, CreatedAt: createdAt},
+		}, nil
+	}
+	return []mpg.JournalEntry{}, nil
+}
+
+// GetRidesInBox Get a ride requested near (0.01, 0.01) if the box contains it
+func (mockDbPg) GetRidesInBox(minLat, minLng, maxLat, maxLng float64, since time.Time) ([]mpg.Ride, error) {
+	if minLat > 0.01 || maxLat < 0.01 || minLng > 0.01 || maxLng < 0.01 {
+		return []mpg.Ride{}, nil
+	}
+	return []mpg.Ride{{ID: 1, PassengerID: 1, Lat: 0.01, Lng: 0.01, Status: mpg.RideRequested, CreatedAt: since.Add(time.Minute)}}, nil
+}
+
+// CreateZone Insert zone
+func (mockDbPg) CreateZone(zone *mpg.Zone) error {
+	return nil
+}
+
+// GetZones Get a service area from lat 20 to 40 and lng 90 to 110 with a restricted zone and an airport in it
+func (mockDbPg) GetZones() ([]mpg.Zone, error) {
+	return []mpg.Zone{
+		{ID: 1, Name: "region", Kind: mpg.ZoneServiceArea, Geometry: `{"type":"Polygon","coordinates":[[[90,20],[110,20],[110,40],[90,40],[90,20]]]}`, FareMultiplier: 1},
+		{ID: 2, Name: "base", Kind: mpg.ZoneRestricted, Geometry: `{"type":"Polygon","coordinates":[[[101,31],[102,31],[102,32],[101,32],[101,31]]]}`, FareMultiplier: 1},
+		{ID: 3, Name: "airport", Kind: mpg.ZoneAirport, Geometry: `{"type":"Polygon","coordinates":[[[95,25],[96,25],[96,26],[95,26],[95,25]]]}`, Queue: true, PickupFee: 10000, FareMultiplier: 1.2},
+	}, nil
+}
+
 // =======
 // Mock database redis
 // =======
 
 // UpdateLocation Update driver's location in database
-func (mockDbRedis) PushDriverLocationGeo(driverID int, lat, lng float64) error {
+func (mockDbRedis) PushDriverLocationGeo(driverID int, lat, lng float64, classes []string) error {
 	return nil
 }
 
@@ -319,10 +1549,54 @@ func (mockDbRedis) RemoveDriverLocationGeo(driverID int) error {
 }
 
 // GetNearestDrivers Get near available driver near a geo location
-func (mockDbRedis) GetNearestDrivers(lat, lng, radius float64, limit int) ([]mredis.DriverLocation, error) {
+// Only driver 3 has a premium vehicle
+func (mockDbRedis) GetNearestDrivers(lat, lng, radius float64, limit int, class string) ([]mredis.DriverLocation, error) {
+	if class == mpg.VehicleClassPremium {
+		return []mredis.DriverLocation{{DriverID: 3, Lat: lat, Lng: lng, Distance: 1.2345}}, nil
+	}
 	return []mredis.DriverLocation{}, nil
 }
 
+// GetDriversInBox Get drivers in a bounding box
+func (mockDbRedis) GetDriversInBox(minLat, minLng, maxLat, maxLng float64) ([]mredis.DriverLocation, error) {
+	return []mredis.DriverLocation{}, nil
+}
+
+// GetDriversInPolygon Get drivers in a polygon
+func (mockDbRedis) GetDriversInPolygon(polygon geo.Polygon) ([]mredis.DriverLocation, error) {
+	return []mredis.DriverLocation{}, nil
+}
+
+// ClaimDriver Claim a driver for a ride
+func (mockDbRedis) ClaimDriver(driverID, rideID int, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+// ReleaseDriver Release the claim of a ride on a driver
+func (mockDbRedis) ReleaseDriver(driverID, rideID int) (bool, error) {
+	return true, nil
+}
+
+// JoinZoneQueue Add driver to the queue of a zone
+func (mockDbRedis) JoinZoneQueue(zone string, driverID int) error {
+	return nil
+}
+
+// LeaveZoneQueue Remove driver from the queue of a zone
+func (mockDbRedis) LeaveZoneQueue(zone string, driverID int) error {
+	return nil
+}
+
+// GetZoneQueue Get drivers queued in a zone
+func (mockDbRedis) GetZoneQueue(zone string, limit int) ([]int, error) {
+	return []int{}, nil
+}
+
+// TakeToken Take a token from a rate limit bucket
+func (mockDbRedis) TakeToken(key string, rate float64, burst int) (bool, time.Duration, error) {
+	return true, 0, nil
+}
+
 // =======
 // Mock database cassandra
 // =======
@@ -331,6 +1605,9 @@ func (mockDbRedis) GetNearestDrivers(lat, lng, radius float64, limit int) ([]mre
 
 // UpdateLocation Update driver's location in database
 func (mockDbCass) CreateDriverLocation(location *mcass.DriverLocation) error {
+	if location.DriverID == 2 {
+		return writebehind.ErrQueueFull
+	}
 	location.DriverID = 1
 	location.Lat = 30
 	location.Lng = 100
@@ -0,0 +1,118 @@
+// Package heatmap counts available drivers and recent ride requests in the geohash cells of a bounding box
+// for the supply density map of the ops dashboard
+package heatmap
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mpg"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+const (
+	// MaxZoom Highest map zoom level
+	MaxZoom = 20
+
+	// MaxCells Maximum number of cells covering a bounding box, larger boxes need a lower zoom level
+	MaxCells = 10000
+
+	// RequestWindow How far back ride requests are counted
+	RequestWindow = 15 * time.Minute
+)
+
+// Cell Counts of a geohash cell
+type Cell struct {
+	Geohash  string
+	Box      geo.Box
+	Drivers  int
+	Requests int
+}
+
+// Precision Geohash precision of a map zoom level, each step of two zoom levels adds a character so cells keep
+// about the same size on screen, a few dozen pixels wide
+func Precision(zoom int) int {
+	precision := zoom / 2
+	if precision < 1 {
+		return 1
+	}
+	if precision > 9 {
+		return 9
+	}
+
+	return precision
+}
+
+// CellCount Upper bound of the number of cells of a precision covering a bounding box
+func CellCount(box geo.Box, precision int) int {
+	center := box.Center()
+	cell, _ := geo.GeohashBox(geo.Geohash(center.Lat, center.Lng, precision))
+	rows := math.Ceil((box.MaxLat-box.MinLat)/(cell.MaxLat-cell.MinLat)) + 1
+	columns := math.Ceil((box.MaxLng-box.MinLng)/(cell.MaxLng-cell.MinLng)) + 1
+	return int(math.Min(rows*columns, math.MaxInt32))
+}
+
+// Heatmap Read drivers and ride requests of a bounding box
+type Heatmap struct {
+	dbPg    database.PgI
+	dbRedis database.RedisI
+}
+
+// New Create a heatmap reading available drivers from dbRedis and ride requests from dbPg
+func New(dbPg database.PgI, dbRedis database.RedisI) *Heatmap {
+	return &Heatmap{
+		dbPg:    dbPg,
+		dbRedis: dbRedis,
+	}
+}
+
+// Cells Count available drivers, and ride requests of the last RequestWindow if requests is set, in the cells of
+// a bounding box at a zoom level. Drivers are searched through the geo index, so the cost depends on the drivers
+// in the box and not on every driver
+func (h *Heatmap) Cells(box geo.Box, zoom int, requests bool, now time.Time) ([]Cell, error) {
+	drivers, err := h.dbRedis.GetDriversInBox(box.MinLat, box.MinLng, box.MaxLat, box.MaxLng)
+	if err != nil {
+		return nil, err
+	}
+
+	rides := []mpg.Ride{}
+	if requests {
+		if rides, err = h.dbPg.GetRidesInBox(box.MinLat, box.MinLng, box.MaxLat, box.MaxLng, now.Add(-RequestWindow)); err != nil {
+			return nil, err
+		}
+	}
+
+	return Aggregate(Precision(zoom), drivers, rides), nil
+}
+
+// Aggregate Count drivers and ride pickups in cells of a precision, cells without any are left out.
+// Cells are sorted by geohash
+func Aggregate(precision int, drivers []mredis.DriverLocation, rides []mpg.Ride) []Cell {
+	cells := map[string]*Cell{}
+	cell := func(lat, lng float64) *Cell {
+		hash := geo.Geohash(lat, lng, precision)
+		c, ok := cells[hash]
+		if !ok {
+			box, _ := geo.GeohashBox(hash)
+			c = &Cell{Geohash: hash, Box: box}
+			cells[hash] = c
+		}
+		return c
+	}
+	for _, driver := range drivers {
+		cell(driver.Lat, driver.Lng).Drivers++
+	}
+	for _, ride := range rides {
+		cell(ride.Lat, ride.Lng).Requests++
+	}
+
+	resp := make([]Cell, 0, len(cells))
+	for _, c := range cells {
+		resp = append(resp, *c)
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Geohash < resp[j].Geohash })
+	return resp
+}
@@ -0,0 +1,74 @@
+package heatmap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mpg"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+func TestPrecision(t *testing.T) {
+	for zoom, expected := range map[int]int{0: 1, 3: 1, 10: 5, 12: 6, 13: 6, 17: 8, 18: 9, 20: 9} {
+		assert.Equal(t, expected, Precision(zoom), "zoom %d", zoom)
+	}
+}
+
+func TestCellCount(t *testing.T) {
+	// Cells of precision 1 are 45 degrees wide and high
+	assert.Equal(t, 9, CellCount(geo.Box{MinLat: 0, MinLng: 0, MaxLat: 90, MaxLng: 90}, 1))
+	assert.Equal(t, 4, CellCount(geo.Box{MinLat: 10, MinLng: 10, MaxLat: 20, MaxLng: 20}, 1))
+	assert.True(t, CellCount(geo.Box{MinLat: -80, MinLng: -170, MaxLat: 80, MaxLng: 170}, 9) > MaxCells)
+}
+
+func TestAggregate(t *testing.T) {
+	drivers := []mredis.DriverLocation{
+		{DriverID: 1, Lat: 0.01, Lng: 0.01},
+		{DriverID: 2, Lat: 0.02, Lng: 0.02},
+		{DriverID: 3, Lat: 0.01, Lng: 0.06},
+	}
+	rides := []mpg.Ride{{ID: 1, Lat: 0.03, Lng: 0.03}, {ID: 2, Lat: -0.01, Lng: 0.01}}
+
+	cells := Aggregate(5, drivers, rides)
+	if assert.Len(t, cells, 3) {
+		assert.Equal(t, Cell{Geohash: "kpbpb", Box: cells[0].Box, Requests: 1}, cells[0])
+		assert.Equal(t, Cell{Geohash: "s0000", Box: cells[1].Box, Drivers: 2, Requests: 1}, cells[1])
+		assert.Equal(t, geo.Box{MinLat: 0, MinLng: 0, MaxLat: 0.0439453125, MaxLng: 0.0439453125}, cells[1].Box)
+		assert.Equal(t, 1, cells[2].Drivers)
+		assert.Equal(t, 0, cells[2].Requests)
+	}
+	assert.Equal(t, []Cell{}, Aggregate(5, nil, nil))
+}
+
+func TestCells(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	for id, lng := range map[int]float64{1: 0.01, 2: 0.02, 3: 0.2} {
+		if err := dbRedis.PushDriverLocationGeo(id, 0.01, lng, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ride := mpg.Ride{PassengerID: 1, Lat: 0.02, Lng: 0.02}
+	if err := dbPg.CreateRide(&ride); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(dbPg, dbRedis)
+	box := geo.Box{MinLat: 0, MinLng: 0, MaxLat: 0.04, MaxLng: 0.04}
+	cells, err := h.Cells(box, 10, false, time.Now())
+	assert.NoError(t, err)
+	// Driver 3 is outside the box
+	assert.Equal(t, []Cell{{Geohash: "s0000", Box: cells[0].Box, Drivers: 2}}, cells)
+
+	cells, err = h.Cells(box, 10, true, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []Cell{{Geohash: "s0000", Box: cells[0].Box, Drivers: 2, Requests: 1}}, cells)
+
+	// Requests older than RequestWindow are not counted
+	cells, err = h.Cells(box, 10, true, time.Now().Add(RequestWindow+time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cells[0].Requests)
+}
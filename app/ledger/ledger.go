@@ -0,0 +1,390 @@
+// Package ledger records the fares of rides in the double-entry ledger and collects them through the payment provider
+package ledger
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/trietphm/gruber/app/payment"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+var (
+	// ErrNotChargeable The ride has no fare or cancellation fee to charge, or its passenger is deleted
+	ErrNotChargeable = errors.New("Ride is not chargeable")
+	// ErrNotPaid The fare of the ride is not paid yet
+	ErrNotPaid = errors.New("Ride is not paid")
+	// ErrNotRefundable The fare was paid in cash to the driver
+	ErrNotRefundable = errors.New("Ride was paid in cash")
+	// ErrExceedsFare The refunds of the ride would exceed its fare
+	ErrExceedsFare = errors.New("Refund exceeds the fare")
+	// ErrKeyReused The idempotency key was used by a refund of another amount
+	ErrKeyReused = errors.New("Idempotency key is already used")
+	// ErrRefundFailed The provider rejected the refund of the idempotency key
+	ErrRefundFailed = errors.New("Refund failed")
+)
+
+// Ledger Records charges, payments and refunds of rides
+type Ledger struct {
+	dbPg     database.PgI
+	provider payment.Provider
+}
+
+// New Create ledger collecting fares through provider
+func New(dbPg database.PgI, provider payment.Provider) *Ledger {
+	return &Ledger{
+		dbPg:     dbPg,
+		provider: provider,
+	}
+}
+
+// ChargeKey Idempotency key of the charge entry of a ride
+func ChargeKey(rideID int) string {
+	return fmt.Sprintf("ride:%d:charge", rideID)
+}
+
+// PaymentKey Idempotency key of the payment entry of a ride, also used for the provider charge
+func PaymentKey(rideID int) string {
+	return fmt.Sprintf("ride:%d:payment", rideID)
+}
+
+// CancellationKey Idempotency key of the cancellation fee entry of a ride
+func CancellationKey(rideID int) string {
+	return fmt.Sprintf("ride:%d:cancellation", rideID)
+}
+
+// CancellationPaymentKey Idempotency key of the payment entry of the cancellation fee of a ride, also used for the
+// provider charge
+func CancellationPaymentKey(rideID int) string {
+	return fmt.Sprintf("ride:%d:cancellation:payment", rideID)
+}
+
+// TipKey Idempotency key of the charge entry of the tip of a ride
+func TipKey(rideID int) string {
+	return fmt.Sprintf("ride:%d:tip", rideID)
+}
+
+// TipPaymentKey Idempotency key of the payment entry of the tip of a ride, also used for the provider charge
+func TipPaymentKey(rideID int) string {
+	return fmt.Sprintf("ride:%d:tip:payment", rideID)
+}
+
+// RefundKey Idempotency key of a refund entry of a ride
+func RefundKey(rideID int, key string) string {
+	return fmt.Sprintf("ride:%d:refund:%s", rideID, key)
+}
+
+// ChargeRide Record the fare of a completed ride as owed by the passenger to the driver and the platform, then collect it,
+// and the same for its tip, owed to the driver only. Fares of the cash payment method of the ride are paid to the driver,
+// others are charged by the provider. It is safe to retry, entries are recorded once and a failed provider charge leaves
+// the ride charged but not paid. It returns the entries of the ride
+func (l *Ledger) ChargeRide(ride *mpg.Ride) ([]mpg.JournalEntry, error) {
+	if ride.Status != mpg.RideCompleted || ride.Fare <= 0 {
+		return nil, ErrNotChargeable
+	}
+
+	passenger, err := l.dbPg.GetPassenger(ride.PassengerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if passenger == nil {
+		return nil, ErrNotChargeable
+	}
+
+	passengerAccount, err := l.dbPg.GetOrCreateAccount(mpg.AccountPassenger, ride.PassengerID, ride.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	driverAccount, err := l.dbPg.GetOrCreateAccount(mpg.AccountDriver, ride.DriverID, ride.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	commissionAccount, err := l.dbPg.GetOrCreateAccount(mpg.AccountCommission, 0, ride.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	charge := mpg.JournalEntry{
+		IdempotencyKey: ChargeKey(ride.ID),
+		Kind:           mpg.EntryCharge,
+		RideID:         ride.ID,
+		Currency:       ride.Currency,
+		Amount:         ride.Fare,
+	}
+	postings := newPostings(map[int]int64{
+		passengerAccount.ID:  ride.Fare,
+		driverAccount.ID:     -(ride.Fare - ride.Commission),
+		commissionAccount.ID: -ride.Commission,
+	})
+	if _, err := l.dbPg.CreateJournalEntry(&charge, postings); err != nil {
+		return nil, err
+	}
+
+	if err := l.pay(ride, PaymentKey(ride.ID), ride.Fare, passengerAccount, driverAccount); err != nil {
+		return nil, err
+	}
+
+	if ride.Tip > 0 {
+		tip := mpg.JournalEntry{
+			IdempotencyKey: TipKey(ride.ID),
+			Kind:           mpg.EntryCharge,
+			RideID:         ride.ID,
+			Currency:       ride.Currency,
+			Amount:         ride.Tip,
+			Memo:           "tip",
+		}
+		if _, err := l.dbPg.CreateJournalEntry(&tip, newPostings(map[int]int64{
+			passengerAccount.ID: ride.Tip,
+			driverAccount.ID:    -ride.Tip,
+		})); err != nil {
+			return nil, err
+		}
+
+		if err := l.pay(ride, TipPaymentKey(ride.ID), ride.Tip, passengerAccount, driverAccount); err != nil {
+			return nil, err
+		}
+	}
+
+	return l.dbPg.GetRideJournalEntries(ride.ID)
+}
+
+// ChargeCancellation Record the fee of the cancellation of a ride in currency as owed by the passenger to the driver
+// who was assigned, then collect it. The fee of a cash ride stays owed by the passenger, others are charged by the
+// provider. It is safe to retry like ChargeRide and returns the entries of the ride
+func (l *Ledger) ChargeCancellation(ride *mpg.Ride, cancellation *mpg.RideCancellation, currency string) ([]mpg.JournalEntry, error) {
+	if ride.Status != mpg.RideCancelled || cancellation.Fee <= 0 || cancellation.DriverID == 0 {
+		return nil, ErrNotChargeable
+	}
+
+	passenger, err := l.dbPg.GetPassenger(ride.PassengerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if passenger == nil {
+		return nil, ErrNotChargeable
+	}
+
+	passengerAccount, err := l.dbPg.GetOrCreateAccount(mpg.AccountPassenger, ride.PassengerID, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	driverAccount, err := l.dbPg.GetOrCreateAccount(mpg.AccountDriver, cancellation.DriverID, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	charge := mpg.JournalEntry{
+		IdempotencyKey: CancellationKey(ride.ID),
+		Kind:           mpg.EntryCharge,
+		RideID:         ride.ID,
+		Currency:       currency,
+		Amount:         cancellation.Fee,
+		Memo:           "cancellation",
+	}
+	if _, err := l.dbPg.CreateJournalEntry(&charge, newPostings(map[int]int64{
+		passengerAccount.ID: cancellation.Fee,
+		driverAccount.ID:    -cancellation.Fee,
+	})); err != nil {
+		return nil, err
+	}
+
+	paid, err := l.dbPg.GetJournalEntry(CancellationPaymentKey(ride.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	if paid == nil && ride.PaymentMethod != mpg.PaymentMethodCash {
+		cashAccount, err := l.dbPg.GetOrCreateAccount(mpg.AccountCash, 0, currency)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := mpg.JournalEntry{
+			IdempotencyKey: CancellationPaymentKey(ride.ID),
+			Kind:           mpg.EntryPayment,
+			RideID:         ride.ID,
+			Currency:       currency,
+			Amount:         cancellation.Fee,
+			Memo:           "cancellation",
+		}
+		entry.ProviderRef, err = l.provider.Charge(entry.IdempotencyKey, ride.PassengerID, entry.Amount, currency)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := l.dbPg.CreateJournalEntry(&entry, newPostings(map[int]int64{
+			cashAccount.ID:      cancellation.Fee,
+			passengerAccount.ID: -cancellation.Fee,
+		})); err != nil {
+			return nil, err
+		}
+	}
+
+	return l.dbPg.GetRideJournalEntries(ride.ID)
+}
+
+// pay Record the payment of an amount owed by the passenger of a ride once per key
+func (l *Ledger) pay(ride *mpg.Ride, key string, amount int64, passengerAccount, driverAccount *mpg.Account) error {
+	paid, err := l.dbPg.GetJournalEntry(key)
+	if err != nil || paid != nil {
+		return err
+	}
+
+	entry := mpg.JournalEntry{
+		IdempotencyKey: key,
+		Kind:           mpg.EntryPayment,
+		RideID:         ride.ID,
+		Currency:       ride.Currency,
+		Amount:         amount,
+	}
+
+	// The driver collected the amount, it is taken from its earnings
+	if ride.PaymentMethod == mpg.PaymentMethodCash {
+		entry.Memo = mpg.PaymentMethodCash
+		_, err := l.dbPg.CreateJournalEntry(&entry, newPostings(map[int]int64{
+			driverAccount.ID:    amount,
+			passengerAccount.ID: -amount,
+		}))
+		return err
+	}
+
+	cashAccount, err := l.dbPg.GetOrCreateAccount(mpg.AccountCash, 0, ride.Currency)
+	if err != nil {
+		return err
+	}
+
+	ref, err := l.provider.Charge(key, ride.PassengerID, amount, ride.Currency)
+	if err != nil {
+		return err
+	}
+
+	entry.ProviderRef = ref
+	_, err = l.dbPg.CreateJournalEntry(&entry, newPostings(map[int]int64{
+		cashAccount.ID:      amount,
+		passengerAccount.ID: -amount,
+	}))
+	return err
+}
+
+// Refund Refund part of the fare of a ride paid through the provider, key identifies the refund for retries and memo
+// is its reason. The refund is reserved against the fare as pending before the provider is called and recorded once the
+// provider confirms it, a refund left pending by an unknown provider outcome is completed by a retry of the same key.
+// A retried refund returns the recorded entry
+func (l *Ledger) Refund(ride *mpg.Ride, amount int64, key, memo string) (*mpg.JournalEntry, error) {
+	entryKey := RefundKey(ride.ID, key)
+	refunded, err := l.dbPg.GetJournalEntry(entryKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if refunded != nil {
+		if refunded.Amount != amount {
+			return nil, ErrKeyReused
+		}
+		return refunded, nil
+	}
+
+	paid, err := l.dbPg.GetJournalEntry(PaymentKey(ride.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	if paid == nil {
+		return nil, ErrNotPaid
+	}
+
+	if paid.ProviderRef == "" {
+		return nil, ErrNotRefundable
+	}
+
+	// Refunds of the ride are serialized so concurrent ones can not exceed the fare together
+	refund := mpg.Refund{
+		IdempotencyKey: entryKey,
+		RideID:         ride.ID,
+		Currency:       paid.Currency,
+		Amount:         amount,
+		Memo:           memo,
+	}
+	created, err := l.dbPg.CreateRefund(&refund, PaymentKey(ride.ID), func(reserved int64) error {
+		if reserved+amount > paid.Amount {
+			return ErrExceedsFare
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !created {
+		if refund.Amount != amount {
+			return nil, ErrKeyReused
+		}
+		if refund.Status == mpg.RefundFailed {
+			return nil, ErrRefundFailed
+		}
+	}
+
+	// The provider is called outside of the lock, it refunds once per key
+	ref, err := l.provider.Refund(entryKey, paid.ProviderRef, amount)
+	if err == payment.ErrRefundExceedsCharge || err == payment.ErrChargeNotFound {
+		if err := l.dbPg.FailRefund(refund.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefundFailed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	refundsAccount, err := l.dbPg.GetOrCreateAccount(mpg.AccountRefunds, 0, refund.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	cashAccount, err := l.dbPg.GetOrCreateAccount(mpg.AccountCash, 0, refund.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	refund.ProviderRef = ref
+	entry := mpg.JournalEntry{
+		IdempotencyKey: entryKey,
+		Kind:           mpg.EntryRefund,
+		RideID:         ride.ID,
+		Currency:       refund.Currency,
+		Amount:         refund.Amount,
+		ProviderRef:    ref,
+		Memo:           refund.Memo,
+	}
+	created, err = l.dbPg.CompleteRefund(&refund, &entry, newPostings(map[int]int64{
+		refundsAccount.ID: refund.Amount,
+		cashAccount.ID:    -refund.Amount,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	// A concurrent retry recorded the refund first
+	if !created {
+		return l.dbPg.GetJournalEntry(entryKey)
+	}
+
+	return &entry, nil
+}
+
+// newPostings Postings of amounts by account, zero amounts are skipped
+func newPostings(amounts map[int]int64) []mpg.Posting {
+	postings := []mpg.Posting{}
+	for accountID, amount := range amounts {
+		if amount != 0 {
+			postings = append(postings, mpg.Posting{AccountID: accountID, Amount: amount})
+		}
+	}
+	return postings
+}
@@ -0,0 +1,399 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/app/payment"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+func newRide(t *testing.T, dbPg *memory.Pg, paymentMethod string) *mpg.Ride {
+	passenger := mpg.Passenger{Name: "Passenger", DefaultPaymentMethod: paymentMethod}
+	if err := dbPg.CreatePassenger(&passenger); err != nil {
+		t.Fatal(err)
+	}
+
+	ride := mpg.Ride{
+		PassengerID:   passenger.ID,
+		DriverID:      7,
+		Status:        mpg.RideCompleted,
+		Fare:          50000,
+		Commission:    10000,
+		Currency:      "VND",
+		PaymentMethod: paymentMethod,
+	}
+	if err := dbPg.CreateRide(&ride); err != nil {
+		t.Fatal(err)
+	}
+	return &ride
+}
+
+func balance(t *testing.T, dbPg *memory.Pg, kind string, ownerID int) int64 {
+	account, err := dbPg.GetOrCreateAccount(kind, ownerID, "VND")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account.Balance
+}
+
+func TestChargeRide(t *testing.T) {
+	dbPg := memory.NewPg()
+	provider := payment.NewFake()
+	ledger := New(dbPg, provider)
+
+	ride := newRide(t, dbPg, mpg.PaymentMethodCard)
+	entries, err := ledger.ChargeRide(ride)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	assert.Equal(t, mpg.EntryCharge, entries[0].Kind)
+	assert.Equal(t, int64(50000), entries[0].Amount)
+	assert.Equal(t, mpg.EntryPayment, entries[1].Kind)
+	assert.Equal(t, "ch_1", entries[1].ProviderRef)
+
+	// Retries record and charge once
+	entries, err = ledger.ChargeRide(ride)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 2)
+	assert.Len(t, provider.Charges(), 1)
+
+	assert.Equal(t, int64(0), balance(t, dbPg, mpg.AccountPassenger, ride.PassengerID))
+	assert.Equal(t, int64(-40000), balance(t, dbPg, mpg.AccountDriver, 7))
+	assert.Equal(t, int64(-10000), balance(t, dbPg, mpg.AccountCommission, 0))
+	assert.Equal(t, int64(50000), balance(t, dbPg, mpg.AccountCash, 0))
+
+	// The tip is owed to the driver only
+	ride.Tip = 5000
+	entries, err = ledger.ChargeRide(ride)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %v", entries)
+	}
+	assert.Equal(t, "ride:1:tip", entries[2].IdempotencyKey)
+	assert.Equal(t, int64(5000), entries[2].Amount)
+	assert.Equal(t, "ride:1:tip:payment", entries[3].IdempotencyKey)
+	assert.Equal(t, "ch_2", entries[3].ProviderRef)
+	assert.Len(t, provider.Charges(), 2)
+
+	assert.Equal(t, int64(0), balance(t, dbPg, mpg.AccountPassenger, ride.PassengerID))
+	assert.Equal(t, int64(-45000), balance(t, dbPg, mpg.AccountDriver, 7))
+	assert.Equal(t, int64(55000), balance(t, dbPg, mpg.AccountCash, 0))
+	ride.Tip = 0
+
+	cashRide := newRide(t, dbPg, mpg.PaymentMethodCash)
+	entries, err = ledger.ChargeRide(cashRide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	assert.Equal(t, mpg.PaymentMethodCash, entries[1].Memo)
+	assert.Empty(t, entries[1].ProviderRef)
+	assert.Len(t, provider.Charges(), 2)
+
+	// The driver keeps the fare it collected, the commission is owed to the platform
+	assert.Equal(t, int64(0), balance(t, dbPg, mpg.AccountPassenger, cashRide.PassengerID))
+	assert.Equal(t, int64(-35000), balance(t, dbPg, mpg.AccountDriver, 7))
+	assert.Equal(t, int64(-20000), balance(t, dbPg, mpg.AccountCommission, 0))
+}
+
+func TestChargeRideDeclined(t *testing.T) {
+	dbPg := memory.NewPg()
+	provider := payment.NewFake()
+	ledger := New(dbPg, provider)
+
+	ride := newRide(t, dbPg, mpg.PaymentMethodWallet)
+	provider.Decline(ride.PassengerID)
+	_, err := ledger.ChargeRide(ride)
+	assert.Equal(t, payment.ErrDeclined, err)
+
+	// The ride is charged but not paid
+	entries, err := dbPg.GetRideJournalEntries(ride.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entries, got %v", entries)
+	}
+	assert.Equal(t, mpg.EntryCharge, entries[0].Kind)
+	assert.Equal(t, int64(50000), balance(t, dbPg, mpg.AccountPassenger, ride.PassengerID))
+
+	_, err = ledger.Refund(ride, 1000, "a", "")
+	assert.Equal(t, ErrNotPaid, err)
+}
+
+func TestChargeRidePaymentMethod(t *testing.T) {
+	dbPg := memory.NewPg()
+	provider := payment.NewFake()
+	ledger := New(dbPg, provider)
+
+	// The fare is collected with the payment method of the request, not the current default of the passenger
+	ride := newRide(t, dbPg, mpg.PaymentMethodCash)
+	passenger, err := dbPg.GetPassenger(ride.PassengerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passenger.DefaultPaymentMethod = mpg.PaymentMethodCard
+	if err := dbPg.UpdatePassenger(passenger); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ledger.ChargeRide(ride)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, mpg.PaymentMethodCash, entries[1].Memo)
+	}
+	assert.Len(t, provider.Charges(), 0)
+}
+
+func TestChargeRideNotChargeable(t *testing.T) {
+	dbPg := memory.NewPg()
+	provider := payment.NewFake()
+	ledger := New(dbPg, provider)
+
+	deleted := newRide(t, dbPg, mpg.PaymentMethodCard)
+	if err := dbPg.DeletePassenger(deleted.PassengerID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ride mpg.Ride
+	}{
+		{name: "not completed", ride: mpg.Ride{ID: 2, Status: mpg.RideStarted, Fare: 100, Currency: "VND"}},
+		{name: "no fare", ride: mpg.Ride{ID: 2, Status: mpg.RideCompleted, Currency: "VND"}},
+		{name: "deleted passenger", ride: *deleted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ledger.ChargeRide(&test.ride)
+			assert.Equal(t, ErrNotChargeable, err)
+
+			entries, err := dbPg.GetRideJournalEntries(test.ride.ID)
+			assert.NoError(t, err)
+			assert.Len(t, entries, 0)
+		})
+	}
+	assert.Len(t, provider.Charges(), 0)
+}
+
+func TestChargeCancellation(t *testing.T) {
+	dbPg := memory.NewPg()
+	provider := payment.NewFake()
+	ledger := New(dbPg, provider)
+
+	cancelled := func(paymentMethod string) *mpg.Ride {
+		ride := newRide(t, dbPg, paymentMethod)
+		ride.Status = mpg.RideCancelled
+		ride.Fare, ride.Commission, ride.Currency = 0, 0, ""
+		return ride
+	}
+	cancellation := &mpg.RideCancellation{DriverID: 7, CancelledBy: mpg.CancelledByPassenger, Fee: 10000}
+
+	// The fee is charged by the provider and earned by the driver, retries charge it once
+	ride := cancelled(mpg.PaymentMethodCard)
+	for i := 0; i < 2; i++ {
+		entries, err := ledger.ChargeCancellation(ride, cancellation, "VND")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, "ride:1:cancellation", entries[0].IdempotencyKey)
+			assert.Equal(t, int64(10000), entries[0].Amount)
+			assert.Equal(t, "ride:1:cancellation:payment", entries[1].IdempotencyKey)
+			assert.Equal(t, "ch_1", entries[1].ProviderRef)
+		}
+	}
+	assert.Len(t, provider.Charges(), 1)
+	assert.Equal(t, int64(0), balance(t, dbPg, mpg.AccountPassenger, ride.PassengerID))
+	assert.Equal(t, int64(-10000), balance(t, dbPg, mpg.AccountDriver, 7))
+	assert.Equal(t, int64(10000), balance(t, dbPg, mpg.AccountCash, 0))
+
+	// The fee of a cash ride stays owed
+	cashRide := cancelled(mpg.PaymentMethodCash)
+	entries, err := ledger.ChargeCancellation(cashRide, cancellation, "VND")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 1)
+	assert.Len(t, provider.Charges(), 1)
+	assert.Equal(t, int64(10000), balance(t, dbPg, mpg.AccountPassenger, cashRide.PassengerID))
+
+	_, err = ledger.ChargeCancellation(cancelled(mpg.PaymentMethodCard), &mpg.RideCancellation{DriverID: 7}, "VND")
+	assert.Equal(t, ErrNotChargeable, err)
+	_, err = ledger.ChargeCancellation(newRide(t, dbPg, mpg.PaymentMethodCard), cancellation, "VND")
+	assert.Equal(t, ErrNotChargeable, err)
+}
+
+func TestRefund(t *testing.T) {
+	dbPg := memory.NewPg()
+	provider := payment.NewFake()
+	ledger := New(dbPg, provider)
+
+	ride := newRide(t, dbPg, mpg.PaymentMethodCard)
+	_, err := ledger.ChargeRide(ride)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := ledger.Refund(ride, 20000, "a", "Wrong route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, mpg.EntryRefund, entry.Kind)
+	assert.Equal(t, "ride:1:refund:a", entry.IdempotencyKey)
+	assert.Equal(t, "re_1", entry.ProviderRef)
+	assert.Equal(t, "Wrong route", entry.Memo)
+
+	replayed, err := ledger.Refund(ride, 20000, "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, entry.ID, replayed.ID)
+	assert.Len(t, provider.Refunds(), 1)
+
+	_, err = ledger.Refund(ride, 10000, "a", "")
+	assert.Equal(t, ErrKeyReused, err)
+
+	_, err = ledger.Refund(ride, 30001, "b", "")
+	assert.Equal(t, ErrExceedsFare, err)
+
+	_, err = ledger.Refund(ride, 30000, "b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(50000), balance(t, dbPg, mpg.AccountRefunds, 0))
+	assert.Equal(t, int64(0), balance(t, dbPg, mpg.AccountCash, 0))
+
+	cashRide := newRide(t, dbPg, mpg.PaymentMethodCash)
+	_, err = ledger.ChargeRide(cashRide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ledger.Refund(cashRide, 1000, "a", "")
+	assert.Equal(t, ErrNotRefundable, err)
+}
+
+func TestRefundConcurrent(t *testing.T) {
+	dbPg := memory.NewPg()
+	provider := payment.NewFake()
+	ledger := New(dbPg, provider)
+
+	ride := newRide(t, dbPg, mpg.PaymentMethodCard)
+	if _, err := ledger.ChargeRide(ride); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one of the refunds fits in the fare
+	errs := make(chan error)
+	for _, key := range []string{"a", "b", "c"} {
+		go func(key string) {
+			_, err := ledger.Refund(ride, 30000, key, "")
+			errs <- err
+		}(key)
+	}
+	var refunded, exceeded int
+	for i := 0; i < 3; i++ {
+		switch err := <-errs; err {
+		case nil:
+			refunded++
+		case ErrExceedsFare:
+			exceeded++
+		default:
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, 1, refunded)
+	assert.Equal(t, 2, exceeded)
+	assert.Len(t, provider.Refunds(), 1)
+	assert.Equal(t, int64(30000), balance(t, dbPg, mpg.AccountRefunds, 0))
+}
+
+// lostProvider Fake provider whose refunds fail with err, after refunding unless err is final
+type lostProvider struct {
+	*payment.Fake
+	err error
+}
+
+func (p *lostProvider) Refund(key string, chargeRef string, amount int64) (string, error) {
+	if p.err == payment.ErrChargeNotFound {
+		return "", p.err
+	}
+	ref, err := p.Fake.Refund(key, chargeRef, amount)
+	if err != nil {
+		return "", err
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+	return ref, nil
+}
+
+func TestRefundPending(t *testing.T) {
+	dbPg := memory.NewPg()
+	provider := &lostProvider{Fake: payment.NewFake(), err: errors.New("timeout")}
+	ledger := New(dbPg, provider)
+
+	ride := newRide(t, dbPg, mpg.PaymentMethodCard)
+	if _, err := ledger.ChargeRide(ride); err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider refunded but the response is lost, the refund stays pending and reserved
+	_, err := ledger.Refund(ride, 30000, "a", "Wrong route")
+	assert.EqualError(t, err, "timeout")
+	assert.Len(t, provider.Refunds(), 1)
+	assert.Equal(t, int64(0), balance(t, dbPg, mpg.AccountRefunds, 0))
+
+	_, err = ledger.Refund(ride, 30000, "b", "")
+	assert.Equal(t, ErrExceedsFare, err)
+
+	// The retry completes it without refunding twice
+	provider.err = nil
+	entry, err := ledger.Refund(ride, 30000, "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "re_1", entry.ProviderRef)
+	assert.Equal(t, "Wrong route", entry.Memo)
+	assert.Len(t, provider.Refunds(), 1)
+	assert.Equal(t, int64(30000), balance(t, dbPg, mpg.AccountRefunds, 0))
+}
+
+func TestRefundFailed(t *testing.T) {
+	dbPg := memory.NewPg()
+	provider := &lostProvider{Fake: payment.NewFake(), err: payment.ErrChargeNotFound}
+	ledger := New(dbPg, provider)
+
+	ride := newRide(t, dbPg, mpg.PaymentMethodCard)
+	if _, err := ledger.ChargeRide(ride); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ledger.Refund(ride, 30000, "a", "")
+	assert.Equal(t, ErrRefundFailed, err)
+
+	// The key stays failed and its amount is released
+	provider.err = nil
+	_, err = ledger.Refund(ride, 30000, "a", "")
+	assert.Equal(t, ErrRefundFailed, err)
+
+	_, err = ledger.Refund(ride, 50000, "b", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50000), balance(t, dbPg, mpg.AccountRefunds, 0))
+}
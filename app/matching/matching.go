@@ -0,0 +1,290 @@
+// Package matching finds drivers for a ride, it is shared by ride requests and scheduled rides
+package matching
+
+import (
+	"time"
+
+	"github.com/trietphm/gruber/app/geofence"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mpg"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+const (
+	// Radius Search radius in kilometer. TODO if not enough then increase radius
+	Radius float64 = 10
+
+	// Top Maximum number of drivers found for a ride
+	Top = 5
+
+	// ClaimTTL How long a driver assigned to a ride stays claimed by it, unless it is released before.
+	// It covers the time the driver takes to accept the ride and its state to become busy
+	ClaimTTL = time.Minute
+)
+
+// Matcher Find nearest eligible drivers
+type Matcher struct {
+	dbPg    database.PgI
+	dbRedis database.RedisI
+	ranker  Ranker
+	fences  *geofence.Fences
+	// minRating Drivers rated below are not eligible, zero disables it
+	minRating float64
+}
+
+// New Create a matcher reading drivers from dbRedis and their documents and ratings from dbPg.
+// Drivers rated below minRating are not eligible, drivers not rated yet are.
+// Eligible drivers are ordered by ranker, nearest first if ranker is nil, except in the queued airports of fences
+func New(dbPg database.PgI, dbRedis database.RedisI, ranker Ranker, fences *geofence.Fences, minRating float64) *Matcher {
+	return &Matcher{
+		dbPg:      dbPg,
+		dbRedis:   dbRedis,
+		ranker:    ranker,
+		fences:    fences,
+		minRating: minRating,
+	}
+}
+
+// QueueZone Get the airport whose drivers are dispatched in arrival order containing a location, nil if there is none
+func (m *Matcher) QueueZone(lat, lng float64) *geofence.Zone {
+	zone := m.fences.Airport(lat, lng)
+	if zone == nil || !zone.Queue {
+		return nil
+	}
+
+	return zone
+}
+
+// NearestDrivers Get the best available drivers near a location with a vehicle of class (any class if empty),
+// drivers with an expired document or a low rating are skipped. In a queued airport they are the drivers of its queue in arrival
+// order, or the nearest drivers if none of them is eligible
+func (m *Matcher) NearestDrivers(lat, lng float64, class string) ([]mredis.DriverLocation, error) {
+	if zone := m.QueueZone(lat, lng); zone != nil {
+		drivers, err := m.queuedDrivers(zone, lat, lng, class)
+		if err != nil || len(drivers) > 0 {
+			return drivers, err
+		}
+	}
+
+	// Get more drivers than needed since drivers with ineligible drivers are skipped and the rest are ranked
+	drivers, err := m.EligibleDrivers(lat, lng, class, 2*Top)
+	if err != nil {
+		return nil, err
+	}
+	if m.ranker != nil {
+		if drivers, err = m.ranker.Rank(lat, lng, drivers); err != nil {
+			return nil, err
+		}
+	}
+	if len(drivers) > Top {
+		drivers = drivers[:Top]
+	}
+
+	return drivers, nil
+}
+
+// EligibleDrivers Get at most limit available drivers near a location with a vehicle of class (any class if empty),
+// nearest first. Drivers with an expired document or rated below the minimum are skipped, the others are not ranked
+func (m *Matcher) EligibleDrivers(lat, lng float64, class string, limit int) ([]mredis.DriverLocation, error) {
+	drivers, err := m.dbRedis.GetNearestDrivers(lat, lng, Radius, limit, class)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.skipIneligibleDrivers(drivers)
+}
+
+// queuedDrivers Get the first eligible drivers of the queue of a zone, those are its available drivers found
+// near the location and drivers which left the zone without updating their location are skipped
+func (m *Matcher) queuedDrivers(zone *geofence.Zone, lat, lng float64, class string) ([]mredis.DriverLocation, error) {
+	queue, err := m.dbRedis.GetZoneQueue(zone.Name, 0)
+	if err != nil || len(queue) == 0 {
+		return nil, err
+	}
+
+	// Every queued driver is in the zone, within the distance to its farthest vertex
+	drivers, err := m.dbRedis.GetNearestDrivers(lat, lng, zoneRadius(zone, lat, lng), 0, class)
+	if err != nil {
+		return nil, err
+	}
+	available := make(map[int]mredis.DriverLocation, len(drivers))
+	for _, driver := range drivers {
+		if zone.Contains(driver.Lat, driver.Lng) {
+			available[driver.DriverID] = driver
+		}
+	}
+
+	queued := []mredis.DriverLocation{}
+	for _, driverID := range queue {
+		if driver, ok := available[driverID]; ok {
+			queued = append(queued, driver)
+		}
+	}
+	if queued, err = m.skipIneligibleDrivers(queued); err != nil {
+		return nil, err
+	}
+	if len(queued) > Top {
+		queued = queued[:Top]
+	}
+
+	return queued, nil
+}
+
+// zoneRadius Distance in kilometer from a location to the farthest vertex of a zone
+func zoneRadius(zone *geofence.Zone, lat, lng float64) float64 {
+	radius := 0.0
+	for _, polygon := range zone.Polygons {
+		for _, ring := range polygon {
+			for _, point := range ring {
+				if distance := geo.Distance(lat, lng, point.Lat, point.Lng); distance > radius {
+					radius = distance
+				}
+			}
+		}
+	}
+
+	return radius
+}
+
+// Assigner Assign a driver to a requested ride
+type Assigner interface {
+	// AssignDriver Assign an eligible driver, except excluded drivers, to a requested ride and mark the driver busy.
+	// It returns false and leaves the ride unchanged if no driver is found or the ride is no longer requested
+	AssignDriver(ride *mpg.Ride, excluded []int) (bool, error)
+}
+
+var _ Assigner = (*Matcher)(nil)
+
+// AssignDriver Assign the best eligible driver, except excluded drivers, to a requested ride and mark the driver busy.
+// Drivers claimed by other rides meanwhile are skipped. It returns false and leaves the ride unchanged if no driver
+// is found or the ride is no longer requested
+func (m *Matcher) AssignDriver(ride *mpg.Ride, excluded []int) (bool, error) {
+	drivers, err := m.NearestDrivers(ride.Lat, ride.Lng, ride.VehicleClass)
+	if err != nil {
+		return false, err
+	}
+
+	skip := make(map[int]bool, len(excluded))
+	for _, driverID := range excluded {
+		skip[driverID] = true
+	}
+	for _, driver := range drivers {
+		if skip[driver.DriverID] {
+			continue
+		}
+		claimed, err := m.dbRedis.ClaimDriver(driver.DriverID, ride.ID, ClaimTTL)
+		if err != nil {
+			return false, err
+		}
+		if claimed {
+			return m.assign(ride, driver.DriverID)
+		}
+	}
+
+	return false, nil
+}
+
+// Claim Claim a driver for a requested ride then assign it like AssignDriver. It returns false and leaves
+// the ride unchanged if the driver is claimed by another ride or the ride is no longer requested
+func (m *Matcher) Claim(ride *mpg.Ride, driverID int) (bool, error) {
+	claimed, err := m.dbRedis.ClaimDriver(driverID, ride.ID, ClaimTTL)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	return m.assign(ride, driverID)
+}
+
+// assign Assign a claimed driver to a requested ride and mark the driver busy. The claim is released
+// if the ride is no longer requested
+func (m *Matcher) assign(ride *mpg.Ride, driverID int) (bool, error) {
+	assigned := *ride
+	assigned.DriverID = driverID
+	assigned.Status = mpg.RideAssigned
+	assigned.AssignedAt = time.Now()
+	updated, err := m.dbPg.UpdateRideStatus(&assigned, mpg.RideRequested)
+	if err != nil || !updated {
+		if _, releaseErr := m.dbRedis.ReleaseDriver(driverID, ride.ID); err == nil {
+			err = releaseErr
+		}
+		return false, err
+	}
+	*ride = assigned
+
+	if err := m.dbPg.UpdateDriverState(driverID, mpg.StateBusy); err != nil {
+		return true, err
+	}
+
+	return true, LeaveQueues(m.dbRedis, m.fences, driverID)
+}
+
+// UpdateQueues Add an available driver to the queue of the queued airports of fences containing its location
+// and remove it from the others
+func UpdateQueues(dbRedis database.RedisI, fences *geofence.Fences, driverID int, lat, lng float64) error {
+	for _, zone := range fences.Zones() {
+		if zone.Kind != mpg.ZoneAirport || !zone.Queue {
+			continue
+		}
+		var err error
+		if zone.Contains(lat, lng) {
+			err = dbRedis.JoinZoneQueue(zone.Name, driverID)
+		} else {
+			err = dbRedis.LeaveZoneQueue(zone.Name, driverID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LeaveQueues Remove a driver from the queue of every queued airport of fences
+func LeaveQueues(dbRedis database.RedisI, fences *geofence.Fences, driverID int) error {
+	for _, zone := range fences.Zones() {
+		if zone.Kind == mpg.ZoneAirport && zone.Queue {
+			if err := dbRedis.LeaveZoneQueue(zone.Name, driverID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// skipIneligibleDrivers Remove drivers who have an expired document or are rated below minRating, the order is kept
+func (m *Matcher) skipIneligibleDrivers(drivers []mredis.DriverLocation) ([]mredis.DriverLocation, error) {
+	driverIDs := make([]int, len(drivers))
+	for i, driver := range drivers {
+		driverIDs[i] = driver.DriverID
+	}
+
+	ineligibleIDs, err := m.dbPg.GetDriversWithExpiredDocuments(driverIDs, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if m.minRating > 0 {
+		lowRatedIDs, err := m.dbPg.GetDriversRatedBelow(driverIDs, m.minRating)
+		if err != nil {
+			return nil, err
+		}
+		ineligibleIDs = append(ineligibleIDs, lowRatedIDs...)
+	}
+	if len(ineligibleIDs) == 0 {
+		return drivers, nil
+	}
+
+	ineligible := make(map[int]bool, len(ineligibleIDs))
+	for _, driverID := range ineligibleIDs {
+		ineligible[driverID] = true
+	}
+	eligible := make([]mredis.DriverLocation, 0, len(drivers))
+	for _, driver := range drivers {
+		if !ineligible[driver.DriverID] {
+			eligible = append(eligible, driver)
+		}
+	}
+
+	return eligible, nil
+}
@@ -0,0 +1,292 @@
+package matching
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/app/geofence"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+func TestNearestDrivers(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+
+	// Drivers on the equator, 0.01 degree of longitude is about 1.11 km
+	for i := 1; i <= 8; i++ {
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := dbPg.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		classes := []string{mpg.VehicleClassEconomy}
+		if i%2 == 0 {
+			classes = append(classes, mpg.VehicleClassXL)
+		}
+		if err := dbRedis.PushDriverLocationGeo(driver.ID, 0, float64(i)/100, classes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired := mpg.DriverDocument{DriverID: 2, Type: mpg.DocumentLicense, Number: "L2", ExpiresAt: time.Now().AddDate(0, 0, -2)}
+	if err := dbPg.SaveDriverDocument(&expired); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(class string) []int {
+		drivers, err := New(dbPg, dbRedis, nil, nil, 0).NearestDrivers(0, 0, class)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int, len(drivers))
+		for i, driver := range drivers {
+			ids[i] = driver.DriverID
+		}
+		return ids
+	}
+	assert.Equal(t, []int{1, 3, 4, 5, 6}, ids(""))
+	assert.Equal(t, []int{4, 6, 8}, ids(mpg.VehicleClassXL))
+	assert.Equal(t, []int{}, ids(mpg.VehicleClassPremium))
+}
+
+func TestNearestDriversMinRating(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+
+	// Driver 3 is not rated yet
+	for i, rating := range []float64{4.9, 4.2, 0, 4.5} {
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable, Rating: rating}
+		if err := dbPg.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		if err := dbRedis.PushDriverLocationGeo(driver.ID, 0, float64(i+1)/100, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		minRating float64
+		expected  []int
+	}{
+		{0, []int{1, 2, 3, 4}},
+		{4.5, []int{1, 3, 4}},
+		{5, []int{3}},
+	}
+	for _, tc := range tt {
+		drivers, err := New(dbPg, dbRedis, nil, nil, tc.minRating).NearestDrivers(0, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int, len(drivers))
+		for i, driver := range drivers {
+			ids[i] = driver.DriverID
+		}
+		assert.Equal(t, tc.expected, ids, tc.minRating)
+	}
+}
+
+func TestAssignDriver(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	matcher := New(dbPg, dbRedis, nil, nil, 0)
+	for i := 1; i <= 2; i++ {
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := dbPg.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		if err := dbRedis.PushDriverLocationGeo(driver.ID, 0, float64(i)/100, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ride := mpg.Ride{PassengerID: 1, Status: mpg.RideRequested}
+	if err := dbPg.CreateRide(&ride); err != nil {
+		t.Fatal(err)
+	}
+
+	// Driver 1 is nearest but excluded
+	assigned, err := matcher.AssignDriver(&ride, []int{1})
+	assert.NoError(t, err)
+	assert.True(t, assigned)
+	assert.Equal(t, 2, ride.DriverID)
+	assert.Equal(t, mpg.RideAssigned, ride.Status)
+
+	stored, _ := dbPg.GetRide(ride.ID)
+	assert.Equal(t, 2, stored.DriverID)
+	assert.Equal(t, mpg.RideAssigned, stored.Status)
+	driver, _ := dbPg.GetDriver(2)
+	assert.Equal(t, mpg.StateBusy, driver.State)
+	drivers, _ := dbRedis.GetNearestDrivers(0, 0, Radius, Top, "")
+	assert.Len(t, drivers, 1)
+
+	// The ride is no longer requested
+	assigned, err = matcher.AssignDriver(&ride, nil)
+	assert.NoError(t, err)
+	assert.False(t, assigned)
+	assert.Equal(t, 2, ride.DriverID)
+
+	// No driver left
+	other := mpg.Ride{PassengerID: 1, Status: mpg.RideRequested}
+	if err := dbPg.CreateRide(&other); err != nil {
+		t.Fatal(err)
+	}
+	assigned, err = matcher.AssignDriver(&other, []int{1})
+	assert.NoError(t, err)
+	assert.False(t, assigned)
+	assert.Equal(t, 0, other.DriverID)
+	assert.Equal(t, mpg.RideRequested, other.Status)
+}
+
+func TestAssignDriverConcurrent(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	matcher := New(dbPg, dbRedis, nil, nil, 0)
+	for i := 1; i <= 3; i++ {
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := dbPg.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		if err := dbRedis.PushDriverLocationGeo(driver.ID, 0, float64(i)/100, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Many rides race for the same 3 drivers
+	rides := make([]mpg.Ride, 50)
+	for i := range rides {
+		rides[i] = mpg.Ride{PassengerID: 1, Status: mpg.RideRequested}
+		if err := dbPg.CreateRide(&rides[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range rides {
+		wg.Add(1)
+		go func(ride *mpg.Ride) {
+			defer wg.Done()
+			_, err := matcher.AssignDriver(ride, nil)
+			assert.NoError(t, err)
+		}(&rides[i])
+	}
+	wg.Wait()
+
+	rideOf := map[int]int{}
+	for _, ride := range rides {
+		if ride.DriverID == 0 {
+			continue
+		}
+		previous, ok := rideOf[ride.DriverID]
+		assert.False(t, ok, "driver %d assigned to rides %d and %d", ride.DriverID, previous, ride.ID)
+		rideOf[ride.DriverID] = ride.ID
+	}
+	assert.Len(t, rideOf, 3)
+}
+
+func TestClaim(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	matcher := New(dbPg, dbRedis, nil, nil, 0)
+	driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+	if err := dbPg.CreateDriver(&driver); err != nil {
+		t.Fatal(err)
+	}
+	rides := make([]mpg.Ride, 2)
+	for i := range rides {
+		rides[i] = mpg.Ride{PassengerID: 1, Status: mpg.RideRequested}
+		if err := dbPg.CreateRide(&rides[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed, err := matcher.Claim(&rides[0], driver.ID)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, driver.ID, rides[0].DriverID)
+
+	// The driver is claimed by the first ride
+	claimed, err = matcher.Claim(&rides[1], driver.ID)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, 0, rides[1].DriverID)
+
+	// Once released, a ride which is no longer requested does not keep the claim
+	released, _ := dbRedis.ReleaseDriver(driver.ID, rides[0].ID)
+	assert.True(t, released)
+	claimed, err = matcher.Claim(&rides[0], driver.ID)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	claimed, err = matcher.Claim(&rides[1], driver.ID)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestAirportQueue(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	airport := geofence.Zone{
+		Name:     "airport",
+		Kind:     mpg.ZoneAirport,
+		Polygons: []geo.Polygon{{{{Lat: 0, Lng: 0}, {Lat: 0, Lng: 0.1}, {Lat: 0.1, Lng: 0.1}, {Lat: 0.1, Lng: 0}}}},
+		Queue:    true,
+	}
+	fences := geofence.New([]geofence.Zone{airport})
+	matcher := New(dbPg, dbRedis, nil, fences, 0)
+
+	// Drivers arrive in order 1 to 4 at decreasing distances from the pickup, driver 4 arrives outside the airport
+	lngs := []float64{0.09, 0.05, 0.03, 0.15}
+	for i, lng := range lngs {
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := dbPg.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		if err := dbRedis.PushDriverLocationGeo(driver.ID, 0.05, lng, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := UpdateQueues(dbRedis, fences, driver.ID, 0.05, lng); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, i+1, driver.ID)
+	}
+	queue, _ := dbRedis.GetZoneQueue(airport.Name, 0)
+	assert.Equal(t, []int{1, 2, 3}, queue)
+
+	ids := func(lat, lng float64) []int {
+		drivers, err := matcher.NearestDrivers(lat, lng, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int, len(drivers))
+		for i, driver := range drivers {
+			ids[i] = driver.DriverID
+		}
+		return ids
+	}
+	assert.Equal(t, []int{1, 2, 3}, ids(0.05, 0.01))
+	// Outside the airport drivers are nearest first
+	assert.Equal(t, []int{1, 4, 2, 3}, ids(0.05, 0.11))
+
+	// Driver 2 leaves the airport, driver 1 is assigned and leaves the queue
+	if err := UpdateQueues(dbRedis, fences, 2, 0.05, 0.2); err != nil {
+		t.Fatal(err)
+	}
+	ride := mpg.Ride{PassengerID: 1, Lat: 0.05, Lng: 0.01, Status: mpg.RideRequested}
+	if err := dbPg.CreateRide(&ride); err != nil {
+		t.Fatal(err)
+	}
+	assigned, err := matcher.AssignDriver(&ride, nil)
+	assert.NoError(t, err)
+	assert.True(t, assigned)
+	assert.Equal(t, 1, ride.DriverID)
+	queue, _ = dbRedis.GetZoneQueue(airport.Name, 0)
+	assert.Equal(t, []int{3}, queue)
+
+	// A queued driver whose location is outside the airport is skipped, without queued driver the nearest are found
+	if err := dbRedis.JoinZoneQueue(airport.Name, 4); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []int{3}, ids(0.05, 0.01))
+	assert.NoError(t, LeaveQueues(dbRedis, fences, 3))
+	assert.Equal(t, []int{3, 2}, ids(0.05, 0.01))
+}
@@ -0,0 +1,185 @@
+package matching
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mcass"
+	"github.com/trietphm/gruber/model/mpg"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+const (
+	// MaxRating Best driver rating
+	MaxRating = 5
+
+	// MaxIdle Idle time after which drivers get the full idle score
+	MaxIdle = 30 * time.Minute
+
+	// movingDistance Shorter moves between two locations are GPS noise, the heading is unknown, in kilometer
+	movingDistance = 0.02
+)
+
+// Ranker Order the eligible drivers found around a pickup, best first
+type Ranker interface {
+	Rank(lat, lng float64, drivers []mredis.DriverLocation) ([]mredis.DriverLocation, error)
+}
+
+// Weights Weights of each signal of the score of a driver, a zero weight ignores the signal
+type Weights struct {
+	Distance float64
+	Heading  float64
+	Rating   float64
+	Idle     float64
+}
+
+// Candidate Driver with the signals of its score
+type Candidate struct {
+	mredis.DriverLocation
+	// Heading Cosine of the angle between the last move of the driver and the direction to the pickup,
+	// 1 is toward the pickup, -1 away from it and 0 if unknown
+	Heading float64
+	// Rating Average rating from 1 to 5, 0 if not rated yet
+	Rating float64
+	// Idle How long the driver has been available
+	Idle time.Duration
+}
+
+// Score Score a candidate, higher is better. Each signal is scaled to [0, 1] ([-1, 1] for heading) then weighted:
+// distance is 1 at the pickup and 0 at Radius, rating is 0 for 1 star and 1 for MaxRating (0.5 if not rated)
+// and idle is 1 after MaxIdle
+func Score(candidate Candidate, weights Weights) float64 {
+	distance := 1 - math.Min(candidate.Distance/Radius, 1)
+
+	rating := 0.5
+	if candidate.Rating > 0 {
+		rating = (candidate.Rating - 1) / (MaxRating - 1)
+	}
+
+	idle := math.Min(float64(candidate.Idle)/float64(MaxIdle), 1)
+
+	return weights.Distance*distance + weights.Heading*candidate.Heading + weights.Rating*rating + weights.Idle*idle
+}
+
+// RankCandidates Sort candidates by score, candidates with the same score keep their order
+func RankCandidates(candidates []Candidate, weights Weights) {
+	scores := make(map[int]float64, len(candidates))
+	for _, candidate := range candidates {
+		scores[candidate.DriverID] = Score(candidate, weights)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].DriverID] > scores[candidates[j].DriverID]
+	})
+}
+
+// NewRanker Create the ranker of the configuration, nil if ranking is disabled
+func NewRanker(dbPg database.PgI, dbCass database.CassandraI, conf config.Matching) Ranker {
+	if !conf.Ranking {
+		return nil
+	}
+
+	return NewScorer(dbPg, dbCass, Weights{
+		Distance: conf.DistanceWeight,
+		Heading:  conf.HeadingWeight,
+		Rating:   conf.RatingWeight,
+		Idle:     conf.IdleWeight,
+	}, conf.HeadingWindow)
+}
+
+// Scorer Rank drivers by a weighted score of distance, heading toward the pickup, rating and idle time
+type Scorer struct {
+	dbPg    database.PgI
+	dbCass  database.CassandraI
+	weights Weights
+	// window Location history used for the heading of drivers
+	window time.Duration
+}
+
+var _ Ranker = (*Scorer)(nil)
+
+// NewScorer Create a scorer reading ratings and idle time from dbPg and headings from the last two locations
+// of the window in dbCass. A zero window skips the heading
+func NewScorer(dbPg database.PgI, dbCass database.CassandraI, weights Weights, window time.Duration) *Scorer {
+	return &Scorer{
+		dbPg:    dbPg,
+		dbCass:  dbCass,
+		weights: weights,
+		window:  window,
+	}
+}
+
+// Rank Rank drivers by score, drivers are expected nearest first so ties are broken by distance
+func (s *Scorer) Rank(lat, lng float64, drivers []mredis.DriverLocation) ([]mredis.DriverLocation, error) {
+	now := time.Now()
+	candidates := make([]Candidate, len(drivers))
+	for i, driver := range drivers {
+		candidate, err := s.candidate(lat, lng, driver, now)
+		if err != nil {
+			return nil, err
+		}
+		candidates[i] = candidate
+	}
+
+	RankCandidates(candidates, s.weights)
+
+	ranked := make([]mredis.DriverLocation, len(candidates))
+	for i, candidate := range candidates {
+		ranked[i] = candidate.DriverLocation
+	}
+	return ranked, nil
+}
+
+// candidate Read the signals of a driver, signals of unknown drivers are left empty
+func (s *Scorer) candidate(lat, lng float64, location mredis.DriverLocation, now time.Time) (Candidate, error) {
+	candidate := Candidate{DriverLocation: location}
+
+	if s.weights.Rating != 0 || s.weights.Idle != 0 {
+		driver, err := s.dbPg.GetDriver(location.DriverID)
+		if err != nil {
+			return candidate, err
+		}
+		if driver != nil {
+			candidate.Rating = driver.Rating
+			if driver.State == mpg.StateAvailable && !driver.StateUpdatedAt.IsZero() {
+				candidate.Idle = now.Sub(driver.StateUpdatedAt)
+			}
+		}
+	}
+
+	if s.weights.Heading != 0 && s.window > 0 {
+		history, err := s.dbCass.GetDriverHistory(location.DriverID, now.Add(-s.window))
+		if err != nil {
+			return candidate, err
+		}
+		candidate.Heading = heading(lat, lng, history)
+	}
+
+	return candidate, nil
+}
+
+// heading Cosine of the angle between the last move of history (newest first) and the direction to the pickup.
+// The last move is from the previous location at least movingDistance away to the newest location
+func heading(lat, lng float64, history []mcass.DriverLocation) float64 {
+	if len(history) == 0 {
+		return 0
+	}
+
+	newest := history[0]
+	if geo.Distance(newest.Lat, newest.Lng, lat, lng) < movingDistance {
+		return 0
+	}
+	for _, previous := range history[1:] {
+		if geo.Distance(previous.Lat, previous.Lng, newest.Lat, newest.Lng) < movingDistance {
+			continue
+		}
+		move := geo.Bearing(previous.Lat, previous.Lng, newest.Lat, newest.Lng)
+		pickup := geo.Bearing(newest.Lat, newest.Lng, lat, lng)
+		return math.Cos((pickup - move) * math.Pi / 180)
+	}
+
+	return 0
+}
@@ -0,0 +1,123 @@
+package matching
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/model/mcass"
+	"github.com/trietphm/gruber/model/mpg"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+func TestScore(t *testing.T) {
+	weights := Weights{Distance: 1, Heading: 0.5, Rating: 0.3, Idle: 0.2}
+	tt := []struct {
+		candidate Candidate
+		expected  float64
+	}{
+		// At the pickup, heading toward it, best rating and idle for long
+		{Candidate{DriverLocation: mredis.DriverLocation{Distance: 0}, Heading: 1, Rating: 5, Idle: time.Hour}, 2},
+		// Half the radius away, heading away, worst rating and just available
+		{Candidate{DriverLocation: mredis.DriverLocation{Distance: Radius / 2}, Heading: -1, Rating: 1}, 0},
+		// Beyond the radius, unknown heading, not rated and idle for half of MaxIdle
+		{Candidate{DriverLocation: mredis.DriverLocation{Distance: 2 * Radius}, Rating: 0, Idle: MaxIdle / 2}, 0.25},
+	}
+	for _, tc := range tt {
+		assert.InDelta(t, tc.expected, Score(tc.candidate, weights), 1e-9)
+	}
+
+	// Zero weights score everything the same
+	assert.Equal(t, float64(0), Score(tt[0].candidate, Weights{}))
+}
+
+func TestRankCandidates(t *testing.T) {
+	candidates := []Candidate{
+		{DriverLocation: mredis.DriverLocation{DriverID: 1, Distance: 1}, Heading: -1},
+		{DriverLocation: mredis.DriverLocation{DriverID: 2, Distance: 2}, Heading: 1},
+		{DriverLocation: mredis.DriverLocation{DriverID: 3, Distance: 2}, Heading: 1},
+		{DriverLocation: mredis.DriverLocation{DriverID: 4, Distance: 3}},
+	}
+	RankCandidates(candidates, Weights{Distance: 1, Heading: 0.5})
+
+	ids := make([]int, len(candidates))
+	for i, candidate := range candidates {
+		ids[i] = candidate.DriverID
+	}
+	// Drivers 2 and 3 have the same score and keep their order
+	assert.Equal(t, []int{2, 3, 4, 1}, ids)
+}
+
+func TestScorerRank(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbCass := memory.NewCassandra()
+	dbRedis := memory.NewRedis()
+	now := time.Now()
+
+	// Drivers on the equator east of the pickup at (0, 0), 0.01 degree of longitude is about 1.11 km
+	for i := 1; i <= 3; i++ {
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable, Rating: 4, StateUpdatedAt: now}
+		if i == 3 {
+			driver.StateUpdatedAt = now.Add(-time.Hour)
+		}
+		if err := dbPg.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		lng := float64(i) / 100
+		if err := dbRedis.PushDriverLocationGeo(driver.ID, 0, lng, nil); err != nil {
+			t.Fatal(err)
+		}
+		// Driver 1 drives east, away from the pickup, the others drive west toward it
+		previous := lng + 0.001
+		if i == 1 {
+			previous = lng - 0.001
+		}
+		for _, location := range []mcass.DriverLocation{
+			{DriverID: driver.ID, Lat: 0, Lng: previous, CreatedAt: now.Add(-12 * time.Second)},
+			{DriverID: driver.ID, Lat: 0, Lng: lng, CreatedAt: now.Add(-6 * time.Second)},
+		} {
+			if err := dbCass.CreateDriverLocation(&location); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ids := func(ranker Ranker) []int {
+		drivers, err := New(dbPg, dbRedis, ranker, nil, 0).NearestDrivers(0, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int, len(drivers))
+		for i, driver := range drivers {
+			ids[i] = driver.DriverID
+		}
+		return ids
+	}
+	assert.Equal(t, []int{1, 2, 3}, ids(nil))
+	assert.Equal(t, []int{2, 3, 1}, ids(NewScorer(dbPg, dbCass, Weights{Distance: 1, Heading: 0.5}, time.Minute)))
+	// Without history the heading is unknown
+	assert.Equal(t, []int{1, 2, 3}, ids(NewScorer(dbPg, dbCass, Weights{Distance: 1, Heading: 0.5}, 0)))
+
+	// Driver 3 has been idle the longest
+	assert.Equal(t, []int{3, 1, 2}, ids(NewScorer(dbPg, dbCass, Weights{Distance: 1, Idle: 1}, time.Minute)))
+}
+
+func TestHeading(t *testing.T) {
+	history := func(lngs ...float64) []mcass.DriverLocation {
+		locations := make([]mcass.DriverLocation, len(lngs))
+		for i, lng := range lngs {
+			locations[i] = mcass.DriverLocation{Lng: lng}
+		}
+		return locations
+	}
+
+	assert.Equal(t, float64(0), heading(0, 0, nil))
+	assert.InDelta(t, 1, heading(0, 0, history(0.01, 0.011)), 1e-9)
+	assert.InDelta(t, -1, heading(0, 0, history(0.01, 0.009)), 1e-9)
+	// Moves shorter than movingDistance are skipped
+	assert.InDelta(t, 1, heading(0, 0, history(0.01, 0.01001, 0.011)), 1e-9)
+	assert.Equal(t, float64(0), heading(0, 0, history(0.01, 0.01001)))
+	// Driving north while the pickup is west
+	assert.InDelta(t, 0, heading(0, 0, []mcass.DriverLocation{{Lat: 0, Lng: 0.01}, {Lat: -0.001, Lng: 0.01}}), 1e-6)
+}
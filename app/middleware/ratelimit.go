@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/util"
+)
+
+// ContextKeyIdentity Gin context key of the authenticated identity, rate limits use it before anything else.
+// Nothing sets it until the API has authentication, so until then KeyByIdentity keys by client IP only
+const ContextKeyIdentity = "identity"
+
+// KeyFunc Get the rate limit key of a request
+type KeyFunc func(c *gin.Context) string
+
+// KeyByIdentity Key by authenticated identity, or by client IP for anonymous requests.
+// Without authentication every request is anonymous, so clients behind one IP share a bucket
+func KeyByIdentity(c *gin.Context) string {
+	if identity := c.GetString(ContextKeyIdentity); identity != "" {
+		return "identity:" + identity
+	}
+
+	return "ip:" + c.ClientIP()
+}
+
+// KeyByParam Key by a route param, e.g. the driver id of /drivers/:id, falling back to KeyByIdentity
+func KeyByParam(param string) KeyFunc {
+	return func(c *gin.Context) string {
+		if c.GetString(ContextKeyIdentity) == "" {
+			if value := c.Param(param); value != "" {
+				return param + ":" + value
+			}
+		}
+
+		return KeyByIdentity(c)
+	}
+}
+
+// RateLimit Limit requests of each key with a token bucket of rate tokens per second and size burst.
+// group namespaces the buckets so route groups are limited independently. A zero rate disables the limit
+func RateLimit(db database.RedisI, group string, rate float64, burst int, key KeyFunc) gin.HandlerFunc {
+	if rate <= 0 {
+		return func(c *gin.Context) {}
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return func(c *gin.Context) {
+		allowed, retryAfter, err := db.TakeToken(group+":"+key(c), rate, burst)
+		if err != nil {
+			// Do not reject traffic when the limiter is down
+			c.Error(err)
+			return
+		}
+
+		if !allowed {
+			util.RespTooManyRequests(c, retryAfter)
+		}
+	}
+}
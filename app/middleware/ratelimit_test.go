@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/database/memory"
+)
+
+func newRateLimitEngine(rate float64, burst int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	group := engine.Group("/drivers", RateLimit(memory.NewRedis(), "drivers", rate, burst, KeyByParam("id")))
+	group.PUT("/:id/locations", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	return engine
+}
+
+func TestRateLimit(t *testing.T) {
+	tt := []struct {
+		url        string
+		StatusCode int
+		RetryAfter string
+	}{
+		{"/drivers/1/locations", http.StatusOK, ""},
+		{"/drivers/1/locations", http.StatusOK, ""},
+		{"/drivers/1/locations", http.StatusTooManyRequests, "1"},
+		{"/drivers/2/locations", http.StatusOK, ""},
+	}
+
+	engine := newRateLimitEngine(1, 2)
+	for _, tc := range tt {
+		req := httptest.NewRequest("PUT", tc.url, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		assert.Equal(t, tc.StatusCode, w.Code, tc.url)
+		assert.Equal(t, tc.RetryAfter, w.Header().Get("Retry-After"), tc.url)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	engine := newRateLimitEngine(0, 0)
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("PUT", "/drivers/1/locations", nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+}
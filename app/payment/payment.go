@@ -0,0 +1,180 @@
+// Package payment charges passengers through a payment provider
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/trietphm/gruber/config"
+)
+
+var (
+	// ErrDeclined The payment method of the passenger was declined
+	ErrDeclined = errors.New("Payment declined")
+	// ErrRefundExceedsCharge The refunds of a charge exceed its amount
+	ErrRefundExceedsCharge = errors.New("Refund exceeds the charge")
+	// ErrChargeNotFound The charge to refund does not exist
+	ErrChargeNotFound = errors.New("Charge not found")
+)
+
+// Provider Payment provider, operations are idempotent: an operation retried with the same key is done once
+// and returns the same reference, whatever the outcome of the previous attempts. Callers record the operation
+// before calling the provider and retry it with the same key when an error leaves its outcome unknown, so keys
+// must be kept at least as long as such retries happen. Amounts are in minor units of the currency
+type Provider interface {
+	// Charge Charge the default payment method of a passenger, it returns the reference of the charge.
+	// ErrDeclined means nothing is charged, other errors leave the outcome unknown
+	Charge(key string, passengerID int, amount int64, currency string) (string, error)
+
+	// Refund Refund part of a charge to the passenger, it returns the reference of the refund.
+	// ErrRefundExceedsCharge and ErrChargeNotFound are final, other errors leave the outcome unknown
+	Refund(key string, chargeRef string, amount int64) (string, error)
+}
+
+// New Create the provider of the configuration, nil if none is set
+func New(conf config.Payment) (Provider, error) {
+	switch conf.Provider {
+	case "":
+		return nil, nil
+	case "fake":
+		return NewFake(), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", conf.Provider)
+	}
+}
+
+// Operation Charge or refund made by the fake provider
+type Operation struct {
+	Ref         string
+	PassengerID int
+	Amount      int64
+	Currency    string
+	// ChargeRef Charge of a refund
+	ChargeRef string
+}
+
+// Fake In-memory provider for development and tests, every charge succeeds unless the passenger is declined
+type Fake struct {
+	mu       sync.Mutex
+	charges  map[string]Operation
+	refunds  map[string]Operation
+	declined map[int]bool
+	calls    int
+}
+
+var _ Provider = (*Fake)(nil)
+
+// NewFake Create a fake provider without operations
+func NewFake() *Fake {
+	return &Fake{
+		charges:  make(map[string]Operation),
+		refunds:  make(map[string]Operation),
+		declined: make(map[int]bool),
+	}
+}
+
+// Decline Decline the next charges of a passenger
+func (f *Fake) Decline(passengerID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.declined[passengerID] = true
+}
+
+// Charge Record a charge, the reference is ch_<n>
+func (f *Fake) Charge(key string, passengerID int, amount int64, currency string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if charge, ok := f.charges[key]; ok {
+		return charge.Ref, nil
+	}
+	if f.declined[passengerID] {
+		return "", ErrDeclined
+	}
+
+	charge := Operation{
+		Ref:         fmt.Sprintf("ch_%d", len(f.charges)+1),
+		PassengerID: passengerID,
+		Amount:      amount,
+		Currency:    currency,
+	}
+	f.charges[key] = charge
+	return charge.Ref, nil
+}
+
+// Refund Record a refund of a charge, the reference is re_<n>
+func (f *Fake) Refund(key string, chargeRef string, amount int64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if refund, ok := f.refunds[key]; ok {
+		return refund.Ref, nil
+	}
+
+	var charge *Operation
+	for _, operation := range f.charges {
+		if operation.Ref == chargeRef {
+			charge = &operation
+			break
+		}
+	}
+	if charge == nil {
+		return "", ErrChargeNotFound
+	}
+
+	refunded := amount
+	for _, refund := range f.refunds {
+		if refund.ChargeRef == chargeRef {
+			refunded += refund.Amount
+		}
+	}
+	if refunded > charge.Amount {
+		return "", ErrRefundExceedsCharge
+	}
+
+	refund := Operation{
+		Ref:         fmt.Sprintf("re_%d", len(f.refunds)+1),
+		PassengerID: charge.PassengerID,
+		Amount:      amount,
+		Currency:    charge.Currency,
+		ChargeRef:   chargeRef,
+	}
+	f.refunds[key] = refund
+	return refund.Ref, nil
+}
+
+// Charges Get charges by key
+func (f *Fake) Charges() map[string]Operation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	charges := make(map[string]Operation, len(f.charges))
+	for key, charge := range f.charges {
+		charges[key] = charge
+	}
+	return charges
+}
+
+// Refunds Get refunds by key
+func (f *Fake) Refunds() map[string]Operation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	refunds := make(map[string]Operation, len(f.refunds))
+	for key, refund := range f.refunds {
+		refunds[key] = refund
+	}
+	return refunds
+}
+
+// Calls Count of charge and refund calls, retries included
+func (f *Fake) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls
+}
@@ -0,0 +1,60 @@
+package payment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/config"
+)
+
+func TestNew(t *testing.T) {
+	provider, err := New(config.Payment{})
+	assert.NoError(t, err)
+	assert.Nil(t, provider)
+
+	provider, err = New(config.Payment{Provider: "fake"})
+	assert.NoError(t, err)
+	assert.IsType(t, &Fake{}, provider)
+
+	_, err = New(config.Payment{Provider: "bank"})
+	assert.Error(t, err)
+}
+
+func TestFake(t *testing.T) {
+	fake := NewFake()
+
+	ref, err := fake.Charge("ride:1", 1, 50000, "VND")
+	assert.NoError(t, err)
+	assert.Equal(t, "ch_1", ref)
+
+	// A retried charge is made once
+	ref, err = fake.Charge("ride:1", 1, 50000, "VND")
+	assert.NoError(t, err)
+	assert.Equal(t, "ch_1", ref)
+	assert.Len(t, fake.Charges(), 1)
+
+	fake.Decline(2)
+	_, err = fake.Charge("ride:2", 2, 30000, "VND")
+	assert.Equal(t, ErrDeclined, err)
+
+	ref, err = fake.Refund("refund:1", "ch_1", 20000)
+	assert.NoError(t, err)
+	assert.Equal(t, "re_1", ref)
+	ref, err = fake.Refund("refund:1", "ch_1", 20000)
+	assert.NoError(t, err)
+	assert.Equal(t, "re_1", ref)
+
+	_, err = fake.Refund("refund:2", "ch_1", 30001)
+	assert.Equal(t, ErrRefundExceedsCharge, err)
+	ref, err = fake.Refund("refund:2", "ch_1", 30000)
+	assert.NoError(t, err)
+	assert.Equal(t, "re_2", ref)
+
+	_, err = fake.Refund("refund:3", "ch_9", 1)
+	assert.Equal(t, ErrChargeNotFound, err)
+
+	refunds := fake.Refunds()
+	assert.Len(t, refunds, 2)
+	assert.Equal(t, Operation{Ref: "re_2", PassengerID: 1, Amount: 30000, Currency: "VND", ChargeRef: "ch_1"}, refunds["refund:2"])
+	assert.Equal(t, 8, fake.Calls())
+}
@@ -0,0 +1,81 @@
+// Package pricing computes the fare of completed rides
+package pricing
+
+import (
+	"math"
+	"sort"
+
+	"github.com/trietphm/gruber/app/geofence"
+	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// DefaultCurrency Currency of fares if none is configured
+const DefaultCurrency = "VND"
+
+// Pricing Fare rules, amounts are in minor units of Currency
+type Pricing struct {
+	Currency    string
+	BaseFare    int64
+	PerKm       int64
+	PerMinute   int64
+	MinimumFare int64
+	// CommissionRate Part of the fare kept by the platform
+	CommissionRate float64
+}
+
+// New Create the pricing of the configuration
+func New(conf config.Pricing) Pricing {
+	currency := conf.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+
+	return Pricing{
+		Currency:       currency,
+		BaseFare:       conf.BaseFare,
+		PerKm:          conf.PerKm,
+		PerMinute:      conf.PerMinute,
+		MinimumFare:    conf.MinimumFare,
+		CommissionRate: conf.CommissionRate,
+	}
+}
+
+// Price Set the fare and commission of a completed ride. The fare is the base fare plus the distance from pickup
+// through the stops and the time since the ride started, at least the minimum fare. The airport zone of the pickup,
+// if any, multiplies it and adds its pickup fee
+func (p Pricing) Price(ride *mpg.Ride, stops []mpg.RideStop, zone *geofence.Zone) {
+	minutes := 0.0
+	if !ride.StartedAt.IsZero() && ride.CompletedAt.After(ride.StartedAt) {
+		minutes = ride.CompletedAt.Sub(ride.StartedAt).Minutes()
+	}
+
+	fare := float64(p.BaseFare) + float64(p.PerKm)*Distance(ride, stops) + float64(p.PerMinute)*minutes
+	fare = math.Max(fare, float64(p.MinimumFare))
+	if zone != nil {
+		if zone.FareMultiplier > 0 {
+			fare *= zone.FareMultiplier
+		}
+		fare += float64(zone.PickupFee)
+	}
+
+	ride.Fare = int64(math.Round(fare))
+	ride.Commission = int64(math.Round(float64(ride.Fare) * p.CommissionRate))
+	ride.Currency = p.Currency
+}
+
+// Distance Distance in kilometer from the pickup of a ride through its stops in position order
+func Distance(ride *mpg.Ride, stops []mpg.RideStop) float64 {
+	ordered := make([]mpg.RideStop, len(stops))
+	copy(ordered, stops)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Position < ordered[j].Position })
+
+	distance := 0.0
+	lat, lng := ride.Lat, ride.Lng
+	for _, stop := range ordered {
+		distance += geo.Distance(lat, lng, stop.Lat, stop.Lng)
+		lat, lng = stop.Lat, stop.Lng
+	}
+	return distance
+}
@@ -0,0 +1,55 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/app/geofence"
+	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+func TestPrice(t *testing.T) {
+	pricing := New(config.Pricing{BaseFare: 10000, PerKm: 1000, PerMinute: 100, MinimumFare: 15000, CommissionRate: 0.2})
+	startedAt := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	// 0.1 degree of longitude on the equator is about 11.12 km
+	stops := []mpg.RideStop{
+		{Position: 2, Dropoff: true, Lat: 0, Lng: 0.2},
+		{Position: 1, Lat: 0, Lng: 0.1},
+	}
+	airport := &geofence.Zone{Name: "airport", Kind: mpg.ZoneAirport, PickupFee: 5000, FareMultiplier: 1.5}
+
+	tt := []struct {
+		name               string
+		stops              []mpg.RideStop
+		minutes            time.Duration
+		zone               *geofence.Zone
+		expectedFare       int64
+		expectedCommission int64
+	}{
+		{"Stops", stops, 20, nil, 34245, 6849},
+		{"Airport", stops, 20, airport, 56368, 11274},
+		{"Minimum", nil, 0, nil, 15000, 3000},
+		{"MinimumAirport", nil, 0, airport, 27500, 5500},
+	}
+	for _, tc := range tt {
+		ride := mpg.Ride{Lat: 0, Lng: 0, StartedAt: startedAt, CompletedAt: startedAt.Add(tc.minutes * time.Minute)}
+		pricing.Price(&ride, tc.stops, tc.zone)
+		assert.Equal(t, tc.expectedFare, ride.Fare, tc.name)
+		assert.Equal(t, tc.expectedCommission, ride.Commission, tc.name)
+		assert.Equal(t, DefaultCurrency, ride.Currency, tc.name)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	ride := mpg.Ride{Lat: 0, Lng: 0}
+	assert.Equal(t, 0.0, Distance(&ride, nil))
+	stops := []mpg.RideStop{
+		{Position: 2, Lat: 0, Lng: 0.2},
+		{Position: 1, Lat: 0, Lng: 0.1},
+	}
+	assert.InDelta(t, 22.245, Distance(&ride, stops), 0.001)
+	// Stops are visited in position order
+	assert.Equal(t, 2, stops[0].Position)
+}
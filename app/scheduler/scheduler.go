@@ -0,0 +1,207 @@
+// Package scheduler dispatches scheduled rides: a lead time before pickup it requests a ride and
+// assigns it a driver through the same assigner as ride requests. Pending rides are read from the
+// database on every tick, so rides scheduled before a restart are dispatched after it.
+package scheduler
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trietphm/gruber/app/matching"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// Options Scheduler options, zero values use defaults
+type Options struct {
+	// LeadTime Drivers are searched this long before pickup (default 15m)
+	LeadTime time.Duration
+	// Interval Time between two reads of due rides (default 10s)
+	Interval time.Duration
+}
+
+// Stats Scheduler counters
+type Stats struct {
+	// Dispatched Rides which a driver was assigned to
+	Dispatched uint64 `json:"dispatched"`
+	// Expired Rides without driver at pickup time
+	Expired uint64 `json:"expired"`
+	// Errors Failed reads of due rides or dispatches, failed dispatches are retried on the next tick
+	Errors uint64 `json:"errors"`
+}
+
+// Scheduler Dispatch due scheduled rides in background
+type Scheduler struct {
+	dbPg     database.PgI
+	assigner matching.Assigner
+	opts     Options
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	dispatched, expired, errors uint64
+}
+
+// New Start dispatching due rides, Close must be called to stop
+func New(dbPg database.PgI, assigner matching.Assigner, opts Options) *Scheduler {
+	s := newScheduler(dbPg, assigner, opts)
+	go s.run()
+	return s
+}
+
+// newScheduler Create a scheduler without starting it
+func newScheduler(dbPg database.PgI, assigner matching.Assigner, opts Options) *Scheduler {
+	if opts.LeadTime <= 0 {
+		opts.LeadTime = 15 * time.Minute
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+
+	return &Scheduler{
+		dbPg:     dbPg,
+		assigner: assigner,
+		opts:     opts,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Close Stop the scheduler and wait for the running tick
+func (s *Scheduler) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// Stats Get scheduler counters
+func (s *Scheduler) Stats() Stats {
+	return Stats{
+		Dispatched: atomic.LoadUint64(&s.dispatched),
+		Expired:    atomic.LoadUint64(&s.expired),
+		Errors:     atomic.LoadUint64(&s.errors),
+	}
+}
+
+// run Tick at start then every interval until stopped
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		s.tick(time.Now())
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick Dispatch every pending ride picked up within the lead time of now
+func (s *Scheduler) tick(now time.Time) {
+	rides, err := s.dbPg.GetDueScheduledRides(now.Add(s.opts.LeadTime))
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return
+	}
+
+	for i := range rides {
+		if err := s.dispatch(&rides[i], now); err != nil {
+			atomic.AddUint64(&s.errors, 1)
+		}
+	}
+}
+
+// dispatch Request the ride of a due scheduled ride and assign it a driver. A ride without driver is
+// assigned again on the next tick until its pickup time, then it is cancelled and the scheduled ride
+// expires. A scheduled ride cancelled meanwhile is left cancelled
+func (s *Scheduler) dispatch(scheduled *mpg.ScheduledRide, now time.Time) error {
+	ride, err := s.ride(scheduled)
+	if err != nil || ride == nil {
+		return err
+	}
+
+	// A ride assigned by a previous tick whose scheduled ride was not saved is not assigned again
+	assigned := ride.Status != mpg.RideRequested
+	if !assigned {
+		assigned, err = s.assigner.AssignDriver(ride, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if assigned {
+		scheduled.Status = mpg.ScheduledRideDispatched
+		scheduled.DriverIDs = []int{ride.DriverID}
+	} else {
+		if now.Before(scheduled.PickupAt) {
+			return nil
+		}
+		if err := s.cancelRide(ride, now); err != nil {
+			return err
+		}
+		scheduled.Status = mpg.ScheduledRideExpired
+	}
+
+	updated, err := s.dbPg.UpdateScheduledRideStatus(scheduled, mpg.ScheduledRidePending)
+	if err != nil || !updated {
+		return err
+	}
+
+	if scheduled.Status == mpg.ScheduledRideDispatched {
+		atomic.AddUint64(&s.dispatched, 1)
+	} else {
+		atomic.AddUint64(&s.expired, 1)
+	}
+	return nil
+}
+
+// ride Get the ride of a scheduled ride, it is requested on the first dispatch. It returns nil if the
+// scheduled ride was cancelled or another scheduler requested its ride meanwhile
+func (s *Scheduler) ride(scheduled *mpg.ScheduledRide) (*mpg.Ride, error) {
+	if scheduled.RideID != 0 {
+		return s.dbPg.GetRide(scheduled.RideID)
+	}
+
+	ride := mpg.Ride{
+		PassengerID:  scheduled.PassengerID,
+		Lat:          scheduled.Lat,
+		Lng:          scheduled.Lng,
+		VehicleClass: scheduled.VehicleClass,
+		Status:       mpg.RideRequested,
+	}
+	passenger, err := s.dbPg.GetPassenger(scheduled.PassengerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if passenger != nil {
+		ride.PaymentMethod = passenger.DefaultPaymentMethod
+	}
+
+	if err := s.dbPg.CreateRide(&ride); err != nil {
+		return nil, err
+	}
+
+	linked, err := s.dbPg.LinkScheduledRide(scheduled.ID, ride.ID)
+	if err != nil || !linked {
+		if cancelErr := s.cancelRide(&ride, time.Now()); err == nil {
+			err = cancelErr
+		}
+		return nil, err
+	}
+
+	scheduled.RideID = ride.ID
+	return &ride, nil
+}
+
+// cancelRide Cancel a ride which is still requested
+func (s *Scheduler) cancelRide(ride *mpg.Ride, now time.Time) error {
+	ride.Status = mpg.RideCancelled
+	ride.CancelledAt = now
+	_, err := s.dbPg.UpdateRideStatus(ride, mpg.RideRequested)
+	return err
+}
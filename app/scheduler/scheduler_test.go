@@ -0,0 +1,116 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/app/matching"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+func TestTick(t *testing.T) {
+	dbPg := memory.NewPg()
+	dbRedis := memory.NewRedis()
+	s := newScheduler(dbPg, matching.New(dbPg, dbRedis, nil, nil, 0), Options{LeadTime: 15 * time.Minute})
+
+	driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+	if err := dbPg.CreateDriver(&driver); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbRedis.PushDriverLocationGeo(driver.ID, 10, 106, []string{mpg.VehicleClassEconomy}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	rides := []mpg.ScheduledRide{
+		// Due with a driver nearby
+		{PassengerID: 1, Lat: 10, Lng: 106.01, PickupAt: now.Add(10 * time.Minute)},
+		// Not due yet
+		{PassengerID: 1, Lat: 10, Lng: 106.01, PickupAt: now.Add(time.Hour)},
+		// Due without premium driver, searched again until pickup
+		{PassengerID: 1, Lat: 10, Lng: 106.01, PickupAt: now.Add(5 * time.Minute), VehicleClass: mpg.VehicleClassPremium},
+		// Due but cancelled
+		{PassengerID: 1, Lat: 10, Lng: 106.01, PickupAt: now.Add(5 * time.Minute), Status: mpg.ScheduledRideCancelled},
+	}
+	for i := range rides {
+		if err := dbPg.CreateScheduledRide(&rides[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := func(i int) *mpg.ScheduledRide {
+		ride, err := dbPg.GetScheduledRide(rides[i].ID)
+		if err != nil || ride == nil {
+			t.Fatal("ride not found", err)
+		}
+		return ride
+	}
+
+	ride := func(rideID int) *mpg.Ride {
+		ride, err := dbPg.GetRide(rideID)
+		if err != nil || ride == nil {
+			t.Fatal("ride not found", err)
+		}
+		return ride
+	}
+
+	s.tick(now)
+	assert.Equal(t, mpg.ScheduledRideDispatched, status(0).Status)
+	assert.Equal(t, []int{driver.ID}, status(0).DriverIDs)
+	assert.Equal(t, mpg.RideAssigned, ride(status(0).RideID).Status)
+	assert.Equal(t, driver.ID, ride(status(0).RideID).DriverID)
+	assert.Equal(t, mpg.ScheduledRidePending, status(1).Status)
+	assert.Equal(t, 0, status(1).RideID)
+	assert.Equal(t, mpg.ScheduledRidePending, status(2).Status)
+	assert.Equal(t, mpg.RideRequested, ride(status(2).RideID).Status)
+	assert.Equal(t, mpg.ScheduledRideCancelled, status(3).Status)
+	assert.Equal(t, 0, status(3).RideID)
+
+	// The ride requested on the first dispatch is assigned again
+	rideID := status(2).RideID
+	s.tick(now.Add(time.Minute))
+	assert.Equal(t, rideID, status(2).RideID)
+
+	s.tick(now.Add(6 * time.Minute))
+	assert.Equal(t, mpg.ScheduledRideExpired, status(2).Status)
+	assert.Equal(t, mpg.RideCancelled, ride(rideID).Status)
+	assert.Equal(t, mpg.ScheduledRidePending, status(1).Status)
+
+	assert.Equal(t, Stats{Dispatched: 1, Expired: 1}, s.Stats())
+}
+
+func TestDispatchRequestedElsewhere(t *testing.T) {
+	dbPg := memory.NewPg()
+	s := newScheduler(dbPg, matching.New(dbPg, memory.NewRedis(), nil, nil, 0), Options{})
+
+	now := time.Now()
+	scheduled := mpg.ScheduledRide{PassengerID: 1, Lat: 10, Lng: 106, PickupAt: now.Add(10 * time.Minute)}
+	if err := dbPg.CreateScheduledRide(&scheduled); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another scheduler read the same ride and requested it first
+	stale := scheduled
+	s.tick(now)
+	assert.NoError(t, s.dispatch(&stale, now))
+
+	stored, err := dbPg.GetScheduledRide(scheduled.ID)
+	if err != nil || stored == nil {
+		t.Fatal("ride not found", err)
+	}
+	assert.Equal(t, 1, stored.RideID)
+	ride, err := dbPg.GetRide(2)
+	if err != nil || ride == nil {
+		t.Fatal("ride not found", err)
+	}
+	assert.Equal(t, mpg.RideCancelled, ride.Status)
+}
+
+func TestClose(t *testing.T) {
+	dbPg := memory.NewPg()
+	s := New(dbPg, matching.New(dbPg, memory.NewRedis(), nil, nil, 0), Options{Interval: time.Hour})
+	s.Close()
+	s.Close()
+}
@@ -0,0 +1,136 @@
+// Package trip tracks the progress of a started ride through its stops
+package trip
+
+import (
+	"errors"
+	"time"
+
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+var (
+	// ErrStopNotFound The ride has no stop at the position
+	ErrStopNotFound = errors.New("Stop not found")
+
+	ErrNotArrived      = errors.New("Driver is not at pickup")
+	ErrNotStarted      = errors.New("Ride is not started")
+	ErrPreviousStop    = errors.New("Previous stop is not departed")
+	ErrStopArrived     = errors.New("Stop is already arrived")
+	ErrStopNotArrived  = errors.New("Stop is not arrived")
+	ErrStopDeparted    = errors.New("Stop is already departed")
+	ErrDropoffDeparted = errors.New("Dropoff can not be departed")
+)
+
+// Start The passenger is picked up, the driver leaves pickup for the stops
+func Start(ride *mpg.Ride, at time.Time) error {
+	if ride.Status != mpg.RideArrived {
+		return ErrNotArrived
+	}
+
+	ride.Status = mpg.RideStarted
+	ride.StartedAt = at
+	return nil
+}
+
+// Arrive The driver arrives at the stop at a position, stops are in position order.
+// Stops before it must be departed. Arriving at the dropoff completes the ride
+func Arrive(ride *mpg.Ride, stops []mpg.RideStop, position int, at time.Time) (*mpg.RideStop, error) {
+	stop, err := find(ride, stops, position)
+	if err != nil {
+		return nil, err
+	}
+
+	if !stop.ArrivedAt.IsZero() {
+		return nil, ErrStopArrived
+	}
+
+	if err := departed(stops, position); err != nil {
+		return nil, err
+	}
+
+	stop.ArrivedAt = at
+	if stop.Dropoff {
+		complete(ride, at)
+	}
+	return stop, nil
+}
+
+// Depart The driver leaves the stop at a position, the dropoff is never departed
+func Depart(ride *mpg.Ride, stops []mpg.RideStop, position int, at time.Time) (*mpg.RideStop, error) {
+	stop, err := find(ride, stops, position)
+	if err != nil {
+		return nil, err
+	}
+
+	if stop.Dropoff {
+		return nil, ErrDropoffDeparted
+	}
+
+	if stop.ArrivedAt.IsZero() {
+		return nil, ErrStopNotArrived
+	}
+
+	if !stop.DepartedAt.IsZero() {
+		return nil, ErrStopDeparted
+	}
+
+	stop.DepartedAt = at
+	return stop, nil
+}
+
+// Complete The passenger is dropped off. Every stop before the dropoff must be departed.
+// It returns the dropoff with its arrival set, or nil if the ride has no dropoff
+func Complete(ride *mpg.Ride, stops []mpg.RideStop, at time.Time) (*mpg.RideStop, error) {
+	if ride.Status != mpg.RideStarted {
+		return nil, ErrNotStarted
+	}
+
+	var dropoff *mpg.RideStop
+	for i := range stops {
+		if stops[i].Dropoff {
+			dropoff = &stops[i]
+			continue
+		}
+		if stops[i].DepartedAt.IsZero() {
+			return nil, ErrPreviousStop
+		}
+	}
+
+	if dropoff != nil {
+		dropoff.ArrivedAt = at
+	}
+	complete(ride, at)
+	return dropoff, nil
+}
+
+// find Find the stop of a started ride at a position
+func find(ride *mpg.Ride, stops []mpg.RideStop, position int) (*mpg.RideStop, error) {
+	if ride.Status != mpg.RideStarted {
+		return nil, ErrNotStarted
+	}
+
+	for i := range stops {
+		if stops[i].Position == position {
+			return &stops[i], nil
+		}
+	}
+
+	return nil, ErrStopNotFound
+}
+
+// departed Check stops before a position are departed
+func departed(stops []mpg.RideStop, position int) error {
+	for _, stop := range stops {
+		if stop.Position < position && stop.DepartedAt.IsZero() {
+			return ErrPreviousStop
+		}
+	}
+
+	return nil
+}
+
+// complete Set the ride completed
+func complete(ride *mpg.Ride, at time.Time) {
+	ride.Status = mpg.RideCompleted
+	ride.CompletedAt = at
+}
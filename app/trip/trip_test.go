@@ -0,0 +1,148 @@
+package trip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+func TestStart(t *testing.T) {
+	at := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	tt := []struct {
+		name     string
+		status   string
+		expected error
+	}{
+		{"Arrived", mpg.RideArrived, nil},
+		{"Assigned", mpg.RideAssigned, ErrNotArrived},
+		{"Started", mpg.RideStarted, ErrNotArrived},
+	}
+	for _, tc := range tt {
+		ride := mpg.Ride{Status: tc.status}
+		err := Start(&ride, at)
+		assert.Equal(t, tc.expected, err, tc.name)
+		if err == nil {
+			assert.Equal(t, mpg.RideStarted, ride.Status, tc.name)
+			assert.Equal(t, at, ride.StartedAt, tc.name)
+		}
+	}
+}
+
+func TestStops(t *testing.T) {
+	at := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	newStops := func() []mpg.RideStop {
+		return []mpg.RideStop{
+			{ID: 1, Position: 1},
+			{ID: 2, Position: 2},
+			{ID: 3, Position: 3, Dropoff: true},
+		}
+	}
+	arrived := newStops()
+	arrived[0].ArrivedAt = at
+	departed := newStops()
+	departed[0].ArrivedAt = at
+	departed[0].DepartedAt = at
+	allDeparted := newStops()
+	for i := 0; i < 2; i++ {
+		allDeparted[i].ArrivedAt = at
+		allDeparted[i].DepartedAt = at
+	}
+
+	tt := []struct {
+		name      string
+		status    string
+		stops     []mpg.RideStop
+		depart    bool
+		position  int
+		expected  error
+		completed bool
+	}{
+		{"ArriveNotStarted", mpg.RideArrived, newStops(), false, 1, ErrNotStarted, false},
+		{"ArriveNotFound", mpg.RideStarted, newStops(), false, 4, ErrStopNotFound, false},
+		{"ArriveFirst", mpg.RideStarted, newStops(), false, 1, nil, false},
+		{"ArriveAgain", mpg.RideStarted, arrived, false, 1, ErrStopArrived, false},
+		{"ArriveSkipped", mpg.RideStarted, newStops(), false, 2, ErrPreviousStop, false},
+		{"ArriveNotDeparted", mpg.RideStarted, arrived, false, 2, ErrPreviousStop, false},
+		{"ArriveSecond", mpg.RideStarted, departed, false, 2, nil, false},
+		{"ArriveDropoff", mpg.RideStarted, allDeparted, false, 3, nil, true},
+		{"DepartNotStarted", mpg.RideAssigned, arrived, true, 1, ErrNotStarted, false},
+		{"DepartNotArrived", mpg.RideStarted, newStops(), true, 1, ErrStopNotArrived, false},
+		{"DepartFirst", mpg.RideStarted, arrived, true, 1, nil, false},
+		{"DepartAgain", mpg.RideStarted, departed, true, 1, ErrStopDeparted, false},
+		{"DepartDropoff", mpg.RideStarted, allDeparted, true, 3, ErrDropoffDeparted, false},
+	}
+	for _, tc := range tt {
+		ride := mpg.Ride{Status: tc.status}
+		var stop *mpg.RideStop
+		var err error
+		if tc.depart {
+			stop, err = Depart(&ride, tc.stops, tc.position, at)
+		} else {
+			stop, err = Arrive(&ride, tc.stops, tc.position, at)
+		}
+		assert.Equal(t, tc.expected, err, tc.name)
+		if err != nil {
+			assert.Nil(t, stop, tc.name)
+			continue
+		}
+
+		assert.Equal(t, tc.position, stop.Position, tc.name)
+		if tc.depart {
+			assert.Equal(t, at, stop.DepartedAt, tc.name)
+		} else {
+			assert.Equal(t, at, stop.ArrivedAt, tc.name)
+		}
+		if tc.completed {
+			assert.Equal(t, mpg.RideCompleted, ride.Status, tc.name)
+			assert.Equal(t, at, ride.CompletedAt, tc.name)
+		} else {
+			assert.Equal(t, tc.status, ride.Status, tc.name)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	at := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	departed := []mpg.RideStop{
+		{ID: 1, Position: 1, ArrivedAt: at, DepartedAt: at},
+		{ID: 2, Position: 2, Dropoff: true},
+	}
+	notDeparted := []mpg.RideStop{
+		{ID: 1, Position: 1, ArrivedAt: at},
+		{ID: 2, Position: 2, Dropoff: true},
+	}
+
+	tt := []struct {
+		name     string
+		status   string
+		stops    []mpg.RideStop
+		expected error
+		dropoff  bool
+	}{
+		{"NotStarted", mpg.RideArrived, nil, ErrNotStarted, false},
+		{"WithoutStops", mpg.RideStarted, nil, nil, false},
+		{"Dropoff", mpg.RideStarted, departed, nil, true},
+		{"StopNotDeparted", mpg.RideStarted, notDeparted, ErrPreviousStop, false},
+	}
+	for _, tc := range tt {
+		ride := mpg.Ride{Status: tc.status}
+		dropoff, err := Complete(&ride, tc.stops, at)
+		assert.Equal(t, tc.expected, err, tc.name)
+		if err != nil {
+			assert.Equal(t, tc.status, ride.Status, tc.name)
+			continue
+		}
+
+		assert.Equal(t, mpg.RideCompleted, ride.Status, tc.name)
+		assert.Equal(t, at, ride.CompletedAt, tc.name)
+		if tc.dropoff {
+			if assert.NotNil(t, dropoff, tc.name) {
+				assert.Equal(t, at, dropoff.ArrivedAt, tc.name)
+			}
+		} else {
+			assert.Nil(t, dropoff, tc.name)
+		}
+	}
+}
@@ -2,9 +2,14 @@ package view
 
 import (
 	"encoding/json"
+	"math"
 	"time"
 
+	"github.com/trietphm/gruber/app/earnings"
+	"github.com/trietphm/gruber/app/geofence"
+	"github.com/trietphm/gruber/app/heatmap"
 	"github.com/trietphm/gruber/model/mcass"
+	"github.com/trietphm/gruber/model/mpg"
 	"github.com/trietphm/gruber/model/mredis"
 )
 
@@ -15,6 +20,21 @@ func (t timestamp) MarshalJSON() ([]byte, error) {
 	return json.Marshal(str)
 }
 
+// optionalTimestamp Timestamp of a time, nil if the time is not set
+func optionalTimestamp(t time.Time) *timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	ts := timestamp(t)
+	return &ts
+}
+
+type date time.Time
+
+func (d date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(d).UTC().Format("2006-01-02"))
+}
+
 func (t *timestamp) String() string {
 	return time.Time(*t).String()
 }
@@ -28,10 +48,51 @@ type User struct {
 	ID int `json:"id"`
 }
 
-// DriverRequest Response data when passenger request a ride
+// Driver Response driver profile with vehicles and documents
+type Driver struct {
+	ID        int              `json:"id"`
+	Name      string           `json:"name"`
+	State     string           `json:"state"`
+	CreatedAt timestamp        `json:"created_at"`
+	Vehicles  []Vehicle        `json:"vehicles"`
+	Documents []DriverDocument `json:"documents"`
+}
+
+// Vehicle Response vehicle of a driver
+type Vehicle struct {
+	ID    int    `json:"id"`
+	Plate string `json:"plate"`
+	Make  string `json:"make"`
+	Model string `json:"model"`
+	Color string `json:"color"`
+	Seats int    `json:"seats"`
+	Class string `json:"class"`
+}
+
+// DriverDocument Response document of a driver
+type DriverDocument struct {
+	Type      string `json:"type"`
+	Number    string `json:"number"`
+	ExpiresAt date   `json:"expires_at"`
+}
+
+// Passenger Response passenger profile
+type Passenger struct {
+	ID                   int       `json:"id"`
+	Name                 string    `json:"name"`
+	Phone                string    `json:"phone"`
+	Email                string    `json:"email"`
+	Rating               float64   `json:"rating"`
+	DefaultPaymentMethod string    `json:"default_payment_method"`
+	CreatedAt            timestamp `json:"created_at"`
+}
+
+// DriverRequest Response data when passenger request a ride, distance is in kilometer and ETA in seconds
 type DriverRequest struct {
-	DriverID int      `json:"driver_id"`
+	ID       int      `json:"id"`
 	Location Location `json:"location"`
+	Distance float64  `json:"distance"`
+	ETA      int      `json:"eta"`
 }
 
 // DriverLocation Response updating driver location
@@ -52,17 +113,20 @@ type Location struct {
 	Lng float64 `json:"lng"`
 }
 
-// PopulateDriverRequests Populate repsonse for an array of drivers for ride request
-func PopulateDriverRequests(drivers []mredis.DriverLocation) []DriverLocation {
-	res := make([]DriverLocation, len(drivers))
+// PopulateDriverRequests Populate repsonse for an array of drivers for ride request with their pickup time,
+// distance is rounded to meter and ETA up to second
+func PopulateDriverRequests(drivers []mredis.DriverLocation, etas []time.Duration) []DriverRequest {
+	res := make([]DriverRequest, len(drivers))
 
 	for i, driver := range drivers {
-		res[i] = DriverLocation{
+		res[i] = DriverRequest{
 			ID: driver.DriverID,
 			Location: Location{
 				Lat: driver.Lat,
 				Lng: driver.Lng,
 			},
+			Distance: math.Round(driver.Distance*1000) / 1000,
+			ETA:      int(math.Ceil(etas[i].Seconds())),
 		}
 	}
 
@@ -73,7 +137,7 @@ func PopulateDriverHistory(driverLocations []mcass.DriverLocation) []DriverHisto
 	resp := make([]DriverHistory, len(driverLocations))
 	for i, driverLocation := range driverLocations {
 		resp[i] = DriverHistory{
-			Timestamp: timestamp(time.Unix(driverLocation.CreatedAt, 0)),
+			Timestamp: timestamp(driverLocation.CreatedAt),
 			Location: Location{
 				Lat: driverLocation.Lat,
 				Lng: driverLocation.Lng,
@@ -83,3 +147,532 @@ func PopulateDriverHistory(driverLocations []mcass.DriverLocation) []DriverHisto
 
 	return resp
 }
+
+// PopulatePassenger Populate response passenger profile
+func PopulatePassenger(passenger *mpg.Passenger) Passenger {
+	return Passenger{
+		ID:                   passenger.ID,
+		Name:                 passenger.Name,
+		Phone:                passenger.Phone,
+		Email:                passenger.Email,
+		Rating:               passenger.Rating,
+		DefaultPaymentMethod: passenger.DefaultPaymentMethod,
+		CreatedAt:            timestamp(passenger.CreatedAt),
+	}
+}
+
+// PopulateDriver Populate response driver profile
+func PopulateDriver(driver *mpg.Driver, vehicles []mpg.Vehicle, documents []mpg.DriverDocument) Driver {
+	return Driver{
+		ID:        driver.ID,
+		Name:      driver.Name,
+		State:     driver.State,
+		CreatedAt: timestamp(driver.CreatedAt),
+		Vehicles:  PopulateVehicles(vehicles),
+		Documents: PopulateDriverDocuments(documents),
+	}
+}
+
+// PopulateVehicle Populate response vehicle
+func PopulateVehicle(vehicle *mpg.Vehicle) Vehicle {
+	return Vehicle{
+		ID:    vehicle.ID,
+		Plate: vehicle.Plate,
+		Make:  vehicle.Make,
+		Model: vehicle.Model,
+		Color: vehicle.Color,
+		Seats: vehicle.Seats,
+		Class: vehicle.Class,
+	}
+}
+
+// PopulateVehicles Populate response for an array of vehicles
+func PopulateVehicles(vehicles []mpg.Vehicle) []Vehicle {
+	resp := make([]Vehicle, len(vehicles))
+	for i := range vehicles {
+		resp[i] = PopulateVehicle(&vehicles[i])
+	}
+
+	return resp
+}
+
+// PopulateDriverDocument Populate response driver document
+func PopulateDriverDocument(document *mpg.DriverDocument) DriverDocument {
+	return DriverDocument{
+		Type:      document.Type,
+		Number:    document.Number,
+		ExpiresAt: date(document.ExpiresAt),
+	}
+}
+
+// PopulateDriverDocuments Populate response for an array of driver documents
+func PopulateDriverDocuments(documents []mpg.DriverDocument) []DriverDocument {
+	resp := make([]DriverDocument, len(documents))
+	for i := range documents {
+		resp[i] = PopulateDriverDocument(&documents[i])
+	}
+
+	return resp
+}
+
+// ScheduledRide Response scheduled ride
+type ScheduledRide struct {
+	ID           int       `json:"id"`
+	PassengerID  int       `json:"passenger_id"`
+	Location     Location  `json:"location"`
+	VehicleClass string    `json:"vehicle_class"`
+	PickupAt     timestamp `json:"pickup_at"`
+	Status       string    `json:"status"`
+	RideID       int       `json:"ride_id"`
+	DriverIDs    []int     `json:"driver_ids"`
+}
+
+// PopulateScheduledRide Populate response scheduled ride
+func PopulateScheduledRide(ride *mpg.ScheduledRide) ScheduledRide {
+	driverIDs := ride.DriverIDs
+	if driverIDs == nil {
+		driverIDs = []int{}
+	}
+
+	return ScheduledRide{
+		ID:          ride.ID,
+		PassengerID: ride.PassengerID,
+		Location: Location{
+			Lat: ride.Lat,
+			Lng: ride.Lng,
+		},
+		VehicleClass: ride.VehicleClass,
+		PickupAt:     timestamp(ride.PickupAt),
+		Status:       ride.Status,
+		RideID:       ride.RideID,
+		DriverIDs:    driverIDs,
+	}
+}
+
+// Ride Response ride with its stops and cancellations
+type Ride struct {
+	ID           int        `json:"id"`
+	PassengerID  int        `json:"passenger_id"`
+	DriverID     int        `json:"driver_id"`
+	Location     Location   `json:"location"`
+	VehicleClass string     `json:"vehicle_class"`
+	Status       string     `json:"status"`
+	CreatedAt    timestamp  `json:"created_at"`
+	StartedAt    *timestamp `json:"started_at,omitempty"`
+	CompletedAt  *timestamp `json:"completed_at,omitempty"`
+	Fare         *Fare      `json:"fare,omitempty"`
+	// Payment Result of collecting the fare of a completed or tipped ride or the fee of a cancelled one, omitted otherwise
+	Payment       string             `json:"payment,omitempty"`
+	Stops         []RideStop         `json:"stops"`
+	Cancellations []RideCancellation `json:"cancellations"`
+}
+
+const (
+	// PaymentPaid The fare and tip, or the fee, are collected
+	PaymentPaid = "paid"
+	// PaymentDeclined The payment provider declined the charge, the fare stays owed until the ride is charged again
+	PaymentDeclined = "declined"
+	// PaymentFailed The charge could not be made or recorded, the fare stays owed until the ride is charged again
+	PaymentFailed = "failed"
+	// PaymentOwed The cancellation fee of a cash ride is recorded as owed by the passenger
+	PaymentOwed = "owed"
+)
+
+// Fare Response fare of a completed ride, amounts are in the smallest currency unit
+type Fare struct {
+	Amount     int64  `json:"amount"`
+	Commission int64  `json:"commission"`
+	Tip        int64  `json:"tip"`
+	Currency   string `json:"currency"`
+}
+
+// RideStop Response stop of a ride, the times are omitted until the driver arrives and departs
+type RideStop struct {
+	Position   int        `json:"position"`
+	Dropoff    bool       `json:"dropoff"`
+	Location   Location   `json:"location"`
+	Address    string     `json:"address"`
+	PlaceID    string     `json:"place_id"`
+	ArrivedAt  *timestamp `json:"arrived_at,omitempty"`
+	DepartedAt *timestamp `json:"departed_at,omitempty"`
+}
+
+// RideCancellation Response cancellation of a ride
+type RideCancellation struct {
+	CancelledBy string    `json:"cancelled_by"`
+	DriverID    int       `json:"driver_id"`
+	Reason      string    `json:"reason"`
+	Fee         int64     `json:"fee"`
+	NoShow      bool      `json:"no_show"`
+	CreatedAt   timestamp `json:"created_at"`
+}
+
+// PopulateRide Populate response ride
+func PopulateRide(ride *mpg.Ride, stops []mpg.RideStop, cancellations []mpg.RideCancellation) Ride {
+	res := Ride{
+		ID:          ride.ID,
+		PassengerID: ride.PassengerID,
+		DriverID:    ride.DriverID,
+		Location: Location{
+			Lat: ride.Lat,
+			Lng: ride.Lng,
+		},
+		VehicleClass:  ride.VehicleClass,
+		Status:        ride.Status,
+		CreatedAt:     timestamp(ride.CreatedAt),
+		StartedAt:     optionalTimestamp(ride.StartedAt),
+		CompletedAt:   optionalTimestamp(ride.CompletedAt),
+		Stops:         make([]RideStop, len(stops)),
+		Cancellations: make([]RideCancellation, len(cancellations)),
+	}
+	if ride.Currency != "" {
+		res.Fare = &Fare{
+			Amount:     ride.Fare,
+			Commission: ride.Commission,
+			Tip:        ride.Tip,
+			Currency:   ride.Currency,
+		}
+	}
+	for i, stop := range stops {
+		res.Stops[i] = PopulateRideStop(&stop)
+	}
+	for i, cancellation := range cancellations {
+		res.Cancellations[i] = RideCancellation{
+			CancelledBy: cancellation.CancelledBy,
+			DriverID:    cancellation.DriverID,
+			Reason:      cancellation.Reason,
+			Fee:         cancellation.Fee,
+			NoShow:      cancellation.NoShow,
+			CreatedAt:   timestamp(cancellation.CreatedAt),
+		}
+	}
+
+	return res
+}
+
+// PopulateRideStop Populate response stop of a ride
+func PopulateRideStop(stop *mpg.RideStop) RideStop {
+	return RideStop{
+		Position: stop.Position,
+		Dropoff:  stop.Dropoff,
+		Location: Location{
+			Lat: stop.Lat,
+			Lng: stop.Lng,
+		},
+		Address:    stop.Address,
+		PlaceID:    stop.PlaceID,
+		ArrivedAt:  optionalTimestamp(stop.ArrivedAt),
+		DepartedAt: optionalTimestamp(stop.DepartedAt),
+	}
+}
+
+// RideRating Response rating of a ride
+type RideRating struct {
+	ID          int       `json:"id"`
+	RideID      int       `json:"ride_id"`
+	DriverID    int       `json:"driver_id"`
+	PassengerID int       `json:"passenger_id"`
+	RatedBy     string    `json:"rated_by"`
+	Rating      int       `json:"rating"`
+	Tags        []string  `json:"tags"`
+	Comment     string    `json:"comment"`
+	CreatedAt   timestamp `json:"created_at"`
+}
+
+// PopulateRideRating Populate response rating of a ride
+func PopulateRideRating(rating *mpg.RideRating) RideRating {
+	tags := rating.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return RideRating{
+		ID:          rating.ID,
+		RideID:      rating.RideID,
+		DriverID:    rating.DriverID,
+		PassengerID: rating.PassengerID,
+		RatedBy:     rating.RatedBy,
+		Rating:      rating.Rating,
+		Tags:        tags,
+		Comment:     rating.Comment,
+		CreatedAt:   timestamp(rating.CreatedAt),
+	}
+}
+
+// PopulateRideRatings Populate response ratings
+func PopulateRideRatings(ratings []mpg.RideRating) []RideRating {
+	res := make([]RideRating, len(ratings))
+	for i := range ratings {
+		res[i] = PopulateRideRating(&ratings[i])
+	}
+	return res
+}
+
+// JournalEntry Response ledger entry of a ride, amounts are in the smallest currency unit
+type JournalEntry struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"`
+	RideID      int       `json:"ride_id"`
+	Amount      int64     `json:"amount"`
+	Currency    string    `json:"currency"`
+	ProviderRef string    `json:"provider_ref"`
+	Memo        string    `json:"memo"`
+	CreatedAt   timestamp `json:"created_at"`
+}
+
+// PopulateJournalEntry Populate response ledger entry
+func PopulateJournalEntry(entry *mpg.JournalEntry) JournalEntry {
+	return JournalEntry{
+		ID:          entry.ID,
+		Kind:        entry.Kind,
+		RideID:      entry.RideID,
+		Amount:      entry.Amount,
+		Currency:    entry.Currency,
+		ProviderRef: entry.ProviderRef,
+		Memo:        entry.Memo,
+		CreatedAt:   timestamp(entry.CreatedAt),
+	}
+}
+
+// PopulateJournalEntries Populate response ledger entries
+func PopulateJournalEntries(entries []mpg.JournalEntry) []JournalEntry {
+	res := make([]JournalEntry, len(entries))
+	for i := range entries {
+		res[i] = PopulateJournalEntry(&entries[i])
+	}
+	return res
+}
+
+// EarningAdjustment Response adjustment of the earnings of a driver
+type EarningAdjustment struct {
+	ID        int       `json:"id"`
+	DriverID  int       `json:"driver_id"`
+	RideID    int       `json:"ride_id"`
+	Amount    int64     `json:"amount"`
+	Currency  string    `json:"currency"`
+	Reason    string    `json:"reason"`
+	CreatedAt timestamp `json:"created_at"`
+}
+
+// PopulateEarningAdjustment Populate response adjustment of the earnings of a driver
+func PopulateEarningAdjustment(adjustment *mpg.EarningAdjustment) EarningAdjustment {
+	return EarningAdjustment{
+		ID:        adjustment.ID,
+		DriverID:  adjustment.DriverID,
+		RideID:    adjustment.RideID,
+		Amount:    adjustment.Amount,
+		Currency:  adjustment.Currency,
+		Reason:    adjustment.Reason,
+		CreatedAt: timestamp(adjustment.CreatedAt),
+	}
+}
+
+// Earnings Response earnings statement of a driver, days are in the timezone of the statement and To is included
+type Earnings struct {
+	DriverID int             `json:"driver_id"`
+	From     string          `json:"from"`
+	To       string          `json:"to"`
+	Totals   []EarningTotals `json:"totals"`
+	Days     []EarningTotals `json:"days"`
+	Weeks    []EarningTotals `json:"weeks"`
+	Lines    []EarningLine   `json:"lines"`
+}
+
+// EarningTotals Response totals of a statement, a day or a week from its start day in a currency
+type EarningTotals struct {
+	Start       string `json:"start"`
+	Currency    string `json:"currency"`
+	Rides       int    `json:"rides"`
+	Fares       int64  `json:"fares"`
+	Commission  int64  `json:"commission"`
+	Tips        int64  `json:"tips"`
+	Adjustments int64  `json:"adjustments"`
+	Net         int64  `json:"net"`
+}
+
+// EarningLine Response completed ride or adjustment of a statement
+type EarningLine struct {
+	Kind         string    `json:"kind"`
+	Time         timestamp `json:"time"`
+	RideID       int       `json:"ride_id"`
+	AdjustmentID int       `json:"adjustment_id"`
+	Currency     string    `json:"currency"`
+	Fare         int64     `json:"fare"`
+	Commission   int64     `json:"commission"`
+	Tip          int64     `json:"tip"`
+	Adjustment   int64     `json:"adjustment"`
+	Net          int64     `json:"net"`
+	Memo         string    `json:"memo"`
+}
+
+// PopulateEarnings Populate response earnings statement
+func PopulateEarnings(statement *earnings.Statement) Earnings {
+	res := Earnings{
+		DriverID: statement.DriverID,
+		From:     statement.From.Format(mpg.DateFormat),
+		To:       statement.To.AddDate(0, 0, -1).Format(mpg.DateFormat),
+		Totals:   populateEarningTotals(statement.Totals),
+		Days:     populateEarningTotals(statement.Days),
+		Weeks:    populateEarningTotals(statement.Weeks),
+		Lines:    make([]EarningLine, len(statement.Lines)),
+	}
+	for i := range statement.Lines {
+		line := &statement.Lines[i]
+		res.Lines[i] = EarningLine{
+			Kind:         line.Kind,
+			Time:         timestamp(line.At),
+			RideID:       line.RideID,
+			AdjustmentID: line.AdjustmentID,
+			Currency:     line.Currency,
+			Fare:         line.Fare,
+			Commission:   line.Commission,
+			Tip:          line.Tip,
+			Adjustment:   line.Adjustment,
+			Net:          line.Net(),
+			Memo:         line.Memo,
+		}
+	}
+	return res
+}
+
+// populateEarningTotals Populate response totals of periods
+func populateEarningTotals(periods []earnings.Totals) []EarningTotals {
+	res := make([]EarningTotals, len(periods))
+	for i, totals := range periods {
+		res[i] = EarningTotals{
+			Start:       totals.Start.Format(mpg.DateFormat),
+			Currency:    totals.Currency,
+			Rides:       totals.Rides,
+			Fares:       totals.Fares,
+			Commission:  totals.Commission,
+			Tips:        totals.Tips,
+			Adjustments: totals.Adjustments,
+			Net:         totals.Net,
+		}
+	}
+	return res
+}
+
+// Zones Response GeoJSON FeatureCollection of zones
+type Zones struct {
+	Type     string `json:"type"`
+	Features []Zone `json:"features"`
+}
+
+// Zone Response GeoJSON Feature of a zone
+type Zone struct {
+	Type       string         `json:"type"`
+	Geometry   ZoneGeometry   `json:"geometry"`
+	Properties ZoneProperties `json:"properties"`
+}
+
+// ZoneGeometry Response GeoJSON MultiPolygon, positions are [lng, lat]
+type ZoneGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates [][][][]float64 `json:"coordinates"`
+}
+
+// ZoneProperties Response zone rules
+type ZoneProperties struct {
+	ID             int     `json:"id,omitempty"`
+	Name           string  `json:"name"`
+	Kind           string  `json:"kind"`
+	Queue          bool    `json:"queue"`
+	PickupFee      int64   `json:"pickup_fee"`
+	FareMultiplier float64 `json:"fare_multiplier"`
+}
+
+// PopulateZone Populate response zone
+func PopulateZone(zone *geofence.Zone) Zone {
+	coordinates := make([][][][]float64, len(zone.Polygons))
+	for i, polygon := range zone.Polygons {
+		coordinates[i] = make([][][]float64, len(polygon))
+		for j, ring := range polygon {
+			coordinates[i][j] = make([][]float64, len(ring))
+			for k, point := range ring {
+				coordinates[i][j][k] = []float64{point.Lng, point.Lat}
+			}
+		}
+	}
+
+	return Zone{
+		Type:     "Feature",
+		Geometry: ZoneGeometry{Type: "MultiPolygon", Coordinates: coordinates},
+		Properties: ZoneProperties{
+			ID:             zone.ID,
+			Name:           zone.Name,
+			Kind:           zone.Kind,
+			Queue:          zone.Queue,
+			PickupFee:      zone.PickupFee,
+			FareMultiplier: zone.FareMultiplier,
+		},
+	}
+}
+
+// PopulateZones Populate response for an array of zones
+func PopulateZones(zones []geofence.Zone) Zones {
+	resp := Zones{Type: "FeatureCollection", Features: make([]Zone, len(zones))}
+	for i := range zones {
+		resp.Features[i] = PopulateZone(&zones[i])
+	}
+
+	return resp
+}
+
+// HeatmapCells Response GeoJSON FeatureCollection of heatmap cells
+type HeatmapCells struct {
+	Type     string        `json:"type"`
+	Features []HeatmapCell `json:"features"`
+}
+
+// HeatmapCell Response GeoJSON Feature of a heatmap cell
+type HeatmapCell struct {
+	Type       string                `json:"type"`
+	Geometry   HeatmapCellGeometry   `json:"geometry"`
+	Properties HeatmapCellProperties `json:"properties"`
+}
+
+// HeatmapCellGeometry Response GeoJSON Polygon of a cell, positions are [lng, lat]
+type HeatmapCellGeometry struct {
+	Type        string        `json:"type"`
+	Coordinates [][][]float64 `json:"coordinates"`
+}
+
+// HeatmapCellProperties Response counts of a cell
+type HeatmapCellProperties struct {
+	Geohash  string `json:"geohash"`
+	Drivers  int    `json:"drivers"`
+	Requests int    `json:"requests"`
+}
+
+// PopulateHeatmapCell Populate response heatmap cell
+func PopulateHeatmapCell(cell *heatmap.Cell) HeatmapCell {
+	box := cell.Box
+	return HeatmapCell{
+		Type: "Feature",
+		Geometry: HeatmapCellGeometry{
+			Type: "Polygon",
+			Coordinates: [][][]float64{{
+				{box.MinLng, box.MinLat},
+				{box.MaxLng, box.MinLat},
+				{box.MaxLng, box.MaxLat},
+				{box.MinLng, box.MaxLat},
+				{box.MinLng, box.MinLat},
+			}},
+		},
+		Properties: HeatmapCellProperties{
+			Geohash:  cell.Geohash,
+			Drivers:  cell.Drivers,
+			Requests: cell.Requests,
+		},
+	}
+}
+
+// PopulateHeatmapCells Populate response for an array of heatmap cells
+func PopulateHeatmapCells(cells []heatmap.Cell) HeatmapCells {
+	resp := HeatmapCells{Type: "FeatureCollection", Features: make([]HeatmapCell, len(cells))}
+	for i := range cells {
+		resp.Features[i] = PopulateHeatmapCell(&cells[i])
+	}
+
+	return resp
+}
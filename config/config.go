@@ -1,24 +1,79 @@
 package config
 
 import (
-	"fmt"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
-var envKeys = []string{
-	"PG_HOST", "PG_PORT", "PG_USER", "PG_PASS", "PG_NAME",
-	"CS_CLUSTER", "CS_PORT", "CS_USER", "CS_PASSWORD", "CS_KEYSPACE",
-	"RD_HOST", "RD_PORT", "RD_PASSWORD",
-	"GB_PORT",
+// envKeys Environment variables of each configuration section
+var envKeys = map[string][]string{
+	"postgresql": {
+		"PG_HOST", "PG_PORT", "PG_USER", "PG_PASS", "PG_NAME",
+		"PG_POOL_SIZE", "PG_POOL_TIMEOUT", "PG_IDLE_TIMEOUT", "PG_DIAL_TIMEOUT", "PG_READ_TIMEOUT", "PG_WRITE_TIMEOUT", "PG_MAX_RETRIES",
+		"PG_SSLMODE", "PG_SSLROOTCERT", "PG_SSLCERT", "PG_SSLKEY",
+	},
+	"cassandra": {
+		"CS_CLUSTER", "CS_PORT", "CS_USER", "CS_PASSWORD", "CS_KEYSPACE",
+		"CS_NUM_CONNS", "CS_TIMEOUT", "CS_CONNECT_TIMEOUT", "CS_CONSISTENCY", "CS_LOCAL_DC",
+		"CS_SSL", "CS_SSL_CA", "CS_SSL_CERT", "CS_SSL_KEY", "CS_SSL_VERIFY_HOST",
+	},
+	"redis": {
+		"RD_HOST", "RD_PORT", "RD_PASSWORD", "RD_DB",
+		"RD_POOL_SIZE", "RD_POOL_TIMEOUT", "RD_IDLE_TIMEOUT", "RD_DIAL_TIMEOUT", "RD_READ_TIMEOUT", "RD_WRITE_TIMEOUT", "RD_MAX_RETRIES",
+		"RD_TLS", "RD_TLS_CA", "RD_TLS_SKIP_VERIFY",
+		"RD_SENTINEL_MASTER", "RD_SENTINEL_ADDRS", "RD_CLUSTER_ADDRS",
+	},
+	"app": {"GB_PORT", "GB_DEBUG_ADDR"},
+	"ratelimit": {
+		"RL_DEFAULT_RATE", "RL_DEFAULT_BURST", "RL_DRIVERS_RATE", "RL_DRIVERS_BURST",
+	},
+	"cache": {
+		"CA_DRIVER_STORE", "CA_DRIVER_SIZE", "CA_DRIVER_TTL",
+	},
+	"writebehind": {
+		"WB_ENABLED", "WB_QUEUE_SIZE", "WB_WORKERS", "WB_BATCH_SIZE", "WB_FLUSH_INTERVAL", "WB_MAX_RETRIES", "WB_RETRY_BACKOFF", "WB_ENQUEUE_TIMEOUT",
+	},
+	"scheduler": {
+		"SC_ENABLED", "SC_LEAD_TIME", "SC_INTERVAL",
+	},
+	"cancellation": {
+		"CN_FREE_WINDOW", "CN_FEE", "CN_NO_SHOW_WAIT", "CN_NO_SHOW_FEE",
+	},
+	"eta": {
+		"ETA_DEFAULT_SPEED", "ETA_SPEED_PROFILE", "ETA_TIMEZONE", "ETA_HISTORY_WINDOW",
+	},
+	"matching": {
+		"MT_RANKING", "MT_DISTANCE_WEIGHT", "MT_HEADING_WEIGHT", "MT_RATING_WEIGHT", "MT_IDLE_WEIGHT", "MT_HEADING_WINDOW",
+		"MT_BATCH_WINDOW", "MT_BATCH_SIZE",
+		"MT_MIN_RATING",
+	},
+	"geofence": {"GF_FILES", "GF_DATABASE"},
+	"pricing": {
+		"PR_CURRENCY", "PR_BASE_FARE", "PR_PER_KM", "PR_PER_MINUTE", "PR_MINIMUM_FARE", "PR_COMMISSION_RATE",
+	},
+	"payment":  {"PAY_PROVIDER"},
+	"earnings": {"ER_TIMEZONE"},
 }
 
 // Config app configuration
 type Config struct {
-	Postgresql Postgresql
-	Cassandra  Cassandra
-	Redis      Redis
-	App        App
+	Postgresql   Postgresql
+	Cassandra    Cassandra
+	Redis        Redis
+	App          App
+	RateLimit    RateLimit
+	Cache        Cache
+	WriteBehind  WriteBehind
+	Scheduler    Scheduler
+	Cancellation Cancellation
+	ETA          ETA
+	Matching     Matching
+	Geofence     Geofence
+	Pricing      Pricing
+	Payment      Payment
+	Earnings     Earnings
 }
 
 // Postgresql Postgresql configuration
@@ -28,30 +83,197 @@ type Postgresql struct {
 	User     string `mapstructure:"pg_user"`
 	Password string `mapstructure:"pg_pass"`
 	Name     string `mapstructure:"pg_name"`
+
+	// Connection pool, zero values fall back to go-pg defaults
+	PoolSize     int           `mapstructure:"pg_pool_size"`
+	PoolTimeout  time.Duration `mapstructure:"pg_pool_timeout"`
+	IdleTimeout  time.Duration `mapstructure:"pg_idle_timeout"`
+	DialTimeout  time.Duration `mapstructure:"pg_dial_timeout"`
+	ReadTimeout  time.Duration `mapstructure:"pg_read_timeout"`
+	WriteTimeout time.Duration `mapstructure:"pg_write_timeout"`
+	MaxRetries   int           `mapstructure:"pg_max_retries"`
+
+	// SSLMode is one of disable, require, verify-ca, verify-full (same meaning as libpq)
+	SSLMode     string `mapstructure:"pg_sslmode"`
+	SSLRootCert string `mapstructure:"pg_sslrootcert"`
+	SSLCert     string `mapstructure:"pg_sslcert"`
+	SSLKey      string `mapstructure:"pg_sslkey"`
 }
 
+// Cassandra Cassandra configuration
 type Cassandra struct {
+	// Cluster comma separated list of contact points
 	Cluster  string `mapstructure:"cs_cluster"`
 	Port     string `mapstructure:"cs_port"`
 	User     string `mapstructure:"cs_user"`
 	Password string `mapstructure:"cs_password"`
 	Keyspace string `mapstructure:"cs_keyspace"`
+
+	NumConns       int           `mapstructure:"cs_num_conns"`
+	Timeout        time.Duration `mapstructure:"cs_timeout"`
+	ConnectTimeout time.Duration `mapstructure:"cs_connect_timeout"`
+	// Consistency default consistency level, e.g. QUORUM, LOCAL_QUORUM, ONE
+	Consistency string `mapstructure:"cs_consistency"`
+	// LocalDC enable DC-aware load balancing with this data center as local
+	LocalDC string `mapstructure:"cs_local_dc"`
+
+	SSL           bool   `mapstructure:"cs_ssl"`
+	SSLCA         string `mapstructure:"cs_ssl_ca"`
+	SSLCert       string `mapstructure:"cs_ssl_cert"`
+	SSLKey        string `mapstructure:"cs_ssl_key"`
+	SSLVerifyHost bool   `mapstructure:"cs_ssl_verify_host"`
 }
 
+// Redis Redis configuration
 type Redis struct {
 	Host     string `mapstructure:"rd_host"`
 	Port     string `mapstructure:"rd_port"`
 	Password string `mapstructure:"rd_password"`
+	DB       int    `mapstructure:"rd_db"`
+
+	// Connection pool, zero values fall back to go-redis defaults
+	PoolSize     int           `mapstructure:"rd_pool_size"`
+	PoolTimeout  time.Duration `mapstructure:"rd_pool_timeout"`
+	IdleTimeout  time.Duration `mapstructure:"rd_idle_timeout"`
+	DialTimeout  time.Duration `mapstructure:"rd_dial_timeout"`
+	ReadTimeout  time.Duration `mapstructure:"rd_read_timeout"`
+	WriteTimeout time.Duration `mapstructure:"rd_write_timeout"`
+	MaxRetries   int           `mapstructure:"rd_max_retries"`
+
+	// TLS is only supported when connecting to a single node
+	TLS           bool   `mapstructure:"rd_tls"`
+	TLSCA         string `mapstructure:"rd_tls_ca"`
+	TLSSkipVerify bool   `mapstructure:"rd_tls_skip_verify"`
+
+	// SentinelMaster and SentinelAddrs (comma separated) enable Redis Sentinel failover
+	SentinelMaster string `mapstructure:"rd_sentinel_master"`
+	SentinelAddrs  string `mapstructure:"rd_sentinel_addrs"`
+	// ClusterAddrs comma separated seed list of Redis Cluster nodes
+	ClusterAddrs string `mapstructure:"rd_cluster_addrs"`
 }
 
 // App
 type App struct {
 	Port int `mapstructure:"gb_port"`
+	// DebugAddr Internal address serving the counters of /debug/vars, e.g. 127.0.0.1:6060. They are not served if empty
+	DebugAddr string `mapstructure:"gb_debug_addr"`
+}
+
+// RateLimit Token bucket limits per route group, rate is requests per second and burst the bucket size.
+// A zero rate disables the limit of the group
+type RateLimit struct {
+	// Default limit of routes outside of /drivers, keyed by client IP
+	DefaultRate  float64 `mapstructure:"rl_default_rate"`
+	DefaultBurst int     `mapstructure:"rl_default_burst"`
+	// Drivers limit of /drivers routes, keyed by driver id
+	DriversRate  float64 `mapstructure:"rl_drivers_rate"`
+	DriversBurst int     `mapstructure:"rl_drivers_burst"`
+}
+
+// Cache Cache configuration
+type Cache struct {
+	// DriverStore Store of the driver lookup cache: lru (in-process), redis, or empty to disable
+	DriverStore string        `mapstructure:"ca_driver_store"`
+	DriverSize  int           `mapstructure:"ca_driver_size"`
+	DriverTTL   time.Duration `mapstructure:"ca_driver_ttl"`
+}
+
+// WriteBehind Asynchronous writes of driver location history, zero values use defaults
+type WriteBehind struct {
+	Enabled        bool          `mapstructure:"wb_enabled"`
+	QueueSize      int           `mapstructure:"wb_queue_size"`
+	Workers        int           `mapstructure:"wb_workers"`
+	BatchSize      int           `mapstructure:"wb_batch_size"`
+	FlushInterval  time.Duration `mapstructure:"wb_flush_interval"`
+	MaxRetries     int           `mapstructure:"wb_max_retries"`
+	RetryBackoff   time.Duration `mapstructure:"wb_retry_backoff"`
+	EnqueueTimeout time.Duration `mapstructure:"wb_enqueue_timeout"`
+}
+
+// Scheduler Dispatch of scheduled rides, zero values use defaults
+type Scheduler struct {
+	Enabled bool `mapstructure:"sc_enabled"`
+	// LeadTime Drivers are searched this long before pickup
+	LeadTime time.Duration `mapstructure:"sc_lead_time"`
+	// Interval Time between two reads of due rides
+	Interval time.Duration `mapstructure:"sc_interval"`
+}
+
+// Cancellation Ride cancellation policy, fees are in the smallest currency unit
+type Cancellation struct {
+	// FreeWindow Passengers cancel for free this long after the request
+	FreeWindow time.Duration `mapstructure:"cn_free_window"`
+	// Fee Passenger cancellation fee after the free window once a driver is assigned
+	Fee int64 `mapstructure:"cn_fee"`
+	// NoShowWait Wait of the driver at pickup after which the passenger is a no-show, 0 disables no-shows
+	NoShowWait time.Duration `mapstructure:"cn_no_show_wait"`
+	NoShowFee  int64         `mapstructure:"cn_no_show_fee"`
+}
+
+// ETA Pickup time estimation, speeds are in km/h
+type ETA struct {
+	// DefaultSpeed Average speed of hours missing in SpeedProfile (default 25)
+	DefaultSpeed float64 `mapstructure:"eta_default_speed"`
+	// SpeedProfile Average speed by hours of day, e.g. "7-9:15,17-19:12"
+	SpeedProfile string `mapstructure:"eta_speed_profile"`
+	// Timezone Location of the hours of SpeedProfile, e.g. Asia/Ho_Chi_Minh (default UTC)
+	Timezone string `mapstructure:"eta_timezone"`
+	// HistoryWindow Location history used for the recent speed of drivers, zero disables it
+	HistoryWindow time.Duration `mapstructure:"eta_history_window"`
+}
+
+// Matching Ranking and rating threshold of drivers found for a ride and batching of ride assignment.
+// Drivers are ordered nearest first if ranking is disabled
+type Matching struct {
+	Ranking        bool    `mapstructure:"mt_ranking"`
+	DistanceWeight float64 `mapstructure:"mt_distance_weight"`
+	HeadingWeight  float64 `mapstructure:"mt_heading_weight"`
+	RatingWeight   float64 `mapstructure:"mt_rating_weight"`
+	IdleWeight     float64 `mapstructure:"mt_idle_weight"`
+	// HeadingWindow Location history used for the heading of drivers, zero ignores the heading
+	HeadingWindow time.Duration `mapstructure:"mt_heading_window"`
+	// BatchWindow Rides are collected this long then assigned together, zero assigns each ride on request
+	BatchWindow time.Duration `mapstructure:"mt_batch_window"`
+	// BatchSize A batch is assigned as soon as it has this many rides (default 100)
+	BatchSize int `mapstructure:"mt_batch_size"`
+	// MinRating Drivers rated below are not matched, drivers not rated yet are. Zero matches every driver
+	MinRating float64 `mapstructure:"mt_min_rating"`
+}
+
+// Geofence Sources of geofenced zones, there is no zone if none is set
+type Geofence struct {
+	// Files Comma separated GeoJSON files of zones
+	Files string `mapstructure:"gf_files"`
+	// Database Load zones of the zones table
+	Database bool `mapstructure:"gf_database"`
+}
+
+// Pricing Fare of completed rides, amounts are in minor units of the currency
+type Pricing struct {
+	// Currency ISO 4217 code of fares (default VND)
+	Currency    string `mapstructure:"pr_currency"`
+	BaseFare    int64  `mapstructure:"pr_base_fare"`
+	PerKm       int64  `mapstructure:"pr_per_km"`
+	PerMinute   int64  `mapstructure:"pr_per_minute"`
+	MinimumFare int64  `mapstructure:"pr_minimum_fare"`
+	// CommissionRate Part of fares kept by the platform, e.g. 0.2
+	CommissionRate float64 `mapstructure:"pr_commission_rate"`
+}
+
+// Payment Payment provider charging passengers
+type Payment struct {
+	// Provider Only "fake" is supported, rides are not charged if empty
+	Provider string `mapstructure:"pay_provider"`
+}
+
+// Earnings Driver earnings statements
+type Earnings struct {
+	// Timezone Location of the days and weeks of statements, e.g. Asia/Ho_Chi_Minh (default UTC)
+	Timezone string `mapstructure:"er_timezone"`
 }
 
 // ReadConfig read configuration from ENV or from config file
 func ReadConfig(configFile string) (*Config, error) {
-	var cf Config
 	if configFile != "" {
 		// read from config yaml
 		viper.AddConfigPath(".")
@@ -59,39 +281,19 @@ func ReadConfig(configFile string) (*Config, error) {
 		if err := viper.ReadInConfig(); err != nil {
 			return nil, err
 		}
-		if err := viper.Unmarshal(&cf); err != nil {
-			panic(err)
+	} else {
+		// bind every variable under its section, e.g. PG_HOST to postgresql.pg_host, so the whole config unmarshals at once
+		for section, keys := range envKeys {
+			for _, key := range keys {
+				if err := viper.BindEnv(section+"."+strings.ToLower(key), key); err != nil {
+					return nil, err
+				}
+			}
 		}
-		fmt.Printf("%+v", cf)
-
-		return &cf, nil
-	}
-	viper.AutomaticEnv()
-	for _, key := range envKeys {
-		viper.BindEnv(key)
-	}
-	if err := viper.Unmarshal(&cf.Postgresql); err != nil {
-		return nil, err
-	}
-
-	for _, key := range envKeys {
-		viper.BindEnv(key)
-	}
-	if err := viper.Unmarshal(&cf.Redis); err != nil {
-		return nil, err
 	}
 
-	for _, key := range envKeys {
-		viper.BindEnv(key)
-	}
-	if err := viper.Unmarshal(&cf.Cassandra); err != nil {
-		return nil, err
-	}
-
-	for _, key := range envKeys {
-		viper.BindEnv(key)
-	}
-	if err := viper.Unmarshal(&cf.App); err != nil {
+	var cf Config
+	if err := viper.Unmarshal(&cf); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadConfigEnv(t *testing.T) {
+	env := map[string]string{
+		"PG_HOST":         "pg.local",
+		"PG_POOL_TIMEOUT": "4s",
+		"CS_NUM_CONNS":    "2",
+		"RD_TLS":          "true",
+		"GB_PORT":         "8000",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	cf, err := ReadConfig("")
+	assert.Nil(t, err)
+	assert.Equal(t, "pg.local", cf.Postgresql.Host)
+	assert.Equal(t, 4*time.Second, cf.Postgresql.PoolTimeout)
+	assert.Equal(t, 2, cf.Cassandra.NumConns)
+	assert.True(t, cf.Redis.TLS)
+	assert.Equal(t, 8000, cf.App.Port)
+	assert.Equal(t, "", cf.Redis.Host)
+}
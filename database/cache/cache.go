@@ -0,0 +1,116 @@
+// Package cache implements a read-through cache of driver lookups in front of database.PgI
+package cache
+
+import (
+	"sync/atomic"
+
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// Store Storage of cached drivers, Get returns nil without error on a miss
+type Store interface {
+	Get(driverID int) (*mpg.Driver, error)
+	Set(driver *mpg.Driver) error
+	Delete(driverID int) error
+}
+
+// Stats Hit and miss counters of a cache
+type Stats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	// Errors store errors, the lookup falls back to the database
+	Errors uint64 `json:"errors"`
+}
+
+// Pg Cache GetDriver of a database.PgI, writes changing a driver invalidate it and other methods are passed through.
+// Drivers not found are not cached so a new driver is visible at once
+type Pg struct {
+	database.PgI
+	store Store
+
+	hits, misses, errors uint64
+}
+
+var _ database.PgI = (*Pg)(nil)
+
+// NewPg Wrap db with a driver cache in store
+func NewPg(db database.PgI, store Store) *Pg {
+	return &Pg{
+		PgI:   db,
+		store: store,
+	}
+}
+
+// GetDriver Get driver from cache, or from the database on a miss
+func (db *Pg) GetDriver(driverID int) (*mpg.Driver, error) {
+	driver, err := db.store.Get(driverID)
+	if err != nil {
+		atomic.AddUint64(&db.errors, 1)
+	}
+	if driver != nil {
+		atomic.AddUint64(&db.hits, 1)
+		return driver, nil
+	}
+
+	atomic.AddUint64(&db.misses, 1)
+	driver, err = db.PgI.GetDriver(driverID)
+	if err != nil || driver == nil {
+		return driver, err
+	}
+
+	if err := db.store.Set(driver); err != nil {
+		atomic.AddUint64(&db.errors, 1)
+	}
+	return driver, nil
+}
+
+// UpdateDriverState Update driver state in the database then invalidate the cached driver
+func (db *Pg) UpdateDriverState(driverID int, state string) error {
+	if err := db.PgI.UpdateDriverState(driverID, state); err != nil {
+		return err
+	}
+
+	return db.store.Delete(driverID)
+}
+
+// CreateRideRating Insert rating then invalidate the cached driver if the driver is rated, its average rating changed
+func (db *Pg) CreateRideRating(rating *mpg.RideRating) (bool, error) {
+	created, err := db.PgI.CreateRideRating(rating)
+	if err != nil || !created || rating.RatedBy != mpg.RatedByPassenger {
+		return created, err
+	}
+
+	return created, db.store.Delete(rating.DriverID)
+}
+
+// CreateVehicle Insert vehicle then invalidate the cached driver, its vehicle classes changed
+func (db *Pg) CreateVehicle(vehicle *mpg.Vehicle) error {
+	if err := db.PgI.CreateVehicle(vehicle); err != nil {
+		return err
+	}
+
+	return db.store.Delete(vehicle.DriverID)
+}
+
+// DeleteVehicle Delete vehicle then invalidate the cached driver, its vehicle classes changed
+func (db *Pg) DeleteVehicle(vehicleID int) error {
+	vehicle, err := db.PgI.GetVehicle(vehicleID)
+	if err != nil || vehicle == nil {
+		return err
+	}
+	if err := db.PgI.DeleteVehicle(vehicleID); err != nil {
+		return err
+	}
+
+	return db.store.Delete(vehicle.DriverID)
+}
+
+// Stats Get hit and miss counters
+func (db *Pg) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadUint64(&db.hits),
+		Misses: atomic.LoadUint64(&db.misses),
+		Errors: atomic.LoadUint64(&db.errors),
+	}
+}
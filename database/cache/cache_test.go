@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/database/dbtest"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+func TestPgContract(t *testing.T) {
+	dbtest.TestPg(t, func(t *testing.T) database.PgI {
+		return NewPg(memory.NewPg(), NewLRU(10, time.Minute))
+	})
+}
+
+func TestPgGetDriver(t *testing.T) {
+	db := NewPg(memory.NewPg(), NewLRU(10, time.Minute))
+	driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+	assert.NoError(t, db.CreateDriver(&driver))
+
+	for i := 0; i < 3; i++ {
+		cached, err := db.GetDriver(driver.ID)
+		assert.NoError(t, err)
+		if assert.NotNil(t, cached) {
+			assert.Equal(t, mpg.StateAvailable, cached.State)
+		}
+	}
+	assert.Equal(t, Stats{Hits: 2, Misses: 1}, db.Stats())
+
+	// Not found drivers are not cached
+	for i := 0; i < 2; i++ {
+		cached, err := db.GetDriver(driver.ID + 1)
+		assert.NoError(t, err)
+		assert.Nil(t, cached)
+	}
+	assert.Equal(t, Stats{Hits: 2, Misses: 3}, db.Stats())
+
+	// Updating state invalidates the cached driver
+	assert.NoError(t, db.UpdateDriverState(driver.ID, mpg.StateBusy))
+	cached, err := db.GetDriver(driver.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, cached) {
+		assert.Equal(t, mpg.StateBusy, cached.State)
+	}
+	assert.Equal(t, Stats{Hits: 2, Misses: 4}, db.Stats())
+}
+
+func TestPgCreateRideRating(t *testing.T) {
+	db := NewPg(memory.NewPg(), NewLRU(10, time.Minute))
+	driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+	assert.NoError(t, db.CreateDriver(&driver))
+	passenger := mpg.Passenger{Name: "passenger"}
+	assert.NoError(t, db.CreatePassenger(&passenger))
+	ride := mpg.Ride{PassengerID: passenger.ID, DriverID: driver.ID, Status: mpg.RideCompleted}
+	assert.NoError(t, db.CreateRide(&ride))
+
+	cached, err := db.GetDriver(driver.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, cached) {
+		assert.Equal(t, 0.0, cached.Rating)
+	}
+
+	// Rating the driver invalidates the cached driver so the new average is read
+	rating := mpg.RideRating{RideID: ride.ID, DriverID: driver.ID, PassengerID: passenger.ID, RatedBy: mpg.RatedByPassenger, Rating: 4}
+	created, err := db.CreateRideRating(&rating)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	cached, err = db.GetDriver(driver.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, cached) {
+		assert.Equal(t, 4.0, cached.Rating)
+	}
+	assert.Equal(t, Stats{Hits: 0, Misses: 2}, db.Stats())
+}
+
+func TestLRU(t *testing.T) {
+	store := NewLRU(2, time.Minute)
+	for id := 1; id <= 2; id++ {
+		assert.NoError(t, store.Set(&mpg.Driver{ID: id}))
+	}
+
+	// 1 is used so 2 is evicted by 3
+	driver, _ := store.Get(1)
+	assert.NotNil(t, driver)
+	assert.NoError(t, store.Set(&mpg.Driver{ID: 3}))
+	driver, _ = store.Get(2)
+	assert.Nil(t, driver)
+	driver, _ = store.Get(1)
+	assert.NotNil(t, driver)
+
+	assert.NoError(t, store.Delete(1))
+	driver, _ = store.Get(1)
+	assert.Nil(t, driver)
+}
+
+func TestLRUExpire(t *testing.T) {
+	store := NewLRU(2, 10*time.Millisecond)
+	assert.NoError(t, store.Set(&mpg.Driver{ID: 1}))
+	driver, _ := store.Get(1)
+	assert.NotNil(t, driver)
+
+	time.Sleep(20 * time.Millisecond)
+	driver, _ = store.Get(1)
+	assert.Nil(t, driver)
+}
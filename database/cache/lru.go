@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// LRU In-process Store which keeps at most size drivers for ttl, the least recently used is evicted first
+type LRU struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[int]*list.Element
+}
+
+type lruEntry struct {
+	driver    mpg.Driver
+	expiresAt time.Time
+}
+
+var _ Store = (*LRU)(nil)
+
+// NewLRU Create an in-process LRU store
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[int]*list.Element),
+	}
+}
+
+// Get Get a driver which is not expired
+func (s *LRU) Get(driverID int) (*mpg.Driver, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[driverID]
+	if !ok {
+		return nil, nil
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		s.order.Remove(element)
+		delete(s.entries, driverID)
+		return nil, nil
+	}
+
+	s.order.MoveToFront(element)
+	driver := entry.driver
+	return &driver, nil
+}
+
+// Set Add or replace a driver
+func (s *LRU) Set(driver *mpg.Driver) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := &lruEntry{driver: *driver, expiresAt: time.Now().Add(s.ttl)}
+	if element, ok := s.entries[driver.ID]; ok {
+		element.Value = entry
+		s.order.MoveToFront(element)
+		return nil
+	}
+
+	s.entries[driver.ID] = s.order.PushFront(entry)
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruEntry).driver.ID)
+	}
+	return nil
+}
+
+// Delete Remove a driver
+func (s *LRU) Delete(driverID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.entries[driverID]; ok {
+		s.order.Remove(element)
+		delete(s.entries, driverID)
+	}
+	return nil
+}
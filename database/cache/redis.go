@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/trietphm/gruber/model/mpg"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+// Redis Store shared by every app instance, drivers are JSON values which expire after ttl
+type Redis struct {
+	client redis.Cmdable
+	ttl    time.Duration
+}
+
+var _ Store = (*Redis)(nil)
+
+// NewRedis Create a redis store
+func NewRedis(client redis.Cmdable, ttl time.Duration) *Redis {
+	return &Redis{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+func driverKey(driverID int) string {
+	return mredis.KeyPrefixDriver + strconv.Itoa(driverID)
+}
+
+// Get Get a driver
+func (s *Redis) Get(driverID int) (*mpg.Driver, error) {
+	data, err := s.client.Get(driverKey(driverID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var driver mpg.Driver
+	if err := json.Unmarshal(data, &driver); err != nil {
+		return nil, err
+	}
+	return &driver, nil
+}
+
+// Set Add or replace a driver
+func (s *Redis) Set(driver *mpg.Driver) error {
+	data, err := json.Marshal(driver)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Set(driverKey(driver.ID), data, s.ttl).Err()
+}
+
+// Delete Remove a driver
+func (s *Redis) Delete(driverID int) error {
+	return s.client.Del(driverKey(driverID)).Err()
+}
@@ -1,9 +1,11 @@
 package database
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/pkg/errors"
 	"github.com/trietphm/gruber/config"
 	"github.com/trietphm/gruber/model/mcass"
 )
@@ -26,9 +28,25 @@ type Cassandra struct {
 
 var _ CassandraI = CassandraI(Cassandra{})
 
-// OpenPostgresqlDB Open connection to postgresql
+// OpenCassandraDB Open connection to cassandra
 func OpenCassandraDB(cfg config.Cassandra) (*Cassandra, error) {
-	cluster := gocql.NewCluster([]string{cfg.Cluster}...)
+	cluster, err := newCassandraCluster(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	casSession, err := cluster.CreateSession()
+	return &Cassandra{casSession}, err
+}
+
+// newCassandraCluster Build cluster config from app configuration
+func newCassandraCluster(cfg config.Cassandra) (*gocql.ClusterConfig, error) {
+	hosts := splitAddrs(cfg.Cluster)
+	if len(hosts) == 0 {
+		return nil, errors.New("cassandra cluster has no contact points")
+	}
+
+	cluster := gocql.NewCluster(hosts...)
 	cluster.ProtoVersion = 4
 	cluster.Timeout = 6 * time.Second
 	cluster.Keyspace = cfg.Keyspace
@@ -36,69 +54,194 @@ func OpenCassandraDB(cfg config.Cassandra) (*Cassandra, error) {
 		Username: cfg.User,
 		Password: cfg.Password,
 	}
-	var err error
-	casSession, err := cluster.CreateSession()
-	return &Cassandra{casSession}, err
+
+	if cfg.Port != "" {
+		port, err := strconv.Atoi(cfg.Port)
+		if err != nil {
+			return nil, errors.Errorf("invalid cassandra port %q", cfg.Port)
+		}
+		cluster.Port = port
+	}
+	if cfg.NumConns > 0 {
+		cluster.NumConns = cfg.NumConns
+	}
+	if cfg.Timeout > 0 {
+		cluster.Timeout = cfg.Timeout
+	}
+	if cfg.ConnectTimeout > 0 {
+		cluster.ConnectTimeout = cfg.ConnectTimeout
+	}
+	if cfg.Consistency != "" {
+		consistency, err := gocql.ParseConsistencyWrapper(cfg.Consistency)
+		if err != nil {
+			return nil, err
+		}
+		cluster.Consistency = consistency
+	}
+	if cfg.LocalDC != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(cfg.LocalDC))
+	}
+	if cfg.SSL {
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 cfg.SSLCA,
+			CertPath:               cfg.SSLCert,
+			KeyPath:                cfg.SSLKey,
+			EnableHostVerification: cfg.SSLVerifyHost,
+		}
+	}
+
+	return cluster, nil
 }
 
-// CreateDriverLocation Create new driver location in database
+const insertDriverLocation = `INSERT INTO driver_locations_by_day("driver_id", "day", "id", "created_at", "lat", "lng")
+	VALUES (?, ?, ?, ?, ?, ?) `
+
+// CreateDriverLocation Create new driver location in database, the location is stored in the bucket of its CreatedAt day.
+// The ID is generated from CreatedAt unless it is already set
 func (db Cassandra) CreateDriverLocation(location *mcass.DriverLocation) error {
-	err := db.Query(
-		`INSERT INTO driver_locations("id", "driver_id", "created_at", "lat", "lng")
-		VALUES (?, ?, ?, ?, ?) `,
-		gocql.TimeUUID(), location.DriverID, location.CreatedAt, location.Lat, location.Lng).Exec()
+	if location.ID == (gocql.UUID{}) {
+		location.ID = gocql.UUIDFromTime(location.CreatedAt)
+	}
+	err := db.Query(insertDriverLocation,
+		location.DriverID, mcass.DayBucket(location.CreatedAt), location.ID, location.CreatedAt, location.Lat, location.Lng).Exec()
 	return err
 }
 
-// GetDriverHistory Get driver history
-func (db Cassandra) GetDriverHistory(driverID int, from time.Time) ([]mcass.DriverLocation, error) {
-	var locations []mcass.DriverLocation
-	iter := db.Query(
-		`SELECT "id", "driver_id", "created_at", "lat", "lng" 
-		FROM  driver_locations
-		WHERE driver_id = ? AND created_at > ?;`,
-		driverID, from.Unix()).Iter()
-	defer iter.Close()
-	results, err := iter.SliceMap()
-	if err != nil {
-		return locations, err
+// driverLocationPartition Partition key of driver_locations_by_day, day is the Unix time of the bucket
+type driverLocationPartition struct {
+	driverID int
+	day      int64
+}
+
+// CreateDriverLocations Create many driver locations with one unlogged batch per partition so each batch is written by
+// a single replica set. The batches are executed concurrently, IDs are set like CreateDriverLocation
+func (db Cassandra) CreateDriverLocations(locations []mcass.DriverLocation) error {
+	batches := make(map[driverLocationPartition]*gocql.Batch)
+	for i := range locations {
+		location := &locations[i]
+		if location.ID == (gocql.UUID{}) {
+			location.ID = gocql.UUIDFromTime(location.CreatedAt)
+		}
+		day := mcass.DayBucket(location.CreatedAt)
+		partition := driverLocationPartition{driverID: location.DriverID, day: day.Unix()}
+		batch, ok := batches[partition]
+		if !ok {
+			batch = db.NewBatch(gocql.UnloggedBatch)
+			batches[partition] = batch
+		}
+		batch.Query(insertDriverLocation,
+			location.DriverID, day, location.ID, location.CreatedAt, location.Lat, location.Lng)
 	}
-	locations = make([]mcass.DriverLocation, len(results))
-	for i, row := range results {
-		locations[i].ID = row["id"].(gocql.UUID)
-		locations[i].DriverID = row["driver_id"].(int)
-		locations[i].CreatedAt = row["created_at"].(int64)
-		locations[i].Lat = row["lat"].(float64)
-		locations[i].Lng = row["lng"].(float64)
+
+	errs := make(chan error, len(batches))
+	for _, batch := range batches {
+		go func(batch *gocql.Batch) {
+			errs <- db.ExecuteBatch(batch)
+		}(batch)
 	}
+
+	// Every batch is waited for, the first error is returned
+	var err error
+	for range batches {
+		if batchErr := <-errs; batchErr != nil && err == nil {
+			err = batchErr
+		}
+	}
+	return err
+}
+
+// GetDriverHistory Get driver history since from, newest first. It reads every day bucket between from and now
+func (db Cassandra) GetDriverHistory(driverID int, from time.Time) ([]mcass.DriverLocation, error) {
+	locations := []mcass.DriverLocation{}
+	oldest := mcass.DayBucket(from)
+	for day := mcass.DayBucket(time.Now()); !day.Before(oldest); day = day.Add(-mcass.BucketDuration) {
+		bucket, err := db.getDriverLocations(driverID, day, from, 0)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, bucket...)
+	}
+
 	return locations, nil
 }
 
-// GetDriverLatestLocation Get latest driver location
+// GetDriverLatestLocation Get latest driver location, it walks back day buckets until the retention period
 func (db Cassandra) GetDriverLatestLocation(driverID int) (*mcass.DriverLocation, error) {
-	var locations []mcass.DriverLocation
-	iter := db.Query(
-		`SELECT "id", "driver_id", "created_at", "lat", "lng" 
-		FROM  driver_locations
-		WHERE driver_id = ?
-		LIMIT 1;`,
-		driverID).Iter()
-	defer iter.Close()
-	results, err := iter.SliceMap()
-	if err != nil {
-		return nil, err
+	now := time.Now()
+	from := now.Add(-mcass.Retention)
+	oldest := mcass.DayBucket(from)
+	for day := mcass.DayBucket(now); !day.Before(oldest); day = day.Add(-mcass.BucketDuration) {
+		locations, err := db.getDriverLocations(driverID, day, from, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(locations) > 0 {
+			location := locations[0]
+			return &location, nil
+		}
 	}
-	locations = make([]mcass.DriverLocation, len(results))
-	for i, row := range results {
-		locations[i].ID = row["id"].(gocql.UUID)
-		locations[i].DriverID = row["driver_id"].(int)
-		locations[i].CreatedAt = row["created_at"].(int64)
-		locations[i].Lat = row["lat"].(float64)
-		locations[i].Lng = row["lng"].(float64)
+
+	return nil, nil
+}
+
+// getDriverLocations Get driver locations created after from in one day bucket, newest first. No limit if limit is 0.
+// from is compared with the timeuuid clustering key so it keeps sub-second precision
+func (db Cassandra) getDriverLocations(driverID int, day, from time.Time, limit int) ([]mcass.DriverLocation, error) {
+	stmt := `SELECT "id", "driver_id", "created_at", "lat", "lng"
+		FROM driver_locations_by_day
+		WHERE driver_id = ? AND day = ? AND id > minTimeuuid(?)`
+	values := []interface{}{driverID, day, from}
+	if limit > 0 {
+		stmt += ` LIMIT ?`
+		values = append(values, limit)
+	}
+
+	return scanDriverLocations(db.Query(stmt, values...).Iter())
+}
+
+// scanDriverLocations Stream rows of "id", "driver_id", "created_at", "lat", "lng" into driver locations.
+// A row which does not match the types of mcass.DriverLocation makes it return an error
+func scanDriverLocations(iter *gocql.Iter) ([]mcass.DriverLocation, error) {
+	locations := []mcass.DriverLocation{}
+	var location mcass.DriverLocation
+	for iter.Scan(&location.ID, &location.DriverID, &location.CreatedAt, &location.Lat, &location.Lng) {
+		locations = append(locations, location)
 	}
-	if len(locations) == 0 {
-		return nil, nil
+	if err := iter.Close(); err != nil {
+		return nil, errors.Wrap(err, "can not scan driver locations")
 	}
-	location := locations[0]
-	return &location, nil
+
+	return locations, nil
+}
+
+// CopyLegacyDriverLocations Copy every row of the legacy driver_locations table (created_at in seconds)
+// into driver_locations_by_day. Rows older than the retention period are skipped, rows are
+// written with a TTL of their remaining retention. It returns the number of copied rows
+func (db Cassandra) CopyLegacyDriverLocations() (int, error) {
+	iter := db.Query(`SELECT "driver_id", "created_at", "lat", "lng" FROM driver_locations`).Iter()
+	var (
+		driverID  int
+		createdAt int64
+		lat, lng  float64
+		copied    int
+	)
+	now := time.Now()
+	for iter.Scan(&driverID, &createdAt, &lat, &lng) {
+		t := time.Unix(createdAt, 0)
+		ttl := int(t.Add(mcass.Retention).Sub(now).Seconds())
+		if ttl <= 0 {
+			continue
+		}
+		err := db.Query(
+			`INSERT INTO driver_locations_by_day("driver_id", "day", "id", "created_at", "lat", "lng")
+			VALUES (?, ?, ?, ?, ?, ?) USING TTL ?`,
+			driverID, mcass.DayBucket(t), gocql.UUIDFromTime(t), t, lat, lng, ttl).Exec()
+		if err != nil {
+			iter.Close()
+			return copied, err
+		}
+		copied++
+	}
+
+	return copied, iter.Close()
 }
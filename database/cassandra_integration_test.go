@@ -0,0 +1,123 @@
+//go:build integration
+// +build integration
+
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/model/mcass"
+)
+
+// Run with a local cassandra, e.g.
+//
+//	$ docker run -d -p 9042:9042 cassandra:3.11
+//	$ CS_CLUSTER=127.0.0.1 go test -tags integration ./database/
+const testKeyspace = "gruber_test"
+
+// OpenTestCassandra Open a test keyspace with an empty driver_locations_by_day, it is used by the contract tests
+var OpenTestCassandra = openTestCassandra
+
+func openTestCassandra(t *testing.T) *Cassandra {
+	host := os.Getenv("CS_CLUSTER")
+	if host == "" {
+		t.Skip("CS_CLUSTER is not set")
+	}
+
+	cluster := gocql.NewCluster(host)
+	cluster.ProtoVersion = 4
+	cluster.Timeout = 10 * time.Second
+	session, err := cluster.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	stmts := []string{
+		`CREATE KEYSPACE IF NOT EXISTS ` + testKeyspace + ` WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '1'}`,
+		`DROP TABLE IF EXISTS ` + testKeyspace + `.driver_locations_by_day`,
+	}
+	for _, stmt := range stmts {
+		if err := session.Query(stmt).Exec(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := OpenCassandraDB(config.Cassandra{
+		Cluster:  host,
+		Keyspace: testKeyspace,
+		Timeout:  10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := ioutil.ReadFile("../migration/cassandra/migrations/1521000000_driver_locations_by_day.up.cql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Query(string(schema)).Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestCassandraScanSchemaMismatch(t *testing.T) {
+	db := openTestCassandra(t)
+	defer db.Close()
+
+	location := mcass.DriverLocation{DriverID: 1, Lat: 10, Lng: 100, CreatedAt: time.Now()}
+	assert.NoError(t, db.CreateDriverLocation(&location))
+
+	// "lat" is a double which can not be scanned into DriverID
+	iter := db.Query(`SELECT "id", "lat", "created_at", "lat", "lng" FROM driver_locations_by_day`).Iter()
+	_, err := scanDriverLocations(iter)
+	assert.Error(t, err)
+
+	iter = db.Query(`SELECT "id", "driver_id" FROM driver_locations_by_day`).Iter()
+	_, err = scanDriverLocations(iter)
+	assert.Error(t, err)
+}
+
+func TestCassandraCreateDriverLocations(t *testing.T) {
+	db := openTestCassandra(t)
+	defer db.Close()
+
+	// Locations of two drivers over two day buckets are written in their own partitions
+	now := time.Now()
+	yesterday := now.Add(-mcass.BucketDuration)
+	locations := []mcass.DriverLocation{
+		{DriverID: 1, Lat: 10, Lng: 100, CreatedAt: yesterday},
+		{DriverID: 2, Lat: 20, Lng: 100, CreatedAt: yesterday.Add(time.Second)},
+		{DriverID: 1, Lat: 11, Lng: 100, CreatedAt: now},
+		{DriverID: 1, Lat: 12, Lng: 100, CreatedAt: now.Add(time.Second)},
+	}
+	if err := db.CreateDriverLocations(locations); err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range locations {
+		assert.NotEqual(t, gocql.UUID{}, location.ID)
+	}
+
+	history, err := db.GetDriverHistory(1, yesterday.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, history, 3) {
+		assert.Equal(t, 12.0, history[0].Lat)
+		assert.Equal(t, 10.0, history[2].Lat)
+	}
+
+	history, err = db.GetDriverHistory(2, yesterday.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, history, 1)
+}
@@ -0,0 +1,100 @@
+//go:build integration
+// +build integration
+
+package database_test
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/database/dbtest"
+	"github.com/trietphm/gruber/model/mpg"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+// Run against local databases, each test is skipped when its host is not set, e.g.
+//	$ CS_CLUSTER=127.0.0.1 \
+//	  PG_HOST=127.0.0.1 PG_PORT=5432 PG_USER=gruber PG_PASS=1 PG_NAME=gruber_test \
+//	  RD_HOST=127.0.0.1 RD_PORT=6379 RD_DB=15 \
+//	  go test -tags integration ./database/
+// Postgresql must be migrated, every table of PG_NAME but goose_db_version is truncated. The driver geo keys, test driver claims and test rate limit keys of RD_DB are deleted.
+
+func TestPgContract(t *testing.T) {
+	if os.Getenv("PG_HOST") == "" {
+		t.Skip("PG_HOST is not set")
+	}
+
+	db, err := database.OpenPostgresqlDB(config.Postgresql{
+		Host:     os.Getenv("PG_HOST"),
+		Port:     os.Getenv("PG_PORT"),
+		User:     os.Getenv("PG_USER"),
+		Password: os.Getenv("PG_PASS"),
+		Name:     os.Getenv("PG_NAME"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dbtest.TestPg(t, func(t *testing.T) database.PgI {
+		if _, err := db.Exec(truncateTables); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+// truncateTables Empty every migrated table and reset its sequences
+const truncateTables = `DO $$
+BEGIN
+	EXECUTE (
+		SELECT 'TRUNCATE ' || string_agg(quote_ident(tablename), ', ') || ' RESTART IDENTITY CASCADE'
+		FROM pg_tables
+		WHERE schemaname = 'public' AND tablename <> 'goose_db_version'
+	);
+END $$`
+
+func TestCassandraContract(t *testing.T) {
+	dbtest.TestCassandra(t, func(t *testing.T) database.CassandraI {
+		return database.OpenTestCassandra(t)
+	})
+}
+
+func TestRedisContract(t *testing.T) {
+	if os.Getenv("RD_HOST") == "" {
+		t.Skip("RD_HOST is not set")
+	}
+
+	dbIndex, _ := strconv.Atoi(os.Getenv("RD_DB"))
+	db, err := database.OpenRedisDB(config.Redis{
+		Host:     os.Getenv("RD_HOST"),
+		Port:     os.Getenv("RD_PORT"),
+		Password: os.Getenv("RD_PASSWORD"),
+		DB:       dbIndex,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dbtest.TestRedis(t, func(t *testing.T) database.RedisI {
+		keys := []string{mredis.KeyDriverGeo}
+		for _, class := range mpg.VehicleClasses {
+			keys = append(keys, mredis.KeyPrefixDriverGeoClass+class)
+		}
+		for _, key := range []string{"test:1", "test:2", "test:3"} {
+			keys = append(keys, mredis.KeyPrefixRateLimit+key)
+		}
+		for driverID := 1; driverID <= 3; driverID++ {
+			keys = append(keys, mredis.KeyPrefixDriverClaim+strconv.Itoa(driverID))
+		}
+		keys = append(keys, mredis.KeyPrefixZoneQueue+"airport")
+		if err := db.Del(keys...).Err(); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
@@ -0,0 +1,1398 @@
+// Package dbtest provides a contract test suite for the datastore interfaces of package database.
+// Every implementation runs it from its own tests, e.g.
+//
+//	func TestPg(t *testing.T) {
+//		dbtest.TestPg(t, func(t *testing.T) database.PgI { return NewPg() })
+//	}
+//
+// Each factory call must return an empty store.
+package dbtest
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mcass"
+	"github.com/trietphm/gruber/model/mpg"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+// notFoundID An id which never exists in a store
+const notFoundID = 1 << 30
+
+// TestPg Run the contract suite of database.PgI
+func TestPg(t *testing.T, newDB func(t *testing.T) database.PgI) {
+	t.Run("CreateAndGetDriver", func(t *testing.T) {
+		db := newDB(t)
+		driver1 := mpg.Driver{Name: "driver 1", State: mpg.StateAvailable}
+		driver2 := mpg.Driver{Name: "driver 2", State: mpg.StateBusy}
+		if err := db.CreateDriver(&driver1); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateDriver(&driver2); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, driver1.ID > 0)
+		assert.NotEqual(t, driver1.ID, driver2.ID)
+
+		driver, err := db.GetDriver(driver2.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if driver == nil {
+			t.Fatal("driver not found")
+		}
+		assert.Equal(t, driver2.ID, driver.ID)
+		assert.Equal(t, "driver 2", driver.Name)
+		assert.Equal(t, mpg.StateBusy, driver.State)
+	})
+
+	t.Run("GetDriverNotFound", func(t *testing.T) {
+		db := newDB(t)
+		driver, err := db.GetDriver(notFoundID)
+		assert.NoError(t, err)
+		assert.Nil(t, driver)
+	})
+
+	t.Run("UpdateDriverState", func(t *testing.T) {
+		db := newDB(t)
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := db.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		created, err := db.GetDriver(driver.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created == nil {
+			t.Fatal("created not found")
+		}
+		assert.False(t, created.StateUpdatedAt.IsZero())
+
+		if err := db.UpdateDriverState(driver.ID, mpg.StateBusy); err != nil {
+			t.Fatal(err)
+		}
+
+		updated, err := db.GetDriver(driver.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated == nil {
+			t.Fatal("updated not found")
+		}
+		assert.Equal(t, mpg.StateBusy, updated.State)
+		assert.False(t, updated.StateUpdatedAt.Before(created.StateUpdatedAt))
+
+		// Same state keeps the state change time
+		if err := db.UpdateDriverState(driver.ID, mpg.StateBusy); err != nil {
+			t.Fatal(err)
+		}
+		unchanged, err := db.GetDriver(driver.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, unchanged.StateUpdatedAt.Equal(updated.StateUpdatedAt))
+
+		assert.NoError(t, db.UpdateDriverState(notFoundID, mpg.StateBusy))
+	})
+
+	t.Run("CreatePassenger", func(t *testing.T) {
+		db := newDB(t)
+		passenger1 := mpg.Passenger{Name: "passenger 1"}
+		passenger2 := mpg.Passenger{Name: "passenger 2"}
+		if err := db.CreatePassenger(&passenger1); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreatePassenger(&passenger2); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, passenger1.ID > 0)
+		assert.NotEqual(t, passenger1.ID, passenger2.ID)
+	})
+
+	t.Run("GetPassengerNotFound", func(t *testing.T) {
+		db := newDB(t)
+		passenger, err := db.GetPassenger(notFoundID)
+		assert.NoError(t, err)
+		assert.Nil(t, passenger)
+	})
+
+	t.Run("UpdatePassenger", func(t *testing.T) {
+		db := newDB(t)
+		passenger := mpg.Passenger{Name: "passenger", DefaultPaymentMethod: mpg.PaymentMethodCash}
+		if err := db.CreatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+
+		passenger.Name = "new name"
+		passenger.Phone = "+84901234567"
+		passenger.Email = "passenger@example.com"
+		passenger.DefaultPaymentMethod = mpg.PaymentMethodCard
+		if err := db.UpdatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+
+		updated, err := db.GetPassenger(passenger.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated == nil {
+			t.Fatal("updated not found")
+		}
+		assert.Equal(t, "new name", updated.Name)
+		assert.Equal(t, "+84901234567", updated.Phone)
+		assert.Equal(t, "passenger@example.com", updated.Email)
+		assert.Equal(t, mpg.PaymentMethodCard, updated.DefaultPaymentMethod)
+		assert.Nil(t, updated.DeletedAt)
+	})
+
+	t.Run("DeletePassenger", func(t *testing.T) {
+		db := newDB(t)
+		passenger := mpg.Passenger{Name: "passenger", DefaultPaymentMethod: mpg.PaymentMethodCash}
+		if err := db.CreatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeletePassenger(passenger.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		deleted, err := db.GetPassenger(passenger.ID)
+		assert.NoError(t, err)
+		assert.Nil(t, deleted)
+
+		// Deleting again or updating a deleted passenger is not an error
+		assert.NoError(t, db.DeletePassenger(passenger.ID))
+		passenger.Name = "new name"
+		assert.NoError(t, db.UpdatePassenger(&passenger))
+		deleted, err = db.GetPassenger(passenger.ID)
+		assert.NoError(t, err)
+		assert.Nil(t, deleted)
+	})
+	t.Run("Vehicles", func(t *testing.T) {
+		db := newDB(t)
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := db.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+
+		vehicles, err := db.GetVehicles(driver.ID)
+		assert.NoError(t, err)
+		assert.Len(t, vehicles, 0)
+
+		for _, plate := range []string{"51A-12345", "51A-67890"} {
+			vehicle := mpg.Vehicle{DriverID: driver.ID, Plate: plate, Make: "Toyota", Model: "Vios", Color: "white", Seats: 4, Class: mpg.VehicleClassEconomy}
+			if err := db.CreateVehicle(&vehicle); err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, vehicle.ID > 0)
+		}
+
+		vehicles, err = db.GetVehicles(driver.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, vehicles, 2) {
+			assert.Equal(t, "51A-12345", vehicles[0].Plate)
+			assert.Equal(t, 4, vehicles[0].Seats)
+			assert.Equal(t, mpg.VehicleClassEconomy, vehicles[0].Class)
+
+			vehicle, err := db.GetVehicle(vehicles[1].ID)
+			assert.NoError(t, err)
+			if assert.NotNil(t, vehicle) {
+				assert.Equal(t, "51A-67890", vehicle.Plate)
+				assert.Equal(t, driver.ID, vehicle.DriverID)
+			}
+
+			// Vehicle classes are kept with the driver
+			stored, err := db.GetDriver(driver.ID)
+			assert.NoError(t, err)
+			if assert.NotNil(t, stored) {
+				assert.Equal(t, []string{mpg.VehicleClassEconomy}, stored.VehicleClasses)
+			}
+
+			assert.NoError(t, db.DeleteVehicle(vehicles[0].ID))
+			vehicle, err = db.GetVehicle(vehicles[0].ID)
+			assert.NoError(t, err)
+			assert.Nil(t, vehicle)
+
+			premium := mpg.Vehicle{DriverID: driver.ID, Plate: "51A-24680", Seats: 4, Class: mpg.VehicleClassPremium}
+			if err := db.CreateVehicle(&premium); err != nil {
+				t.Fatal(err)
+			}
+			stored, err = db.GetDriver(driver.ID)
+			assert.NoError(t, err)
+			if assert.NotNil(t, stored) {
+				assert.Equal(t, []string{mpg.VehicleClassEconomy, mpg.VehicleClassPremium}, stored.VehicleClasses)
+			}
+
+			assert.NoError(t, db.DeleteVehicle(vehicles[1].ID))
+			assert.NoError(t, db.DeleteVehicle(premium.ID))
+			stored, err = db.GetDriver(driver.ID)
+			assert.NoError(t, err)
+			if assert.NotNil(t, stored) {
+				assert.Empty(t, stored.VehicleClasses)
+			}
+		}
+
+		vehicle, err := db.GetVehicle(notFoundID)
+		assert.NoError(t, err)
+		assert.Nil(t, vehicle)
+	})
+
+	t.Run("DriverDocuments", func(t *testing.T) {
+		db := newDB(t)
+		valid := mpg.Driver{Name: "valid"}
+		expired := mpg.Driver{Name: "expired"}
+		none := mpg.Driver{Name: "no documents"}
+		for _, driver := range []*mpg.Driver{&valid, &expired, &none} {
+			if err := db.CreateDriver(driver); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		now := time.Now().UTC()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		documents := []mpg.DriverDocument{
+			{DriverID: valid.ID, Type: mpg.DocumentLicense, Number: "L1", ExpiresAt: today},
+			{DriverID: valid.ID, Type: mpg.DocumentInsurance, Number: "I1", ExpiresAt: today.AddDate(1, 0, 0)},
+			{DriverID: expired.ID, Type: mpg.DocumentLicense, Number: "L2", ExpiresAt: today.AddDate(1, 0, 0)},
+			{DriverID: expired.ID, Type: mpg.DocumentInsurance, Number: "I2", ExpiresAt: today.AddDate(0, 0, -1)},
+			// Replace the license of valid
+			{DriverID: valid.ID, Type: mpg.DocumentLicense, Number: "L3", ExpiresAt: today.AddDate(2, 0, 0)},
+		}
+		for i := range documents {
+			if err := db.SaveDriverDocument(&documents[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.Equal(t, documents[0].ID, documents[4].ID)
+
+		saved, err := db.GetDriverDocuments(valid.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, saved, 2) {
+			assert.Equal(t, mpg.DocumentLicense, saved[0].Type)
+			assert.Equal(t, "L3", saved[0].Number)
+			assert.Equal(t, today.AddDate(2, 0, 0).Format(mpg.DateFormat), saved[0].ExpiresAt.UTC().Format(mpg.DateFormat))
+		}
+
+		ids, err := db.GetDriversWithExpiredDocuments([]int{valid.ID, expired.ID, none.ID}, now)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{expired.ID}, ids)
+
+		ids, err = db.GetDriversWithExpiredDocuments([]int{valid.ID}, now.AddDate(1, 0, 1))
+		assert.NoError(t, err)
+		assert.Equal(t, []int{valid.ID}, ids)
+
+		ids, err = db.GetDriversWithExpiredDocuments(nil, now)
+		assert.NoError(t, err)
+		assert.Len(t, ids, 0)
+	})
+
+	t.Run("ScheduledRides", func(t *testing.T) {
+		db := newDB(t)
+		passenger := mpg.Passenger{Name: "passenger"}
+		if err := db.CreatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now()
+		rides := []mpg.ScheduledRide{
+			{PassengerID: passenger.ID, Lat: 10, Lng: 106, PickupAt: now.Add(2 * time.Hour)},
+			{PassengerID: passenger.ID, Lat: 10, Lng: 106, PickupAt: now.Add(time.Hour), VehicleClass: mpg.VehicleClassXL},
+			{PassengerID: passenger.ID, Lat: 10, Lng: 106, PickupAt: now.Add(3 * time.Hour)},
+		}
+		for i := range rides {
+			if err := db.CreateScheduledRide(&rides[i]); err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, rides[i].ID > 0)
+		}
+
+		ride, err := db.GetScheduledRide(rides[1].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ride == nil {
+			t.Fatal("ride not found")
+		}
+		assert.Equal(t, passenger.ID, ride.PassengerID)
+		assert.Equal(t, mpg.ScheduledRidePending, ride.Status)
+		assert.Equal(t, mpg.VehicleClassXL, ride.VehicleClass)
+		assert.Equal(t, rides[1].PickupAt.Unix(), ride.PickupAt.Unix())
+		assert.Equal(t, 0, ride.RideID)
+		assert.Len(t, ride.DriverIDs, 0)
+
+		due, err := db.GetDueScheduledRides(now.Add(2 * time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, due, 2) {
+			assert.Equal(t, rides[1].ID, due[0].ID)
+			assert.Equal(t, rides[0].ID, due[1].ID)
+		}
+
+		requested := mpg.Ride{PassengerID: passenger.ID, Lat: 10, Lng: 106}
+		if err := db.CreateRide(&requested); err != nil {
+			t.Fatal(err)
+		}
+		linked, err := db.LinkScheduledRide(rides[1].ID, requested.ID)
+		assert.NoError(t, err)
+		assert.True(t, linked)
+
+		// A scheduled ride is linked once
+		linked, err = db.LinkScheduledRide(rides[1].ID, requested.ID)
+		assert.NoError(t, err)
+		assert.False(t, linked)
+
+		linked, err = db.LinkScheduledRide(notFoundID, requested.ID)
+		assert.NoError(t, err)
+		assert.False(t, linked)
+
+		ride.Status = mpg.ScheduledRideDispatched
+		ride.DriverIDs = []int{3, 1}
+		updated, err := db.UpdateScheduledRideStatus(ride, mpg.ScheduledRidePending)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+
+		// Cancelling a dispatched ride does nothing
+		cancelled := *ride
+		cancelled.Status = mpg.ScheduledRideCancelled
+		updated, err = db.UpdateScheduledRideStatus(&cancelled, mpg.ScheduledRidePending)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+
+		ride, err = db.GetScheduledRide(rides[1].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, mpg.ScheduledRideDispatched, ride.Status)
+		assert.Equal(t, requested.ID, ride.RideID)
+		assert.Equal(t, []int{3, 1}, ride.DriverIDs)
+
+		due, err = db.GetDueScheduledRides(now.Add(2 * time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, due, 1) {
+			assert.Equal(t, rides[0].ID, due[0].ID)
+		}
+
+		updated, err = db.UpdateScheduledRideStatus(&mpg.ScheduledRide{ID: notFoundID, Status: mpg.ScheduledRideCancelled}, mpg.ScheduledRidePending)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+
+		ride, err = db.GetScheduledRide(notFoundID)
+		assert.NoError(t, err)
+		assert.Nil(t, ride)
+	})
+
+	t.Run("Rides", func(t *testing.T) {
+		db := newDB(t)
+		passenger := mpg.Passenger{Name: "passenger"}
+		if err := db.CreatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := db.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+
+		ride := mpg.Ride{PassengerID: passenger.ID, Lat: 10, Lng: 106, VehicleClass: mpg.VehicleClassXL, PaymentMethod: mpg.PaymentMethodCard}
+		if err := db.CreateRide(&ride); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, ride.ID > 0)
+
+		stored, err := db.GetRide(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored == nil {
+			t.Fatal("ride not found")
+		}
+		assert.Equal(t, mpg.RideRequested, stored.Status)
+		assert.Equal(t, 0, stored.DriverID)
+		assert.Equal(t, mpg.VehicleClassXL, stored.VehicleClass)
+		assert.Equal(t, mpg.PaymentMethodCard, stored.PaymentMethod)
+		assert.False(t, stored.CreatedAt.IsZero())
+		assert.True(t, stored.AssignedAt.IsZero())
+
+		assigned := *stored
+		assigned.Status = mpg.RideAssigned
+		assigned.DriverID = driver.ID
+		assigned.AssignedAt = time.Now()
+		updated, err := db.UpdateRideStatus(&assigned, mpg.RideRequested)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+
+		// Another dispatch of the same ride fails
+		updated, err = db.UpdateRideStatus(&assigned, mpg.RideRequested)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+
+		// The driver cancels, the ride is requested again
+		requested := assigned
+		requested.Status = mpg.RideRequested
+		requested.DriverID = 0
+		requested.AssignedAt = time.Time{}
+		cancellation := mpg.RideCancellation{DriverID: driver.ID, CancelledBy: mpg.CancelledByDriver, Reason: "Flat tire"}
+		updated, err = db.CancelRide(&requested, mpg.RideAssigned, &cancellation)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+		assert.True(t, cancellation.ID > 0)
+
+		stored, err = db.GetRide(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, mpg.RideRequested, stored.Status)
+		assert.Equal(t, 0, stored.DriverID)
+		assert.True(t, stored.AssignedAt.IsZero())
+
+		// A cancellation of a ride whose status changed is not saved
+		cancelled := *stored
+		cancelled.Status = mpg.RideCancelled
+		cancelled.CancelledAt = time.Now()
+		noShow := mpg.RideCancellation{CancelledBy: mpg.CancelledByPassenger, Reason: "Late", Fee: 10000, NoShow: true}
+		updated, err = db.CancelRide(&cancelled, mpg.RideArrived, &noShow)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+
+		passengerCancellation := mpg.RideCancellation{CancelledBy: mpg.CancelledByPassenger, Reason: "Changed plans", Fee: 10000}
+		updated, err = db.CancelRide(&cancelled, mpg.RideRequested, &passengerCancellation)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+
+		cancellations, err := db.GetRideCancellations(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, cancellations, 2) {
+			assert.Equal(t, ride.ID, cancellations[0].RideID)
+			assert.Equal(t, driver.ID, cancellations[0].DriverID)
+			assert.Equal(t, mpg.CancelledByDriver, cancellations[0].CancelledBy)
+			assert.Equal(t, "Flat tire", cancellations[0].Reason)
+			assert.Equal(t, 0, cancellations[1].DriverID)
+			assert.Equal(t, mpg.CancelledByPassenger, cancellations[1].CancelledBy)
+			assert.Equal(t, int64(10000), cancellations[1].Fee)
+			assert.False(t, cancellations[1].NoShow)
+		}
+
+		stored, err = db.GetRide(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, mpg.RideCancelled, stored.Status)
+		assert.False(t, stored.CancelledAt.IsZero())
+
+		stored, err = db.GetRide(notFoundID)
+		assert.NoError(t, err)
+		assert.Nil(t, stored)
+	})
+
+	t.Run("RideStops", func(t *testing.T) {
+		db := newDB(t)
+		passenger := mpg.Passenger{Name: "passenger"}
+		if err := db.CreatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := db.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+
+		ride := mpg.Ride{PassengerID: passenger.ID, DriverID: driver.ID, Lat: 10, Lng: 106, Status: mpg.RideStarted}
+		stops := []mpg.RideStop{
+			{Position: 2, Dropoff: true, Lat: 10.2, Lng: 106.2, Address: "Airport", PlaceID: "place-2"},
+			{Position: 1, Lat: 10.1, Lng: 106.1, Address: "School"},
+		}
+		if err := db.CreateRideWithStops(&ride, stops); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, ride.ID > 0)
+
+		stored, err := db.GetRideStops(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, stored, 2) {
+			assert.Equal(t, ride.ID, stored[0].RideID)
+			assert.Equal(t, 1, stored[0].Position)
+			assert.Equal(t, "School", stored[0].Address)
+			assert.Equal(t, "", stored[0].PlaceID)
+			assert.False(t, stored[0].Dropoff)
+			assert.True(t, stored[0].ArrivedAt.IsZero())
+			assert.Equal(t, 2, stored[1].Position)
+			assert.Equal(t, "place-2", stored[1].PlaceID)
+			assert.True(t, stored[1].Dropoff)
+		}
+
+		// A ride without stops
+		other := mpg.Ride{PassengerID: passenger.ID, Lat: 10, Lng: 106}
+		if err := db.CreateRideWithStops(&other, nil); err != nil {
+			t.Fatal(err)
+		}
+		none, err := db.GetRideStops(other.ID)
+		assert.NoError(t, err)
+		assert.Len(t, none, 0)
+
+		stop := stored[0]
+		stop.ArrivedAt = time.Now()
+		updated, err := db.UpdateRideStop(&ride, mpg.RideStarted, &stop)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+
+		// The dropoff is not saved when the ride status changed
+		dropoff := stored[1]
+		dropoff.ArrivedAt = time.Now()
+		completed := ride
+		completed.Status = mpg.RideCompleted
+		completed.CompletedAt = dropoff.ArrivedAt
+		completed.Fare = 42000
+		completed.Commission = 8400
+		completed.Currency = "VND"
+		updated, err = db.UpdateRideStop(&completed, mpg.RideArrived, &dropoff)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+
+		stored, err = db.GetRideStops(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, stored[0].ArrivedAt.IsZero())
+		assert.True(t, stored[0].DepartedAt.IsZero())
+		assert.True(t, stored[1].ArrivedAt.IsZero())
+
+		updated, err = db.UpdateRideStop(&completed, mpg.RideStarted, &dropoff)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+
+		stored, err = db.GetRideStops(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, stored[1].ArrivedAt.IsZero())
+
+		storedRide, err := db.GetRide(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, mpg.RideCompleted, storedRide.Status)
+		assert.False(t, storedRide.CompletedAt.IsZero())
+		assert.Equal(t, int64(42000), storedRide.Fare)
+		assert.Equal(t, int64(8400), storedRide.Commission)
+		assert.Equal(t, "VND", storedRide.Currency)
+	})
+
+	t.Run("RideRatings", func(t *testing.T) {
+		db := newDB(t)
+		since := time.Now().Add(-time.Minute)
+		passenger := mpg.Passenger{Name: "passenger"}
+		if err := db.CreatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+		drivers := make([]mpg.Driver, 3)
+		for i := range drivers {
+			drivers[i] = mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+			if err := db.CreateDriver(&drivers[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Two rides with the first driver, one with the second, the third is not rated
+		rides := make([]mpg.Ride, 3)
+		for i, driver := range []mpg.Driver{drivers[0], drivers[0], drivers[1]} {
+			rides[i] = mpg.Ride{PassengerID: passenger.ID, DriverID: driver.ID, Lat: 10, Lng: 106, Status: mpg.RideCompleted}
+			if err := db.CreateRide(&rides[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ratings := []mpg.RideRating{
+			{RideID: rides[0].ID, DriverID: drivers[0].ID, PassengerID: passenger.ID, RatedBy: mpg.RatedByPassenger, Rating: 5},
+			{RideID: rides[1].ID, DriverID: drivers[0].ID, PassengerID: passenger.ID, RatedBy: mpg.RatedByPassenger, Rating: 2,
+				Tags: []string{"rude", "unsafe driving"}, Comment: "Too fast"},
+			{RideID: rides[2].ID, DriverID: drivers[1].ID, PassengerID: passenger.ID, RatedBy: mpg.RatedByPassenger, Rating: 4},
+			{RideID: rides[2].ID, DriverID: drivers[1].ID, PassengerID: passenger.ID, RatedBy: mpg.RatedByDriver, Rating: 1, Tags: []string{"late"}},
+		}
+		for i := range ratings {
+			created, err := db.CreateRideRating(&ratings[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, created)
+			assert.True(t, ratings[i].ID > 0)
+		}
+
+		// A ride is rated once by each side
+		again := mpg.RideRating{RideID: rides[0].ID, DriverID: drivers[0].ID, PassengerID: passenger.ID, RatedBy: mpg.RatedByPassenger, Rating: 1}
+		created, err := db.CreateRideRating(&again)
+		assert.NoError(t, err)
+		assert.False(t, created)
+
+		for i, expected := range []float64{3.5, 4, 0} {
+			driver, err := db.GetDriver(drivers[i].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.InDelta(t, expected, driver.Rating, 1e-9)
+		}
+		stored, err := db.GetPassenger(passenger.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.InDelta(t, 1, stored.Rating, 1e-9)
+
+		ids, err := db.GetDriversRatedBelow([]int{drivers[0].ID, drivers[1].ID, drivers[2].ID}, 4)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{drivers[0].ID}, ids)
+
+		ids, err = db.GetDriversRatedBelow(nil, 4)
+		assert.NoError(t, err)
+		assert.Len(t, ids, 0)
+
+		lowRatings := func(maxRating int, ratedBy string) []mpg.RideRating {
+			low, err := db.GetLowRatings(maxRating, ratedBy, since, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return low
+		}
+		low := lowRatings(2, "")
+		if assert.Len(t, low, 2) {
+			assert.Equal(t, ratings[3].ID, low[0].ID)
+			assert.Equal(t, mpg.RatedByDriver, low[0].RatedBy)
+			assert.Equal(t, []string{"late"}, low[0].Tags)
+			assert.Equal(t, ratings[1].ID, low[1].ID)
+			assert.Equal(t, rides[1].ID, low[1].RideID)
+			assert.Equal(t, []string{"rude", "unsafe driving"}, low[1].Tags)
+			assert.Equal(t, "Too fast", low[1].Comment)
+			assert.False(t, low[1].CreatedAt.IsZero())
+		}
+		low = lowRatings(2, mpg.RatedByPassenger)
+		if assert.Len(t, low, 1) {
+			assert.Equal(t, ratings[1].ID, low[0].ID)
+		}
+		assert.Len(t, lowRatings(5, ""), 4)
+
+		low, err = db.GetLowRatings(5, "", time.Now().Add(time.Minute), 100)
+		assert.NoError(t, err)
+		assert.Len(t, low, 0)
+	})
+
+	t.Run("Ledger", func(t *testing.T) {
+		db := newDB(t)
+		passenger := mpg.Passenger{Name: "passenger"}
+		if err := db.CreatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := db.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+		ride := mpg.Ride{PassengerID: passenger.ID, DriverID: driver.ID, Lat: 10, Lng: 106, Status: mpg.RideCompleted,
+			Fare: 50000, Commission: 10000, Currency: "VND"}
+		if err := db.CreateRide(&ride); err != nil {
+			t.Fatal(err)
+		}
+
+		account := func(kind string, ownerID int, currency string) *mpg.Account {
+			account, err := db.GetOrCreateAccount(kind, ownerID, currency)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return account
+		}
+		passengerAccount := account(mpg.AccountPassenger, passenger.ID, "VND")
+		assert.True(t, passengerAccount.ID > 0)
+		assert.Equal(t, int64(0), passengerAccount.Balance)
+		assert.Equal(t, passengerAccount.ID, account(mpg.AccountPassenger, passenger.ID, "VND").ID)
+		assert.NotEqual(t, passengerAccount.ID, account(mpg.AccountPassenger, passenger.ID, "USD").ID)
+		driverAccount := account(mpg.AccountDriver, driver.ID, "VND")
+		commission := account(mpg.AccountCommission, 0, "VND")
+
+		charge := mpg.JournalEntry{IdempotencyKey: "test:charge", Kind: mpg.EntryCharge, RideID: ride.ID, Currency: "VND", Amount: 50000}
+		postings := []mpg.Posting{
+			{AccountID: passengerAccount.ID, Amount: 50000},
+			{AccountID: driverAccount.ID, Amount: -40000},
+			{AccountID: commission.ID, Amount: -10000},
+		}
+		created, err := db.CreateJournalEntry(&charge, postings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, created)
+		assert.True(t, charge.ID > 0)
+
+		// The same idempotency key saves nothing
+		again := mpg.JournalEntry{IdempotencyKey: charge.IdempotencyKey, Kind: mpg.EntryCharge, RideID: ride.ID, Currency: "VND", Amount: 50000}
+		created, err = db.CreateJournalEntry(&again, []mpg.Posting{
+			{AccountID: passengerAccount.ID, Amount: 50000},
+			{AccountID: driverAccount.ID, Amount: -50000},
+		})
+		assert.NoError(t, err)
+		assert.False(t, created)
+
+		assert.Equal(t, int64(50000), account(mpg.AccountPassenger, passenger.ID, "VND").Balance)
+		assert.Equal(t, int64(-40000), account(mpg.AccountDriver, driver.ID, "VND").Balance)
+		assert.Equal(t, int64(-10000), account(mpg.AccountCommission, 0, "VND").Balance)
+
+		// Unbalanced entries, debits different from the amount and accounts in another currency are rejected
+		invalid := []struct {
+			amount   int64
+			postings []mpg.Posting
+		}{
+			{50000, []mpg.Posting{{AccountID: passengerAccount.ID, Amount: 50000}, {AccountID: driverAccount.ID, Amount: -40000}}},
+			{40000, []mpg.Posting{{AccountID: passengerAccount.ID, Amount: 50000}, {AccountID: driverAccount.ID, Amount: -50000}}},
+			{50000, []mpg.Posting{{AccountID: passengerAccount.ID, Amount: 50000}, {AccountID: account(mpg.AccountDriver, driver.ID, "USD").ID, Amount: -50000}}},
+		}
+		for i, tc := range invalid {
+			entry := mpg.JournalEntry{IdempotencyKey: "test:invalid:" + strconv.Itoa(i), Kind: mpg.EntryPayment, RideID: ride.ID, Currency: "VND", Amount: tc.amount}
+			created, err := db.CreateJournalEntry(&entry, tc.postings)
+			assert.Error(t, err, i)
+			assert.False(t, created, i)
+
+			stored, err := db.GetJournalEntry(entry.IdempotencyKey)
+			assert.NoError(t, err)
+			assert.Nil(t, stored, i)
+		}
+		assert.Equal(t, int64(50000), account(mpg.AccountPassenger, passenger.ID, "VND").Balance)
+
+		payment := mpg.JournalEntry{IdempotencyKey: "test:payment", Kind: mpg.EntryPayment, RideID: ride.ID, Currency: "VND", Amount: 50000,
+			ProviderRef: "ch_1", Memo: "card"}
+		created, err = db.CreateJournalEntry(&payment, []mpg.Posting{
+			{AccountID: account(mpg.AccountCash, 0, "VND").ID, Amount: 50000},
+			{AccountID: passengerAccount.ID, Amount: -50000},
+		})
+		assert.NoError(t, err)
+		assert.True(t, created)
+		assert.Equal(t, int64(0), account(mpg.AccountPassenger, passenger.ID, "VND").Balance)
+
+		stored, err := db.GetJournalEntry(payment.IdempotencyKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.NotNil(t, stored) {
+			assert.Equal(t, payment.ID, stored.ID)
+			assert.Equal(t, mpg.EntryPayment, stored.Kind)
+			assert.Equal(t, "ch_1", stored.ProviderRef)
+			assert.Equal(t, "card", stored.Memo)
+			assert.False(t, stored.CreatedAt.IsZero())
+		}
+
+		entries, err := db.GetRideJournalEntries(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, charge.ID, entries[0].ID)
+			assert.Equal(t, int64(50000), entries[0].Amount)
+			assert.Equal(t, payment.ID, entries[1].ID)
+		}
+
+		// Pending and succeeded refunds are reserved, a failed reservation saves nothing
+		refund := mpg.Refund{IdempotencyKey: "test:refund:a", RideID: ride.ID, Currency: "VND", Amount: 20000, Memo: "Wrong route"}
+		created, err = db.CreateRefund(&refund, payment.IdempotencyKey, func(reserved int64) error {
+			assert.Equal(t, int64(0), reserved)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, created)
+		assert.True(t, refund.ID > 0)
+		assert.Equal(t, mpg.RefundPending, refund.Status)
+
+		retried := mpg.Refund{IdempotencyKey: refund.IdempotencyKey, RideID: ride.ID, Currency: "VND", Amount: 30000}
+		created, err = db.CreateRefund(&retried, payment.IdempotencyKey, func(reserved int64) error {
+			t.Error("reserve is called for an existing refund")
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.False(t, created)
+		assert.Equal(t, refund.ID, retried.ID)
+		assert.Equal(t, int64(20000), retried.Amount)
+		assert.Equal(t, "Wrong route", retried.Memo)
+
+		rejected := mpg.Refund{IdempotencyKey: "test:refund:b", RideID: ride.ID, Currency: "VND", Amount: 40000}
+		created, err = db.CreateRefund(&rejected, payment.IdempotencyKey, func(reserved int64) error {
+			assert.Equal(t, int64(20000), reserved)
+			return errors.New("refund exceeds the fare")
+		})
+		assert.Error(t, err)
+		assert.False(t, created)
+
+		failed := mpg.Refund{IdempotencyKey: "test:refund:c", RideID: ride.ID, Currency: "VND", Amount: 10000}
+		created, err = db.CreateRefund(&failed, payment.IdempotencyKey, func(reserved int64) error { return nil })
+		assert.NoError(t, err)
+		assert.True(t, created)
+		assert.NoError(t, db.FailRefund(failed.ID))
+
+		// The refund entry is recorded with the refund succeeded
+		refund.ProviderRef = "re_1"
+		refundEntry := mpg.JournalEntry{IdempotencyKey: refund.IdempotencyKey, Kind: mpg.EntryRefund, RideID: ride.ID, Currency: "VND",
+			Amount: 20000, ProviderRef: refund.ProviderRef}
+		refundPostings := []mpg.Posting{
+			{AccountID: account(mpg.AccountRefunds, 0, "VND").ID, Amount: 20000},
+			{AccountID: account(mpg.AccountCash, 0, "VND").ID, Amount: -20000},
+		}
+		created, err = db.CompleteRefund(&refund, &refundEntry, refundPostings)
+		assert.NoError(t, err)
+		assert.True(t, created)
+		assert.Equal(t, mpg.RefundSucceeded, refund.Status)
+		stored, err = db.GetJournalEntry(refund.IdempotencyKey)
+		assert.NoError(t, err)
+		if assert.NotNil(t, stored) {
+			assert.Equal(t, "re_1", stored.ProviderRef)
+		}
+
+		created, err = db.CompleteRefund(&refund, &mpg.JournalEntry{IdempotencyKey: refund.IdempotencyKey, Kind: mpg.EntryRefund,
+			RideID: ride.ID, Currency: "VND", Amount: 20000}, refundPostings)
+		assert.NoError(t, err)
+		assert.False(t, created)
+		assert.Equal(t, int64(20000), account(mpg.AccountRefunds, 0, "VND").Balance)
+
+		// Failed refunds are not reserved
+		next := mpg.Refund{IdempotencyKey: "test:refund:d", RideID: ride.ID, Currency: "VND", Amount: 30000}
+		_, err = db.CreateRefund(&next, payment.IdempotencyKey, func(reserved int64) error {
+			assert.Equal(t, int64(20000), reserved)
+			return nil
+		})
+		assert.NoError(t, err)
+
+		_, err = db.CreateRefund(&mpg.Refund{IdempotencyKey: "test:refund:e", RideID: ride.ID, Currency: "VND", Amount: 1000}, "test:missing",
+			func(reserved int64) error { return nil })
+		assert.Error(t, err)
+
+		stored, err = db.GetJournalEntry("test:missing")
+		assert.NoError(t, err)
+		assert.Nil(t, stored)
+
+		storedRide, err := db.GetRide(ride.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(50000), storedRide.Fare)
+		assert.Equal(t, int64(10000), storedRide.Commission)
+		assert.Equal(t, "VND", storedRide.Currency)
+	})
+
+	t.Run("Earnings", func(t *testing.T) {
+		db := newDB(t)
+		passenger := mpg.Passenger{Name: "passenger"}
+		if err := db.CreatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+		driver := mpg.Driver{Name: "driver", State: mpg.StateAvailable}
+		if err := db.CreateDriver(&driver); err != nil {
+			t.Fatal(err)
+		}
+
+		monday := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+		newRide := func(status string, completedAt time.Time) mpg.Ride {
+			ride := mpg.Ride{PassengerID: passenger.ID, DriverID: driver.ID, Lat: 10, Lng: 106, Status: status,
+				CompletedAt: completedAt, Fare: 50000, Commission: 10000, Currency: "VND"}
+			if err := db.CreateRide(&ride); err != nil {
+				t.Fatal(err)
+			}
+			return ride
+		}
+		late := newRide(mpg.RideCompleted, monday.Add(25*time.Hour))
+		early := newRide(mpg.RideCompleted, monday.Add(time.Hour))
+		newRide(mpg.RideCompleted, monday.Add(7*24*time.Hour))
+		started := newRide(mpg.RideStarted, time.Time{})
+
+		rides, err := db.GetCompletedRides(driver.ID, monday, monday.Add(7*24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, rides, 2) {
+			assert.Equal(t, early.ID, rides[0].ID)
+			assert.Equal(t, late.ID, rides[1].ID)
+			assert.Equal(t, int64(50000), rides[0].Fare)
+			assert.Equal(t, int64(0), rides[0].Tip)
+		}
+
+		// A completed ride is tipped once
+		early.Tip = 5000
+		updated, err := db.UpdateRideTip(&early)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+		early.Tip = 7000
+		updated, err = db.UpdateRideTip(&early)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+		started.Tip = 5000
+		updated, err = db.UpdateRideTip(&started)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+		ride, err := db.GetRide(early.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(5000), ride.Tip)
+
+		bonus := mpg.EarningAdjustment{DriverID: driver.ID, Amount: 20000, Currency: "VND", Reason: "Weekend bonus", CreatedAt: monday.Add(2 * time.Hour)}
+		correction := mpg.EarningAdjustment{DriverID: driver.ID, RideID: late.ID, Amount: -3000, Currency: "VND", Reason: "Toll refunded", CreatedAt: monday.Add(time.Hour)}
+		outside := mpg.EarningAdjustment{DriverID: driver.ID, Amount: 1000, Currency: "VND", Reason: "Referral", CreatedAt: monday.Add(-time.Hour)}
+		for _, adjustment := range []*mpg.EarningAdjustment{&bonus, &correction, &outside} {
+			if err := db.CreateEarningAdjustment(adjustment); err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, adjustment.ID > 0)
+		}
+
+		adjustments, err := db.GetEarningAdjustments(driver.ID, monday, monday.Add(7*24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, adjustments, 2) {
+			assert.Equal(t, correction.ID, adjustments[0].ID)
+			assert.Equal(t, late.ID, adjustments[0].RideID)
+			assert.Equal(t, int64(-3000), adjustments[0].Amount)
+			assert.Equal(t, bonus.ID, adjustments[1].ID)
+			assert.Equal(t, 0, adjustments[1].RideID)
+			assert.Equal(t, "Weekend bonus", adjustments[1].Reason)
+		}
+	})
+
+	t.Run("GetRidesInBox", func(t *testing.T) {
+		db := newDB(t)
+		passenger := mpg.Passenger{Name: "passenger"}
+		if err := db.CreatePassenger(&passenger); err != nil {
+			t.Fatal(err)
+		}
+
+		since := time.Now().Add(-time.Minute)
+		rides := []mpg.Ride{
+			{PassengerID: passenger.ID, Lat: -45.5, Lng: -120.5},
+			{PassengerID: passenger.ID, Lat: -45.1, Lng: -120.9},
+			// Outside the box
+			{PassengerID: passenger.ID, Lat: -44.5, Lng: -120.5},
+			{PassengerID: passenger.ID, Lat: -45.5, Lng: -119.5},
+		}
+		for i := range rides {
+			if err := db.CreateRide(&rides[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ids := func(since time.Time) []int {
+			found, err := db.GetRidesInBox(-46, -121, -45, -120, since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []int{}
+			for _, ride := range found {
+				ids = append(ids, ride.ID)
+			}
+			return ids
+		}
+		assert.Equal(t, []int{rides[0].ID, rides[1].ID}, ids(since))
+		assert.Equal(t, []int{}, ids(time.Now().Add(time.Hour)))
+	})
+
+	t.Run("Zones", func(t *testing.T) {
+		db := newDB(t)
+		geometry := `{"type":"Polygon","coordinates":[[[106,10],[107,10],[107,11],[106,10]]]}`
+		city := mpg.Zone{Name: "city", Kind: mpg.ZoneServiceArea, Geometry: geometry}
+		airport := mpg.Zone{Name: "airport", Kind: mpg.ZoneAirport, Geometry: geometry, Queue: true, PickupFee: 5000, FareMultiplier: 1.5}
+		for _, zone := range []*mpg.Zone{&city, &airport} {
+			if err := db.CreateZone(zone); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.True(t, city.ID > 0)
+		assert.True(t, airport.ID > city.ID)
+
+		zones, err := db.GetZones()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, zones, 2)
+		stored := map[int]mpg.Zone{}
+		for i, zone := range zones {
+			if i > 0 {
+				assert.True(t, zones[i-1].ID < zone.ID)
+			}
+			stored[zone.ID] = zone
+		}
+		assert.Equal(t, city.Name, stored[city.ID].Name)
+		assert.Equal(t, mpg.ZoneServiceArea, stored[city.ID].Kind)
+		assert.Equal(t, float64(1), stored[city.ID].FareMultiplier)
+		assert.False(t, stored[city.ID].Queue)
+		assert.JSONEq(t, geometry, stored[city.ID].Geometry)
+		assert.Equal(t, mpg.ZoneAirport, stored[airport.ID].Kind)
+		assert.True(t, stored[airport.ID].Queue)
+		assert.Equal(t, int64(5000), stored[airport.ID].PickupFee)
+		assert.Equal(t, 1.5, stored[airport.ID].FareMultiplier)
+	})
+}
+
+// TestCassandra Run the contract suite of database.CassandraI
+func TestCassandra(t *testing.T, newDB func(t *testing.T) database.CassandraI) {
+	t.Run("LatestLocationNotFound", func(t *testing.T) {
+		db := newDB(t)
+		location, err := db.GetDriverLatestLocation(1)
+		assert.NoError(t, err)
+		assert.Nil(t, location)
+	})
+
+	t.Run("HistoryEmpty", func(t *testing.T) {
+		db := newDB(t)
+		history, err := db.GetDriverHistory(1, time.Now().Add(-time.Hour))
+		assert.NoError(t, err)
+		assert.Len(t, history, 0)
+	})
+
+	t.Run("HistoryOrder", func(t *testing.T) {
+		db := newDB(t)
+		now := time.Now()
+		// Inserted out of order, the last two are in the same second
+		createdAts := []time.Time{
+			now.Add(-10 * time.Minute),
+			now.Add(-time.Hour),
+			now.Add(-20 * time.Minute),
+			now.Add(-2 * time.Second).Truncate(time.Second),
+			now.Add(-2 * time.Second).Truncate(time.Second).Add(100 * time.Millisecond),
+		}
+		for i, createdAt := range createdAts {
+			location := mcass.DriverLocation{DriverID: 1, Lat: float64(i), Lng: 100, CreatedAt: createdAt}
+			if err := db.CreateDriverLocation(&location); err != nil {
+				t.Fatal(err)
+			}
+		}
+		other := mcass.DriverLocation{DriverID: 2, Lat: 50, Lng: 50, CreatedAt: now}
+		if err := db.CreateDriverLocation(&other); err != nil {
+			t.Fatal(err)
+		}
+
+		history, err := db.GetDriverHistory(1, now.Add(-30*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lats := make([]float64, len(history))
+		for i, location := range history {
+			assert.Equal(t, 1, location.DriverID)
+			lats[i] = location.Lat
+		}
+		assert.Equal(t, []float64{4, 3, 0, 2}, lats)
+		if assert.Len(t, history, 4) {
+			assert.WithinDuration(t, createdAts[4], history[0].CreatedAt, time.Millisecond)
+		}
+
+		latest, err := db.GetDriverLatestLocation(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest == nil {
+			t.Fatal("latest not found")
+		}
+		assert.Equal(t, float64(4), latest.Lat)
+		assert.Equal(t, float64(100), latest.Lng)
+	})
+}
+
+// TestRedis Run the contract suite of database.RedisI
+func TestRedis(t *testing.T, newDB func(t *testing.T) database.RedisI) {
+	// Drivers on the equator, 0.01 degree of longitude is about 1.11 km
+	push := func(t *testing.T, db database.RedisI) {
+		for id, lng := range map[int]float64{1: 0.03, 2: 0.01, 3: 0.02, 4: 0.5} {
+			if err := db.PushDriverLocationGeo(id, 0, lng, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		db := newDB(t)
+		drivers, err := db.GetNearestDrivers(0, 0, 10, 5, "")
+		assert.NoError(t, err)
+		assert.Len(t, drivers, 0)
+	})
+
+	t.Run("RadiusAndOrder", func(t *testing.T) {
+		db := newDB(t)
+		push(t, db)
+		drivers, err := db.GetNearestDrivers(0, 0, 5, 10, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, drivers, 3) {
+			assert.Equal(t, 2, drivers[0].DriverID)
+			assert.Equal(t, 3, drivers[1].DriverID)
+			assert.Equal(t, 1, drivers[2].DriverID)
+			assert.InDelta(t, 0, drivers[0].Lat, 1e-4)
+			assert.InDelta(t, 0.01, drivers[0].Lng, 1e-4)
+			assert.InDelta(t, 1.11, drivers[0].Distance, 0.01)
+			assert.InDelta(t, 2.22, drivers[1].Distance, 0.01)
+		}
+
+		drivers, err = db.GetNearestDrivers(0, 0, 2, 10, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, drivers, 1) {
+			assert.Equal(t, 2, drivers[0].DriverID)
+		}
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		db := newDB(t)
+		push(t, db)
+		drivers, err := db.GetNearestDrivers(0, 0, 100, 2, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, drivers, 2) {
+			assert.Equal(t, 2, drivers[0].DriverID)
+			assert.Equal(t, 3, drivers[1].DriverID)
+		}
+	})
+
+	t.Run("MoveAndRemove", func(t *testing.T) {
+		db := newDB(t)
+		push(t, db)
+		if err := db.PushDriverLocationGeo(4, 0, 0.001, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.RemoveDriverLocationGeo(2); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.RemoveDriverLocationGeo(notFoundID); err != nil {
+			t.Fatal(err)
+		}
+
+		drivers, err := db.GetNearestDrivers(0, 0, 5, 10, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int, len(drivers))
+		for i, driver := range drivers {
+			ids[i] = driver.DriverID
+		}
+		assert.Equal(t, []int{4, 3, 1}, ids)
+	})
+
+	t.Run("VehicleClass", func(t *testing.T) {
+		db := newDB(t)
+		classes := map[int][]string{
+			1: {mpg.VehicleClassEconomy},
+			2: {mpg.VehicleClassEconomy, mpg.VehicleClassXL},
+			3: {mpg.VehicleClassPremium},
+		}
+		for id, lng := range map[int]float64{1: 0.03, 2: 0.01, 3: 0.02} {
+			if err := db.PushDriverLocationGeo(id, 0, lng, classes[id]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids := func(class string) []int {
+			drivers, err := db.GetNearestDrivers(0, 0, 5, 10, class)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int, len(drivers))
+			for i, driver := range drivers {
+				ids[i] = driver.DriverID
+			}
+			return ids
+		}
+		assert.Equal(t, []int{2, 3, 1}, ids(""))
+		assert.Equal(t, []int{2, 1}, ids(mpg.VehicleClassEconomy))
+		assert.Equal(t, []int{2}, ids(mpg.VehicleClassXL))
+		assert.Equal(t, []int{3}, ids(mpg.VehicleClassPremium))
+
+		// Driver 2 removed its economy vehicle, driver 3 went busy
+		if err := db.PushDriverLocationGeo(2, 0, 0.01, []string{mpg.VehicleClassXL}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.RemoveDriverLocationGeo(3); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []int{1}, ids(mpg.VehicleClassEconomy))
+		assert.Equal(t, []int{2}, ids(mpg.VehicleClassXL))
+		assert.Equal(t, []int{}, ids(mpg.VehicleClassPremium))
+	})
+
+	t.Run("ClaimDriver", func(t *testing.T) {
+		db := newDB(t)
+		push(t, db)
+		claim := func(driverID, rideID int, ttl time.Duration) bool {
+			claimed, err := db.ClaimDriver(driverID, rideID, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return claimed
+		}
+		release := func(driverID, rideID int) bool {
+			released, err := db.ReleaseDriver(driverID, rideID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return released
+		}
+
+		assert.True(t, claim(1, 10, time.Minute))
+		assert.False(t, claim(1, 11, time.Minute))
+		assert.False(t, claim(1, 10, time.Minute))
+
+		// The claimed driver is not found anymore
+		drivers, err := db.GetNearestDrivers(0, 0, 5, 10, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int, len(drivers))
+		for i, driver := range drivers {
+			ids[i] = driver.DriverID
+		}
+		assert.Equal(t, []int{2, 3}, ids)
+
+		// Only the claiming ride releases it
+		assert.False(t, release(1, 11))
+		assert.True(t, release(1, 10))
+		assert.False(t, release(1, 10))
+		assert.True(t, claim(1, 11, time.Minute))
+		assert.True(t, release(1, 11))
+
+		// The claim expires
+		assert.True(t, claim(2, 10, 50*time.Millisecond))
+		time.Sleep(100 * time.Millisecond)
+		assert.False(t, release(2, 10))
+		assert.True(t, claim(2, 11, time.Minute))
+		assert.True(t, release(2, 11))
+	})
+
+	t.Run("ClaimDriverConcurrent", func(t *testing.T) {
+		db := newDB(t)
+		var (
+			wg      sync.WaitGroup
+			claimed int32
+		)
+		for rideID := 1; rideID <= 50; rideID++ {
+			wg.Add(1)
+			go func(rideID int) {
+				defer wg.Done()
+				ok, err := db.ClaimDriver(3, rideID, time.Minute)
+				assert.NoError(t, err)
+				if ok {
+					atomic.AddInt32(&claimed, 1)
+				}
+			}(rideID)
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), claimed)
+
+		for rideID := 1; rideID <= 50; rideID++ {
+			db.ReleaseDriver(3, rideID)
+		}
+	})
+
+	t.Run("GetDriversInBox", func(t *testing.T) {
+		db := newDB(t)
+		push(t, db)
+		ids := func(drivers []mredis.DriverLocation, err error) []int {
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int, len(drivers))
+			for i, driver := range drivers {
+				ids[i] = driver.DriverID
+				assert.InDelta(t, 0, driver.Lat, 1e-5)
+			}
+			return ids
+		}
+
+		assert.Equal(t, []int{1, 3}, ids(db.GetDriversInBox(-0.01, 0.015, 0.01, 0.1)))
+		assert.Equal(t, []int{1, 2, 3, 4}, ids(db.GetDriversInBox(-1, -1, 1, 1)))
+		assert.Equal(t, []int{}, ids(db.GetDriversInBox(0.005, 0, 0.01, 1)))
+		drivers, err := db.GetDriversInBox(-0.01, 0.025, 0.01, 0.035)
+		if assert.NoError(t, err) && assert.Len(t, drivers, 1) {
+			assert.InDelta(t, 0.03, drivers[0].Lng, 1e-5)
+		}
+	})
+
+	t.Run("GetDriversInPolygon", func(t *testing.T) {
+		db := newDB(t)
+		push(t, db)
+		ids := func(polygon geo.Polygon) []int {
+			drivers, err := db.GetDriversInPolygon(polygon)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int, len(drivers))
+			for i, driver := range drivers {
+				ids[i] = driver.DriverID
+			}
+			return ids
+		}
+
+		// A triangle which is 0.025 degree wide on the equator
+		triangle := []geo.Point{{Lat: -0.01, Lng: 0}, {Lat: 0.01, Lng: 0}, {Lat: 0, Lng: 0.025}}
+		assert.Equal(t, []int{2, 3}, ids(geo.Polygon{triangle}))
+		hole := []geo.Point{{Lat: -0.002, Lng: 0.018}, {Lat: -0.002, Lng: 0.022}, {Lat: 0.002, Lng: 0.022}, {Lat: 0.002, Lng: 0.018}}
+		assert.Equal(t, []int{2}, ids(geo.Polygon{triangle, hole}))
+		assert.Equal(t, []int{}, ids(geo.Polygon{{{Lat: 1, Lng: 1}, {Lat: 2, Lng: 1}, {Lat: 2, Lng: 2}}}))
+	})
+
+	t.Run("ZoneQueue", func(t *testing.T) {
+		db := newDB(t)
+		queue := func(limit int) []int {
+			driverIDs, err := db.GetZoneQueue("airport", limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return driverIDs
+		}
+		assert.Equal(t, []int{}, queue(0))
+
+		for _, driverID := range []int{3, 1, 2, 1} {
+			assert.NoError(t, db.JoinZoneQueue("airport", driverID))
+		}
+		// Joining again keeps the position
+		assert.Equal(t, []int{3, 1, 2}, queue(0))
+		assert.Equal(t, []int{3, 1}, queue(2))
+
+		assert.NoError(t, db.LeaveZoneQueue("airport", 1))
+		assert.NoError(t, db.LeaveZoneQueue("airport", 4))
+		assert.NoError(t, db.JoinZoneQueue("airport", 1))
+		assert.Equal(t, []int{3, 2, 1}, queue(0))
+
+		for _, driverID := range []int{1, 2, 3} {
+			assert.NoError(t, db.LeaveZoneQueue("airport", driverID))
+		}
+		assert.Equal(t, []int{}, queue(0))
+	})
+
+	t.Run("TakeToken", func(t *testing.T) {
+		db := newDB(t)
+		for i := 0; i < 2; i++ {
+			allowed, _, err := db.TakeToken("test:1", 1, 2)
+			assert.NoError(t, err)
+			assert.True(t, allowed)
+		}
+
+		allowed, wait, err := db.TakeToken("test:1", 1, 2)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+		assert.True(t, wait > 0 && wait <= time.Second, "wait %s", wait)
+
+		allowed, _, err = db.TakeToken("test:2", 1, 2)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+
+		// 100 tokens per second refills a token within 10ms
+		for i := 0; i < 2; i++ {
+			db.TakeToken("test:3", 100, 1)
+		}
+		time.Sleep(20 * time.Millisecond)
+		allowed, _, err = db.TakeToken("test:3", 100, 1)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	})
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"math"
+
+	"github.com/trietphm/gruber/geo"
+)
+
+// Geohash scores of Redis geo sets: 26 bits of latitude and 26 bits of longitude interleaved, longitude bits first.
+// Unlike standard geohashes latitudes are limited to the range of Web Mercator
+const (
+	geoLatMin  = -85.05112878
+	geoLatMax  = 85.05112878
+	geoLngMin  = -180.0
+	geoLngMax  = 180.0
+	geoMaxStep = 26
+)
+
+// scoreRange Scores of the members of a geohash cell, from min included to max excluded
+type scoreRange struct {
+	min, max uint64
+}
+
+// geoScore Score of a coordinate in a Redis geo set
+func geoScore(lat, lng float64) uint64 {
+	latIndex, lngIndex := geoCell(lat, lng, geoMaxStep)
+	return interleave(latIndex, lngIndex)
+}
+
+// geoCell Indexes of the cell of a coordinate in the grid of a step, 2^step cells per dimension
+func geoCell(lat, lng float64, step uint) (latIndex, lngIndex uint32) {
+	cells := float64(uint64(1) << step)
+	index := func(value, min, max float64) uint32 {
+		i := math.Floor((value - min) / (max - min) * cells)
+		return uint32(math.Max(0, math.Min(i, cells-1)))
+	}
+
+	return index(lat, geoLatMin, geoLatMax), index(lng, geoLngMin, geoLngMax)
+}
+
+// geoDecode Center of the cell of a score in a Redis geo set
+func geoDecode(score uint64) (lat, lng float64) {
+	latIndex, lngIndex := deinterleave(score)
+	cells := float64(uint64(1) << geoMaxStep)
+	lat = geoLatMin + (float64(latIndex)+0.5)*(geoLatMax-geoLatMin)/cells
+	lng = geoLngMin + (float64(lngIndex)+0.5)*(geoLngMax-geoLngMin)/cells
+	return lat, lng
+}
+
+// geoRanges Score ranges of the cells covering a box, cells are the smallest ones of the same step such that the box
+// spans at most 2 of them in each dimension
+func geoRanges(box geo.Box) []scoreRange {
+	step := uint(geoMaxStep)
+	for ; step > 1; step-- {
+		cells := float64(uint64(1) << step)
+		if box.MaxLat-box.MinLat <= (geoLatMax-geoLatMin)/cells && box.MaxLng-box.MinLng <= (geoLngMax-geoLngMin)/cells {
+			break
+		}
+	}
+
+	minLat, minLng := geoCell(box.MinLat, box.MinLng, step)
+	maxLat, maxLng := geoCell(box.MaxLat, box.MaxLng, step)
+	shift := 2 * (geoMaxStep - step)
+	ranges := []scoreRange{}
+	for latIndex := minLat; latIndex <= maxLat; latIndex++ {
+		for lngIndex := minLng; lngIndex <= maxLng; lngIndex++ {
+			hash := interleave(latIndex, lngIndex)
+			ranges = append(ranges, scoreRange{min: hash << shift, max: (hash + 1) << shift})
+		}
+	}
+
+	return ranges
+}
+
+// interleave Interleave the bits of two indexes, latitude bits are the even bits and longitude bits the odd bits
+func interleave(latIndex, lngIndex uint32) uint64 {
+	return spread(latIndex) | spread(lngIndex)<<1
+}
+
+// deinterleave Split the bits of interleave
+func deinterleave(hash uint64) (latIndex, lngIndex uint32) {
+	return squash(hash), squash(hash >> 1)
+}
+
+// spread Move bit i of x to bit 2i
+func spread(x uint32) uint64 {
+	v := uint64(x)
+	v = (v | v<<16) & 0x0000FFFF0000FFFF
+	v = (v | v<<8) & 0x00FF00FF00FF00FF
+	v = (v | v<<4) & 0x0F0F0F0F0F0F0F0F
+	v = (v | v<<2) & 0x3333333333333333
+	v = (v | v<<1) & 0x5555555555555555
+	return v
+}
+
+// squash Move bit 2i of x to bit i, odd bits are dropped
+func squash(x uint64) uint32 {
+	v := x & 0x5555555555555555
+	v = (v | v>>1) & 0x3333333333333333
+	v = (v | v>>2) & 0x0F0F0F0F0F0F0F0F
+	v = (v | v>>4) & 0x00FF00FF00FF00FF
+	v = (v | v>>8) & 0x0000FFFF0000FFFF
+	v = (v | v>>16) & 0x00000000FFFFFFFF
+	return uint32(v)
+}
@@ -0,0 +1,44 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/geo"
+)
+
+func TestGeoScore(t *testing.T) {
+	// Scores of the GEOADD examples of the Redis documentation
+	assert.Equal(t, uint64(3479099956230698), geoScore(38.115556, 13.361389))
+	assert.Equal(t, uint64(3479447370796909), geoScore(37.502669, 15.087269))
+
+	lat, lng := geoDecode(3479099956230698)
+	assert.InDelta(t, 38.115556, lat, 1e-5)
+	assert.InDelta(t, 13.361389, lng, 1e-5)
+
+	latIndex, lngIndex := deinterleave(interleave(12345, 67890))
+	assert.Equal(t, uint32(12345), latIndex)
+	assert.Equal(t, uint32(67890), lngIndex)
+}
+
+func TestGeoRanges(t *testing.T) {
+	box := geo.Box{MinLat: 10.7, MinLng: 106.6, MaxLat: 10.9, MaxLng: 106.8}
+	ranges := geoRanges(box)
+	assert.True(t, len(ranges) >= 1 && len(ranges) <= 4, "%d ranges", len(ranges))
+
+	inRanges := func(lat, lng float64) bool {
+		score := geoScore(lat, lng)
+		for _, r := range ranges {
+			if score >= r.min && score < r.max {
+				return true
+			}
+		}
+		return false
+	}
+	// Every coordinate of the box is in a range, coordinates far away are not
+	for _, point := range [][2]float64{{10.7, 106.6}, {10.9, 106.8}, {10.8, 106.7}, {10.7, 106.8}, {10.9, 106.6}} {
+		assert.True(t, inRanges(point[0], point[1]), "%v", point)
+	}
+	assert.False(t, inRanges(21.0278, 105.8342))
+	assert.False(t, inRanges(10.8, 108))
+}
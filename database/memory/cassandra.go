@@ -0,0 +1,74 @@
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/model/mcass"
+)
+
+// Cassandra In-memory implementation of database.CassandraI
+type Cassandra struct {
+	mu sync.RWMutex
+	// locations of each driver, newest first
+	locations map[int][]mcass.DriverLocation
+}
+
+var _ database.CassandraI = (*Cassandra)(nil)
+
+// NewCassandra Create an empty in-memory cassandra store
+func NewCassandra() *Cassandra {
+	return &Cassandra{
+		locations: make(map[int][]mcass.DriverLocation),
+	}
+}
+
+// CreateDriverLocation Save a driver location, the ID is a timeuuid of CreatedAt unless it is set like in cassandra
+func (db *Cassandra) CreateDriverLocation(location *mcass.DriverLocation) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if location.ID == (gocql.UUID{}) {
+		location.ID = gocql.UUIDFromTime(location.CreatedAt)
+	}
+	locations := db.locations[location.DriverID]
+	i := sort.Search(len(locations), func(i int) bool {
+		return !locations[i].CreatedAt.After(location.CreatedAt)
+	})
+	locations = append(locations, mcass.DriverLocation{})
+	copy(locations[i+1:], locations[i:])
+	locations[i] = *location
+	db.locations[location.DriverID] = locations
+	return nil
+}
+
+// GetDriverHistory Get driver locations created after from, newest first
+func (db *Cassandra) GetDriverHistory(driverID int, from time.Time) ([]mcass.DriverLocation, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	history := []mcass.DriverLocation{}
+	for _, location := range db.locations[driverID] {
+		if !location.CreatedAt.After(from) {
+			break
+		}
+		history = append(history, location)
+	}
+	return history, nil
+}
+
+// GetDriverLatestLocation Get latest driver location within the retention period, nil if there is none
+func (db *Cassandra) GetDriverLatestLocation(driverID int) (*mcass.DriverLocation, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	locations := db.locations[driverID]
+	if len(locations) == 0 || locations[0].CreatedAt.Before(time.Now().Add(-mcass.Retention)) {
+		return nil, nil
+	}
+	location := locations[0]
+	return &location, nil
+}
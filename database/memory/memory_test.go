@@ -0,0 +1,20 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/database/dbtest"
+)
+
+func TestPg(t *testing.T) {
+	dbtest.TestPg(t, func(t *testing.T) database.PgI { return NewPg() })
+}
+
+func TestCassandra(t *testing.T) {
+	dbtest.TestCassandra(t, func(t *testing.T) database.CassandraI { return NewCassandra() })
+}
+
+func TestRedis(t *testing.T) {
+	dbtest.TestRedis(t, func(t *testing.T) database.RedisI { return NewRedis() })
+}
@@ -0,0 +1,921 @@
+// Package memory implements the datastore interfaces of package database in memory.
+// It is meant for local development and tests, all data is lost when the process exits.
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/model/mpg"
+)
+
+// Pg In-memory implementation of database.PgI
+type Pg struct {
+	mu             sync.RWMutex
+	drivers        map[int]mpg.Driver
+	passengers     map[int]mpg.Passenger
+	vehicles       map[int]mpg.Vehicle
+	documents      map[int]mpg.DriverDocument
+	scheduledRides map[int]mpg.ScheduledRide
+	rides          map[int]mpg.Ride
+	cancellations  map[int]mpg.RideCancellation
+	rideStops      map[int]mpg.RideStop
+	ratings        map[int]mpg.RideRating
+	accounts       map[int]mpg.Account
+	entries        map[int]mpg.JournalEntry
+	postings       map[int]mpg.Posting
+	refunds        map[int]mpg.Refund
+	adjustments    map[int]mpg.EarningAdjustment
+	zones          map[int]mpg.Zone
+	// Sequences of table ids
+	lastDriverID        int
+	lastPassengerID     int
+	lastVehicleID       int
+	lastDocumentID      int
+	lastScheduledRideID int
+	lastRideID          int
+	lastCancellationID  int
+	lastRideStopID      int
+	lastRatingID        int
+	lastAccountID       int
+	lastEntryID         int
+	lastPostingID       int
+	lastRefundID        int
+	lastAdjustmentID    int
+	lastZoneID          int
+}
+
+var _ database.PgI = (*Pg)(nil)
+
+// NewPg Create an empty in-memory postgresql store
+func NewPg() *Pg {
+	return &Pg{
+		drivers:        make(map[int]mpg.Driver),
+		passengers:     make(map[int]mpg.Passenger),
+		vehicles:       make(map[int]mpg.Vehicle),
+		documents:      make(map[int]mpg.DriverDocument),
+		scheduledRides: make(map[int]mpg.ScheduledRide),
+		rides:          make(map[int]mpg.Ride),
+		cancellations:  make(map[int]mpg.RideCancellation),
+		rideStops:      make(map[int]mpg.RideStop),
+		ratings:        make(map[int]mpg.RideRating),
+		accounts:       make(map[int]mpg.Account),
+		entries:        make(map[int]mpg.JournalEntry),
+		postings:       make(map[int]mpg.Posting),
+		refunds:        make(map[int]mpg.Refund),
+		adjustments:    make(map[int]mpg.EarningAdjustment),
+		zones:          make(map[int]mpg.Zone),
+	}
+}
+
+// CreateDriver Insert driver to memory, ID and CreatedAt are set like the database defaults
+func (db *Pg) CreateDriver(driver *mpg.Driver) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lastDriverID++
+	driver.ID = db.lastDriverID
+	if driver.CreatedAt.IsZero() {
+		driver.CreatedAt = time.Now()
+	}
+	if driver.StateUpdatedAt.IsZero() {
+		driver.StateUpdatedAt = driver.CreatedAt
+	}
+	db.drivers[driver.ID] = *driver
+	return nil
+}
+
+// CreatePassenger Insert passenger to memory, ID and CreatedAt are set like the database defaults
+func (db *Pg) CreatePassenger(passenger *mpg.Passenger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lastPassengerID++
+	passenger.ID = db.lastPassengerID
+	if passenger.CreatedAt.IsZero() {
+		passenger.CreatedAt = time.Now()
+	}
+	db.passengers[passenger.ID] = *passenger
+	return nil
+}
+
+// UpdateDriverState Update driver state, it does nothing if the driver does not exist.
+// The state change time is kept when the state is unchanged
+func (db *Pg) UpdateDriverState(driverID int, state string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	driver, ok := db.drivers[driverID]
+	if !ok {
+		return nil
+	}
+	if driver.State != state {
+		driver.StateUpdatedAt = time.Now()
+	}
+	driver.State = state
+	db.drivers[driverID] = driver
+	return nil
+}
+
+// GetDriver Get driver by id, it returns nil if not found
+func (db *Pg) GetDriver(driverID int) (*mpg.Driver, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	driver, ok := db.drivers[driverID]
+	if !ok {
+		return nil, nil
+	}
+	return &driver, nil
+}
+
+// GetPassenger Get passenger by id, it returns nil if not found or soft deleted
+func (db *Pg) GetPassenger(passengerID int) (*mpg.Passenger, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	passenger, ok := db.passengers[passengerID]
+	if !ok || passenger.DeletedAt != nil {
+		return nil, nil
+	}
+	return &passenger, nil
+}
+
+// UpdatePassenger Update passenger profile, it does nothing if the passenger does not exist or is deleted
+func (db *Pg) UpdatePassenger(passenger *mpg.Passenger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.passengers[passenger.ID]
+	if !ok || stored.DeletedAt != nil {
+		return nil
+	}
+	stored.Name = passenger.Name
+	stored.Phone = passenger.Phone
+	stored.Email = passenger.Email
+	stored.DefaultPaymentMethod = passenger.DefaultPaymentMethod
+	db.passengers[passenger.ID] = stored
+	return nil
+}
+
+// DeletePassenger Soft delete passenger
+func (db *Pg) DeletePassenger(passengerID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	passenger, ok := db.passengers[passengerID]
+	if !ok || passenger.DeletedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	passenger.DeletedAt = &now
+	db.passengers[passengerID] = passenger
+	return nil
+}
+
+// CreateVehicle Insert vehicle of a driver
+func (db *Pg) CreateVehicle(vehicle *mpg.Vehicle) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lastVehicleID++
+	vehicle.ID = db.lastVehicleID
+	if vehicle.CreatedAt.IsZero() {
+		vehicle.CreatedAt = time.Now()
+	}
+	db.vehicles[vehicle.ID] = *vehicle
+	db.updateDriverVehicleClasses(vehicle.DriverID)
+	return nil
+}
+
+// GetVehicle Get vehicle by id, it returns nil if not found
+func (db *Pg) GetVehicle(vehicleID int) (*mpg.Vehicle, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	vehicle, ok := db.vehicles[vehicleID]
+	if !ok {
+		return nil, nil
+	}
+	return &vehicle, nil
+}
+
+// GetVehicles Get vehicles of a driver ordered by id
+func (db *Pg) GetVehicles(driverID int) ([]mpg.Vehicle, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	vehicles := []mpg.Vehicle{}
+	for _, vehicle := range db.vehicles {
+		if vehicle.DriverID == driverID {
+			vehicles = append(vehicles, vehicle)
+		}
+	}
+	sort.Slice(vehicles, func(i, j int) bool { return vehicles[i].ID < vehicles[j].ID })
+	return vehicles, nil
+}
+
+// DeleteVehicle Delete vehicle by id
+func (db *Pg) DeleteVehicle(vehicleID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	vehicle, ok := db.vehicles[vehicleID]
+	if !ok {
+		return nil
+	}
+	delete(db.vehicles, vehicleID)
+	db.updateDriverVehicleClasses(vehicle.DriverID)
+	return nil
+}
+
+// updateDriverVehicleClasses Recompute the vehicle classes kept with the driver from its vehicles, the caller holds the lock
+func (db *Pg) updateDriverVehicleClasses(driverID int) {
+	driver, ok := db.drivers[driverID]
+	if !ok {
+		return
+	}
+	seen := map[string]bool{}
+	classes := []string{}
+	for _, vehicle := range db.vehicles {
+		if vehicle.DriverID == driverID && !seen[vehicle.Class] {
+			seen[vehicle.Class] = true
+			classes = append(classes, vehicle.Class)
+		}
+	}
+	sort.Strings(classes)
+	driver.VehicleClasses = classes
+	db.drivers[driverID] = driver
+}
+
+// SaveDriverDocument Insert document or replace the driver's document of the same type
+func (db *Pg) SaveDriverDocument(document *mpg.DriverDocument) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for id, stored := range db.documents {
+		if stored.DriverID == document.DriverID && stored.Type == document.Type {
+			stored.Number = document.Number
+			stored.ExpiresAt = document.ExpiresAt
+			db.documents[id] = stored
+			document.ID = stored.ID
+			document.CreatedAt = stored.CreatedAt
+			return nil
+		}
+	}
+
+	db.lastDocumentID++
+	document.ID = db.lastDocumentID
+	if document.CreatedAt.IsZero() {
+		document.CreatedAt = time.Now()
+	}
+	db.documents[document.ID] = *document
+	return nil
+}
+
+// GetDriverDocuments Get documents of a driver ordered by id
+func (db *Pg) GetDriverDocuments(driverID int) ([]mpg.DriverDocument, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	documents := []mpg.DriverDocument{}
+	for _, document := range db.documents {
+		if document.DriverID == driverID {
+			documents = append(documents, document)
+		}
+	}
+	sort.Slice(documents, func(i, j int) bool { return documents[i].ID < documents[j].ID })
+	return documents, nil
+}
+
+// GetDriversWithExpiredDocuments Get drivers among driverIDs who have a document expired at a time
+func (db *Pg) GetDriversWithExpiredDocuments(driverIDs []int, at time.Time) ([]int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	wanted := make(map[int]bool, len(driverIDs))
+	for _, driverID := range driverIDs {
+		wanted[driverID] = true
+	}
+
+	expired := []int{}
+	for _, document := range db.documents {
+		if wanted[document.DriverID] && document.Expired(at) {
+			expired = append(expired, document.DriverID)
+			wanted[document.DriverID] = false
+		}
+	}
+	sort.Ints(expired)
+	return expired, nil
+}
+
+// GetDriversRatedBelow Get drivers among driverIDs whose rating is below a rating, drivers not rated yet are not
+func (db *Pg) GetDriversRatedBelow(driverIDs []int, rating float64) ([]int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	below := []int{}
+	for _, driverID := range driverIDs {
+		driver, ok := db.drivers[driverID]
+		if ok && driver.Rating > 0 && driver.Rating < rating {
+			below = append(below, driverID)
+		}
+	}
+	sort.Ints(below)
+	return below, nil
+}
+
+// CreateScheduledRide Insert scheduled ride, the status is pending unless set
+func (db *Pg) CreateScheduledRide(ride *mpg.ScheduledRide) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lastScheduledRideID++
+	ride.ID = db.lastScheduledRideID
+	if ride.Status == "" {
+		ride.Status = mpg.ScheduledRidePending
+	}
+	if ride.CreatedAt.IsZero() {
+		ride.CreatedAt = time.Now()
+	}
+	if ride.UpdatedAt.IsZero() {
+		ride.UpdatedAt = ride.CreatedAt
+	}
+	db.scheduledRides[ride.ID] = *ride
+	return nil
+}
+
+// GetScheduledRide Get scheduled ride by id, it returns nil if not found
+func (db *Pg) GetScheduledRide(rideID int) (*mpg.ScheduledRide, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ride, ok := db.scheduledRides[rideID]
+	if !ok {
+		return nil, nil
+	}
+	return &ride, nil
+}
+
+// GetDueScheduledRides Get pending rides to pick up until a time, earliest pickup first
+func (db *Pg) GetDueScheduledRides(until time.Time) ([]mpg.ScheduledRide, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	rides := []mpg.ScheduledRide{}
+	for _, ride := range db.scheduledRides {
+		if ride.Status == mpg.ScheduledRidePending && !ride.PickupAt.After(until) {
+			rides = append(rides, ride)
+		}
+	}
+	sort.Slice(rides, func(i, j int) bool {
+		if rides[i].PickupAt.Equal(rides[j].PickupAt) {
+			return rides[i].ID < rides[j].ID
+		}
+		return rides[i].PickupAt.Before(rides[j].PickupAt)
+	})
+	return rides, nil
+}
+
+// UpdateScheduledRideStatus Save status and driver ids of a ride if its status is still from
+func (db *Pg) UpdateScheduledRideStatus(ride *mpg.ScheduledRide, from string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.scheduledRides[ride.ID]
+	if !ok || stored.Status != from {
+		return false, nil
+	}
+	ride.UpdatedAt = time.Now()
+	stored.Status = ride.Status
+	stored.DriverIDs = append([]int(nil), ride.DriverIDs...)
+	stored.UpdatedAt = ride.UpdatedAt
+	db.scheduledRides[ride.ID] = stored
+	return true, nil
+}
+
+// LinkScheduledRide Set the ride of a pending scheduled ride which has none
+func (db *Pg) LinkScheduledRide(scheduledRideID, rideID int) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.scheduledRides[scheduledRideID]
+	if !ok || stored.Status != mpg.ScheduledRidePending || stored.RideID != 0 {
+		return false, nil
+	}
+	stored.RideID = rideID
+	stored.UpdatedAt = time.Now()
+	db.scheduledRides[scheduledRideID] = stored
+	return true, nil
+}
+
+// CreateRide Insert ride, the status is requested unless set
+func (db *Pg) CreateRide(ride *mpg.Ride) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.createRide(ride)
+	return nil
+}
+
+// createRide Insert ride, db.mu must be locked
+func (db *Pg) createRide(ride *mpg.Ride) {
+	db.lastRideID++
+	ride.ID = db.lastRideID
+	if ride.Status == "" {
+		ride.Status = mpg.RideRequested
+	}
+	if ride.CreatedAt.IsZero() {
+		ride.CreatedAt = time.Now()
+	}
+	db.rides[ride.ID] = *ride
+}
+
+// GetRide Get ride by id, it returns nil if not found
+func (db *Pg) GetRide(rideID int) (*mpg.Ride, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ride, ok := db.rides[rideID]
+	if !ok {
+		return nil, nil
+	}
+	return &ride, nil
+}
+
+// UpdateRideStatus Save status, driver and status times of a ride if its status is still from
+func (db *Pg) UpdateRideStatus(ride *mpg.Ride, from string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.updateRideStatus(ride, from), nil
+}
+
+// CancelRide Save the ride like UpdateRideStatus and insert the cancellation
+func (db *Pg) CancelRide(ride *mpg.Ride, from string, cancellation *mpg.RideCancellation) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.updateRideStatus(ride, from) {
+		return false, nil
+	}
+
+	db.lastCancellationID++
+	cancellation.ID = db.lastCancellationID
+	cancellation.RideID = ride.ID
+	if cancellation.CreatedAt.IsZero() {
+		cancellation.CreatedAt = time.Now()
+	}
+	db.cancellations[cancellation.ID] = *cancellation
+	return true, nil
+}
+
+// updateRideStatus Save ride status fields, db.mu must be locked
+func (db *Pg) updateRideStatus(ride *mpg.Ride, from string) bool {
+	stored, ok := db.rides[ride.ID]
+	if !ok || stored.Status != from {
+		return false
+	}
+	stored.DriverID = ride.DriverID
+	stored.Status = ride.Status
+	stored.AssignedAt = ride.AssignedAt
+	stored.ArrivedAt = ride.ArrivedAt
+	stored.StartedAt = ride.StartedAt
+	stored.CompletedAt = ride.CompletedAt
+	stored.CancelledAt = ride.CancelledAt
+	stored.Fare = ride.Fare
+	stored.Commission = ride.Commission
+	stored.Currency = ride.Currency
+	db.rides[ride.ID] = stored
+	return true
+}
+
+// GetRideCancellations Get cancellations of a ride, oldest first
+func (db *Pg) GetRideCancellations(rideID int) ([]mpg.RideCancellation, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	cancellations := []mpg.RideCancellation{}
+	for _, cancellation := range db.cancellations {
+		if cancellation.RideID == rideID {
+			cancellations = append(cancellations, cancellation)
+		}
+	}
+	sort.Slice(cancellations, func(i, j int) bool { return cancellations[i].ID < cancellations[j].ID })
+	return cancellations, nil
+}
+
+// CreateRideWithStops Insert ride like CreateRide and its stops
+func (db *Pg) CreateRideWithStops(ride *mpg.Ride, stops []mpg.RideStop) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.createRide(ride)
+	for i := range stops {
+		db.lastRideStopID++
+		stops[i].ID = db.lastRideStopID
+		stops[i].RideID = ride.ID
+		db.rideStops[stops[i].ID] = stops[i]
+	}
+	return nil
+}
+
+// GetRideStops Get stops of a ride in position order
+func (db *Pg) GetRideStops(rideID int) ([]mpg.RideStop, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stops := []mpg.RideStop{}
+	for _, stop := range db.rideStops {
+		if stop.RideID == rideID {
+			stops = append(stops, stop)
+		}
+	}
+	sort.Slice(stops, func(i, j int) bool { return stops[i].Position < stops[j].Position })
+	return stops, nil
+}
+
+// UpdateRideStop Save the ride like UpdateRideStatus and the arrival and departure times of the stop
+func (db *Pg) UpdateRideStop(ride *mpg.Ride, from string, stop *mpg.RideStop) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.updateRideStatus(ride, from) {
+		return false, nil
+	}
+
+	stored, ok := db.rideStops[stop.ID]
+	if !ok || stored.RideID != ride.ID {
+		return true, nil
+	}
+	stored.ArrivedAt = stop.ArrivedAt
+	stored.DepartedAt = stop.DepartedAt
+	db.rideStops[stop.ID] = stored
+	return true, nil
+}
+
+// CreateRideRating Insert rating and update the average rating of the rated driver or passenger.
+// It returns false if the ride is already rated by the same side
+func (db *Pg) CreateRideRating(rating *mpg.RideRating) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, stored := range db.ratings {
+		if stored.RideID == rating.RideID && stored.RatedBy == rating.RatedBy {
+			return false, nil
+		}
+	}
+
+	db.lastRatingID++
+	rating.ID = db.lastRatingID
+	if rating.CreatedAt.IsZero() {
+		rating.CreatedAt = time.Now()
+	}
+	db.ratings[rating.ID] = *rating
+
+	// The passenger rates the driver and the driver rates the passenger
+	if rating.RatedBy == mpg.RatedByDriver {
+		if passenger, ok := db.passengers[rating.PassengerID]; ok {
+			passenger.Rating = db.averageRating(rating.RatedBy, func(r mpg.RideRating) bool { return r.PassengerID == passenger.ID })
+			db.passengers[passenger.ID] = passenger
+		}
+	} else if driver, ok := db.drivers[rating.DriverID]; ok {
+		driver.Rating = db.averageRating(rating.RatedBy, func(r mpg.RideRating) bool { return r.DriverID == driver.ID })
+		db.drivers[driver.ID] = driver
+	}
+	return true, nil
+}
+
+// averageRating Average of the latest RatingWindow ratings by a side matching rated, db.mu must be locked
+func (db *Pg) averageRating(ratedBy string, rated func(mpg.RideRating) bool) float64 {
+	ratings := []mpg.RideRating{}
+	for _, rating := range db.ratings {
+		if rating.RatedBy == ratedBy && rated(rating) {
+			ratings = append(ratings, rating)
+		}
+	}
+	sort.Slice(ratings, func(i, j int) bool { return ratings[i].ID > ratings[j].ID })
+	if len(ratings) > mpg.RatingWindow {
+		ratings = ratings[:mpg.RatingWindow]
+	}
+
+	sum := 0
+	for _, rating := range ratings {
+		sum += rating.Rating
+	}
+	return float64(sum) / float64(len(ratings))
+}
+
+// GetLowRatings Get ratings up to maxRating since a time, by a side or both if ratedBy is empty, newest first
+func (db *Pg) GetLowRatings(maxRating int, ratedBy string, since time.Time, limit int) ([]mpg.RideRating, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ratings := []mpg.RideRating{}
+	for _, rating := range db.ratings {
+		if rating.Rating <= maxRating && !rating.CreatedAt.Before(since) && (ratedBy == "" || rating.RatedBy == ratedBy) {
+			ratings = append(ratings, rating)
+		}
+	}
+	sort.Slice(ratings, func(i, j int) bool { return ratings[i].ID > ratings[j].ID })
+	if len(ratings) > limit {
+		ratings = ratings[:limit]
+	}
+	return ratings, nil
+}
+
+// GetRidesInBox Get rides requested since a time with a pickup in a bounding box, oldest first
+func (db *Pg) GetRidesInBox(minLat, minLng, maxLat, maxLng float64, since time.Time) ([]mpg.Ride, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	rides := []mpg.Ride{}
+	for _, ride := range db.rides {
+		if !ride.CreatedAt.Before(since) && ride.Lat >= minLat && ride.Lat <= maxLat && ride.Lng >= minLng && ride.Lng <= maxLng {
+			rides = append(rides, ride)
+		}
+	}
+	sort.Slice(rides, func(i, j int) bool { return rides[i].ID < rides[j].ID })
+	return rides, nil
+}
+
+// GetOrCreateAccount Get the ledger account of an owner in a currency, it is created with a zero balance if missing
+func (db *Pg) GetOrCreateAccount(kind string, ownerID int, currency string) (*mpg.Account, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, account := range db.accounts {
+		if account.Kind == kind && account.OwnerID == ownerID && account.Currency == currency {
+			return &account, nil
+		}
+	}
+
+	db.lastAccountID++
+	account := mpg.Account{ID: db.lastAccountID, Kind: kind, OwnerID: ownerID, Currency: currency, CreatedAt: time.Now()}
+	db.accounts[account.ID] = account
+	return &account, nil
+}
+
+// CreateJournalEntry Insert entry and its postings and update the balances of their accounts.
+// The invariants of postings are checked like the database does
+func (db *Pg) CreateJournalEntry(entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.createJournalEntry(entry, postings)
+}
+
+// CreateRefund Insert pending refund, reserve is called under the lock with the pending and succeeded refunds of the ride
+func (db *Pg) CreateRefund(refund *mpg.Refund, paymentKey string, reserve func(reserved int64) error) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	paid := false
+	for _, entry := range db.entries {
+		if entry.IdempotencyKey == paymentKey {
+			paid = true
+		}
+	}
+	if !paid {
+		return false, fmt.Errorf("payment entry %s not found", paymentKey)
+	}
+
+	var reserved int64
+	for _, stored := range db.refunds {
+		if stored.IdempotencyKey == refund.IdempotencyKey {
+			*refund = stored
+			return false, nil
+		}
+		if stored.RideID == refund.RideID && stored.Status != mpg.RefundFailed {
+			reserved += stored.Amount
+		}
+	}
+
+	if err := reserve(reserved); err != nil {
+		return false, err
+	}
+
+	db.lastRefundID++
+	refund.ID = db.lastRefundID
+	refund.Status = mpg.RefundPending
+	if refund.CreatedAt.IsZero() {
+		refund.CreatedAt = time.Now()
+	}
+	db.refunds[refund.ID] = *refund
+	return true, nil
+}
+
+// CompleteRefund Save the refund as succeeded and insert its entry, both or none are saved
+func (db *Pg) CompleteRefund(refund *mpg.Refund, entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.refunds[refund.ID]
+	if !ok {
+		return false, fmt.Errorf("refund %d not found", refund.ID)
+	}
+
+	created, err := db.createJournalEntry(entry, postings)
+	if err != nil {
+		return false, err
+	}
+
+	refund.Status = mpg.RefundSucceeded
+	stored.Status = refund.Status
+	stored.ProviderRef = refund.ProviderRef
+	db.refunds[stored.ID] = stored
+	return created, nil
+}
+
+// FailRefund Save a pending refund as failed
+func (db *Pg) FailRefund(refundID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if refund, ok := db.refunds[refundID]; ok && refund.Status == mpg.RefundPending {
+		refund.Status = mpg.RefundFailed
+		db.refunds[refundID] = refund
+	}
+	return nil
+}
+
+// createJournalEntry Insert entry and its postings, the caller holds the lock
+func (db *Pg) createJournalEntry(entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error) {
+	for _, stored := range db.entries {
+		if stored.IdempotencyKey == entry.IdempotencyKey {
+			return false, nil
+		}
+	}
+
+	var sum, debits int64
+	for _, posting := range postings {
+		account, ok := db.accounts[posting.AccountID]
+		if !ok {
+			return false, fmt.Errorf("account %d not found", posting.AccountID)
+		}
+		if account.Currency != entry.Currency {
+			return false, errors.New("journal entry has accounts in another currency")
+		}
+		if posting.Amount == 0 {
+			return false, errors.New("journal entry has a zero posting")
+		}
+		sum += posting.Amount
+		if posting.Amount > 0 {
+			debits += posting.Amount
+		}
+	}
+	if sum != 0 {
+		return false, errors.New("journal entry is not balanced")
+	}
+	if debits != entry.Amount || entry.Amount <= 0 {
+		return false, errors.New("journal entry debits do not match its amount")
+	}
+
+	db.lastEntryID++
+	entry.ID = db.lastEntryID
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	db.entries[entry.ID] = *entry
+	for i := range postings {
+		db.lastPostingID++
+		postings[i].ID = db.lastPostingID
+		postings[i].EntryID = entry.ID
+		db.postings[postings[i].ID] = postings[i]
+
+		account := db.accounts[postings[i].AccountID]
+		account.Balance += postings[i].Amount
+		db.accounts[account.ID] = account
+	}
+	return true, nil
+}
+
+// GetJournalEntry Get journal entry by idempotency key, it returns nil if not found
+func (db *Pg) GetJournalEntry(idempotencyKey string) (*mpg.JournalEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, entry := range db.entries {
+		if entry.IdempotencyKey == idempotencyKey {
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetRideJournalEntries Get journal entries of a ride, oldest first
+func (db *Pg) GetRideJournalEntries(rideID int) ([]mpg.JournalEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entries := []mpg.JournalEntry{}
+	for _, entry := range db.entries {
+		if entry.RideID == rideID {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+// UpdateRideTip Save the tip of a completed ride, it returns false if the ride is not completed or already tipped
+func (db *Pg) UpdateRideTip(ride *mpg.Ride) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.rides[ride.ID]
+	if !ok || stored.Status != mpg.RideCompleted || stored.Tip != 0 {
+		return false, nil
+	}
+	stored.Tip = ride.Tip
+	db.rides[ride.ID] = stored
+	return true, nil
+}
+
+// GetCompletedRides Get rides of a driver completed from a time until before another, oldest first
+func (db *Pg) GetCompletedRides(driverID int, from, to time.Time) ([]mpg.Ride, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	rides := []mpg.Ride{}
+	for _, ride := range db.rides {
+		if ride.DriverID == driverID && ride.Status == mpg.RideCompleted && !ride.CompletedAt.Before(from) && ride.CompletedAt.Before(to) {
+			rides = append(rides, ride)
+		}
+	}
+	sort.Slice(rides, func(i, j int) bool {
+		if !rides[i].CompletedAt.Equal(rides[j].CompletedAt) {
+			return rides[i].CompletedAt.Before(rides[j].CompletedAt)
+		}
+		return rides[i].ID < rides[j].ID
+	})
+	return rides, nil
+}
+
+// CreateEarningAdjustment Insert adjustment of the earnings of a driver, ID and CreatedAt are set like the database defaults
+func (db *Pg) CreateEarningAdjustment(adjustment *mpg.EarningAdjustment) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lastAdjustmentID++
+	adjustment.ID = db.lastAdjustmentID
+	if adjustment.CreatedAt.IsZero() {
+		adjustment.CreatedAt = time.Now()
+	}
+	db.adjustments[adjustment.ID] = *adjustment
+	return nil
+}
+
+// GetEarningAdjustments Get adjustments of a driver created from a time until before another, oldest first
+func (db *Pg) GetEarningAdjustments(driverID int, from, to time.Time) ([]mpg.EarningAdjustment, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	adjustments := []mpg.EarningAdjustment{}
+	for _, adjustment := range db.adjustments {
+		if adjustment.DriverID == driverID && !adjustment.CreatedAt.Before(from) && adjustment.CreatedAt.Before(to) {
+			adjustments = append(adjustments, adjustment)
+		}
+	}
+	sort.Slice(adjustments, func(i, j int) bool {
+		if !adjustments[i].CreatedAt.Equal(adjustments[j].CreatedAt) {
+			return adjustments[i].CreatedAt.Before(adjustments[j].CreatedAt)
+		}
+		return adjustments[i].ID < adjustments[j].ID
+	})
+	return adjustments, nil
+}
+
+// CreateZone Insert geofenced zone, ID, FareMultiplier and CreatedAt are set like the database defaults
+func (db *Pg) CreateZone(zone *mpg.Zone) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lastZoneID++
+	zone.ID = db.lastZoneID
+	if zone.FareMultiplier == 0 {
+		zone.FareMultiplier = 1
+	}
+	if zone.CreatedAt.IsZero() {
+		zone.CreatedAt = time.Now()
+	}
+	db.zones[zone.ID] = *zone
+	return nil
+}
+
+// GetZones Get every geofenced zone, oldest first
+func (db *Pg) GetZones() ([]mpg.Zone, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	zones := make([]mpg.Zone, 0, len(db.zones))
+	for _, zone := range db.zones {
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].ID < zones[j].ID })
+	return zones, nil
+}
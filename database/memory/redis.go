@@ -0,0 +1,234 @@
+package memory
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+// Redis In-memory implementation of database.RedisI
+type Redis struct {
+	mu      sync.RWMutex
+	drivers map[int]mredis.DriverLocation
+	// classes Vehicle classes of each driver in drivers
+	classes map[int][]string
+	claims  map[int]claim
+	// queues Drivers queued in each zone in arrival order
+	queues  map[string][]int
+	buckets map[string]tokenBucket
+}
+
+// claim Claim of a ride on a driver
+type claim struct {
+	rideID    int
+	expiresAt time.Time
+}
+
+// tokenBucket Remaining tokens at the last refill time ts
+type tokenBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+var _ database.RedisI = (*Redis)(nil)
+
+// NewRedis Create an empty in-memory redis store
+func NewRedis() *Redis {
+	return &Redis{
+		drivers: make(map[int]mredis.DriverLocation),
+		classes: make(map[int][]string),
+		claims:  make(map[int]claim),
+		queues:  make(map[string][]int),
+		buckets: make(map[string]tokenBucket),
+	}
+}
+
+// PushDriverLocationGeo Add or move a driver in the geo set, its vehicle classes are replaced by classes
+func (db *Redis) PushDriverLocationGeo(driverID int, lat, lng float64, classes []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.drivers[driverID] = mredis.DriverLocation{
+		DriverID: driverID,
+		Lat:      lat,
+		Lng:      lng,
+	}
+	db.classes[driverID] = append([]string(nil), classes...)
+	return nil
+}
+
+// RemoveDriverLocationGeo Remove a driver from the geo set
+func (db *Redis) RemoveDriverLocationGeo(driverID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.drivers, driverID)
+	delete(db.classes, driverID)
+	return nil
+}
+
+// GetNearestDrivers Get drivers in radius kilometer sorted by distance, nearest first.
+// Like GEORADIUS COUNT, a limit of 0 returns every driver in radius. A class keeps drivers of that vehicle class only
+func (db *Redis) GetNearestDrivers(lat, lng, radius float64, limit int, class string) ([]mredis.DriverLocation, error) {
+	db.mu.RLock()
+	locations := []mredis.DriverLocation{}
+	for _, location := range db.drivers {
+		if class != "" && !hasClass(db.classes[location.DriverID], class) {
+			continue
+		}
+		location.Distance = geo.Distance(lat, lng, location.Lat, location.Lng)
+		if location.Distance <= radius {
+			locations = append(locations, location)
+		}
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(locations, func(i, j int) bool {
+		if locations[i].Distance == locations[j].Distance {
+			return locations[i].DriverID < locations[j].DriverID
+		}
+		return locations[i].Distance < locations[j].Distance
+	})
+	if limit > 0 && len(locations) > limit {
+		locations = locations[:limit]
+	}
+	return locations, nil
+}
+
+// hasClass Check class is in classes
+func hasClass(classes []string, class string) bool {
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDriversInBox Get drivers in a bounding box sorted by id
+func (db *Redis) GetDriversInBox(minLat, minLng, maxLat, maxLng float64) ([]mredis.DriverLocation, error) {
+	box := geo.Box{MinLat: minLat, MinLng: minLng, MaxLat: maxLat, MaxLng: maxLng}
+	return db.driversWhere(func(location mredis.DriverLocation) bool {
+		return box.Contains(location.Lat, location.Lng)
+	}), nil
+}
+
+// GetDriversInPolygon Get drivers in a polygon sorted by id
+func (db *Redis) GetDriversInPolygon(polygon geo.Polygon) ([]mredis.DriverLocation, error) {
+	return db.driversWhere(func(location mredis.DriverLocation) bool {
+		return polygon.Contains(location.Lat, location.Lng)
+	}), nil
+}
+
+// driversWhere Get drivers matching a condition sorted by id
+func (db *Redis) driversWhere(match func(location mredis.DriverLocation) bool) []mredis.DriverLocation {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	locations := []mredis.DriverLocation{}
+	for _, location := range db.drivers {
+		if match(location) {
+			locations = append(locations, location)
+		}
+	}
+	sort.Slice(locations, func(i, j int) bool { return locations[i].DriverID < locations[j].DriverID })
+	return locations
+}
+
+// ClaimDriver Claim a driver unless another ride holds an unexpired claim, then remove it from the geo set
+func (db *Redis) ClaimDriver(driverID, rideID int, ttl time.Duration) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	if current, ok := db.claims[driverID]; ok && now.Before(current.expiresAt) {
+		return false, nil
+	}
+	db.claims[driverID] = claim{rideID: rideID, expiresAt: now.Add(ttl)}
+	delete(db.drivers, driverID)
+	delete(db.classes, driverID)
+	return true, nil
+}
+
+// ReleaseDriver Release the unexpired claim of a ride on a driver
+func (db *Redis) ReleaseDriver(driverID, rideID int) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	current, ok := db.claims[driverID]
+	if !ok || current.rideID != rideID || !time.Now().Before(current.expiresAt) {
+		return false, nil
+	}
+	delete(db.claims, driverID)
+	return true, nil
+}
+
+// JoinZoneQueue Append a driver to the queue of a zone unless it is already queued
+func (db *Redis) JoinZoneQueue(zone string, driverID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, queued := range db.queues[zone] {
+		if queued == driverID {
+			return nil
+		}
+	}
+	db.queues[zone] = append(db.queues[zone], driverID)
+	return nil
+}
+
+// LeaveZoneQueue Remove a driver from the queue of a zone, the others keep their order
+func (db *Redis) LeaveZoneQueue(zone string, driverID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	queue := db.queues[zone]
+	for i, queued := range queue {
+		if queued == driverID {
+			db.queues[zone] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// GetZoneQueue Get a copy of the head of the queue of a zone
+func (db *Redis) GetZoneQueue(zone string, limit int) ([]int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	queue := db.queues[zone]
+	if limit > 0 && len(queue) > limit {
+		queue = queue[:limit]
+	}
+	return append([]int{}, queue...), nil
+}
+
+// TakeToken Take a token from an in-process token bucket, buckets are never evicted
+func (db *Redis) TakeToken(key string, rate float64, burst int) (bool, time.Duration, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := db.buckets[key]
+	if !ok {
+		bucket = tokenBucket{tokens: float64(burst), ts: now}
+	}
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.ts).Seconds()*rate)
+	bucket.ts = now
+
+	allowed := bucket.tokens >= 1
+	var wait time.Duration
+	if allowed {
+		bucket.tokens--
+	} else {
+		wait = time.Duration(math.Ceil((1-bucket.tokens)*1000/rate)) * time.Millisecond
+	}
+	db.buckets[key] = bucket
+	return allowed, wait, nil
+}
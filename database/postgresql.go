@@ -1,7 +1,12 @@
 package database
 
 import (
+	"crypto/tls"
+	"sort"
+	"time"
+
 	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
 	"github.com/pkg/errors"
 	"github.com/trietphm/gruber/config"
 	"github.com/trietphm/gruber/model/mpg"
@@ -20,6 +25,137 @@ type PgI interface {
 
 	// GetDriver get driver by id
 	GetDriver(driverID int) (*mpg.Driver, error)
+
+	// GetPassenger get passenger by id, soft deleted passengers are not found
+	GetPassenger(passengerID int) (*mpg.Passenger, error)
+
+	// UpdatePassenger Update passenger profile: name, phone, email and default payment method
+	UpdatePassenger(passenger *mpg.Passenger) error
+
+	// DeletePassenger Soft delete passenger
+	DeletePassenger(passengerID int) error
+
+	// CreateVehicle Insert vehicle of a driver
+	CreateVehicle(vehicle *mpg.Vehicle) error
+
+	// GetVehicle Get vehicle by id
+	GetVehicle(vehicleID int) (*mpg.Vehicle, error)
+
+	// GetVehicles Get vehicles of a driver
+	GetVehicles(driverID int) ([]mpg.Vehicle, error)
+
+	// DeleteVehicle Delete vehicle by id
+	DeleteVehicle(vehicleID int) error
+
+	// SaveDriverDocument Insert document or replace the driver's document of the same type
+	SaveDriverDocument(document *mpg.DriverDocument) error
+
+	// GetDriverDocuments Get documents of a driver
+	GetDriverDocuments(driverID int) ([]mpg.DriverDocument, error)
+
+	// GetDriversWithExpiredDocuments Get drivers among driverIDs who have a document expired at a time
+	GetDriversWithExpiredDocuments(driverIDs []int, at time.Time) ([]int, error)
+
+	// GetDriversRatedBelow Get drivers among driverIDs whose rating is below a rating, drivers not rated yet are not
+	GetDriversRatedBelow(driverIDs []int, rating float64) ([]int, error)
+
+	// CreateScheduledRide Insert scheduled ride, the status is pending unless set
+	CreateScheduledRide(ride *mpg.ScheduledRide) error
+
+	// GetScheduledRide Get scheduled ride by id
+	GetScheduledRide(rideID int) (*mpg.ScheduledRide, error)
+
+	// GetDueScheduledRides Get pending rides to pick up until a time, earliest pickup first
+	GetDueScheduledRides(until time.Time) ([]mpg.ScheduledRide, error)
+
+	// UpdateScheduledRideStatus Save status and driver ids of a ride if its status is still from.
+	// It returns false if the ride is not found or its status changed
+	UpdateScheduledRideStatus(ride *mpg.ScheduledRide, from string) (bool, error)
+
+	// LinkScheduledRide Set the ride of a pending scheduled ride which has none.
+	// It returns false if the scheduled ride is not found, not pending or has a ride
+	LinkScheduledRide(scheduledRideID, rideID int) (bool, error)
+
+	// CreateRide Insert ride, the status is requested unless set
+	CreateRide(ride *mpg.Ride) error
+
+	// GetRide Get ride by id
+	GetRide(rideID int) (*mpg.Ride, error)
+
+	// UpdateRideStatus Save status, driver and status times of a ride if its status is still from.
+	// It returns false if the ride is not found or its status changed
+	UpdateRideStatus(ride *mpg.Ride, from string) (bool, error)
+
+	// CancelRide Save the ride like UpdateRideStatus and insert the cancellation, both or none are saved
+	CancelRide(ride *mpg.Ride, from string, cancellation *mpg.RideCancellation) (bool, error)
+
+	// GetRideCancellations Get cancellations of a ride, oldest first
+	GetRideCancellations(rideID int) ([]mpg.RideCancellation, error)
+
+	// CreateRideWithStops Insert ride like CreateRide and its stops, both or none are saved
+	CreateRideWithStops(ride *mpg.Ride, stops []mpg.RideStop) error
+
+	// GetRideStops Get stops of a ride in position order
+	GetRideStops(rideID int) ([]mpg.RideStop, error)
+
+	// UpdateRideStop Save the ride like UpdateRideStatus and the arrival and departure times of the stop,
+	// both or none are saved
+	UpdateRideStop(ride *mpg.Ride, from string, stop *mpg.RideStop) (bool, error)
+
+	// CreateRideRating Insert rating and update the average rating of the rated driver or passenger, both or none
+	// are saved. It returns false if the ride is already rated by the same side
+	CreateRideRating(rating *mpg.RideRating) (bool, error)
+
+	// GetLowRatings Get ratings up to maxRating since a time, by a side or both if ratedBy is empty, newest first
+	GetLowRatings(maxRating int, ratedBy string, since time.Time, limit int) ([]mpg.RideRating, error)
+
+	// GetRidesInBox Get rides requested since a time with a pickup in a bounding box, oldest first
+	GetRidesInBox(minLat, minLng, maxLat, maxLng float64, since time.Time) ([]mpg.Ride, error)
+
+	// GetOrCreateAccount Get the ledger account of an owner in a currency, it is created with a zero balance if missing
+	GetOrCreateAccount(kind string, ownerID int, currency string) (*mpg.Account, error)
+
+	// CreateJournalEntry Insert entry and its postings and update the balances of their accounts, all or none are saved.
+	// Postings must sum to 0 with debits summing to the amount of the entry, in accounts of its currency.
+	// It returns false and saves nothing if an entry of the same idempotency key exists
+	CreateJournalEntry(entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error)
+
+	// CreateRefund Insert pending refund with the payment entry of paymentKey locked, so refunds of a payment are
+	// serialized. reserve is called under the lock with the amount of the pending and succeeded refunds of the ride,
+	// nothing is saved if it fails. It returns false and gets the stored refund without calling reserve if a refund
+	// of the same idempotency key exists
+	CreateRefund(refund *mpg.Refund, paymentKey string, reserve func(reserved int64) error) (bool, error)
+
+	// CompleteRefund Save a refund as succeeded with its provider reference and insert its entry and postings like
+	// CreateJournalEntry, all or none are saved. It returns false if the entry exists
+	CompleteRefund(refund *mpg.Refund, entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error)
+
+	// FailRefund Save a pending refund as failed, its amount is released
+	FailRefund(refundID int) error
+
+	// GetJournalEntry Get journal entry by idempotency key
+	GetJournalEntry(idempotencyKey string) (*mpg.JournalEntry, error)
+
+	// GetRideJournalEntries Get journal entries of a ride, oldest first
+	GetRideJournalEntries(rideID int) ([]mpg.JournalEntry, error)
+
+	// UpdateRideTip Save the tip of a completed ride, it returns false if the ride is not completed or already tipped
+	UpdateRideTip(ride *mpg.Ride) (bool, error)
+
+	// GetCompletedRides Get rides of a driver completed from a time until before another, oldest first
+	GetCompletedRides(driverID int, from, to time.Time) ([]mpg.Ride, error)
+
+	// CreateEarningAdjustment Insert adjustment of the earnings of a driver
+	CreateEarningAdjustment(adjustment *mpg.EarningAdjustment) error
+
+	// GetEarningAdjustments Get adjustments of a driver created from a time until before another, oldest first
+	GetEarningAdjustments(driverID int, from, to time.Time) ([]mpg.EarningAdjustment, error)
+
+	// CreateZone Insert geofenced zone, an unset fare multiplier is 1
+	CreateZone(zone *mpg.Zone) error
+
+	// GetZones Get every geofenced zone, oldest first
+	GetZones() ([]mpg.Zone, error)
 }
 
 // Pg
@@ -29,16 +165,31 @@ type Pg struct {
 
 // OpenPostgresqlDB Open connection to postgresql
 func OpenPostgresqlDB(cfg config.Postgresql) (*Pg, error) {
+	tlsConfig, err := pgTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	options := pg.Options{
 		User:     cfg.User,
 		Password: cfg.Password,
 		Addr:     cfg.Host + ":" + cfg.Port,
 		Database: cfg.Name,
+
+		TLSConfig: tlsConfig,
+
+		PoolSize:     cfg.PoolSize,
+		PoolTimeout:  cfg.PoolTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		MaxRetries:   cfg.MaxRetries,
 	}
 	db := pg.Connect(&options)
 
 	// Try with simple query
-	_, err := db.Exec("SELECT 1")
+	_, err = db.Exec("SELECT 1")
 	if err != nil {
 		panic(errors.Errorf("error on connecting to database %s", err))
 	}
@@ -46,6 +197,37 @@ func OpenPostgresqlDB(cfg config.Postgresql) (*Pg, error) {
 	return &Pg{*db}, err
 }
 
+// pgTLSConfig Build TLS config from libpq style sslmode, empty sslmode is the same as disable
+func pgTLSConfig(cfg config.Postgresql) (*tls.Config, error) {
+	switch cfg.SSLMode {
+	case "", "disable":
+		return nil, nil
+	case "require", "verify-ca", "verify-full":
+	default:
+		return nil, errors.Errorf("invalid sslmode %q", cfg.SSLMode)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg.SSLRootCert, cfg.SSLCert, cfg.SSLKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.SSLMode {
+	case "require":
+		tlsConfig.InsecureSkipVerify = true
+	case "verify-ca":
+		if tlsConfig.RootCAs == nil {
+			return nil, errors.New("sslmode verify-ca requires sslrootcert")
+		}
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verifyChainOnly(tlsConfig.RootCAs)
+	case "verify-full":
+		tlsConfig.ServerName = cfg.Host
+	}
+
+	return tlsConfig, nil
+}
+
 // CreateDriver Insert driver to database
 func (db *Pg) CreateDriver(driver *mpg.Driver) error {
 	return db.Insert(driver)
@@ -56,9 +238,11 @@ func (db *Pg) CreatePassenger(passenger *mpg.Passenger) error {
 	return db.Insert(passenger)
 }
 
-// UpdateDriverState Update driver state in database
+// UpdateDriverState Update driver state in database, the state change time is kept when the state is unchanged
 func (db *Pg) UpdateDriverState(driverID int, state string) error {
-	_, err := db.Exec(`UPDATE drivers SET state = ? WHERE id = ?`, state, driverID)
+	_, err := db.Exec(`UPDATE drivers
+		SET state_updated_at = CASE WHEN state = ? THEN state_updated_at ELSE CURRENT_TIMESTAMP END, state = ?
+		WHERE id = ?`, state, state, driverID)
 	return err
 }
 
@@ -72,3 +256,551 @@ func (db *Pg) GetDriver(driverID int) (*mpg.Driver, error) {
 
 	return &driver, err
 }
+
+// GetPassenger Get passenger by id, soft deleted passengers are not found
+func (db *Pg) GetPassenger(passengerID int) (*mpg.Passenger, error) {
+	var passenger mpg.Passenger
+	err := db.Model(&passenger).Where("id = ?", passengerID).Where("deleted_at IS NULL").Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+
+	return &passenger, err
+}
+
+// UpdatePassenger Update passenger profile: name, phone, email and default payment method
+func (db *Pg) UpdatePassenger(passenger *mpg.Passenger) error {
+	_, err := db.Model(passenger).
+		Column("name", "phone", "email", "default_payment_method").
+		WherePK().
+		Where("deleted_at IS NULL").
+		Update()
+	return err
+}
+
+// DeletePassenger Soft delete passenger
+func (db *Pg) DeletePassenger(passengerID int) error {
+	_, err := db.Exec(`UPDATE passengers SET deleted_at = now() WHERE id = ? AND deleted_at IS NULL`, passengerID)
+	return err
+}
+
+// CreateVehicle Insert vehicle of a driver
+func (db *Pg) CreateVehicle(vehicle *mpg.Vehicle) error {
+	return db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Insert(vehicle); err != nil {
+			return err
+		}
+		return updateDriverVehicleClasses(tx, vehicle.DriverID)
+	})
+}
+
+// GetVehicle Get vehicle by id
+func (db *Pg) GetVehicle(vehicleID int) (*mpg.Vehicle, error) {
+	var vehicle mpg.Vehicle
+	err := db.Model(&vehicle).Where("id = ?", vehicleID).Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+
+	return &vehicle, err
+}
+
+// GetVehicles Get vehicles of a driver
+func (db *Pg) GetVehicles(driverID int) ([]mpg.Vehicle, error) {
+	vehicles := []mpg.Vehicle{}
+	err := db.Model(&vehicles).Where("driver_id = ?", driverID).Order("id").Select()
+	return vehicles, err
+}
+
+// DeleteVehicle Delete vehicle by id
+func (db *Pg) DeleteVehicle(vehicleID int) error {
+	return db.RunInTransaction(func(tx *pg.Tx) error {
+		var driverID int
+		_, err := tx.QueryOne(pg.Scan(&driverID), `DELETE FROM vehicles WHERE id = ? RETURNING driver_id`, vehicleID)
+		if err == pg.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return updateDriverVehicleClasses(tx, driverID)
+	})
+}
+
+// updateDriverVehicleClasses Recompute the vehicle classes kept with the driver from its vehicles
+func updateDriverVehicleClasses(tx *pg.Tx, driverID int) error {
+	_, err := tx.Exec(`UPDATE drivers
+		SET vehicle_classes = ARRAY(SELECT DISTINCT class::TEXT FROM vehicles WHERE driver_id = ? ORDER BY 1)
+		WHERE id = ?`, driverID, driverID)
+	return err
+}
+
+// SaveDriverDocument Insert document or replace the driver's document of the same type
+func (db *Pg) SaveDriverDocument(document *mpg.DriverDocument) error {
+	_, err := db.Model(document).
+		OnConflict("(driver_id, type) DO UPDATE").
+		Set("number = EXCLUDED.number, expires_at = EXCLUDED.expires_at").
+		Returning("id, created_at").
+		Insert()
+	return err
+}
+
+// GetDriverDocuments Get documents of a driver
+func (db *Pg) GetDriverDocuments(driverID int) ([]mpg.DriverDocument, error) {
+	documents := []mpg.DriverDocument{}
+	err := db.Model(&documents).Where("driver_id = ?", driverID).Order("id").Select()
+	return documents, err
+}
+
+// GetDriversWithExpiredDocuments Get drivers among driverIDs who have a document expired at a time, see DriverDocument.Expired
+func (db *Pg) GetDriversWithExpiredDocuments(driverIDs []int, at time.Time) ([]int, error) {
+	expired := []int{}
+	if len(driverIDs) == 0 {
+		return expired, nil
+	}
+
+	_, err := db.Query(pg.Scan(pg.Array(&expired)),
+		`SELECT array_agg(DISTINCT driver_id) FROM driver_documents WHERE driver_id IN (?) AND expires_at < ?`,
+		pg.In(driverIDs), at.UTC().Format(mpg.DateFormat))
+	return expired, err
+}
+
+// GetDriversRatedBelow Get drivers among driverIDs whose rating is below a rating, drivers not rated yet are not
+func (db *Pg) GetDriversRatedBelow(driverIDs []int, rating float64) ([]int, error) {
+	below := []int{}
+	if len(driverIDs) == 0 {
+		return below, nil
+	}
+
+	err := db.Model((*mpg.Driver)(nil)).
+		Column("id").
+		Where("id IN (?)", pg.In(driverIDs)).
+		Where("rating > 0 AND rating < ?", rating).
+		Order("id").
+		Select(&below)
+	return below, err
+}
+
+// CreateScheduledRide Insert scheduled ride, the status is pending unless set
+func (db *Pg) CreateScheduledRide(ride *mpg.ScheduledRide) error {
+	return db.Insert(ride)
+}
+
+// GetScheduledRide Get scheduled ride by id
+func (db *Pg) GetScheduledRide(rideID int) (*mpg.ScheduledRide, error) {
+	var ride mpg.ScheduledRide
+	err := db.Model(&ride).Where("id = ?", rideID).Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+
+	return &ride, err
+}
+
+// GetDueScheduledRides Get pending rides to pick up until a time, earliest pickup first
+func (db *Pg) GetDueScheduledRides(until time.Time) ([]mpg.ScheduledRide, error) {
+	rides := []mpg.ScheduledRide{}
+	err := db.Model(&rides).
+		Where("status = ?", mpg.ScheduledRidePending).
+		Where("pickup_at <= ?", until).
+		Order("pickup_at", "id").
+		Select()
+	return rides, err
+}
+
+// UpdateScheduledRideStatus Save status and driver ids of a ride if its status is still from, so a ride
+// cancelled while the scheduler searches drivers stays cancelled
+func (db *Pg) UpdateScheduledRideStatus(ride *mpg.ScheduledRide, from string) (bool, error) {
+	ride.UpdatedAt = time.Now()
+	res, err := db.Model(ride).
+		Column("status", "driver_ids", "updated_at").
+		WherePK().
+		Where("status = ?", from).
+		Update()
+	if err != nil {
+		return false, err
+	}
+
+	return res.RowsAffected() == 1, nil
+}
+
+// LinkScheduledRide Set the ride of a pending scheduled ride which has none, so with several schedulers
+// a scheduled ride is requested once
+func (db *Pg) LinkScheduledRide(scheduledRideID, rideID int) (bool, error) {
+	res, err := db.Exec(`UPDATE scheduled_rides SET ride_id = ?, updated_at = ?
+		WHERE id = ? AND status = ? AND ride_id IS NULL`,
+		rideID, time.Now(), scheduledRideID, mpg.ScheduledRidePending)
+	if err != nil {
+		return false, err
+	}
+
+	return res.RowsAffected() == 1, nil
+}
+
+// CreateRide Insert ride, the status is requested unless set
+func (db *Pg) CreateRide(ride *mpg.Ride) error {
+	return db.Insert(ride)
+}
+
+// GetRide Get ride by id
+func (db *Pg) GetRide(rideID int) (*mpg.Ride, error) {
+	var ride mpg.Ride
+	err := db.Model(&ride).Where("id = ?", rideID).Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+
+	return &ride, err
+}
+
+// rideStatusColumns Columns saved on a ride status change
+var rideStatusColumns = []string{
+	"driver_id", "status", "assigned_at", "arrived_at", "started_at", "completed_at", "cancelled_at",
+	"fare", "commission", "currency",
+}
+
+// UpdateRideStatus Save status, driver and status times of a ride if its status is still from
+func (db *Pg) UpdateRideStatus(ride *mpg.Ride, from string) (bool, error) {
+	return updateRideStatus(db, ride, from)
+}
+
+// CancelRide Save the ride like UpdateRideStatus and insert the cancellation in one transaction
+func (db *Pg) CancelRide(ride *mpg.Ride, from string, cancellation *mpg.RideCancellation) (bool, error) {
+	var updated bool
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		var err error
+		updated, err = updateRideStatus(tx, ride, from)
+		if err != nil || !updated {
+			return err
+		}
+
+		cancellation.RideID = ride.ID
+		return tx.Insert(cancellation)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+// updateRideStatus Save ride status columns with a db or a transaction
+func updateRideStatus(db orm.DB, ride *mpg.Ride, from string) (bool, error) {
+	res, err := db.Model(ride).
+		Column(rideStatusColumns...).
+		WherePK().
+		Where("status = ?", from).
+		Update()
+	if err != nil {
+		return false, err
+	}
+
+	return res.RowsAffected() == 1, nil
+}
+
+// GetRideCancellations Get cancellations of a ride, oldest first
+func (db *Pg) GetRideCancellations(rideID int) ([]mpg.RideCancellation, error) {
+	cancellations := []mpg.RideCancellation{}
+	err := db.Model(&cancellations).Where("ride_id = ?", rideID).Order("id").Select()
+	return cancellations, err
+}
+
+// CreateRideWithStops Insert ride like CreateRide and its stops in one transaction
+func (db *Pg) CreateRideWithStops(ride *mpg.Ride, stops []mpg.RideStop) error {
+	return db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Insert(ride); err != nil {
+			return err
+		}
+		if len(stops) == 0 {
+			return nil
+		}
+
+		for i := range stops {
+			stops[i].RideID = ride.ID
+		}
+		return tx.Insert(&stops)
+	})
+}
+
+// GetRideStops Get stops of a ride in position order
+func (db *Pg) GetRideStops(rideID int) ([]mpg.RideStop, error) {
+	stops := []mpg.RideStop{}
+	err := db.Model(&stops).Where("ride_id = ?", rideID).Order("position").Select()
+	return stops, err
+}
+
+// UpdateRideStop Save the ride like UpdateRideStatus and the stop times in one transaction
+func (db *Pg) UpdateRideStop(ride *mpg.Ride, from string, stop *mpg.RideStop) (bool, error) {
+	var updated bool
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		var err error
+		updated, err = updateRideStatus(tx, ride, from)
+		if err != nil || !updated {
+			return err
+		}
+
+		_, err = tx.Model(stop).
+			Column("arrived_at", "departed_at").
+			WherePK().
+			Where("ride_id = ?", ride.ID).
+			Update()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return updated, nil
+}
+
+// CreateRideRating Insert rating and update the average rating of the rated driver or passenger in one transaction.
+// It returns false if the ride is already rated by the same side
+func (db *Pg) CreateRideRating(rating *mpg.RideRating) (bool, error) {
+	var created bool
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		res, err := tx.Model(rating).
+			OnConflict("(ride_id, rated_by) DO NOTHING").
+			Returning("id, created_at").
+			Insert()
+		if err != nil || res.RowsAffected() == 0 {
+			return err
+		}
+		created = true
+
+		// The passenger rates the driver and the driver rates the passenger
+		table, column, ratedID := "drivers", "driver_id", rating.DriverID
+		if rating.RatedBy == mpg.RatedByDriver {
+			table, column, ratedID = "passengers", "passenger_id", rating.PassengerID
+		}
+		_, err = tx.Exec(`UPDATE ? SET rating = (
+				SELECT avg(rating) FROM (
+					SELECT rating FROM ride_ratings WHERE ? = ? AND rated_by = ? ORDER BY id DESC LIMIT ?
+				) AS latest
+			) WHERE id = ?`,
+			pg.F(table), pg.F(column), ratedID, rating.RatedBy, mpg.RatingWindow, ratedID)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return created, nil
+}
+
+// GetLowRatings Get ratings up to maxRating since a time, by a side or both if ratedBy is empty, newest first
+func (db *Pg) GetLowRatings(maxRating int, ratedBy string, since time.Time, limit int) ([]mpg.RideRating, error) {
+	ratings := []mpg.RideRating{}
+	query := db.Model(&ratings).
+		Where("rating <= ?", maxRating).
+		Where("created_at >= ?", since)
+	if ratedBy != "" {
+		query = query.Where("rated_by = ?", ratedBy)
+	}
+	err := query.Order("id DESC").Limit(limit).Select()
+	return ratings, err
+}
+
+// GetRidesInBox Get rides requested since a time with a pickup in a bounding box, oldest first
+func (db *Pg) GetRidesInBox(minLat, minLng, maxLat, maxLng float64, since time.Time) ([]mpg.Ride, error) {
+	rides := []mpg.Ride{}
+	err := db.Model(&rides).
+		Where("created_at >= ?", since).
+		Where("lat BETWEEN ? AND ?", minLat, maxLat).
+		Where("lng BETWEEN ? AND ?", minLng, maxLng).
+		Order("id").
+		Select()
+	return rides, err
+}
+
+// GetOrCreateAccount Get the ledger account of an owner in a currency, it is created with a zero balance if missing
+func (db *Pg) GetOrCreateAccount(kind string, ownerID int, currency string) (*mpg.Account, error) {
+	account := mpg.Account{Kind: kind, OwnerID: ownerID, Currency: currency}
+	_, err := db.Model(&account).
+		Where("kind = ?", kind).
+		Where("owner_id = ?", ownerID).
+		Where("currency = ?", currency).
+		OnConflict("DO NOTHING").
+		SelectOrInsert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// CreateJournalEntry Insert entry and its postings and update the balances of their accounts in one transaction.
+// The invariants of postings are checked by the database at commit
+func (db *Pg) CreateJournalEntry(entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error) {
+	var created bool
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		var err error
+		created, err = insertJournalEntry(tx, entry, postings)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return created, nil
+}
+
+// CreateRefund Insert pending refund in one transaction with the payment entry locked, reserve is called with the
+// amount of the pending and succeeded refunds of the ride
+func (db *Pg) CreateRefund(refund *mpg.Refund, paymentKey string, reserve func(reserved int64) error) (bool, error) {
+	var created bool
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		// Concurrent refunds of the payment wait here until this one is committed
+		var paymentID int
+		if _, err := tx.QueryOne(pg.Scan(&paymentID), `SELECT id FROM journal_entries WHERE idempotency_key = ? FOR UPDATE`, paymentKey); err != nil {
+			return err
+		}
+
+		err := tx.Model(refund).Where("idempotency_key = ?", refund.IdempotencyKey).Select()
+		if err != pg.ErrNoRows {
+			return err
+		}
+
+		var reserved int64
+		if _, err := tx.QueryOne(pg.Scan(&reserved), `SELECT coalesce(sum(amount), 0) FROM refunds WHERE ride_id = ? AND status <> ?`,
+			refund.RideID, mpg.RefundFailed); err != nil {
+			return err
+		}
+
+		if err := reserve(reserved); err != nil {
+			return err
+		}
+
+		refund.Status = mpg.RefundPending
+		created = true
+		_, err = tx.Model(refund).Returning("id, created_at").Insert()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return created, nil
+}
+
+// CompleteRefund Save the refund as succeeded and insert its entry in one transaction
+func (db *Pg) CompleteRefund(refund *mpg.Refund, entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error) {
+	var created bool
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		refund.Status = mpg.RefundSucceeded
+		if _, err := tx.Model(refund).Column("status", "provider_ref").WherePK().Update(); err != nil {
+			return err
+		}
+
+		var err error
+		created, err = insertJournalEntry(tx, entry, postings)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return created, nil
+}
+
+// FailRefund Save a pending refund as failed
+func (db *Pg) FailRefund(refundID int) error {
+	_, err := db.Exec(`UPDATE refunds SET status = ? WHERE id = ? AND status = ?`, mpg.RefundFailed, refundID, mpg.RefundPending)
+	return err
+}
+
+// insertJournalEntry Insert entry and its postings and update the balances of their accounts in a transaction, it
+// returns false if an entry of the same idempotency key exists
+func insertJournalEntry(tx *pg.Tx, entry *mpg.JournalEntry, postings []mpg.Posting) (bool, error) {
+	res, err := tx.Model(entry).
+		OnConflict("(idempotency_key) DO NOTHING").
+		Returning("id, created_at").
+		Insert()
+	if err != nil || res.RowsAffected() == 0 {
+		return false, err
+	}
+
+	// Accounts are locked in id order so concurrent entries do not deadlock
+	sort.Slice(postings, func(i, j int) bool { return postings[i].AccountID < postings[j].AccountID })
+	for i := range postings {
+		postings[i].EntryID = entry.ID
+		if _, err := tx.Exec(`UPDATE accounts SET balance = balance + ? WHERE id = ?`, postings[i].Amount, postings[i].AccountID); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Insert(&postings)
+}
+
+// GetJournalEntry Get journal entry by idempotency key
+func (db *Pg) GetJournalEntry(idempotencyKey string) (*mpg.JournalEntry, error) {
+	var entry mpg.JournalEntry
+	err := db.Model(&entry).Where("idempotency_key = ?", idempotencyKey).Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+
+	return &entry, err
+}
+
+// GetRideJournalEntries Get journal entries of a ride, oldest first
+func (db *Pg) GetRideJournalEntries(rideID int) ([]mpg.JournalEntry, error) {
+	entries := []mpg.JournalEntry{}
+	err := db.Model(&entries).Where("ride_id = ?", rideID).Order("id").Select()
+	return entries, err
+}
+
+// UpdateRideTip Save the tip of a completed ride, it returns false if the ride is not completed or already tipped
+func (db *Pg) UpdateRideTip(ride *mpg.Ride) (bool, error) {
+	res, err := db.Model(ride).
+		Column("tip").
+		WherePK().
+		Where("status = ?", mpg.RideCompleted).
+		Where("tip IS NULL").
+		Update()
+	if err != nil {
+		return false, err
+	}
+
+	return res.RowsAffected() > 0, nil
+}
+
+// GetCompletedRides Get rides of a driver completed from a time until before another, oldest first
+func (db *Pg) GetCompletedRides(driverID int, from, to time.Time) ([]mpg.Ride, error) {
+	rides := []mpg.Ride{}
+	err := db.Model(&rides).
+		Where("driver_id = ?", driverID).
+		Where("status = ?", mpg.RideCompleted).
+		Where("completed_at >= ?", from).
+		Where("completed_at < ?", to).
+		Order("completed_at", "id").
+		Select()
+	return rides, err
+}
+
+// CreateEarningAdjustment Insert adjustment of the earnings of a driver
+func (db *Pg) CreateEarningAdjustment(adjustment *mpg.EarningAdjustment) error {
+	return db.Insert(adjustment)
+}
+
+// GetEarningAdjustments Get adjustments of a driver created from a time until before another, oldest first
+func (db *Pg) GetEarningAdjustments(driverID int, from, to time.Time) ([]mpg.EarningAdjustment, error) {
+	adjustments := []mpg.EarningAdjustment{}
+	err := db.Model(&adjustments).
+		Where("driver_id = ?", driverID).
+		Where("created_at >= ?", from).
+		Where("created_at < ?", to).
+		Order("created_at", "id").
+		Select()
+	return adjustments, err
+}
+
+// CreateZone Insert geofenced zone
+func (db *Pg) CreateZone(zone *mpg.Zone) error {
+	return db.Insert(zone)
+}
+
+// GetZones Get every geofenced zone, oldest first
+func (db *Pg) GetZones() ([]mpg.Zone, error) {
+	zones := []mpg.Zone{}
+	err := db.Model(&zones).Order("id").Select()
+	return zones, err
+}
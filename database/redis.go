@@ -1,83 +1,210 @@
 package database
 
 import (
+	"crypto/tls"
 	"errors"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mpg"
 	"github.com/trietphm/gruber/model/mredis"
 )
 
 // PgI is a interface for manipulating data in database postgresql
 type RedisI interface {
-	// Push driver location to redis
-	PushDriverLocationGeo(driverID int, lat, lng float64) error
+	// Push driver location to redis, the driver is also indexed by the vehicle classes
+	// in classes and removed from the index of every other class
+	PushDriverLocationGeo(driverID int, lat, lng float64, classes []string) error
 
-	// Remove driver location from redis geo
+	// Remove driver location from redis geo and every vehicle class index
 	RemoveDriverLocationGeo(driverID int) error
 
-	// GetNearestDrivers Get near available driver near a geo location
-	GetNearestDrivers(lat, lng, radius float64, limit int) ([]mredis.DriverLocation, error)
+	// GetNearestDrivers Get near available driver near a geo location with a vehicle of class,
+	// drivers of every class if class is empty
+	GetNearestDrivers(lat, lng, radius float64, limit int, class string) ([]mredis.DriverLocation, error)
+
+	// GetDriversInBox Get available drivers in a bounding box which does not cross the antimeridian, sorted by id.
+	// Distance is not set
+	GetDriversInBox(minLat, minLng, maxLat, maxLng float64) ([]mredis.DriverLocation, error)
+
+	// GetDriversInPolygon Get available drivers in a polygon, sorted by id. Distance is not set
+	GetDriversInPolygon(polygon geo.Polygon) ([]mredis.DriverLocation, error)
+
+	// ClaimDriver Claim a driver for a ride until ttl unless another ride holds a claim on it, the claimed
+	// driver is removed from geo data so it is not found anymore. It returns false if the driver is already claimed
+	ClaimDriver(driverID, rideID int, ttl time.Duration) (bool, error)
+
+	// ReleaseDriver Release the claim of a ride on a driver, it returns false if the ride does not hold the claim
+	ReleaseDriver(driverID, rideID int) (bool, error)
+
+	// JoinZoneQueue Add a driver at the tail of the queue of a zone, a driver already queued keeps its position
+	JoinZoneQueue(zone string, driverID int) error
+
+	// LeaveZoneQueue Remove a driver from the queue of a zone
+	LeaveZoneQueue(zone string, driverID int) error
+
+	// GetZoneQueue Get the first limit drivers of the queue of a zone in arrival order, every driver if limit is 0
+	GetZoneQueue(zone string, limit int) ([]int, error)
+
+	// TakeToken Take a token from the bucket of key which refills rate tokens per second up to burst.
+	// If the bucket is empty it returns false and how long to wait for the next token
+	TakeToken(key string, rate float64, burst int) (bool, time.Duration, error)
 }
 
 // Redis
 type Redis struct {
-	redis.Client
+	redis.UniversalClient
 }
 
 var _ RedisI = RedisI(Redis{})
 
+// OpenRedisDB Open connection to redis, it connects to a Sentinel master or a Cluster when
+// those addresses are configured, otherwise to a single node
 func OpenRedisDB(conf config.Redis) (*Redis, error) {
-	db := redis.NewClient(&redis.Options{
-		Addr:     conf.Host + ":" + conf.Port,
-		Password: conf.Password, // no password set
-		DB:       0,             // use default DB
-	})
+	var db redis.UniversalClient
+	switch {
+	case conf.SentinelMaster != "":
+		if conf.TLS {
+			return nil, errors.New("TLS is not supported with Redis Sentinel")
+		}
+		db = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    conf.SentinelMaster,
+			SentinelAddrs: splitAddrs(conf.SentinelAddrs),
+			Password:      conf.Password,
+			DB:            conf.DB,
+
+			MaxRetries:   conf.MaxRetries,
+			DialTimeout:  conf.DialTimeout,
+			ReadTimeout:  conf.ReadTimeout,
+			WriteTimeout: conf.WriteTimeout,
+			PoolSize:     conf.PoolSize,
+			PoolTimeout:  conf.PoolTimeout,
+			IdleTimeout:  conf.IdleTimeout,
+		})
+	case conf.ClusterAddrs != "":
+		if conf.TLS {
+			return nil, errors.New("TLS is not supported with Redis Cluster")
+		}
+		if conf.DB != 0 {
+			return nil, errors.New("Redis Cluster only supports DB 0")
+		}
+		db = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    splitAddrs(conf.ClusterAddrs),
+			Password: conf.Password,
+
+			MaxRetries:   conf.MaxRetries,
+			DialTimeout:  conf.DialTimeout,
+			ReadTimeout:  conf.ReadTimeout,
+			WriteTimeout: conf.WriteTimeout,
+			PoolSize:     conf.PoolSize,
+			PoolTimeout:  conf.PoolTimeout,
+			IdleTimeout:  conf.IdleTimeout,
+		})
+	default:
+		var tlsConfig *tls.Config
+		if conf.TLS {
+			var err error
+			tlsConfig, err = newTLSConfig(conf.TLSCA, "", "")
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.ServerName = conf.Host
+			tlsConfig.InsecureSkipVerify = conf.TLSSkipVerify
+		}
+		db = redis.NewClient(&redis.Options{
+			Addr:     conf.Host + ":" + conf.Port,
+			Password: conf.Password,
+			DB:       conf.DB,
+
+			TLSConfig: tlsConfig,
+
+			MaxRetries:   conf.MaxRetries,
+			DialTimeout:  conf.DialTimeout,
+			ReadTimeout:  conf.ReadTimeout,
+			WriteTimeout: conf.WriteTimeout,
+			PoolSize:     conf.PoolSize,
+			PoolTimeout:  conf.PoolTimeout,
+			IdleTimeout:  conf.IdleTimeout,
+		})
+	}
 
 	_, err := db.Ping().Result()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Redis{*db}, nil
+	return &Redis{db}, nil
 }
 
-// PushDriverLocationGeo Push driver to geo data
-func (db Redis) PushDriverLocationGeo(driverID int, lat, lng float64) error {
+// PushDriverLocationGeo Push driver to geo data and the geo data of its vehicle classes in one pipeline
+func (db Redis) PushDriverLocationGeo(driverID int, lat, lng float64, classes []string) error {
 	location := redis.GeoLocation{
 		Latitude:  lat,
 		Longitude: lng,
 		Name:      strconv.Itoa(driverID),
 	}
-	res := db.GeoAdd(mredis.KeyDriverGeo, &location)
-	if res == nil {
-		return errors.New("Can not execute GEOADD")
+	_, err := db.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.GeoAdd(mredis.KeyDriverGeo, &location)
+		for _, class := range mpg.VehicleClasses {
+			if hasClass(classes, class) {
+				pipe.GeoAdd(mredis.KeyPrefixDriverGeoClass+class, &location)
+			} else {
+				pipe.ZRem(mredis.KeyPrefixDriverGeoClass+class, location.Name)
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+// hasClass Check class is in classes
+func hasClass(classes []string, class string) bool {
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
 	}
 
-	return res.Err()
+	return false
 }
 
-// RemoveDriverLocationGeo remove a driver from redis geo
+// RemoveDriverLocationGeo remove a driver from redis geo and the geo data of every vehicle class
 func (db Redis) RemoveDriverLocationGeo(driverID int) error {
-	res := db.ZRem(mredis.KeyDriverGeo, driverID)
-	if res == nil {
-		return errors.New("Can not execute ZREM")
-	}
+	name := strconv.Itoa(driverID)
+	_, err := db.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRem(mredis.KeyDriverGeo, name)
+		for _, class := range mpg.VehicleClasses {
+			pipe.ZRem(mredis.KeyPrefixDriverGeoClass+class, name)
+		}
+		return nil
+	})
 
-	return res.Err()
+	return err
 }
 
-// GetNearestDrivers get nearest driver in a radius via Redis GEORADIUS, unit is kilometer
-func (db Redis) GetNearestDrivers(lat, lng, radius float64, limit int) (locations []mredis.DriverLocation, err error) {
+// GetNearestDrivers get nearest driver in a radius via Redis GEORADIUS, unit is kilometer.
+// A class searches the geo data of that vehicle class only
+func (db Redis) GetNearestDrivers(lat, lng, radius float64, limit int, class string) (locations []mredis.DriverLocation, err error) {
 	query := redis.GeoRadiusQuery{
 		Radius:    radius,
 		Unit:      "km",
 		Count:     limit,
 		Sort:      "ASC",
 		WithCoord: true,
+		WithDist:  true,
+	}
+	key := mredis.KeyDriverGeo
+	if class != "" {
+		key = mredis.KeyPrefixDriverGeoClass + class
 	}
-	cmd := db.GeoRadius(mredis.KeyDriverGeo, lng, lat, &query)
+	cmd := db.GeoRadius(key, lng, lat, &query)
 	if cmd == nil {
 		err = errors.New("Can not execute GEORADIUS")
 		return
@@ -98,6 +225,7 @@ func (db Redis) GetNearestDrivers(lat, lng, radius float64, limit int) (location
 			DriverID: id,
 			Lat:      redisLocation.Latitude,
 			Lng:      redisLocation.Longitude,
+			Distance: redisLocation.Dist,
 		}
 
 		locations[i] = location
@@ -105,3 +233,240 @@ func (db Redis) GetNearestDrivers(lat, lng, radius float64, limit int) (location
 
 	return
 }
+
+// GetDriversInBox Get drivers in a box with GEOSEARCH BYBOX on the box enclosing it in kilometer, or by reading
+// the score ranges of the geohash cells covering it when the server does not support GEOSEARCH (before Redis 6.2)
+func (db Redis) GetDriversInBox(minLat, minLng, maxLat, maxLng float64) ([]mredis.DriverLocation, error) {
+	box := geo.Box{MinLat: minLat, MinLng: minLng, MaxLat: maxLat, MaxLng: maxLng}
+	locations, err := db.geoSearchBox(box)
+	if err != nil && strings.HasPrefix(err.Error(), "ERR unknown command") {
+		locations, err = db.geoRangesBox(box)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inBox := make([]mredis.DriverLocation, 0, len(locations))
+	for _, location := range locations {
+		if box.Contains(location.Lat, location.Lng) {
+			inBox = append(inBox, location)
+		}
+	}
+	sort.Slice(inBox, func(i, j int) bool { return inBox[i].DriverID < inBox[j].DriverID })
+	return inBox, nil
+}
+
+// geoSearchBox Get drivers in a box centered on the box, as wide as its widest latitude, with GEOSEARCH
+func (db Redis) geoSearchBox(box geo.Box) ([]mredis.DriverLocation, error) {
+	center := box.Center()
+	widestLat := math.Max(box.MinLat, math.Min(box.MaxLat, 0))
+	// A small margin keeps drivers on the edges despite rounding, extra drivers are filtered out by the caller
+	width := geo.Distance(widestLat, box.MinLng, widestLat, box.MaxLng)*1.01 + 0.001
+	height := geo.Distance(box.MinLat, center.Lng, box.MaxLat, center.Lng)*1.01 + 0.001
+	cmd := redis.NewCmd("GEOSEARCH", mredis.KeyDriverGeo, "FROMLONLAT", center.Lng, center.Lat,
+		"BYBOX", width, height, "km", "WITHCOORD")
+	if err := db.Process(cmd); err != nil {
+		return nil, err
+	}
+	res, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	items, _ := res.([]interface{})
+	locations := make([]mredis.DriverLocation, 0, len(items))
+	for _, item := range items {
+		fields, ok := item.([]interface{})
+		if !ok || len(fields) != 2 {
+			return nil, errors.New("Unexpected GEOSEARCH result")
+		}
+		name, _ := fields[0].(string)
+		coord, ok := fields[1].([]interface{})
+		if !ok || len(coord) != 2 {
+			return nil, errors.New("Unexpected GEOSEARCH result")
+		}
+		lngString, _ := coord[0].(string)
+		latString, _ := coord[1].(string)
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		lng, err := strconv.ParseFloat(lngString, 64)
+		if err != nil {
+			return nil, err
+		}
+		lat, err := strconv.ParseFloat(latString, 64)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, mredis.DriverLocation{DriverID: id, Lat: lat, Lng: lng})
+	}
+
+	return locations, nil
+}
+
+// geoRangesBox Get drivers of the geohash cells covering a box with ZRANGEBYSCORE, coordinates are decoded
+// from scores like GEOPOS does
+func (db Redis) geoRangesBox(box geo.Box) ([]mredis.DriverLocation, error) {
+	ranges := geoRanges(box)
+	cmds := make([]*redis.ZSliceCmd, len(ranges))
+	_, err := db.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, r := range ranges {
+			cmds[i] = pipe.ZRangeByScoreWithScores(mredis.KeyDriverGeo, redis.ZRangeBy{
+				Min: strconv.FormatUint(r.min, 10),
+				Max: "(" + strconv.FormatUint(r.max, 10),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	locations := []mredis.DriverLocation{}
+	for _, cmd := range cmds {
+		for _, member := range cmd.Val() {
+			name, _ := member.Member.(string)
+			id, err := strconv.Atoi(name)
+			if err != nil {
+				continue
+			}
+			lat, lng := geoDecode(uint64(member.Score))
+			locations = append(locations, mredis.DriverLocation{DriverID: id, Lat: lat, Lng: lng})
+		}
+	}
+
+	return locations, nil
+}
+
+// GetDriversInPolygon Get drivers in the bounding box of a polygon, then keep those inside it
+func (db Redis) GetDriversInPolygon(polygon geo.Polygon) ([]mredis.DriverLocation, error) {
+	bounds := polygon.Bounds()
+	drivers, err := db.GetDriversInBox(bounds.MinLat, bounds.MinLng, bounds.MaxLat, bounds.MaxLng)
+	if err != nil {
+		return nil, err
+	}
+
+	inside := make([]mredis.DriverLocation, 0, len(drivers))
+	for _, driver := range drivers {
+		if polygon.Contains(driver.Lat, driver.Lng) {
+			inside = append(inside, driver)
+		}
+	}
+
+	return inside, nil
+}
+
+// ClaimDriver Claim a driver with SET NX, then remove it from geo data. The claim alone guarantees
+// exclusivity, so it works with Redis Cluster where the claim and geo keys are in different slots
+func (db Redis) ClaimDriver(driverID, rideID int, ttl time.Duration) (bool, error) {
+	claimed, err := db.SetNX(mredis.KeyPrefixDriverClaim+strconv.Itoa(driverID), rideID, ttl).Result()
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	return true, db.RemoveDriverLocationGeo(driverID)
+}
+
+// releaseScript Delete the claim key only if it is held by the ride
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// ReleaseDriver Release the claim of a ride on a driver atomically
+func (db Redis) ReleaseDriver(driverID, rideID int) (bool, error) {
+	res, err := releaseScript.Run(db, []string{mredis.KeyPrefixDriverClaim + strconv.Itoa(driverID)}, strconv.Itoa(rideID)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	released, _ := res.(int64)
+	return released == 1, nil
+}
+
+// joinScript Add a member after the last one of a sorted set unless it is already in it, scores are arrival ranks
+// so drivers joining within the same millisecond keep their order
+var joinScript = redis.NewScript(`
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+local score = 1
+if last[2] then
+	score = tonumber(last[2]) + 1
+end
+return redis.call("ZADD", KEYS[1], score, ARGV[1])
+`)
+
+// JoinZoneQueue Add a driver to the sorted set of a zone atomically
+func (db Redis) JoinZoneQueue(zone string, driverID int) error {
+	return joinScript.Run(db, []string{mredis.KeyPrefixZoneQueue + zone}, strconv.Itoa(driverID)).Err()
+}
+
+// LeaveZoneQueue Remove a driver from the sorted set of a zone
+func (db Redis) LeaveZoneQueue(zone string, driverID int) error {
+	return db.ZRem(mredis.KeyPrefixZoneQueue+zone, strconv.Itoa(driverID)).Err()
+}
+
+// GetZoneQueue Get the head of the sorted set of a zone, lowest score first
+func (db Redis) GetZoneQueue(zone string, limit int) ([]int, error) {
+	members, err := db.ZRange(mredis.KeyPrefixZoneQueue+zone, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	driverIDs := make([]int, 0, len(members))
+	for _, member := range members {
+		driverID, err := strconv.Atoi(member)
+		if err != nil {
+			continue
+		}
+		driverIDs = append(driverIDs, driverID)
+	}
+
+	return driverIDs, nil
+}
+
+// tokenBucketScript Refill and take one token atomically, the bucket is a hash of tokens and last refill
+// time in milliseconds. It returns {allowed, milliseconds to wait}
+var tokenBucketScript = redis.NewScript(`
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}
+`)
+
+// TakeToken Take a token from a Redis token bucket, the bucket expires once it would be full again
+func (db Redis) TakeToken(key string, rate float64, burst int) (bool, time.Duration, error) {
+	res, err := tokenBucketScript.Run(db, []string{mredis.KeyPrefixRateLimit + key}, rate, burst).Result()
+	if err != nil {
+		return false, 0, err
+	}
+
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, errors.New("Unexpected token bucket result")
+	}
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,76 @@
+//go:build integration
+// +build integration
+
+package database
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/config"
+	"github.com/trietphm/gruber/geo"
+	"github.com/trietphm/gruber/model/mredis"
+)
+
+// TestGeoBoxQueries Compare GEOSEARCH BYBOX, when the server supports it, with reading geohash ranges. Run with
+// a local redis like the contract tests, the driver geo keys of RD_DB are deleted
+func TestGeoBoxQueries(t *testing.T) {
+	if os.Getenv("RD_HOST") == "" {
+		t.Skip("RD_HOST is not set")
+	}
+	dbIndex, _ := strconv.Atoi(os.Getenv("RD_DB"))
+	db, err := OpenRedisDB(config.Redis{
+		Host:     os.Getenv("RD_HOST"),
+		Port:     os.Getenv("RD_PORT"),
+		Password: os.Getenv("RD_PASSWORD"),
+		DB:       dbIndex,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Del(mredis.KeyDriverGeo).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A grid of drivers every 0.01 degree around Ho Chi Minh City
+	id := 0
+	for lat := 10.70; lat < 10.95; lat += 0.01 {
+		for lng := 106.55; lng < 106.85; lng += 0.01 {
+			id++
+			if err := db.PushDriverLocationGeo(id, lat, lng, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	box := geo.Box{MinLat: 10.755, MinLng: 106.605, MaxLat: 10.875, MaxLng: 106.745}
+	inBox := func(locations []mredis.DriverLocation) map[int]bool {
+		ids := map[int]bool{}
+		for _, location := range locations {
+			if box.Contains(location.Lat, location.Lng) {
+				ids[location.DriverID] = true
+			}
+		}
+		return ids
+	}
+
+	ranges, err := db.geoRangesBox(box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 12 rows of 14 drivers
+	assert.Len(t, inBox(ranges), 12*14)
+
+	search, err := db.geoSearchBox(box)
+	if err != nil && strings.HasPrefix(err.Error(), "ERR unknown command") {
+		t.Skip("GEOSEARCH is not supported")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, inBox(ranges), inBox(search))
+}
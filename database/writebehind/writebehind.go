@@ -0,0 +1,277 @@
+// Package writebehind writes driver location history to a database.CassandraI asynchronously.
+// Locations are queued in process and written in batches by workers, so a slow Cassandra
+// does not slow down location updates. GetDriverLatestLocation sees queued locations, other reads
+// only see them once written.
+package writebehind
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/model/mcass"
+)
+
+// ErrQueueFull Returned when a location can not be queued within the enqueue timeout
+var ErrQueueFull = errors.New("Driver location queue is full")
+
+// ErrClosed Returned when a location is created after Close
+var ErrClosed = errors.New("Driver location writer is closed")
+
+// BatchWriter Implemented by stores which can write many locations at once, e.g. database.Cassandra
+type BatchWriter interface {
+	CreateDriverLocations(locations []mcass.DriverLocation) error
+}
+
+// Options Writer options, zero values use defaults
+type Options struct {
+	// QueueSize Maximum number of queued locations (default 10000)
+	QueueSize int
+	// Workers Number of writing goroutines (default 4)
+	Workers int
+	// BatchSize Maximum locations per write (default 100)
+	BatchSize int
+	// FlushInterval Maximum time a location waits for its batch to fill (default 100ms)
+	FlushInterval time.Duration
+	// MaxRetries Retries of a failed batch before it is dropped (default 3, negative disables retries)
+	MaxRetries int
+	// RetryBackoff Wait before the first retry, doubled on each retry (default 100ms)
+	RetryBackoff time.Duration
+	// EnqueueTimeout How long CreateDriverLocation waits when the queue is full (default 0, no wait)
+	EnqueueTimeout time.Duration
+}
+
+// Stats Writer counters
+type Stats struct {
+	// Queued Locations currently in the queue
+	Queued int `json:"queued"`
+	// Enqueued Locations accepted since start
+	Enqueued uint64 `json:"enqueued"`
+	// Rejected Locations rejected because the queue was full
+	Rejected uint64 `json:"rejected"`
+	// Written Locations written to the database
+	Written uint64 `json:"written"`
+	// Retries Batch retries
+	Retries uint64 `json:"retries"`
+	// Failed Locations dropped after all retries failed
+	Failed uint64 `json:"failed"`
+}
+
+// Cassandra Write-behind wrapper of a database.CassandraI, reads are passed through
+type Cassandra struct {
+	database.CassandraI
+	opts  Options
+	queue chan mcass.DriverLocation
+	wg    sync.WaitGroup
+
+	// mu guards closed and sending on queue
+	mu     sync.RWMutex
+	closed bool
+
+	// latest Latest queued location of each driver until it is written
+	latestMu sync.Mutex
+	latest   map[int]mcass.DriverLocation
+
+	enqueued, rejected, written, retries, failed uint64
+}
+
+var _ database.CassandraI = (*Cassandra)(nil)
+
+// New Start workers writing to db, Close must be called to drain the queue
+func New(db database.CassandraI, opts Options) *Cassandra {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 10000
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 100 * time.Millisecond
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 100 * time.Millisecond
+	}
+
+	w := &Cassandra{
+		CassandraI: db,
+		opts:       opts,
+		queue:      make(chan mcass.DriverLocation, opts.QueueSize),
+		latest:     make(map[int]mcass.DriverLocation),
+	}
+	w.wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go w.work()
+	}
+
+	return w
+}
+
+// CreateDriverLocation Queue a location, it returns ErrQueueFull if the queue stays full for the enqueue timeout.
+// The location ID is set before queueing so retried writes overwrite the same row
+func (w *Cassandra) CreateDriverLocation(location *mcass.DriverLocation) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	if location.ID == (gocql.UUID{}) {
+		location.ID = gocql.UUIDFromTime(location.CreatedAt)
+	}
+
+	select {
+	case w.queue <- *location:
+		w.enqueue(*location)
+		return nil
+	default:
+	}
+
+	if w.opts.EnqueueTimeout > 0 {
+		timer := time.NewTimer(w.opts.EnqueueTimeout)
+		defer timer.Stop()
+		select {
+		case w.queue <- *location:
+			w.enqueue(*location)
+			return nil
+		case <-timer.C:
+		}
+	}
+
+	atomic.AddUint64(&w.rejected, 1)
+	return ErrQueueFull
+}
+
+// enqueue Count a queued location and keep it as the driver latest location if it is newer
+func (w *Cassandra) enqueue(location mcass.DriverLocation) {
+	atomic.AddUint64(&w.enqueued, 1)
+
+	w.latestMu.Lock()
+	defer w.latestMu.Unlock()
+	if latest, ok := w.latest[location.DriverID]; !ok || !location.CreatedAt.Before(latest.CreatedAt) {
+		w.latest[location.DriverID] = location
+	}
+}
+
+// GetDriverLatestLocation Get the latest queued location of a driver, or read it from the database when none is queued
+func (w *Cassandra) GetDriverLatestLocation(driverID int) (*mcass.DriverLocation, error) {
+	w.latestMu.Lock()
+	latest, ok := w.latest[driverID]
+	w.latestMu.Unlock()
+	if ok {
+		return &latest, nil
+	}
+
+	return w.CassandraI.GetDriverLatestLocation(driverID)
+}
+
+// Close Stop accepting locations and wait until every queued location is written
+func (w *Cassandra) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
+
+// Stats Get writer counters
+func (w *Cassandra) Stats() Stats {
+	return Stats{
+		Queued:   len(w.queue),
+		Enqueued: atomic.LoadUint64(&w.enqueued),
+		Rejected: atomic.LoadUint64(&w.rejected),
+		Written:  atomic.LoadUint64(&w.written),
+		Retries:  atomic.LoadUint64(&w.retries),
+		Failed:   atomic.LoadUint64(&w.failed),
+	}
+}
+
+// work Collect batches from the queue until it is closed and drained
+func (w *Cassandra) work() {
+	defer w.wg.Done()
+
+	batch := make([]mcass.DriverLocation, 0, w.opts.BatchSize)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case location, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, location)
+			if len(batch) >= w.opts.BatchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush Write a batch, retrying with exponential backoff
+func (w *Cassandra) flush(batch []mcass.DriverLocation) {
+	if len(batch) == 0 {
+		return
+	}
+
+	backoff := w.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := w.write(batch); err == nil {
+			atomic.AddUint64(&w.written, uint64(len(batch)))
+			w.forget(batch)
+			return
+		}
+		if attempt == w.opts.MaxRetries {
+			atomic.AddUint64(&w.failed, uint64(len(batch)))
+			w.forget(batch)
+			return
+		}
+
+		atomic.AddUint64(&w.retries, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// forget Stop serving the locations of a flushed batch as latest, reads fall back to the database
+func (w *Cassandra) forget(batch []mcass.DriverLocation) {
+	w.latestMu.Lock()
+	defer w.latestMu.Unlock()
+	for _, location := range batch {
+		if w.latest[location.DriverID].ID == location.ID {
+			delete(w.latest, location.DriverID)
+		}
+	}
+}
+
+// write Write a batch at once if the database supports it, one by one otherwise.
+// On error the whole batch is retried, rows already written are overwritten because IDs are set on queueing
+func (w *Cassandra) write(batch []mcass.DriverLocation) error {
+	if batchWriter, ok := w.CassandraI.(BatchWriter); ok {
+		return batchWriter.CreateDriverLocations(batch)
+	}
+
+	for i := range batch {
+		if err := w.CassandraI.CreateDriverLocation(&batch[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package writebehind
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/model/mcass"
+)
+
+// flakyCassandra Fail the first failures writes then write to memory, block writes until unblock is closed
+type flakyCassandra struct {
+	*memory.Cassandra
+	mu       sync.Mutex
+	failures int
+	unblock  chan struct{}
+}
+
+func (db *flakyCassandra) CreateDriverLocation(location *mcass.DriverLocation) error {
+	if db.unblock != nil {
+		<-db.unblock
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.failures > 0 {
+		db.failures--
+		return errors.New("Mock database error")
+	}
+	return db.Cassandra.CreateDriverLocation(location)
+}
+
+func TestCloseDrainsQueue(t *testing.T) {
+	db := memory.NewCassandra()
+	w := New(db, Options{Workers: 2, BatchSize: 10, FlushInterval: time.Hour})
+
+	now := time.Now()
+	for i := 0; i < 25; i++ {
+		location := mcass.DriverLocation{DriverID: 1, Lat: float64(i), CreatedAt: now.Add(time.Duration(i) * time.Millisecond)}
+		assert.NoError(t, w.CreateDriverLocation(&location))
+		assert.NotEqual(t, mcass.DriverLocation{}.ID, location.ID)
+	}
+	w.Close()
+
+	history, err := db.GetDriverHistory(1, now.Add(-time.Second))
+	assert.NoError(t, err)
+	assert.Len(t, history, 25)
+	assert.Equal(t, Stats{Enqueued: 25, Written: 25}, w.Stats())
+
+	location := mcass.DriverLocation{DriverID: 1, CreatedAt: now}
+	assert.Equal(t, ErrClosed, w.CreateDriverLocation(&location))
+}
+
+func TestQueueFull(t *testing.T) {
+	db := &flakyCassandra{Cassandra: memory.NewCassandra(), unblock: make(chan struct{})}
+	w := New(db, Options{QueueSize: 1, Workers: 1, BatchSize: 1, EnqueueTimeout: 10 * time.Millisecond})
+
+	// The worker is blocked on the first location, the second fills the queue
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		location := mcass.DriverLocation{DriverID: 1, CreatedAt: time.Now()}
+		err = w.CreateDriverLocation(&location)
+	}
+	assert.Equal(t, ErrQueueFull, err)
+	assert.Equal(t, uint64(1), w.Stats().Rejected)
+
+	close(db.unblock)
+	w.Close()
+	assert.Equal(t, uint64(2), w.Stats().Written)
+}
+
+func TestLatestLocationQueued(t *testing.T) {
+	db := &flakyCassandra{Cassandra: memory.NewCassandra(), unblock: make(chan struct{})}
+	w := New(db, Options{Workers: 1, BatchSize: 1})
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		location := mcass.DriverLocation{DriverID: 1, Lat: float64(i), CreatedAt: now.Add(time.Duration(i) * time.Second)}
+		assert.NoError(t, w.CreateDriverLocation(&location))
+	}
+
+	// Nothing is written yet
+	latest, err := db.GetDriverLatestLocation(1)
+	assert.NoError(t, err)
+	assert.Nil(t, latest)
+
+	latest, err = w.GetDriverLatestLocation(1)
+	assert.NoError(t, err)
+	if assert.NotNil(t, latest) {
+		assert.Equal(t, float64(2), latest.Lat)
+	}
+
+	close(db.unblock)
+	w.Close()
+	assert.Len(t, w.latest, 0)
+
+	latest, err = w.GetDriverLatestLocation(1)
+	assert.NoError(t, err)
+	if assert.NotNil(t, latest) {
+		assert.Equal(t, float64(2), latest.Lat)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	db := &flakyCassandra{Cassandra: memory.NewCassandra(), failures: 2}
+	w := New(db, Options{Workers: 1, MaxRetries: 2, RetryBackoff: time.Millisecond})
+	location := mcass.DriverLocation{DriverID: 1, CreatedAt: time.Now()}
+	assert.NoError(t, w.CreateDriverLocation(&location))
+	w.Close()
+	assert.Equal(t, Stats{Enqueued: 1, Written: 1, Retries: 2}, w.Stats())
+
+	db = &flakyCassandra{Cassandra: memory.NewCassandra(), failures: 5}
+	w = New(db, Options{Workers: 1, MaxRetries: 2, RetryBackoff: time.Millisecond})
+	assert.NoError(t, w.CreateDriverLocation(&location))
+	w.Close()
+	assert.Equal(t, Stats{Enqueued: 1, Failed: 1, Retries: 2}, w.Stats())
+}
@@ -0,0 +1,182 @@
+// Package geo provides distance computations on coordinates in degrees
+package geo
+
+import (
+	"math"
+	"strings"
+)
+
+// EarthRadius Earth radius in kilometer, the same value Redis uses for GEO commands
+const EarthRadius = 6372.797560856
+
+// Distance Great circle distance in kilometer between two coordinates (haversine formula)
+func Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLng := (lng2 - lng1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(a))
+}
+
+// Bearing Initial bearing in degree clockwise from north, in [0, 360), of the great circle from the first
+// coordinate to the second
+func Bearing(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := math.Pi / 180
+	dLng := (lng2 - lng1) * toRad
+	y := math.Sin(dLng) * math.Cos(lat2*toRad)
+	x := math.Cos(lat1*toRad)*math.Sin(lat2*toRad) - math.Sin(lat1*toRad)*math.Cos(lat2*toRad)*math.Cos(dLng)
+	return math.Mod(math.Atan2(y, x)/toRad+360, 360)
+}
+
+// Point Coordinate in degrees
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+// Polygon Outer ring followed by the rings of its holes, a ring is closed whether or not its last point repeats
+// the first one. Edges are straight in degrees, which is precise enough for city sized areas
+type Polygon [][]Point
+
+// Contains Check a coordinate is inside the outer ring and outside every hole
+func (p Polygon) Contains(lat, lng float64) bool {
+	if len(p) == 0 || !inRing(p[0], lat, lng) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if inRing(hole, lat, lng) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Bounds Bounding box of the outer ring
+func (p Polygon) Bounds() Box {
+	if len(p) == 0 || len(p[0]) == 0 {
+		return Box{}
+	}
+	box := Box{MinLat: p[0][0].Lat, MinLng: p[0][0].Lng, MaxLat: p[0][0].Lat, MaxLng: p[0][0].Lng}
+	for _, point := range p[0][1:] {
+		box.MinLat = math.Min(box.MinLat, point.Lat)
+		box.MinLng = math.Min(box.MinLng, point.Lng)
+		box.MaxLat = math.Max(box.MaxLat, point.Lat)
+		box.MaxLng = math.Max(box.MaxLng, point.Lng)
+	}
+
+	return box
+}
+
+// inRing Check a coordinate is inside a ring by counting the edges a ray going east from it crosses
+func inRing(ring []Point, lat, lng float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > lat) != (b.Lat > lat) && lng < (b.Lng-a.Lng)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// Box Bounding box in degrees, it does not cross the antimeridian
+type Box struct {
+	MinLat float64
+	MinLng float64
+	MaxLat float64
+	MaxLng float64
+}
+
+// Contains Check a coordinate is inside the box or on its edges
+func (b Box) Contains(lat, lng float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && lng >= b.MinLng && lng <= b.MaxLng
+}
+
+// Center Center of the box
+func (b Box) Center() Point {
+	return Point{Lat: (b.MinLat + b.MaxLat) / 2, Lng: (b.MinLng + b.MaxLng) / 2}
+}
+
+// Radius Distance in kilometer from the center to the farthest corner, a circle of this radius covers the box
+func (b Box) Radius() float64 {
+	center := b.Center()
+	radius := 0.0
+	for _, corner := range []Point{{b.MinLat, b.MinLng}, {b.MinLat, b.MaxLng}, {b.MaxLat, b.MinLng}, {b.MaxLat, b.MaxLng}} {
+		radius = math.Max(radius, Distance(center.Lat, center.Lng, corner.Lat, corner.Lng))
+	}
+
+	return radius
+}
+
+// geohashAlphabet Base 32 alphabet of geohashes
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Geohash Encode a coordinate as a geohash of precision characters
+func Geohash(lat, lng float64, precision int) string {
+	box := Box{MinLat: -90, MinLng: -180, MaxLat: 90, MaxLng: 180}
+	hash := make([]byte, precision)
+	even := true
+	for i := range hash {
+		index := 0
+		for bit := 4; bit >= 0; bit-- {
+			// Bits alternate between longitude and latitude, longitude first
+			if even {
+				mid := (box.MinLng + box.MaxLng) / 2
+				if lng >= mid {
+					index |= 1 << uint(bit)
+					box.MinLng = mid
+				} else {
+					box.MaxLng = mid
+				}
+			} else {
+				mid := (box.MinLat + box.MaxLat) / 2
+				if lat >= mid {
+					index |= 1 << uint(bit)
+					box.MinLat = mid
+				} else {
+					box.MaxLat = mid
+				}
+			}
+			even = !even
+		}
+		hash[i] = geohashAlphabet[index]
+	}
+
+	return string(hash)
+}
+
+// GeohashBox Decode the cell of a geohash, ok is false if hash is not a geohash
+func GeohashBox(hash string) (box Box, ok bool) {
+	box = Box{MinLat: -90, MinLng: -180, MaxLat: 90, MaxLng: 180}
+	even := true
+	for i := 0; i < len(hash); i++ {
+		index := strings.IndexByte(geohashAlphabet, hash[i])
+		if index < 0 {
+			return Box{}, false
+		}
+		for bit := 4; bit >= 0; bit-- {
+			set := index&(1<<uint(bit)) != 0
+			if even {
+				mid := (box.MinLng + box.MaxLng) / 2
+				if set {
+					box.MinLng = mid
+				} else {
+					box.MaxLng = mid
+				}
+			} else {
+				mid := (box.MinLat + box.MaxLat) / 2
+				if set {
+					box.MinLat = mid
+				} else {
+					box.MaxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+
+	return box, true
+}
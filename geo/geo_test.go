@@ -0,0 +1,84 @@
+package geo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistance(t *testing.T) {
+	assert.Equal(t, float64(0), Distance(10, 106, 10, 106))
+	// 0.01 degree of longitude on the equator
+	assert.InDelta(t, 1.1123, Distance(0, 0, 0, 0.01), 1e-4)
+	// Ho Chi Minh City to Hanoi
+	assert.InDelta(t, 1138, Distance(10.8231, 106.6297, 21.0278, 105.8342), 5)
+}
+
+func TestBearing(t *testing.T) {
+	assert.InDelta(t, 0, Bearing(0, 0, 1, 0), 1e-9)
+	assert.InDelta(t, 90, Bearing(0, 0, 0, 1), 1e-9)
+	assert.InDelta(t, 180, Bearing(0, 0, -1, 0), 1e-9)
+	assert.InDelta(t, 270, Bearing(0, 0, 0, -1), 1e-9)
+}
+
+func TestPolygonContains(t *testing.T) {
+	square := []Point{{0, 0}, {0, 10}, {10, 10}, {10, 0}, {0, 0}}
+	hole := []Point{{4, 4}, {4, 6}, {6, 6}, {6, 4}}
+	tt := []struct {
+		polygon  Polygon
+		lat, lng float64
+		expected bool
+	}{
+		{Polygon{square}, 5, 5, true},
+		{Polygon{square}, 1, 9, true},
+		{Polygon{square}, 11, 5, false},
+		{Polygon{square}, 5, -1, false},
+		{Polygon{square, hole}, 5, 5, false},
+		{Polygon{square, hole}, 2, 5, true},
+		// Not closed
+		{Polygon{square[:4]}, 5, 5, true},
+		// Concave: a V open to the north
+		{Polygon{{{0, 0}, {10, 5}, {10, 4}, {2, 0}, {10, -4}, {10, -5}}}, 8, 0, false},
+		{Polygon{{{0, 0}, {10, 5}, {10, 4}, {2, 0}, {10, -4}, {10, -5}}}, 1, 0, true},
+		{Polygon{}, 0, 0, false},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, tc.polygon.Contains(tc.lat, tc.lng), "%v %v,%v", tc.polygon, tc.lat, tc.lng)
+	}
+}
+
+func TestBox(t *testing.T) {
+	box := Box{MinLat: 10, MinLng: 106, MaxLat: 11, MaxLng: 107}
+	assert.True(t, box.Contains(10.5, 106.5))
+	assert.True(t, box.Contains(10, 107))
+	assert.False(t, box.Contains(11.1, 106.5))
+	assert.Equal(t, Point{Lat: 10.5, Lng: 106.5}, box.Center())
+	assert.InDelta(t, Distance(10.5, 106.5, 10, 106), box.Radius(), 1e-9)
+}
+
+func TestGeohash(t *testing.T) {
+	tt := []struct {
+		lat, lng  float64
+		precision int
+		expected  string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{10.823099, 106.629664, 6, "w3gvd6"},
+		{-33.8688, 151.2093, 5, "r3gx2"},
+		{0, 0, 1, "s"},
+	}
+	for _, tc := range tt {
+		hash := Geohash(tc.lat, tc.lng, tc.precision)
+		assert.Equal(t, tc.expected, hash)
+
+		box, ok := GeohashBox(hash)
+		assert.True(t, ok)
+		assert.True(t, box.Contains(tc.lat, tc.lng), "%s %v", hash, box)
+	}
+
+	box, ok := GeohashBox("s")
+	assert.True(t, ok)
+	assert.Equal(t, Box{MinLat: 0, MinLng: 0, MaxLat: 45, MaxLng: 45}, box)
+	_, ok = GeohashBox("sa")
+	assert.False(t, ok)
+}
@@ -1,17 +1,36 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
+	goredis "github.com/go-redis/redis"
+
+	"github.com/trietphm/gruber/app/batch"
+	"github.com/trietphm/gruber/app/geofence"
 	"github.com/trietphm/gruber/app/handler"
+	"github.com/trietphm/gruber/app/payment"
+	"github.com/trietphm/gruber/app/scheduler"
 	"github.com/trietphm/gruber/config"
 	"github.com/trietphm/gruber/database"
+	"github.com/trietphm/gruber/database/cache"
+	"github.com/trietphm/gruber/database/memory"
+	"github.com/trietphm/gruber/database/writebehind"
 )
 
 func main() {
 	var configPath = flag.String("config", "", "Set config file path")
+	var store = flag.String("store", "database", "Set datastore: database (postgresql, cassandra, redis) or memory")
+	var copyLocations = flag.Bool("copy-legacy-locations", false, "Copy legacy cassandra driver_locations into driver_locations_by_day then exit")
 	flag.Parse()
 
 	conf, err := config.ReadConfig(*configPath)
@@ -19,27 +38,181 @@ func main() {
 		panic(err)
 	}
 
-	dbPg, err := database.OpenPostgresqlDB(conf.Postgresql)
+	var (
+		dbPg    database.PgI
+		dbCass  database.CassandraI
+		dbRedis database.RedisI
+		// redisClient is nil with the memory store
+		redisClient goredis.UniversalClient
+	)
+	switch *store {
+	case "memory":
+		// Everything is kept in memory, for local development only
+		dbPg = memory.NewPg()
+		dbCass = memory.NewCassandra()
+		dbRedis = memory.NewRedis()
+	case "database":
+		pg, err := database.OpenPostgresqlDB(conf.Postgresql)
+		if err != nil {
+			panic(err)
+		}
+
+		cass, err := database.OpenCassandraDB(conf.Cassandra)
+		if err != nil {
+			panic(err)
+		}
+
+		if *copyLocations {
+			copied, err := cass.CopyLegacyDriverLocations()
+			fmt.Println("Copied driver locations:", copied)
+			if err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		redis, err := database.OpenRedisDB(conf.Redis)
+		if err != nil {
+			panic(err)
+		}
+		dbPg, dbCass, dbRedis = pg, cass, redis
+		redisClient = redis.UniversalClient
+	default:
+		panic("Unknown store " + *store)
+	}
+
+	if conf.Cache.DriverStore != "" {
+		driverStore, err := newDriverStore(conf.Cache, redisClient)
+		if err != nil {
+			panic(err)
+		}
+		cachedPg := cache.NewPg(dbPg, driverStore)
+		expvar.Publish("driver_cache", expvar.Func(func() interface{} { return cachedPg.Stats() }))
+		dbPg = cachedPg
+	}
+
+	var locationWriter *writebehind.Cassandra
+	if conf.WriteBehind.Enabled {
+		locationWriter = writebehind.New(dbCass, writebehind.Options{
+			QueueSize:      conf.WriteBehind.QueueSize,
+			Workers:        conf.WriteBehind.Workers,
+			BatchSize:      conf.WriteBehind.BatchSize,
+			FlushInterval:  conf.WriteBehind.FlushInterval,
+			MaxRetries:     conf.WriteBehind.MaxRetries,
+			RetryBackoff:   conf.WriteBehind.RetryBackoff,
+			EnqueueTimeout: conf.WriteBehind.EnqueueTimeout,
+		})
+		expvar.Publish("location_writer", expvar.Func(func() interface{} { return locationWriter.Stats() }))
+		dbCass = locationWriter
+	}
+
+	fences, err := geofence.Load(dbPg, conf.Geofence)
 	if err != nil {
 		panic(err)
 	}
 
-	dbCass, err := database.OpenCassandraDB(conf.Cassandra)
+	provider, err := payment.New(conf.Payment)
 	if err != nil {
 		panic(err)
 	}
 
-	dbRedis, err := database.OpenRedisDB(conf.Redis)
+	matcher, assigner, err := handler.NewMatcher(dbPg, dbCass, dbRedis, conf.ETA, conf.Matching, fences)
 	if err != nil {
 		panic(err)
 	}
 
-	engine, err := handler.NewEngine(dbPg, dbCass, dbRedis)
+	var rideScheduler *scheduler.Scheduler
+	if conf.Scheduler.Enabled {
+		rideScheduler = scheduler.New(dbPg, assigner, scheduler.Options{
+			LeadTime: conf.Scheduler.LeadTime,
+			Interval: conf.Scheduler.Interval,
+		})
+		expvar.Publish("ride_scheduler", expvar.Func(func() interface{} { return rideScheduler.Stats() }))
+	}
+
+	engine, err := handler.NewEngine(dbPg, dbCass, dbRedis, handler.Options{
+		Config:   *conf,
+		Fences:   fences,
+		Provider: provider,
+		Matcher:  matcher,
+		Assigner: assigner,
+	})
 	if err != nil {
 		panic(err)
 	}
 
-	if err := engine.Run(":" + strconv.Itoa(conf.App.Port)); err != nil {
-		fmt.Println("Serve fail:", err)
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(conf.App.Port),
+		Handler: engine,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Println("Serve fail:", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Counters expose internals, they are served apart from the API on an internal address
+	var debugServer *http.Server
+	if conf.App.DebugAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		debugServer = &http.Server{
+			Addr:    conf.App.DebugAddr,
+			Handler: mux,
+		}
+		go func() {
+			if err := debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Println("Serve debug fail:", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Graceful shutdown: match the pending batch, finish in-flight requests, stop the scheduler then drain queued location writes
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Rides waiting for their batch are matched now instead of at the end of the window
+	if batcher, ok := assigner.(*batch.Batcher); ok {
+		batcher.Close()
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("Shutdown fail:", err)
+	}
+	if debugServer != nil {
+		debugServer.Close()
+	}
+	if rideScheduler != nil {
+		rideScheduler.Close()
+	}
+	if locationWriter != nil {
+		locationWriter.Close()
 	}
 }
+
+// newDriverStore Create the store of the driver lookup cache
+func newDriverStore(conf config.Cache, redisClient goredis.UniversalClient) (cache.Store, error) {
+	ttl := conf.DriverTTL
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+
+	switch conf.DriverStore {
+	case "lru":
+		size := conf.DriverSize
+		if size <= 0 {
+			size = 10000
+		}
+		return cache.NewLRU(size, ttl), nil
+	case "redis":
+		if redisClient == nil {
+			return nil, errors.New("Driver cache store redis requires -store=database")
+		}
+		return cache.NewRedis(redisClient, ttl), nil
+	}
+
+	return nil, fmt.Errorf("Unknown driver cache store %q", conf.DriverStore)
+}
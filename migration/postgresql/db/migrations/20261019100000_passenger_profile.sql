@@ -0,0 +1,26 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TYPE enum_payment_method AS ENUM (
+	'cash',
+	'card',
+	'wallet'
+);
+
+ALTER TABLE passengers
+	ADD COLUMN phone TEXT,
+	ADD COLUMN email TEXT,
+	ADD COLUMN rating FLOAT,
+	ADD COLUMN default_payment_method enum_payment_method DEFAULT 'cash',
+	ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE passengers
+	DROP COLUMN IF EXISTS phone,
+	DROP COLUMN IF EXISTS email,
+	DROP COLUMN IF EXISTS rating,
+	DROP COLUMN IF EXISTS default_payment_method,
+	DROP COLUMN IF EXISTS deleted_at;
+DROP TYPE IF EXISTS enum_payment_method;
@@ -0,0 +1,44 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TYPE enum_vehicle_class AS ENUM (
+	'economy',
+	'xl',
+	'premium'
+);
+
+CREATE TABLE vehicles (
+	id SERIAL PRIMARY KEY,
+	driver_id INTEGER NOT NULL REFERENCES drivers (id),
+	plate TEXT NOT NULL,
+	make TEXT,
+	model TEXT,
+	color TEXT,
+	seats INTEGER,
+	class enum_vehicle_class NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX vehicles_driver_id_idx ON vehicles (driver_id);
+
+CREATE TYPE enum_document_type AS ENUM (
+	'license',
+	'insurance'
+);
+
+CREATE TABLE driver_documents (
+	id SERIAL PRIMARY KEY,
+	driver_id INTEGER NOT NULL REFERENCES drivers (id),
+	type enum_document_type NOT NULL,
+	number TEXT NOT NULL,
+	expires_at DATE NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (driver_id, type)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE IF EXISTS driver_documents;
+DROP TYPE IF EXISTS enum_document_type;
+DROP TABLE IF EXISTS vehicles;
+DROP TYPE IF EXISTS enum_vehicle_class;
@@ -0,0 +1,13 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+-- Distinct classes of the vehicles of a driver, kept with the driver so a location update does not read vehicles
+ALTER TABLE drivers ADD COLUMN vehicle_classes TEXT[] NOT NULL DEFAULT '{}';
+
+UPDATE drivers SET vehicle_classes = ARRAY(
+	SELECT DISTINCT class::TEXT FROM vehicles WHERE vehicles.driver_id = drivers.id ORDER BY 1
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE drivers DROP COLUMN IF EXISTS vehicle_classes;
@@ -0,0 +1,31 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TYPE enum_scheduled_ride_status AS ENUM (
+	'pending',
+	'dispatched',
+	'expired',
+	'cancelled'
+);
+
+CREATE TABLE scheduled_rides (
+	id SERIAL PRIMARY KEY,
+	passenger_id INTEGER NOT NULL REFERENCES passengers (id),
+	lat FLOAT NOT NULL,
+	lng FLOAT NOT NULL,
+	-- NULL matches drivers of every vehicle class
+	vehicle_class enum_vehicle_class,
+	pickup_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	status enum_scheduled_ride_status NOT NULL DEFAULT 'pending',
+	driver_ids INTEGER[],
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+-- The scheduler reads pending rides by pickup time
+CREATE INDEX scheduled_rides_pending_pickup_at_idx ON scheduled_rides (pickup_at) WHERE status = 'pending';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE IF EXISTS scheduled_rides;
+DROP TYPE IF EXISTS enum_scheduled_ride_status;
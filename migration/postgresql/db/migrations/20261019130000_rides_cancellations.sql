@@ -0,0 +1,51 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TYPE enum_ride_status AS ENUM (
+	'requested',
+	'assigned',
+	'arrived',
+	'cancelled'
+);
+
+CREATE TABLE rides (
+	id SERIAL PRIMARY KEY,
+	passenger_id INTEGER NOT NULL REFERENCES passengers (id),
+	driver_id INTEGER REFERENCES drivers (id),
+	lat FLOAT NOT NULL,
+	lng FLOAT NOT NULL,
+	-- NULL matches drivers of every vehicle class
+	vehicle_class enum_vehicle_class,
+	status enum_ride_status NOT NULL DEFAULT 'requested',
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	assigned_at TIMESTAMP WITH TIME ZONE,
+	arrived_at TIMESTAMP WITH TIME ZONE,
+	cancelled_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX rides_passenger_id_idx ON rides (passenger_id);
+CREATE INDEX rides_driver_id_idx ON rides (driver_id);
+
+CREATE TYPE enum_cancelled_by AS ENUM (
+	'passenger',
+	'driver'
+);
+
+CREATE TABLE ride_cancellations (
+	id SERIAL PRIMARY KEY,
+	ride_id INTEGER NOT NULL REFERENCES rides (id),
+	driver_id INTEGER REFERENCES drivers (id),
+	cancelled_by enum_cancelled_by NOT NULL,
+	reason TEXT NOT NULL,
+	fee BIGINT NOT NULL DEFAULT 0,
+	no_show BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX ride_cancellations_ride_id_idx ON ride_cancellations (ride_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE IF EXISTS ride_cancellations;
+DROP TYPE IF EXISTS enum_cancelled_by;
+DROP TABLE IF EXISTS rides;
+DROP TYPE IF EXISTS enum_ride_status;
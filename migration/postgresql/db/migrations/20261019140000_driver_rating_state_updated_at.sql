@@ -0,0 +1,13 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+ALTER TABLE drivers
+	ADD COLUMN rating FLOAT,
+	ADD COLUMN state_updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE drivers
+	DROP COLUMN IF EXISTS rating,
+	DROP COLUMN IF EXISTS state_updated_at;
@@ -0,0 +1,10 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+-- Ride requested by the scheduler on the first dispatch of a scheduled ride
+ALTER TABLE scheduled_rides ADD COLUMN ride_id INTEGER REFERENCES rides (id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE scheduled_rides DROP COLUMN IF EXISTS ride_id;
@@ -0,0 +1,27 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TYPE enum_zone_kind AS ENUM (
+	'service_area',
+	'airport',
+	'restricted'
+);
+
+CREATE TABLE zones (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	kind enum_zone_kind NOT NULL,
+	-- GeoJSON Polygon or MultiPolygon geometry, coordinates are [lng, lat]
+	geometry JSONB NOT NULL,
+	-- Airport rules
+	queue BOOLEAN NOT NULL DEFAULT FALSE,
+	pickup_fee BIGINT NOT NULL DEFAULT 0,
+	fare_multiplier FLOAT NOT NULL DEFAULT 1,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE IF EXISTS zones;
+DROP TYPE IF EXISTS enum_zone_kind;
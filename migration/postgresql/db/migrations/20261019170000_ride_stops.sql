@@ -0,0 +1,43 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+-- Values can not be added to an enum inside a transaction before PostgreSQL 12, the type is replaced instead
+ALTER TYPE enum_ride_status RENAME TO enum_ride_status_old;
+CREATE TYPE enum_ride_status AS ENUM (
+	'requested',
+	'assigned',
+	'arrived',
+	'started',
+	'completed',
+	'cancelled'
+);
+ALTER TABLE rides ALTER COLUMN status DROP DEFAULT;
+ALTER TABLE rides ALTER COLUMN status TYPE enum_ride_status USING status::TEXT::enum_ride_status;
+ALTER TABLE rides ALTER COLUMN status SET DEFAULT 'requested';
+DROP TYPE enum_ride_status_old;
+
+ALTER TABLE rides
+	ADD COLUMN started_at TIMESTAMP WITH TIME ZONE,
+	ADD COLUMN completed_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE ride_stops (
+	id SERIAL PRIMARY KEY,
+	ride_id INTEGER NOT NULL REFERENCES rides (id),
+	position INTEGER NOT NULL,
+	dropoff BOOLEAN NOT NULL DEFAULT FALSE,
+	lat FLOAT NOT NULL,
+	lng FLOAT NOT NULL,
+	address TEXT NOT NULL DEFAULT '',
+	place_id TEXT NOT NULL DEFAULT '',
+	arrived_at TIMESTAMP WITH TIME ZONE,
+	departed_at TIMESTAMP WITH TIME ZONE,
+	UNIQUE (ride_id, position)
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+-- 'started' and 'completed' are kept in enum_ride_status since rides may have them
+
+DROP TABLE IF EXISTS ride_stops;
+ALTER TABLE rides
+	DROP COLUMN IF EXISTS started_at,
+	DROP COLUMN IF EXISTS completed_at;
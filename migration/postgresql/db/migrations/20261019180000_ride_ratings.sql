@@ -0,0 +1,30 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TYPE enum_rated_by AS ENUM (
+	'passenger',
+	'driver'
+);
+
+CREATE TABLE ride_ratings (
+	id SERIAL PRIMARY KEY,
+	ride_id INTEGER NOT NULL REFERENCES rides (id),
+	driver_id INTEGER NOT NULL REFERENCES drivers (id),
+	passenger_id INTEGER NOT NULL REFERENCES passengers (id),
+	rated_by enum_rated_by NOT NULL,
+	rating SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+	tags TEXT[] NOT NULL DEFAULT '{}',
+	comment TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (ride_id, rated_by)
+);
+-- Latest ratings received by a driver or a passenger
+CREATE INDEX ride_ratings_driver_id_idx ON ride_ratings (driver_id, rated_by, id);
+CREATE INDEX ride_ratings_passenger_id_idx ON ride_ratings (passenger_id, rated_by, id);
+-- Low ratings for support
+CREATE INDEX ride_ratings_rating_idx ON ride_ratings (rating, id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE IF EXISTS ride_ratings;
+DROP TYPE IF EXISTS enum_rated_by;
@@ -0,0 +1,100 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+-- Fare of completed rides in minor units of the currency
+ALTER TABLE rides
+	ADD COLUMN fare BIGINT,
+	ADD COLUMN commission BIGINT,
+	ADD COLUMN currency TEXT;
+
+CREATE TYPE enum_account_kind AS ENUM (
+	'passenger',
+	'driver',
+	'commission',
+	'cash',
+	'refunds'
+);
+
+CREATE TABLE accounts (
+	id SERIAL PRIMARY KEY,
+	kind enum_account_kind NOT NULL,
+	-- 0 for platform accounts
+	owner_id INTEGER NOT NULL DEFAULT 0,
+	currency CHAR(3) NOT NULL,
+	-- Sum of the postings of the account, debits are positive
+	balance BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (kind, owner_id, currency)
+);
+
+CREATE TYPE enum_entry_kind AS ENUM (
+	'charge',
+	'payment',
+	'refund'
+);
+
+CREATE TABLE journal_entries (
+	id SERIAL PRIMARY KEY,
+	idempotency_key TEXT NOT NULL UNIQUE,
+	kind enum_entry_kind NOT NULL,
+	ride_id INTEGER REFERENCES rides (id),
+	currency CHAR(3) NOT NULL,
+	amount BIGINT NOT NULL CHECK (amount > 0),
+	provider_ref TEXT NOT NULL DEFAULT '',
+	memo TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX journal_entries_ride_id_idx ON journal_entries (ride_id);
+
+-- Postings are append only
+CREATE TABLE postings (
+	id SERIAL PRIMARY KEY,
+	entry_id INTEGER NOT NULL REFERENCES journal_entries (id),
+	account_id INTEGER NOT NULL REFERENCES accounts (id),
+	amount BIGINT NOT NULL CHECK (amount <> 0)
+);
+CREATE INDEX postings_entry_id_idx ON postings (entry_id);
+CREATE INDEX postings_account_id_idx ON postings (account_id);
+
+-- Double-entry invariants, checked at commit once every posting of the entry is inserted:
+-- postings of an entry sum to 0, their debits to the amount of the entry, and their accounts are in its currency
+-- +goose StatementBegin
+CREATE FUNCTION check_journal_entry() RETURNS TRIGGER AS $$
+DECLARE
+	entry journal_entries%ROWTYPE;
+BEGIN
+	SELECT * INTO entry FROM journal_entries WHERE id = NEW.entry_id;
+	IF (SELECT sum(amount) FROM postings WHERE entry_id = entry.id) <> 0 THEN
+		RAISE EXCEPTION 'journal entry % is not balanced', entry.id;
+	END IF;
+	IF (SELECT sum(amount) FROM postings WHERE entry_id = entry.id AND amount > 0) <> entry.amount THEN
+		RAISE EXCEPTION 'journal entry % debits do not match its amount', entry.id;
+	END IF;
+	IF EXISTS (
+		SELECT 1 FROM postings JOIN accounts ON accounts.id = postings.account_id
+		WHERE postings.entry_id = entry.id AND accounts.currency <> entry.currency
+	) THEN
+		RAISE EXCEPTION 'journal entry % has accounts in another currency', entry.id;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE CONSTRAINT TRIGGER postings_check_journal_entry
+	AFTER INSERT ON postings
+	DEFERRABLE INITIALLY DEFERRED
+	FOR EACH ROW EXECUTE PROCEDURE check_journal_entry();
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE IF EXISTS postings;
+DROP FUNCTION IF EXISTS check_journal_entry();
+DROP TABLE IF EXISTS journal_entries;
+DROP TYPE IF EXISTS enum_entry_kind;
+DROP TABLE IF EXISTS accounts;
+DROP TYPE IF EXISTS enum_account_kind;
+ALTER TABLE rides
+	DROP COLUMN IF EXISTS fare,
+	DROP COLUMN IF EXISTS commission,
+	DROP COLUMN IF EXISTS currency;
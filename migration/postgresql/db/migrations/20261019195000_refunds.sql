@@ -0,0 +1,28 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TYPE enum_refund_status AS ENUM (
+	'pending',
+	'succeeded',
+	'failed'
+);
+
+-- Refunds are reserved against the fare before the provider is called, succeeded ones are recorded by the
+-- journal entry of the same idempotency key
+CREATE TABLE refunds (
+	id SERIAL PRIMARY KEY,
+	idempotency_key TEXT NOT NULL UNIQUE,
+	ride_id INTEGER NOT NULL REFERENCES rides (id),
+	currency CHAR(3) NOT NULL,
+	amount BIGINT NOT NULL CHECK (amount > 0),
+	memo TEXT NOT NULL DEFAULT '',
+	status enum_refund_status NOT NULL DEFAULT 'pending',
+	provider_ref TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX refunds_ride_id_idx ON refunds (ride_id);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE IF EXISTS refunds;
+DROP TYPE IF EXISTS enum_refund_status;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+-- Payment method of the passenger when the ride was requested
+ALTER TABLE rides ADD COLUMN payment_method enum_payment_method;
+UPDATE rides SET payment_method = passengers.default_payment_method FROM passengers WHERE passengers.id = rides.passenger_id;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE rides DROP COLUMN IF EXISTS payment_method;
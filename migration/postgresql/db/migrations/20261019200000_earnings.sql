@@ -0,0 +1,26 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+-- Tip of the passenger in minor units of the currency of the fare
+ALTER TABLE rides ADD COLUMN tip BIGINT CHECK (tip > 0);
+
+-- Completed rides of a driver by completion time
+CREATE INDEX rides_driver_id_completed_at_idx ON rides (driver_id, completed_at) WHERE status = 'completed';
+
+CREATE TABLE earning_adjustments (
+	id SERIAL PRIMARY KEY,
+	driver_id INTEGER NOT NULL REFERENCES drivers (id),
+	ride_id INTEGER REFERENCES rides (id),
+	-- Credit to the driver if positive, debit if negative
+	amount BIGINT NOT NULL CHECK (amount <> 0),
+	currency CHAR(3) NOT NULL,
+	reason TEXT NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX earning_adjustments_driver_id_idx ON earning_adjustments (driver_id, created_at);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE IF EXISTS earning_adjustments;
+DROP INDEX IF EXISTS rides_driver_id_completed_at_idx;
+ALTER TABLE rides DROP COLUMN IF EXISTS tip;
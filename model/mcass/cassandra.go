@@ -1,6 +1,18 @@
 package mcass
 
-import "github.com/gocql/gocql"
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	// BucketDuration Size of a driver_locations_by_day partition
+	BucketDuration = 24 * time.Hour
+
+	// Retention How long driver locations are kept, it matches default_time_to_live of driver_locations_by_day
+	Retention = 30 * BucketDuration
+)
 
 // DriverLocation Location of driver which will be updated each 6s
 type DriverLocation struct {
@@ -8,5 +20,10 @@ type DriverLocation struct {
 	DriverID  int
 	Lat       float64
 	Lng       float64
-	CreatedAt int64
+	CreatedAt time.Time
+}
+
+// DayBucket Get the partition bucket (UTC day) of a time
+func DayBucket(t time.Time) time.Time {
+	return t.UTC().Truncate(BucketDuration)
 }
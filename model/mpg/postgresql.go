@@ -7,19 +7,350 @@ const (
 	StateBusy      = "busy"
 )
 
+const (
+	VehicleClassEconomy = "economy"
+	VehicleClassXL      = "xl"
+	VehicleClassPremium = "premium"
+)
+
+// VehicleClasses Every vehicle class
+var VehicleClasses = []string{VehicleClassEconomy, VehicleClassXL, VehicleClassPremium}
+
+const (
+	DocumentLicense   = "license"
+	DocumentInsurance = "insurance"
+)
+
+// DateFormat Format of DATE columns
+const DateFormat = "2006-01-02"
+
+const (
+	PaymentMethodCash   = "cash"
+	PaymentMethodCard   = "card"
+	PaymentMethodWallet = "wallet"
+)
+
+const (
+	// ScheduledRidePending Waiting for the scheduler to find drivers
+	ScheduledRidePending = "pending"
+	// ScheduledRideDispatched Drivers were found
+	ScheduledRideDispatched = "dispatched"
+	// ScheduledRideExpired No driver was found until the pickup time
+	ScheduledRideExpired = "expired"
+	// ScheduledRideCancelled Cancelled by the passenger before dispatch
+	ScheduledRideCancelled = "cancelled"
+)
+
+const (
+	// RideRequested Waiting for a driver
+	RideRequested = "requested"
+	// RideAssigned A driver is on the way to pickup
+	RideAssigned = "assigned"
+	// RideArrived The driver waits at pickup
+	RideArrived = "arrived"
+	// RideStarted The passenger is picked up, the driver is on the way to the stops
+	RideStarted = "started"
+	// RideCompleted The driver arrived at the dropoff
+	RideCompleted = "completed"
+	// RideCancelled Cancelled by the passenger, by the driver for a no-show or with its expired scheduled ride
+	RideCancelled = "cancelled"
+)
+
+const (
+	CancelledByPassenger = "passenger"
+	CancelledByDriver    = "driver"
+)
+
+const (
+	// RatedByPassenger The passenger rates the driver
+	RatedByPassenger = "passenger"
+	// RatedByDriver The driver rates the passenger
+	RatedByDriver = "driver"
+)
+
+const (
+	// MinRating Worst rating of a ride
+	MinRating = 1
+	// MaxRating Best rating of a ride
+	MaxRating = 5
+	// RatingWindow Driver.Rating and Passenger.Rating average this many of the latest ratings received
+	RatingWindow = 100
+)
+
+const (
+	// ZoneServiceArea Area where rides are served, pickups outside every service area are rejected
+	ZoneServiceArea = "service_area"
+	// ZoneAirport Airport with its own driver queue and pricing rules
+	ZoneAirport = "airport"
+	// ZoneRestricted Area where pickups are rejected
+	ZoneRestricted = "restricted"
+)
+
 // Driver
 type Driver struct {
 	tableName struct{} `sql:"drivers,alias:drivers" pg:",discard_unknown_columns"`
 	ID        int
 	Name      string
 	State     string
+	// Rating Average of the latest RatingWindow ratings of the driver, 0 if not rated yet
+	Rating float64
+	// VehicleClasses Distinct classes of the driver's vehicles, maintained by CreateVehicle and DeleteVehicle
+	VehicleClasses []string `pg:",array"`
+	// StateUpdatedAt Last time the state changed, an available driver is idle since then
+	StateUpdatedAt time.Time
+	CreatedAt      time.Time
+}
+
+// Vehicle Vehicle of a driver
+type Vehicle struct {
+	tableName struct{} `sql:"vehicles,alias:vehicles" pg:",discard_unknown_columns"`
+	ID        int
+	DriverID  int
+	Plate     string
+	Make      string
+	Model     string
+	Color     string
+	Seats     int
+	Class     string
+	CreatedAt time.Time
+}
+
+// DriverDocument License or insurance of a driver, a driver has at most one document of each type
+type DriverDocument struct {
+	tableName struct{} `sql:"driver_documents,alias:driver_documents" pg:",discard_unknown_columns"`
+	ID        int
+	DriverID  int
+	Type      string
+	Number    string
+	ExpiresAt time.Time
 	CreatedAt time.Time
 }
 
+// Expired A document is valid until the end of its expiry day (UTC)
+func (document *DriverDocument) Expired(at time.Time) bool {
+	return at.UTC().Format(DateFormat) > document.ExpiresAt.UTC().Format(DateFormat)
+}
+
 // Passenger
 type Passenger struct {
 	tableName struct{} `sql:"passengers,alias:passengers" pg:",discard_unknown_columns"`
 	ID        int
 	Name      string
+	Phone     string
+	Email     string
+	// Rating Average of the latest RatingWindow ratings of the passenger, 0 if not rated yet
+	Rating               float64
+	DefaultPaymentMethod string
+	CreatedAt            time.Time
+	// DeletedAt is set when the passenger is soft deleted
+	DeletedAt *time.Time
+}
+
+// ScheduledRide Ride requested ahead of its pickup time, drivers are searched a lead time before pickup
+type ScheduledRide struct {
+	tableName    struct{} `sql:"scheduled_rides,alias:scheduled_rides" pg:",discard_unknown_columns"`
+	ID           int
+	PassengerID  int
+	Lat          float64
+	Lng          float64
+	VehicleClass string
+	PickupAt     time.Time
+	Status       string
+	// RideID Ride requested on the first dispatch, 0 until then
+	RideID int
+	// DriverIDs Driver assigned to the ride on dispatch
+	DriverIDs []int `pg:",array"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Ride Ride requested by a passenger, DriverID is 0 until a driver is assigned.
+// Zero AssignedAt, ArrivedAt, StartedAt, CompletedAt and CancelledAt are not set.
+// Fare and Commission are set on completion in minor units of Currency
+type Ride struct {
+	tableName    struct{} `sql:"rides,alias:rides" pg:",discard_unknown_columns"`
+	ID           int
+	PassengerID  int
+	DriverID     int
+	Lat          float64
+	Lng          float64
+	VehicleClass string
+	Status       string
+	CreatedAt    time.Time
+	AssignedAt   time.Time
+	ArrivedAt    time.Time
+	StartedAt    time.Time
+	CompletedAt  time.Time
+	CancelledAt  time.Time
+	Fare         int64
+	// Commission Part of the fare kept by the platform, the driver earns the rest
+	Commission int64
+	Currency   string
+	// PaymentMethod Default payment method of the passenger when the ride was requested, the fare is collected with it
+	PaymentMethod string
+	// Tip Added by the passenger after the ride is completed, the driver earns all of it
+	Tip int64
+}
+
+// RideStop Stop of a ride after pickup, in Position order from 1. The last stop is the dropoff if Dropoff is set.
+// Zero ArrivedAt and DepartedAt are not set
+type RideStop struct {
+	tableName struct{} `sql:"ride_stops,alias:ride_stops" pg:",discard_unknown_columns"`
+	ID        int
+	RideID    int
+	Position  int
+	Dropoff   bool
+	Lat       float64
+	Lng       float64
+	Address   string
+	// PlaceID Place of the maps provider, empty if unknown
+	PlaceID    string
+	ArrivedAt  time.Time
+	DepartedAt time.Time
+}
+
+// RideCancellation Cancellation of a ride. A driver cancellation which is not a no-show sends the ride back to dispatch,
+// so a ride may have many cancellations. Fee is owed by the passenger to the driver in the smallest currency unit, it is
+// charged in the ledger when payments are enabled
+type RideCancellation struct {
+	tableName struct{} `sql:"ride_cancellations,alias:ride_cancellations" pg:",discard_unknown_columns"`
+	ID        int
+	RideID    int
+	// DriverID Driver assigned when the ride was cancelled, 0 if none
+	DriverID    int
+	CancelledBy string
+	Reason      string
+	Fee         int64
+	NoShow      bool
+	CreatedAt   time.Time
+}
+
+// RideRating Rating of a completed ride by the passenger or the driver, each rates the other once
+type RideRating struct {
+	tableName   struct{} `sql:"ride_ratings,alias:ride_ratings" pg:",discard_unknown_columns"`
+	ID          int
+	RideID      int
+	DriverID    int
+	PassengerID int
+	RatedBy     string
+	// Rating From MinRating to MaxRating
+	Rating    int
+	Tags      []string `pg:",array"`
+	Comment   string
+	CreatedAt time.Time
+}
+
+// Zone Geofenced zone
+type Zone struct {
+	tableName struct{} `sql:"zones,alias:zones" pg:",discard_unknown_columns"`
+	ID        int
+	Name      string
+	Kind      string
+	// Geometry GeoJSON Polygon or MultiPolygon geometry
+	Geometry string
+	// Queue Drivers in the zone are dispatched in arrival order
+	Queue bool
+	// PickupFee Fee added to rides picked up in the zone, in the smallest currency unit
+	PickupFee int64
+	// FareMultiplier Multiplier of the fare of rides picked up in the zone, 1 if unset
+	FareMultiplier float64
+	CreatedAt      time.Time
+}
+
+const (
+	// AccountPassenger Receivable of a passenger, debited when a ride is charged and credited when it is paid
+	AccountPassenger = "passenger"
+	// AccountDriver Payable to a driver, credited with its earnings
+	AccountDriver = "driver"
+	// AccountCommission Revenue of the platform
+	AccountCommission = "commission"
+	// AccountCash Money held at the payment provider
+	AccountCash = "cash"
+	// AccountRefunds Refunds paid by the platform
+	AccountRefunds = "refunds"
+)
+
+const (
+	// EntryCharge The fare of a completed ride is owed by the passenger to the driver and the platform
+	EntryCharge = "charge"
+	// EntryPayment The passenger paid the fare, by the payment provider or in cash to the driver
+	EntryPayment = "payment"
+	// EntryRefund Part of a paid fare is refunded to the passenger
+	EntryRefund = "refund"
+)
+
+const (
+	// RefundPending The refund is reserved against the fare and not confirmed by the payment provider yet
+	RefundPending = "pending"
+	// RefundSucceeded The provider refunded the passenger and the refund entry is recorded
+	RefundSucceeded = "succeeded"
+	// RefundFailed The provider rejected the refund, its amount is released
+	RefundFailed = "failed"
+)
+
+// Account Ledger account of an owner in a currency, platform accounts have OwnerID 0.
+// Balance is the sum of its postings, debits are positive and credits negative
+type Account struct {
+	tableName struct{} `sql:"accounts,alias:accounts" pg:",discard_unknown_columns"`
+	ID        int
+	Kind      string
+	OwnerID   int
+	Currency  string
+	Balance   int64
+	CreatedAt time.Time
+}
+
+// JournalEntry Balanced set of postings in one currency, recorded once per IdempotencyKey
+type JournalEntry struct {
+	tableName      struct{} `sql:"journal_entries,alias:journal_entries" pg:",discard_unknown_columns"`
+	ID             int
+	IdempotencyKey string
+	Kind           string
+	// RideID Ride of the entry, 0 if none
+	RideID   int
+	Currency string
+	// Amount Sum of the debits of the entry
+	Amount int64
+	// ProviderRef Reference of the payment provider operation, empty if none
+	ProviderRef string
+	Memo        string
+	CreatedAt   time.Time
+}
+
+// Refund Refund of a ride through the payment provider, reserved against the fare while pending and recorded by
+// the journal entry of the same IdempotencyKey once succeeded
+type Refund struct {
+	tableName      struct{} `sql:"refunds,alias:refunds" pg:",discard_unknown_columns"`
+	ID             int
+	IdempotencyKey string
+	RideID         int
+	Currency       string
+	Amount         int64
+	Memo           string
+	Status         string
+	// ProviderRef Reference of the provider refund, empty until succeeded
+	ProviderRef string
+	CreatedAt   time.Time
+}
+
+// Posting Amount debited (positive) or credited (negative) to an account by a journal entry
+type Posting struct {
+	tableName struct{} `sql:"postings,alias:postings" pg:",discard_unknown_columns"`
+	ID        int
+	EntryID   int
+	AccountID int
+	Amount    int64
+}
+
+// EarningAdjustment Amount credited (positive) or debited (negative) to the earnings of a driver by support,
+// e.g. a bonus or a correction. RideID is 0 if it is not about a ride
+type EarningAdjustment struct {
+	tableName struct{} `sql:"earning_adjustments,alias:earning_adjustments" pg:",discard_unknown_columns"`
+	ID        int
+	DriverID  int
+	RideID    int
+	Amount    int64
+	Currency  string
+	Reason    string
 	CreatedAt time.Time
 }
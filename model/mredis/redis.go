@@ -2,10 +2,27 @@ package mredis
 
 const (
 	KeyDriverGeo = "DRIVER_GEO"
+
+	// KeyPrefixDriverGeoClass Prefix of the geo set of drivers with a vehicle of a class, the rest is the class
+	KeyPrefixDriverGeoClass = "DRIVER_GEO:"
+
+	// KeyPrefixDriver Prefix of cached drivers, the rest is the driver id
+	KeyPrefixDriver = "DRIVER:"
+
+	// KeyPrefixDriverClaim Prefix of driver claims holding the claiming ride id, the rest is the driver id
+	KeyPrefixDriverClaim = "DRIVER_CLAIM:"
+
+	// KeyPrefixZoneQueue Prefix of the sorted set of drivers queued in a zone scored by arrival time, the rest is the zone name
+	KeyPrefixZoneQueue = "ZONE_QUEUE:"
+
+	// KeyPrefixRateLimit Prefix of token bucket keys, the rest is the limited identity
+	KeyPrefixRateLimit = "RATE_LIMIT:"
 )
 
 type DriverLocation struct {
 	DriverID int
 	Lat      float64
 	Lng      float64
+	// Distance Distance in kilometer from the searched location, set by GetNearestDrivers
+	Distance float64
 }
@@ -1,7 +1,10 @@
 package util
 
 import (
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,3 +30,36 @@ func RespOK(c *gin.Context, data interface{}) {
 func RespNotFound(c *gin.Context) {
 	c.AbortWithStatus(http.StatusNotFound)
 }
+
+// RespTooManyRequests Abort with HTTP status Too Many Requests, Retry-After is retryAfter rounded up to seconds
+func RespTooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, map[string]string{"message": "Too many requests"})
+}
+
+// RespServiceUnavailable Response HTTP status Service Unavailable with a Json message `{"message":<message>}`, Retry-After is retryAfter rounded up to seconds
+func RespServiceUnavailable(c *gin.Context, message string, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	c.JSON(http.StatusServiceUnavailable, map[string]string{"message": message})
+}
+
+// RespForbidden Response HTTP status Forbidden with a Json message `{"message":<message>}`
+func RespForbidden(c *gin.Context, message string) {
+	c.JSON(http.StatusForbidden, map[string]string{"message": message})
+}
+
+// RespConflict Response HTTP status Conflict with a Json message `{"message":<message>}`
+func RespConflict(c *gin.Context, message string) {
+	c.JSON(http.StatusConflict, map[string]string{"message": message})
+}
+
+// RespPaymentRequired Response HTTP status Payment Required with a Json message `{"message":<message>}`
+func RespPaymentRequired(c *gin.Context, message string) {
+	c.JSON(http.StatusPaymentRequired, map[string]string{"message": message})
+}
+
+// RespCSV Response HTTP status OK with CSV data downloaded as filename
+func RespCSV(c *gin.Context, filename string, data []byte) {
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", data)
+}